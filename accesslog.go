@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AccessLogFormat string
+
+const (
+	AccessLogOff AccessLogFormat = "off"
+	// AccessLogCommon is the Common Log Format of Apache and nginx.
+	AccessLogCommon AccessLogFormat = "common"
+	// AccessLogCombined adds the referer and user agent to it.
+	AccessLogCombined AccessLogFormat = "combined"
+	AccessLogJSON     AccessLogFormat = "json"
+)
+
+func (f *AccessLogFormat) String() string { return string(*f) }
+
+func (f *AccessLogFormat) Set(v string) error {
+	switch AccessLogFormat(v) {
+	case AccessLogOff, AccessLogCommon, AccessLogCombined, AccessLogJSON:
+		*f = AccessLogFormat(v)
+		return nil
+	default:
+		return fmt.Errorf("must be %s, %s, %s or %s", AccessLogOff, AccessLogCommon, AccessLogCombined, AccessLogJSON)
+	}
+}
+
+type AccessLogConfig struct {
+	Format AccessLogFormat
+	// File is appended to; empty writes to stdout.
+	File string
+	// SampleRate is the share of requests logged. Server errors are always
+	// logged.
+	SampleRate float64
+	// Exclude lists paths never logged, such as those of health checks.
+	Exclude []string
+}
+
+func (cfg AccessLogConfig) validate() error {
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return errors.New("-access-log-sample-rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// AccessLog writes a line per request in the format web server tooling
+// expects, separately from the service's own log.
+type AccessLog struct {
+	cfg AccessLogConfig
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	a := &AccessLog{cfg: cfg, out: os.Stdout}
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reopen opens the log file again, so that it can be rotated by renaming
+// it and sending SIGHUP.
+func (a *AccessLog) Reopen() error {
+	if a.cfg.File == "" {
+		return nil
+	}
+	f, err := os.OpenFile(a.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if old, ok := a.out.(*os.File); ok && old != os.Stdout {
+		old.Close()
+	}
+	a.out = f
+	return nil
+}
+
+// accessLogEntry is a line of the JSON format.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	ClientID  string    `json:"clientId,omitempty"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	LatencyMs float64   `json:"latencyMs"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// Wrap logs the requests to next. It must run inside logRequests to learn
+// the authenticated client.
+func (a *AccessLog) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(a.cfg.Exclude, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if recorder.status < http.StatusInternalServerError && rand.Float64() >= a.cfg.SampleRate {
+			return
+		}
+
+		entry := accessLogEntry{
+			Time:      start,
+			Remote:    r.RemoteAddr,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    recorder.status,
+			Bytes:     recorder.bytes,
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			RequestID: requestIDFrom(r.Context()),
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			entry.Remote = host
+		}
+		if rl := requestLogFrom(r.Context()); rl != nil {
+			entry.ClientID = rl.client
+		}
+		a.write(entry)
+	})
+}
+
+func (a *AccessLog) write(entry accessLogEntry) {
+	var line []byte
+	if a.cfg.Format == AccessLogJSON {
+		line, _ = json.Marshal(entry)
+	} else {
+		line = fmt.Appendf(nil, "%s - %s [%s] %s %d %s",
+			orDash(entry.Remote), orDash(entry.ClientID), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Proto), entry.Status, bytesField(entry.Bytes))
+		if a.cfg.Format == AccessLogCombined {
+			line = fmt.Appendf(line, " %s %s", strconv.Quote(orDash(entry.Referer)), strconv.Quote(orDash(entry.UserAgent)))
+		}
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.out.Write(line)
+}
+
+// orDash stands in "-" for missing fields, as the Common Log Format does.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func bytesField(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.Itoa(n)
+}
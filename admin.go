@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ReloadRulesHandler re-reads the rules file and reports the rules now in
+// effect. An invalid file is rejected and the current rules stay active.
+func (s *Server) ReloadRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	rules, err := s.rules.Reload()
+	if err != nil {
+		writeProblem(w, r, Problem{
+			Type:   "/problems/invalid-rules",
+			Title:  "The rules file is invalid",
+			Status: http.StatusUnprocessableEntity,
+			Detail: err.Error(),
+		})
+		return
+	}
+	audit(r, "action=reload-rules")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// ListRuleVersionsHandler lists the rule sets loaded since startup, so the
+// rules behind a receipt's rulesVersion can be looked up.
+func (s *Server) ListRuleVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.rules.Versions())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+)
+
+// FlagAnomalousTotal is set on receipts whose total is an outlier for
+// their retailer.
+const FlagAnomalousTotal = "anomalous-total"
+
+type AnomalyConfig struct {
+	// ZScore is how many standard deviations from its retailer's mean a
+	// total must be to be flagged; zero turns anomaly scoring off.
+	ZScore float64
+	// MinSamples is how many receipts of a retailer must have been seen
+	// before its totals are scored.
+	MinSamples int
+}
+
+// AnomalyDetector keeps a running distribution of the totals of each
+// retailer. Totals are compared on a log scale, since they are skewed
+// toward small amounts: a total ten times the usual is as unusual as one
+// tenth of it.
+type AnomalyDetector struct {
+	cfg AnomalyConfig
+
+	mu    sync.Mutex
+	stats map[string]*runningStats
+}
+
+// runningStats tracks the mean and variance of a series with Welford's
+// algorithm, so the values needn't be kept.
+type runningStats struct {
+	n    int
+	mean float64
+	m2   float64
+}
+
+func (s *runningStats) add(x float64) {
+	s.n++
+	delta := x - s.mean
+	s.mean += delta / float64(s.n)
+	s.m2 += delta * (x - s.mean)
+}
+
+func (s *runningStats) stddev() float64 {
+	if s.n < 2 {
+		return 0
+	}
+	return math.Sqrt(s.m2 / float64(s.n-1))
+}
+
+func NewAnomalyDetector(cfg AnomalyConfig) *AnomalyDetector {
+	return &AnomalyDetector{cfg: cfg, stats: make(map[string]*runningStats)}
+}
+
+func logTotal(total Cents) float64 {
+	return math.Log1p(math.Max(float64(total), 0))
+}
+
+// Score returns how many standard deviations total is from the mean of
+// the retailer, qualified with its tenant, and whether that makes it an
+// outlier. Totals that aren't outliers join the distribution, so outliers
+// can't drag it toward themselves.
+func (d *AnomalyDetector) Score(retailer string, total Cents) (float64, bool) {
+	if d.cfg.ZScore <= 0 {
+		return 0, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, found := d.stats[retailer]
+	if !found {
+		stats = &runningStats{}
+		d.stats[retailer] = stats
+	}
+	x := logTotal(total)
+	var z float64
+	if stddev := stats.stddev(); stddev > 0 {
+		z = (x - stats.mean) / stddev
+	}
+	if stats.n >= d.cfg.MinSamples && math.Abs(z) >= d.cfg.ZScore {
+		return z, true
+	}
+	stats.add(x)
+	return z, false
+}
+
+// observe adds a stored total to the retailer's distribution.
+func (d *AnomalyDetector) observe(retailer string, total Cents) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, found := d.stats[retailer]
+	if !found {
+		stats = &runningStats{}
+		d.stats[retailer] = stats
+	}
+	stats.add(logTotal(total))
+}
+
+// anomalyKey identifies the distribution a receipt belongs to: its
+// canonical retailer within its tenant.
+func anomalyKey(tenant, retailer string) string {
+	return tenant + tenantSeparator + retailer
+}
+
+// seedAnomalies builds the distributions from the stored receipts that
+// weren't flagged as anomalous, so they survive restarts.
+func (s *Server) seedAnomalies() {
+	var seen int
+	err := s.forEachReceipt(func(record ReceiptRecord) {
+		if slices.Contains(record.Flags, FlagAnomalousTotal) {
+			return
+		}
+		total, err := parseCents(record.Receipt.Total)
+		if err != nil {
+			return
+		}
+		s.anomalies.observe(anomalyKey(tenantOfID(record.ID), record.Retailer), total)
+		seen++
+	})
+	if err != nil {
+		slog.Error("Failed to load receipt totals for anomaly scoring", "err", err)
+		return
+	}
+	slog.Info("Loaded receipt totals for anomaly scoring", "receipts", seen)
+}
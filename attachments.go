@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var errAttachmentNotFound = errors.New("attachment not found")
+
+// Attachment describes the original artifact of a receipt, such as the
+// photo, PDF or email it was read from.
+type Attachment struct {
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	AttachedAt  time.Time `json:"attachedAt"`
+}
+
+// AttachmentStore keeps the attachments of receipts in an object store,
+// under their receipt's ID.
+type AttachmentStore struct {
+	bucket ObjectStore
+	prefix string
+}
+
+// OpenAttachmentStore opens a local directory, or the bucket of an
+// s3://bucket/prefix or gs://bucket/prefix URL.
+func OpenAttachmentStore(location string) (*AttachmentStore, error) {
+	bucket, prefix, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	return &AttachmentStore{bucket: bucket, prefix: prefix}, nil
+}
+
+func (a *AttachmentStore) key(id string) string { return a.prefix + id }
+
+func (a *AttachmentStore) Close() error { return a.bucket.Close() }
+
+// EnableAttachments keeps the original artifacts of receipts in store.
+func (s *Server) EnableAttachments(store *AttachmentStore) {
+	s.attachments = store
+}
+
+// attach stores data as the attachment of the receipt id, replacing any
+// attached before, and records it on the receipt.
+func (s *Server) attach(ctx context.Context, store Store, id, contentType string, data []byte) (Attachment, error) {
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	attachment := Attachment{ContentType: contentType, Size: int64(len(data)), AttachedAt: s.clock.Now().UTC()}
+	if err := s.attachments.bucket.Put(ctx, s.attachments.key(id), data, contentType); err != nil {
+		return Attachment{}, fmt.Errorf("store the attachment of %s: %w", id, err)
+	}
+
+	s.amendMu.Lock()
+	defer s.amendMu.Unlock()
+	record, err := store.Get(id)
+	if err != nil {
+		return Attachment{}, err
+	}
+	record.Attachment = &attachment
+	return attachment, store.Put(record)
+}
+
+// attachArtifact attaches the artifact a receipt was read from, if
+// attachments are on. Failing to is only logged, since the receipt is
+// stored either way.
+func (s *Server) attachArtifact(ctx context.Context, tenant, id, contentType string, data []byte) {
+	if s.attachments == nil {
+		return
+	}
+	if _, err := s.attach(ctx, s.tenantStore(ctx, tenant), id, contentType, data); err != nil {
+		slog.ErrorContext(ctx, "Failed to attach the artifact of a receipt", "receiptId", id, "err", err)
+	}
+}
+
+// PutAttachmentHandler attaches the original artifact of a receipt, sent
+// as the body or as the file part of a multipart form, with its
+// Content-Type.
+func (s *Server) PutAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	store := s.tenantStore(r.Context(), tenantFrom(r))
+	record, err := store.Get(id)
+	if err == nil && !ownedBy(r, record.Owner) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	body, contentType, err := uploadedFile(r)
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(body)
+	}
+	if err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		http.Error(w, "The attachment can't be read: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "The attachment is empty", http.StatusBadRequest)
+		return
+	}
+
+	attachment, err := s.attach(r.Context(), store, id, contentType, data)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	logAttrs(r, slog.String("receiptId", id))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// GetAttachmentHandler serves the attachment of a receipt with the
+// Content-Type it was attached with. It is served as a download so that
+// browsers don't render attached HTML as part of the API's origin.
+func (s *Server) GetAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	record, err := s.tenantStore(r.Context(), tenantFrom(r)).Get(id)
+	if err == nil && !ownedBy(r, record.Owner) {
+		err = ErrNotFound
+	}
+	if err == nil && record.Attachment == nil {
+		err = errAttachmentNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body, err := s.attachments.bucket.Open(r.Context(), s.attachments.key(id))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", record.Attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(record.Attachment.Size, 10))
+	w.Header().Set("Content-Disposition", "attachment")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, body)
+}
+
+// deleteAttachment removes the attachment of a deleted receipt, if there
+// may be one. Failing to is only logged.
+func (s *Server) deleteAttachment(ctx context.Context, id string) {
+	if s.attachments == nil {
+		return
+	}
+	if err := s.attachments.bucket.Delete(ctx, s.attachments.key(id)); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete the attachment of a receipt", "receiptId", id, "err", err)
+	}
+}
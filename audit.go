@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// auditLogger logs the audit trail. It ignores the log level, so that
+// raising the level doesn't lose audit lines.
+var auditLogger = slog.Default().With(slog.String("log", "audit"))
+
+// audit records a state-changing action together with the caller that
+// triggered it.
+func audit(r *http.Request, format string, args ...any) {
+	attrs := []slog.Attr{slog.String("remote", r.RemoteAddr)}
+	if p := principalFrom(r); p != nil {
+		attrs = append(attrs, slog.String("principal", p.ID))
+	}
+	auditLogger.LogAttrs(r.Context(), slog.LevelInfo, fmt.Sprintf(format, args...), attrs...)
+}
+
+// auditEvent records an action the service took by itself, such as
+// expiring points.
+func auditEvent(format string, args ...any) {
+	auditLogger.LogAttrs(context.Background(), slog.LevelInfo, fmt.Sprintf(format, args...))
+}
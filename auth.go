@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Scope is a permission granted to a caller. ScopeAdmin implies the
+// others.
+type Scope string
+
+const (
+	// ScopeProcess allows submitting and amending receipts.
+	ScopeProcess Scope = "process"
+	// ScopeRead allows looking up receipts, points and jobs.
+	ScopeRead Scope = "read"
+	// ScopeAdmin allows the admin endpoints and deleting receipts.
+	ScopeAdmin Scope = "admin"
+)
+
+func (s Scope) valid() bool {
+	return s == ScopeProcess || s == ScopeRead || s == ScopeAdmin
+}
+
+// Role is a named bundle of scopes, so API keys and users can be granted
+// access by what they do rather than scope by scope.
+type Role string
+
+const (
+	// RoleReader may look up receipts, points and jobs.
+	RoleReader Role = "reader"
+	// RoleSubmitter may also submit and amend receipts.
+	RoleSubmitter Role = "submitter"
+	// RoleAdmin may do everything, including recalculating points and
+	// changing the rules configuration.
+	RoleAdmin Role = "admin"
+)
+
+var roleScopes = map[Role][]Scope{
+	RoleReader:    {ScopeRead},
+	RoleSubmitter: {ScopeRead, ScopeProcess},
+	RoleAdmin:     {ScopeAdmin},
+}
+
+func (r Role) valid() bool {
+	_, found := roleScopes[r]
+	return found
+}
+
+func (r *Role) String() string { return string(*r) }
+
+// Set accepts an empty role as well, for flags where a role is optional.
+func (r *Role) Set(v string) error {
+	if v != "" && !Role(v).valid() {
+		return fmt.Errorf("must be %s, %s or %s", RoleReader, RoleSubmitter, RoleAdmin)
+	}
+	*r = Role(v)
+	return nil
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	ID     string
+	Name   string
+	Scopes []Scope
+	// Roles grant further scopes on top of Scopes.
+	Roles []Role
+	// OwnReceiptsOnly limits a caller without the admin scope to the
+	// receipts and jobs it submitted.
+	OwnReceiptsOnly bool
+	// Tenant, when set, is the only tenant the caller may act for.
+	Tenant string
+}
+
+// ownerOf names the caller of a request as the owner of the receipts it
+// submits.
+func ownerOf(r *http.Request) string {
+	if p := principalFrom(r); p != nil {
+		return p.ID
+	}
+	return ""
+}
+
+// ownedBy reports whether the caller of r may see what owner submitted.
+// Others' receipts are reported as not found rather than forbidden, so
+// their IDs can't be probed.
+func ownedBy(r *http.Request, owner string) bool {
+	p := principalFrom(r)
+	return p == nil || !p.OwnReceiptsOnly || p.has(ScopeAdmin) || p.ID == owner
+}
+
+// boundTenant is the tenant the caller of r is confined to, or "" when it
+// may act for any tenant.
+func boundTenant(r *http.Request) string {
+	if p := principalFrom(r); p != nil {
+		return p.Tenant
+	}
+	return ""
+}
+
+// ownerFilter is the owner that listings are limited to for the caller of
+// r, or "" when it may list every receipt.
+func ownerFilter(r *http.Request) string {
+	if p := principalFrom(r); p != nil && p.OwnReceiptsOnly && !p.has(ScopeAdmin) {
+		return p.ID
+	}
+	return ""
+}
+
+func (p *Principal) has(scope Scope) bool {
+	scopes := p.Scopes
+	for _, role := range p.Roles {
+		scopes = append(scopes[:len(scopes):len(scopes)], roleScopes[role]...)
+	}
+	for _, s := range scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the caller of a request. It returns a nil
+// Principal and no error when the request carries no credentials it
+// understands, and errUnauthenticated when they are invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+var errUnauthenticated = errors.New("invalid credentials")
+
+type principalKey struct{}
+
+// principalFrom returns the caller of an authenticated request, or nil.
+func principalFrom(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// requireScope is the "auth" middleware, which only lets callers with the
+// scope through. Without authenticators every request is let through.
+func (s *Server) requireScope(scope Scope) Middleware {
+	return Middleware{Name: "auth", Wrap: func(next http.Handler) http.Handler {
+		return s.authenticate(scope, next)
+	}}
+}
+
+func (s *Server) authenticate(scope Scope, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.authenticators) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var principal *Principal
+		for _, a := range s.authenticators {
+			p, err := a.Authenticate(r)
+			if err != nil {
+				// Don't tell callers why their credentials were refused.
+				writeProblem(w, r, unauthorizedProblem("The credentials are invalid."))
+				return
+			}
+			if p != nil {
+				principal = p
+				break
+			}
+		}
+		if principal == nil {
+			writeProblem(w, r, unauthorizedProblem("The request carries no credentials."))
+			return
+		}
+		if !principal.has(scope) {
+			writeProblem(w, r, missingScopeProblem(scope))
+			return
+		}
+		logClient(r, principal.ID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+func missingScopeProblem(scope Scope) Problem {
+	return Problem{
+		Type:   "/problems/forbidden",
+		Title:  "Not allowed",
+		Status: http.StatusForbidden,
+		Detail: fmt.Sprintf("The %q scope is required.", scope),
+	}
+}
+
+func unauthorizedProblem(detail string) Problem {
+	return Problem{
+		Type:   "/problems/unauthorized",
+		Title:  "Authentication required",
+		Status: http.StatusUnauthorized,
+		Detail: detail,
+	}
+}
+
+// EnableAPIKeys requires callers to present a key from keys.
+func (s *Server) EnableAPIKeys(keys *APIKeyStore) {
+	s.apiKeys = keys
+	s.authenticators = append(s.authenticators, keys)
+}
+
+// APIKey describes a key. The key itself is only shown when it is created;
+// afterwards just its hash and first characters are kept.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []Scope    `json:"scopes"`
+	Roles     []Role     `json:"roles,omitempty"`
+	Prefix    string     `json:"prefix"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+	Hash      string     `json:"hash,omitempty"`
+	// Tenant binds the key to a tenant's receipts.
+	Tenant string `json:"tenant,omitempty"`
+	// MonthlyQuota caps the receipts the key may submit each calendar
+	// month (UTC). Zero means the store's default quota.
+	MonthlyQuota int `json:"monthlyQuota,omitempty"`
+	// Usage counts the receipts submitted with the key by month, as
+	// "2006-01".
+	Usage map[string]int `json:"usage,omitempty"`
+}
+
+// APIKeyHeader carries the API key of a request.
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyStore holds the API keys, persisting them to a file if it has a
+// path.
+type APIKeyStore struct {
+	path string
+	// bootstrapHash is the hash of an admin key from the environment, for
+	// creating the first keys.
+	bootstrapHash string
+	// defaultQuota applies to keys without a quota of their own; zero
+	// means unlimited.
+	defaultQuota int
+
+	mu     sync.RWMutex
+	keys   []*APIKey
+	byHash map[string]*APIKey
+	// usageChanged is set when usage was counted since the keys were last
+	// saved.
+	usageChanged bool
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewAPIKeyStore(path, bootstrapKey string, defaultQuota int) (*APIKeyStore, error) {
+	s := &APIKeyStore{path: path, defaultQuota: defaultQuota, byHash: make(map[string]*APIKey)}
+	if bootstrapKey != "" {
+		s.bootstrapHash = hashAPIKey(bootstrapKey)
+	}
+	if err := loadJSONFile(path, &s.keys); err != nil {
+		return nil, fmt.Errorf("load API keys: %w", err)
+	}
+	for _, key := range s.keys {
+		s.byHash[key.Hash] = key
+	}
+	if path != "" {
+		go s.saveUsage(usageSaveInterval)
+	}
+	return s, nil
+}
+
+func (s *APIKeyStore) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	hash := hashAPIKey(key)
+	if s.bootstrapHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(s.bootstrapHash)) == 1 {
+		return &Principal{ID: "bootstrap", Name: "bootstrap", Scopes: []Scope{ScopeAdmin}}, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stored, found := s.byHash[hash]
+	if !found || stored.RevokedAt != nil {
+		return nil, errUnauthenticated
+	}
+	return &Principal{ID: stored.ID, Name: stored.Name, Scopes: stored.Scopes, Roles: stored.Roles, Tenant: stored.Tenant}, nil
+}
+
+// Create generates a new key and returns it along with its description.
+func (s *APIKeyStore) Create(name, tenant string, roles []Role, scopes []Scope, monthlyQuota int) (string, APIKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	key := "rp_" + base64.RawURLEncoding.EncodeToString(secret)
+	apiKey := &APIKey{
+		ID:           uuid.New().String(),
+		Name:         name,
+		Scopes:       scopes,
+		Roles:        roles,
+		Tenant:       tenant,
+		Prefix:       key[:8],
+		CreatedAt:    time.Now().UTC(),
+		Hash:         hashAPIKey(key),
+		MonthlyQuota: monthlyQuota,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := saveJSONFile(s.path, append(s.keys, apiKey)); err != nil {
+		return "", APIKey{}, fmt.Errorf("save API keys: %w", err)
+	}
+	s.keys = append(s.keys, apiKey)
+	s.byHash[apiKey.Hash] = apiKey
+	return key, apiKey.public(), nil
+}
+
+var errAPIKeyNotFound = errors.New("API key not found")
+
+// Revoke disables a key of tenant, or of any tenant when tenant is "".
+// Revoked keys stay listed.
+func (s *APIKeyStore) Revoke(id, tenant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.keys {
+		if key.ID != id || key.RevokedAt != nil || tenant != "" && key.Tenant != tenant {
+			continue
+		}
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+		if err := saveJSONFile(s.path, s.keys); err != nil {
+			key.RevokedAt = nil
+			return fmt.Errorf("save API keys: %w", err)
+		}
+		return nil
+	}
+	return errAPIKeyNotFound
+}
+
+// List returns the keys of tenant, or every key when tenant is "".
+func (s *APIKeyStore) List(tenant string) []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		if tenant == "" || key.Tenant == tenant {
+			keys = append(keys, key.public())
+		}
+	}
+	return keys
+}
+
+// public leaves out the hash. The usage is copied, so it can be encoded
+// while more receipts are counted.
+func (k *APIKey) public() APIKey {
+	key := *k
+	key.Hash = ""
+	if k.Usage != nil {
+		key.Usage = make(map[string]int, len(k.Usage))
+		for month, n := range k.Usage {
+			key.Usage[month] = n
+		}
+	}
+	return key
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string  `json:"name"`
+	Scopes []Scope `json:"scopes"`
+	Roles  []Role  `json:"roles"`
+	// Tenant optionally binds the key to a tenant.
+	Tenant string `json:"tenant"`
+	// MonthlyQuota overrides the default quota when positive.
+	MonthlyQuota int `json:"monthlyQuota"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey
+	// Key is only ever returned here.
+	Key string `json:"key"`
+}
+
+func (s *Server) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var request CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "The request must be a JSON object with a name and roles or scopes", http.StatusBadRequest)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Scopes) == 0 && len(request.Roles) == 0 {
+		http.Error(w, "A name and at least one role or scope are required", http.StatusBadRequest)
+		return
+	}
+	// Keys bound to a tenant can only create keys for it.
+	if p := principalFrom(r); p != nil && p.Tenant != "" {
+		if request.Tenant != "" && request.Tenant != p.Tenant {
+			http.Error(w, "Keys can only be created for your own tenant", http.StatusForbidden)
+			return
+		}
+		request.Tenant = p.Tenant
+	}
+	if request.Tenant != "" && !tenantPattern.MatchString(request.Tenant) {
+		http.Error(w, "Tenants must be lowercase letters, digits and hyphens", http.StatusBadRequest)
+		return
+	}
+	if request.MonthlyQuota < 0 {
+		http.Error(w, "monthlyQuota must not be negative", http.StatusBadRequest)
+		return
+	}
+	if request.Scopes == nil {
+		request.Scopes = []Scope{}
+	}
+	for _, role := range request.Roles {
+		if !role.valid() {
+			http.Error(w, fmt.Sprintf("Unknown role %q", role), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, scope := range request.Scopes {
+		if !scope.valid() {
+			http.Error(w, fmt.Sprintf("Unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, apiKey, err := s.apiKeys.Create(request.Name, request.Tenant, request.Roles, request.Scopes, request.MonthlyQuota)
+	if err != nil {
+		http.Error(w, "Failed to create the API key", http.StatusInternalServerError)
+		return
+	}
+	audit(r, "action=create-api-key key=%s name=%q", apiKey.ID, apiKey.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/api-keys/"+apiKey.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKey: apiKey, Key: key})
+}
+
+func (s *Server) ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.apiKeys.List(boundTenant(r)))
+}
+
+func (s *Server) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.apiKeys.Revoke(id, boundTenant(r)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=revoke-api-key key=%s", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testIssuer serves the key set of an ES256 key, and the OIDC discovery
+// document pointing at it.
+type testIssuer struct {
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{Issuer: issuer.server.URL, JWKSURI: issuer.server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kty: "EC",
+			Kid: "k1",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// token signs claims, with an expiry an hour away unless they have one.
+func (i *testIssuer) token(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	if _, found := claims["exp"]; !found {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	header, _ := json.Marshal(jwtHeader{Alg: "ES256", Kid: "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, i.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestBearerAuthenticationWithJWTAndOIDC(t *testing.T) {
+	jwtIssuer := newTestIssuer(t)
+	oidcIssuer := newTestIssuer(t)
+	otherIssuer := newTestIssuer(t)
+
+	s := NewServer(NewMemoryStore(), nil, systemClock{}, uuidGenerator{}, ServerConfig{})
+	jwtAuth, err := NewJWTAuthenticator(JWTConfig{
+		Issuer:   jwtIssuer.server.URL,
+		Audience: "receipts",
+		JWKSURL:  jwtIssuer.server.URL + "/jwks",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oidcAuth, err := NewOIDCAuthenticator(OIDCConfig{
+		Issuer:      oidcIssuer.server.URL,
+		ClientID:    "receipts-app",
+		RolesClaim:  "roles",
+		DefaultRole: RoleReader,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// JWT comes first, as in main.
+	s.EnableJWT(jwtAuth)
+	s.EnableOIDC(oidcAuth)
+
+	var got *Principal
+	handler := s.requireScope(ScopeRead).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = principalFrom(r)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantOwnOnly   bool
+	}{
+		{
+			name:          "JWT token",
+			authorization: "Bearer " + jwtIssuer.token(t, map[string]any{"iss": jwtIssuer.server.URL, "aud": "receipts", "sub": "svc", "scope": "read"}),
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "OIDC token",
+			authorization: "Bearer " + oidcIssuer.token(t, map[string]any{"iss": oidcIssuer.server.URL, "aud": "receipts-app", "sub": "alice"}),
+			wantStatus:    http.StatusOK,
+			wantOwnOnly:   true,
+		},
+		{
+			name:          "OIDC token signed by another key",
+			authorization: "Bearer " + otherIssuer.token(t, map[string]any{"iss": oidcIssuer.server.URL, "aud": "receipts-app", "sub": "alice"}),
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "expired JWT token",
+			authorization: "Bearer " + jwtIssuer.token(t, map[string]any{"iss": jwtIssuer.server.URL, "aud": "receipts", "sub": "svc", "scope": "read", "exp": time.Now().Add(-time.Hour).Unix()}),
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "token of an unknown issuer",
+			authorization: "Bearer " + otherIssuer.token(t, map[string]any{"iss": otherIssuer.server.URL, "aud": "receipts", "sub": "svc"}),
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "malformed token",
+			authorization: "Bearer nonsense",
+			wantStatus:    http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			r := httptest.NewRequest(http.MethodGet, "/receipts", nil)
+			r.Header.Set("Authorization", tt.authorization)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got == nil || got.OwnReceiptsOnly != tt.wantOwnOnly {
+				t.Errorf("principal = %+v, want OwnReceiptsOnly %v", got, tt.wantOwnOnly)
+			}
+		})
+	}
+}
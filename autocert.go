@@ -0,0 +1,24 @@
+//go:build autocert
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newCertManager returns a manager obtaining and renewing certificates for
+// the configured domains from Let's Encrypt. Certificates are cached in
+// AutocertCacheDir so restarts don't hit the issuance rate limits.
+func newCertManager(cfg TLSConfig) (certManager, error) {
+	if cfg.AutocertCacheDir == "" {
+		return nil, errors.New("autocert needs a cache directory")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+		Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+		Email:      cfg.AutocertEmail,
+	}, nil
+}
@@ -0,0 +1,9 @@
+//go:build !autocert
+
+package main
+
+import "errors"
+
+func newCertManager(cfg TLSConfig) (certManager, error) {
+	return nil, errors.New("autocert is not compiled in; rebuild with -tags autocert")
+}
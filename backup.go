@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// backupVersion is the layout of backup archives, recorded in their
+// backup.json so that restores can refuse layouts they don't know.
+const backupVersion = 1
+
+// BackupInfo is the backup.json entry that starts every backup archive.
+type BackupInfo struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Changes counts the writes of a memory store that its snapshots
+	// include, for its write-ahead log to carry on from.
+	Changes uint64 `json:"changes,omitempty"`
+}
+
+// RestoreResponse counts what a restore loaded. Transfers are the moves
+// between balances that brought them back to those of the backup.
+type RestoreResponse struct {
+	Receipts  int `json:"receipts"`
+	Balances  int `json:"balances"`
+	Transfers int `json:"transfers"`
+}
+
+// errAllTenants refuses callers bound to a tenant the endpoints that read
+// or write the receipts of every tenant, such as backups, and those that
+// change settings every tenant shares, such as the rules.
+var errAllTenants = errors.New("the endpoint spans every tenant")
+
+// BackupHandler streams a snapshot of the whole store, for every tenant,
+// as a tar archive: backup.json, then a receipts/<id>.json entry per
+// receipt in ID order, then balances.json. The snapshot is taken at a
+// single point in time by stores that support it, and is refused by the
+// others.
+//
+// The status goes out with backup.json, so a backup that fails after it
+// is cut short, without the end of the archive.
+func (s *Server) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	snapshotter, ok := unwrapStore(s.store).(Snapshotter)
+	if !ok {
+		http.Error(w, "The store can't take a consistent snapshot to back up", http.StatusNotImplemented)
+		return
+	}
+
+	now := s.clock.Now().UTC()
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="receipts-`+now.Format("20060102T150405Z")+`.tar"`)
+	audit(r, "action=backup")
+	rc := http.NewResponseController(w)
+	// Slow clients get -stream-idle-timeout per entry rather than the
+	// server's write timeout for the whole archive.
+	receipts, err := writeBackup(w, snapshotter, BackupInfo{CreatedAt: now}, func() { s.extendStreamDeadlines(rc) })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to back up the store", "receipts", receipts, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+	logAttrs(r, slog.Int("receipts", receipts))
+}
+
+// writeBackup writes a snapshot of store to w as a backup archive described
+// by info, calling next before each entry, and returns how many receipts it
+// wrote.
+func writeBackup(w io.Writer, store Snapshotter, info BackupInfo, next func()) (int, error) {
+	archive := tar.NewWriter(w)
+	writeEntry := func(name string, v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		next()
+		header := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: info.CreatedAt}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = archive.Write(data)
+		return err
+	}
+
+	info.Version = backupVersion
+	if err := writeEntry("backup.json", info); err != nil {
+		return 0, err
+	}
+	receipts := 0
+	balances, err := store.Snapshot(func(record ReceiptRecord) error {
+		receipts++
+		return writeEntry("receipts/"+record.ID+".json", record)
+	})
+	if err != nil {
+		return receipts, err
+	}
+	if err := writeEntry("balances.json", balances); err != nil {
+		return receipts, err
+	}
+	return receipts, archive.Close()
+}
+
+// RestoreHandler loads a backup archive, plain or gzipped, into an empty
+// store, whatever store the backup was taken from. Receipts are stored as
+// they were, without being processed again or announced.
+//
+// A restore that fails part way leaves what it loaded so far, and the
+// store has to be emptied to try again.
+func (s *Server) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	existing, err := s.store.List(ListOptions{Limit: 1})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(existing) > 0 {
+		http.Error(w, "Backups can only be restored into an empty store", http.StatusConflict)
+		return
+	}
+
+	audit(r, "action=restore")
+	rc := http.NewResponseController(w)
+	// Slow clients get -stream-idle-timeout per entry rather than the
+	// server's read timeout for the whole archive.
+	_, response, err := readBackup(r.Body, restoringStore{s.store}, func() { s.extendStreamDeadlines(rc) })
+	if err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to restore a backup", "receipts", response.Receipts, "err", err)
+		http.Error(w, fmt.Sprintf("The backup can't be restored after %d receipts: %v", response.Receipts, err), http.StatusBadRequest)
+		return
+	}
+
+	logAttrs(r, slog.Int("receipts", response.Receipts))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// restoringStore stores the receipts of a backup as new ones, since the
+// versions they had in the store the backup came from mean nothing in
+// this one.
+type restoringStore struct {
+	Store
+}
+
+func (s restoringStore) Put(record ReceiptRecord) error {
+	record.Version = 0
+	return s.Store.Put(record)
+}
+
+// readBackup reads a backup archive into store, calling next before each
+// entry, and returns its backup.json.
+func readBackup(body io.Reader, store Store, next func()) (BackupInfo, RestoreResponse, error) {
+	var response RestoreResponse
+	buffered := bufio.NewReader(body)
+	body = buffered
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return BackupInfo{}, response, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	archive := tar.NewReader(body)
+	var info *BackupInfo
+	for {
+		next()
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return BackupInfo{}, response, errors.New("the archive ends without balances.json")
+		}
+		if err != nil {
+			return BackupInfo{}, response, err
+		}
+		if info == nil && header.Name != "backup.json" {
+			return BackupInfo{}, response, errors.New("the archive must start with backup.json")
+		}
+
+		decoder := json.NewDecoder(archive)
+		switch {
+		case header.Name == "backup.json":
+			if info != nil {
+				return BackupInfo{}, response, errors.New("the archive has more than one backup.json")
+			}
+			info = &BackupInfo{}
+			if err := decoder.Decode(info); err != nil {
+				return BackupInfo{}, response, fmt.Errorf("backup.json: %w", err)
+			}
+			if info.Version != backupVersion {
+				return BackupInfo{}, response, fmt.Errorf("backup.json: version %d isn't supported", info.Version)
+			}
+		case strings.HasPrefix(header.Name, "receipts/"):
+			var record ReceiptRecord
+			if err := decoder.Decode(&record); err != nil {
+				return BackupInfo{}, response, fmt.Errorf("%s: %w", header.Name, err)
+			}
+			if record.ID == "" {
+				return BackupInfo{}, response, fmt.Errorf("%s: the receipt has no ID", header.Name)
+			}
+			if err := store.Put(record); err != nil {
+				return BackupInfo{}, response, fmt.Errorf("store %s: %w", record.ID, err)
+			}
+			response.Receipts++
+		case header.Name == "balances.json":
+			var balances map[string]int
+			if err := decoder.Decode(&balances); err != nil {
+				return BackupInfo{}, response, fmt.Errorf("balances.json: %w", err)
+			}
+			response.Balances = len(balances)
+			response.Transfers, err = restoreBalances(store, balances)
+			return *info, response, err
+		default:
+			return BackupInfo{}, response, fmt.Errorf("unexpected entry %s", header.Name)
+		}
+	}
+}
+
+// restoreBalances moves points between users until their balances are
+// those of a backup, once its receipts are restored. The receipts account
+// for the balances but for the points users transferred, and transfers
+// keep the total, so the differences add up to nothing. It returns how
+// many transfers it made.
+func restoreBalances(store Store, balances map[string]int) (int, error) {
+	type difference struct {
+		user   string
+		points int
+	}
+	var senders, receivers []difference
+	users := make([]string, 0, len(balances))
+	for user := range balances {
+		users = append(users, user)
+	}
+	slices.Sort(users)
+	for _, user := range users {
+		current, err := store.Balance(user)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return 0, err
+		}
+		switch d := balances[user] - current; {
+		case d < 0:
+			senders = append(senders, difference{user, -d})
+		case d > 0:
+			receivers = append(receivers, difference{user, d})
+		}
+	}
+
+	transfers := 0
+	for len(senders) > 0 && len(receivers) > 0 {
+		from, to := &senders[0], &receivers[0]
+		points := min(from.points, to.points)
+		if _, err := store.Transfer(from.user, to.user, points); err != nil {
+			return transfers, fmt.Errorf("transfer %d points from %s to %s: %w", points, from.user, to.user, err)
+		}
+		transfers++
+		from.points -= points
+		to.points -= points
+		if from.points == 0 {
+			senders = senders[1:]
+		}
+		if to.points == 0 {
+			receivers = receivers[1:]
+		}
+	}
+	if len(senders) > 0 || len(receivers) > 0 {
+		return transfers, errors.New("the balances don't add up to the points of the receipts")
+	}
+	return transfers, nil
+}
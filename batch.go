@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// BatchResult reports the outcome for the receipt or ID at the same position
+// in the request. Either Points or Error is set.
+type BatchResult struct {
+	ID     string `json:"id,omitempty"`
+	Points *int   `json:"points,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Flagged is set when the receipt was stored with flags for review.
+	Flagged bool `json:"flagged,omitempty"`
+	// InvalidParams explains validation failures field by field.
+	InvalidParams []FieldError `json:"invalid-params,omitempty"`
+}
+
+func invalidReceiptResult(err error) BatchResult {
+	problem := invalidReceiptProblem(err)
+	return BatchResult{Error: problem.Title, InvalidParams: problem.InvalidParams}
+}
+
+// ProcessBatchHandler accepts a JSON array of receipts. Invalid receipts do
+// not fail the batch; they get an error entry in the results instead.
+func (s *Server) ProcessBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var batch []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		http.Error(w, "The batch must be a JSON array of receipts", http.StatusBadRequest)
+		return
+	}
+	if len(batch) == 0 || len(batch) > s.cfg.BatchMaxSize {
+		http.Error(w, fmt.Sprintf("The batch must contain between 1 and %d receipts", s.cfg.BatchMaxSize), http.StatusBadRequest)
+		return
+	}
+
+	if !s.chargeQuota(w, r, len(batch)) {
+		return
+	}
+	from := submitterOf(r)
+	results := s.processBatch(len(batch), func(i int) BatchResult {
+		return s.processBatchItem(from, batch[i])
+	})
+
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	s.refundQuota(r, failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// processBatch runs process for each of the n receipts of a batch on up to
+// -batch-workers goroutines, and returns their results in order.
+func (s *Server) processBatch(n int, process func(i int) BatchResult) []BatchResult {
+	results := make([]BatchResult, n)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(s.cfg.BatchWorkers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = process(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func (s *Server) processBatchItem(from submitter, data json.RawMessage) BatchResult {
+	receipt, err := s.parseReceipt(data)
+	if err != nil {
+		return invalidReceiptResult(err)
+	}
+	return s.processBatchReceipt(from, receipt)
+}
+
+// processBatchReceipt processes a receipt of a batch that was already
+// validated.
+func (s *Server) processBatchReceipt(from submitter, receipt Receipt) BatchResult {
+	record, err := s.processReceipt(receipt, from)
+	if err != nil {
+		problem, known := errorProblem(err)
+		if !known {
+			slog.ErrorContext(from.ctx, "Failed to process a receipt of a batch", "err", err)
+		}
+		// Duplicates come with the ID they were stored under.
+		return BatchResult{ID: record.ID, Error: problem.Detail}
+	}
+	return BatchResult{ID: record.ID, Points: &record.Points, Flagged: len(record.Flags) > 0}
+}
+
+type BatchGetPointsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// BatchGetPointsHandler returns points for many receipts at once. Unknown
+// IDs get an error entry rather than failing the whole request.
+func (s *Server) BatchGetPointsHandler(w http.ResponseWriter, r *http.Request) {
+	var request BatchGetPointsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		http.Error(w, "The request must be a JSON object with an ids array", http.StatusBadRequest)
+		return
+	}
+	if len(request.IDs) == 0 || len(request.IDs) > s.cfg.BatchMaxSize {
+		http.Error(w, fmt.Sprintf("The request must contain between 1 and %d ids", s.cfg.BatchMaxSize), http.StatusBadRequest)
+		return
+	}
+
+	records, err := getMany(s.tenantStore(r.Context(), tenantFrom(r)), request.IDs)
+	if err != nil {
+		http.Error(w, "Failed to look up the receipts", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]BatchResult, len(request.IDs))
+	for i, id := range request.IDs {
+		record, found := records[id]
+		if !found || !ownedBy(r, record.Owner) {
+			results[i] = BatchResult{ID: id, Error: "No receipt found for that id"}
+			continue
+		}
+		results[i] = BatchResult{ID: id, Points: &record.Points}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HolidayCalendar decides which purchase dates earn the holiday bonus.
+type HolidayCalendar interface {
+	IsHoliday(date time.Time) bool
+	// Dates lists the holidays as YYYY-MM-DD, for versioning the rules.
+	Dates() []string
+}
+
+// holidaySet is a HolidayCalendar backed by a fixed set of dates.
+type holidaySet map[string]bool
+
+func (h holidaySet) IsHoliday(date time.Time) bool {
+	return h[date.Format("2006-01-02")]
+}
+
+func (h holidaySet) Dates() []string {
+	dates := make([]string, 0, len(h))
+	for date := range h {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	return dates
+}
+
+func (h holidaySet) addDate(date string) error {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return fmt.Errorf("invalid date %q", date)
+	}
+	h[date] = true
+	return nil
+}
+
+// loadHolidayCalendar reads holidays from a file or an http(s) URL. An
+// iCalendar (.ics) source contributes the dates of its all-day events;
+// anything else is read as one YYYY-MM-DD date per line, ignoring blank
+// lines and text after a '#'.
+func loadHolidayCalendar(source string) (holidaySet, error) {
+	data, err := readCalendarSource(source)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("BEGIN:VCALENDAR")) {
+		return parseICalendar(data)
+	}
+
+	holidays := make(holidaySet)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		date, _, _ := strings.Cut(scanner.Text(), "#")
+		date = strings.TrimSpace(date)
+		if date == "" {
+			continue
+		}
+		if err := holidays.addDate(date); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return holidays, scanner.Err()
+}
+
+var calendarClient = &http.Client{Timeout: 10 * time.Second}
+
+func readCalendarSource(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	resp, err := calendarClient.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", source, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// parseICalendar collects every date covered by the VEVENTs in an
+// iCalendar document. Recurrence rules are not expanded, so feeds need to
+// list each year's holidays.
+func parseICalendar(data []byte) (holidaySet, error) {
+	// Unfold continuation lines, which start with a space or a tab.
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.NewReplacer("\n ", "", "\n\t", "").Replace(text)
+
+	holidays := make(holidaySet)
+	var start, end string
+	inEvent := false
+	for _, line := range strings.Split(text, "\n") {
+		name, value, _ := strings.Cut(line, ":")
+		// Drop parameters such as ";VALUE=DATE".
+		name, _, _ = strings.Cut(name, ";")
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			if value == "VEVENT" {
+				inEvent, start, end = true, "", ""
+			}
+		case "DTSTART":
+			start = value
+		case "DTEND":
+			end = value
+		case "END":
+			if value != "VEVENT" || !inEvent {
+				continue
+			}
+			inEvent = false
+			if err := holidays.addEvent(start, end); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return holidays, nil
+}
+
+// addEvent adds the dates from start up to, but not including, end. An
+// event without an end lasts one day.
+func (h holidaySet) addEvent(start, end string) error {
+	from, err := parseICalendarDate(start)
+	if err != nil {
+		return err
+	}
+	to := from.AddDate(0, 0, 1)
+	if end != "" {
+		if to, err = parseICalendarDate(end); err != nil {
+			return err
+		}
+	}
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		h[day.Format("2006-01-02")] = true
+	}
+	return nil
+}
+
+// parseICalendarDate reads the date part of a DATE or DATE-TIME value.
+func parseICalendarDate(value string) (time.Time, error) {
+	if len(value) < 8 {
+		return time.Time{}, fmt.Errorf("invalid iCalendar date %q", value)
+	}
+	date, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid iCalendar date %q", value)
+	}
+	return date, nil
+}
+
+// combineHolidays merges the inline dates of a rules file into a calendar.
+func combineHolidays(dates []string, calendar holidaySet) (holidaySet, error) {
+	if calendar == nil {
+		calendar = make(holidaySet)
+	}
+	for i, date := range dates {
+		if err := calendar.addDate(date); err != nil {
+			return nil, fmt.Errorf("holidays[%d]: %w", i, err)
+		}
+	}
+	return calendar, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Campaign is a time-boxed promotion. Receipts scored between Start and End
+// that meet its criteria earn Bonus points, and the points from the scoring
+// rules are multiplied by Multiplier.
+type Campaign struct {
+	ID    string    `json:"id"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Retailer is a regular expression the retailer name must match,
+	// ignoring case. Empty matches every retailer.
+	Retailer string `json:"retailer,omitempty"`
+	// MinTotal is the smallest qualifying total, such as "50.00".
+	MinTotal string `json:"minTotal,omitempty"`
+	Bonus    int    `json:"bonus,omitempty"`
+	// Multiplier is a decimal with two places, such as "1.50". Empty leaves
+	// the points unchanged.
+	Multiplier string `json:"multiplier,omitempty"`
+
+	retailer   *regexp.Regexp
+	minTotal   Cents
+	multiplier int64
+}
+
+func (c *Campaign) compile() error {
+	if c.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+	if !c.Start.Before(c.End) {
+		return fmt.Errorf("start must be before end")
+	}
+	var err error
+	if c.retailer, err = regexp.Compile("(?i)" + c.Retailer); err != nil {
+		return fmt.Errorf("retailer must be a regular expression: %w", err)
+	}
+	if c.MinTotal != "" {
+		if c.minTotal, err = parseCents(c.MinTotal); err != nil {
+			return fmt.Errorf("minTotal must be a decimal with two places: %w", err)
+		}
+	}
+	if c.Multiplier != "" {
+		multiplier, err := parseCents(c.Multiplier)
+		if err != nil {
+			return fmt.Errorf("multiplier must be a decimal with two places: %w", err)
+		}
+		c.multiplier = int64(multiplier)
+	}
+	return nil
+}
+
+func (c *Campaign) activeAt(at time.Time) bool {
+	return !at.Before(c.Start) && at.Before(c.End)
+}
+
+func (c *Campaign) matches(receipt *Receipt, total Cents) bool {
+	return c.retailer.MatchString(receipt.Retailer) && total >= c.minTotal
+}
+
+// applyCampaigns adds the points of every campaign the receipt qualifies
+// for at the given time. Multipliers apply to the points earned before any
+// campaign, so campaigns don't compound.
+func (rs *RuleSet) applyCampaigns(breakdown *PointsBreakdown, receipt *Receipt, at time.Time) {
+	base := int64(breakdown.Points)
+	total, _ := parseCents(receipt.Total)
+	for i := range rs.Campaigns {
+		c := &rs.Campaigns[i]
+		if !c.activeAt(at) || !c.matches(receipt, total) {
+			continue
+		}
+		points := c.Bonus
+		if c.multiplier != 0 {
+			points += int(base * (c.multiplier - 100) / 100)
+		}
+		breakdown.add("campaign:"+c.ID, points)
+		breakdown.Campaigns = append(breakdown.Campaigns, c.ID)
+	}
+}
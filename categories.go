@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ItemCategory tags the items whose description contains one of Keywords,
+// as a whole word, or matches Pattern, both ignoring case. Every item in
+// the category earns PointsPerItem.
+type ItemCategory struct {
+	Name          string   `json:"name"`
+	Keywords      []string `json:"keywords,omitempty"`
+	Pattern       string   `json:"pattern,omitempty"`
+	PointsPerItem int      `json:"pointsPerItem,omitempty"`
+
+	matchers []*regexp.Regexp
+}
+
+func (c *ItemCategory) compile() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(c.Keywords) == 0 && c.Pattern == "" {
+		return errors.New("keywords or a pattern are required")
+	}
+	c.matchers = nil
+	if len(c.Keywords) > 0 {
+		words := make([]string, len(c.Keywords))
+		for i, keyword := range c.Keywords {
+			words[i] = regexp.QuoteMeta(strings.TrimSpace(keyword))
+		}
+		c.matchers = append(c.matchers, regexp.MustCompile(`(?i)\b(?:`+strings.Join(words, "|")+`)\b`))
+	}
+	if c.Pattern != "" {
+		pattern, err := regexp.Compile("(?i)" + c.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern must be a regular expression: %w", err)
+		}
+		c.matchers = append(c.matchers, pattern)
+	}
+	return nil
+}
+
+func (c *ItemCategory) matches(description string) bool {
+	for _, matcher := range c.matchers {
+		if matcher.MatchString(description) {
+			return true
+		}
+	}
+	return false
+}
+
+type CategorizedItem struct {
+	ShortDescription string `json:"shortDescription"`
+	// Category is empty for items that fit no category.
+	Category string `json:"category,omitempty"`
+}
+
+// categorize returns the first category each item matches.
+func (rs *RuleSet) categorize(items []Item) []CategorizedItem {
+	categorized := make([]CategorizedItem, len(items))
+	for i, item := range items {
+		categorized[i].ShortDescription = item.ShortDescription
+		for j := range rs.ItemCategories {
+			if rs.ItemCategories[j].matches(item.ShortDescription) {
+				categorized[i].Category = rs.ItemCategories[j].Name
+				break
+			}
+		}
+	}
+	return categorized
+}
+
+// applyItemCategories tags the items and awards the per-item points of each
+// category.
+func (rs *RuleSet) applyItemCategories(breakdown *PointsBreakdown, items []Item) {
+	if len(rs.ItemCategories) == 0 {
+		return
+	}
+	breakdown.Items = rs.categorize(items)
+
+	counts := make(map[string]int)
+	for _, item := range breakdown.Items {
+		counts[item.Category]++
+	}
+	for _, category := range rs.ItemCategories {
+		breakdown.add("category:"+category.Name, counts[category.Name]*category.PointsPerItem)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// CBOR (RFC 8949), for the values encoding/json decodes into any. Maps are
+// encoded with their keys sorted and every length definite.
+
+const (
+	cborUint   = 0 << 5
+	cborNegint = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+
+	// cborIndefinite is the additional information of items whose length
+	// is ended by a break rather than given up front.
+	cborIndefinite = 31
+	cborBreak      = cborSimple | cborIndefinite
+)
+
+// appendCBORHead appends the initial bytes of an item of the major type
+// with the argument n.
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, major|27), n)
+	}
+}
+
+func appendCBOR(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, cborSimple|22), nil
+	case bool:
+		if v {
+			return append(b, cborSimple|21), nil
+		}
+		return append(b, cborSimple|20), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i < 0 {
+				return appendCBORHead(b, cborNegint, uint64(-1-i)), nil
+			}
+			return appendCBORHead(b, cborUint, uint64(i)), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(append(b, cborSimple|27), math.Float64bits(f)), nil
+	case string:
+		return append(appendCBORHead(b, cborText, uint64(len(v))), v...), nil
+	case []any:
+		b = appendCBORHead(b, cborArray, uint64(len(v)))
+		var err error
+		for _, elem := range v {
+			if b, err = appendCBOR(b, elem); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		b = appendCBORHead(b, cborMap, uint64(len(v)))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		var err error
+		for _, key := range keys {
+			b = append(appendCBORHead(b, cborText, uint64(len(key))), key...)
+			if b, err = appendCBOR(b, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("can't encode %T as CBOR", v)
+	}
+}
+
+var (
+	errCBORTruncated = errors.New("CBOR data is truncated")
+	errCBORBreak     = errors.New("unexpected CBOR break")
+)
+
+// cborDecoder decodes CBOR into the values encoding/json decodes into any.
+// Byte strings become strings, undefined becomes null and tags are
+// dropped, leaving the items they tag.
+type cborDecoder struct {
+	data []byte
+}
+
+func (d *cborDecoder) take(n uint64) ([]byte, error) {
+	if uint64(len(d.data)) < n {
+		return nil, errCBORTruncated
+	}
+	p := d.data[:n]
+	d.data = d.data[n:]
+	return p, nil
+}
+
+// head reads the initial bytes of an item: its major type, additional
+// information and argument.
+func (d *cborDecoder) head() (major, info byte, n uint64, err error) {
+	p, err := d.take(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = p[0]&0xe0, p[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		p, err := d.take(1 << (info - 24))
+		for _, c := range p {
+			n = n<<8 | uint64(c)
+		}
+		return major, info, n, err
+	case info == cborIndefinite:
+		return major, info, 0, nil
+	}
+	return 0, 0, 0, fmt.Errorf("malformed CBOR item 0x%02x", p[0])
+}
+
+func (d *cborDecoder) decode(depth int) (any, error) {
+	if depth > maxFormatDepth {
+		return nil, errFormatTooDeep
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == cborIndefinite
+	switch major {
+	case cborUint:
+		if indefinite {
+			break
+		}
+		return json.Number(strconv.FormatUint(n, 10)), nil
+	case cborNegint:
+		if indefinite {
+			break
+		}
+		if n > math.MaxInt64 {
+			return formatFloat(-1 - float64(n)), nil
+		}
+		return json.Number(strconv.FormatInt(-1-int64(n), 10)), nil
+	case cborBytes, cborText:
+		return d.str(major, n, indefinite)
+	case cborArray:
+		var elems []any
+		for i := uint64(0); indefinite || i < n; i++ {
+			elem, err := d.decode(depth + 1)
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		if elems == nil {
+			elems = []any{}
+		}
+		return elems, nil
+	case cborMap:
+		m := make(map[string]any)
+		for i := uint64(0); indefinite || i < n; i++ {
+			key, err := d.decode(depth + 1)
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			s, ok := key.(string)
+			if !ok {
+				return nil, errors.New("CBOR map keys must be strings")
+			}
+			if m[s], err = d.decode(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		if indefinite {
+			break
+		}
+		return d.decode(depth + 1)
+	case cborSimple:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			return formatFloat(float16(uint16(n))), nil
+		case 26:
+			return formatFloat(float64(math.Float32frombits(uint32(n)))), nil
+		case 27:
+			return formatFloat(math.Float64frombits(n)), nil
+		case cborIndefinite:
+			return nil, errCBORBreak
+		}
+	}
+	return nil, fmt.Errorf("unsupported CBOR item of major type %d", major>>5)
+}
+
+// str reads a byte or text string, joining the chunks of an indefinite
+// one.
+func (d *cborDecoder) str(major byte, n uint64, indefinite bool) (any, error) {
+	if !indefinite {
+		p, err := d.take(n)
+		return string(p), err
+	}
+	var s []byte
+	for {
+		chunkMajor, info, n, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor == cborSimple && info == cborIndefinite {
+			return string(s), nil
+		}
+		if chunkMajor != major || info == cborIndefinite {
+			return nil, errors.New("malformed indefinite-length CBOR string")
+		}
+		p, err := d.take(n)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, p...)
+	}
+}
+
+// float16 converts an IEEE 754 half-precision number.
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		f = math.Inf(1)
+		if mant != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+func unmarshalCBOR(data []byte) (any, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.decode(0)
+	if err == nil && len(d.data) > 0 {
+		err = errors.New("CBOR data continues after the value")
+	}
+	return v, err
+}
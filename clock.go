@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clock tells the time to handlers and rules, so that pinning it makes
+// their results reproducible.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// fixedClock always tells the same time, for replaying requests while
+// debugging.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// IDGenerator makes the IDs of receipts, jobs and the other records the
+// service creates.
+type IDGenerator interface {
+	NewID() string
+}
+
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() string { return uuid.New().String() }
+
+// seededIDs makes the same sequence of UUIDs for the same seed.
+type seededIDs struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newSeededIDs(seed int64) *seededIDs {
+	return &seededIDs{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (g *seededIDs) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Reading from a math/rand source never fails.
+	id, _ := uuid.NewRandomFromReader(g.rand)
+	return id.String()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pointsETag is the entity tag of a receipt's points. Points only change
+// when the receipt is amended or rescored, which changes them or the rules
+// version. The tag is weak because the response is served in several
+// formats and encodings that all carry the same points.
+func pointsETag(points PointsResponse) string {
+	return `W/"` + points.RulesVersion + "." + strconv.Itoa(points.Points) + `"`
+}
+
+// lastModified is when a receipt last changed: when it was processed, or
+// the latest of its amendments, rescorings, review and expiry.
+func lastModified(record ReceiptRecord) time.Time {
+	modified := record.ProcessedAt
+	for _, amendment := range record.Amendments {
+		if amendment.AmendedAt.After(modified) {
+			modified = amendment.AmendedAt
+		}
+	}
+	if record.Review != nil && record.Review.ReviewedAt != nil && record.Review.ReviewedAt.After(modified) {
+		modified = *record.Review.ReviewedAt
+	}
+	if record.ExpiredAt != nil && record.ExpiredAt.After(modified) {
+		modified = *record.ExpiredAt
+	}
+	return modified
+}
+
+// setValidators sets the ETag and Last-Modified headers of a response, when
+// it has them, and reports whether the conditions of r say the client's
+// copy is current, in which case it should be answered with 304.
+func setValidators(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	return notModified(r, etag, modified)
+}
+
+// notModified reports whether the conditions of r match a response tagged
+// etag and last modified at modified. If-None-Match compares entity tags
+// weakly, and takes precedence over If-Modified-Since, as RFC 9110 has it.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if etag == "" {
+			return false
+		}
+		etag = strings.TrimPrefix(etag, "W/")
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	// Last-Modified only has whole seconds.
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// cacheControl is the "cacheControl" middleware, which sets the
+// Cache-Control header of successful GET responses to policy, unless their
+// handler set one. It is left out when policy is empty.
+func cacheControl(policy string) Middleware {
+	if policy == "" {
+		return Middleware{Name: "cacheControl"}
+	}
+	return Middleware{Name: "cacheControl", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, policy: policy}, r)
+		})
+	}}
+}
+
+// cacheControlWriter sets the Cache-Control header as the status goes out,
+// so that errors aren't cached.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	policy      string
+	wroteHeader bool
+}
+
+func (w *cacheControlWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status < http.StatusBadRequest && w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", w.policy)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheControlWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
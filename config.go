@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configEnvPrefix prefixes the environment variables overriding flags:
+// -shutdown-timeout is RECEIPTS_SHUTDOWN_TIMEOUT.
+const configEnvPrefix = "RECEIPTS_"
+
+// secretEnvVars are the credentials that are only ever read from the
+// environment.
+var secretEnvVars = []string{
+	"RECEIPTS_POSTGRES_DSN",
+	"RECEIPTS_REDIS_PASSWORD",
+	"RECEIPTS_BOOTSTRAP_API_KEY",
+	"RECEIPTS_HMAC_SECRETS",
+	"RECEIPTS_IMAP_PASSWORD",
+}
+
+// ConfigSource is where the effective value of a setting came from, from
+// lowest to highest precedence.
+type ConfigSource string
+
+const (
+	SourceDefault ConfigSource = "default"
+	SourceFile    ConfigSource = "file"
+	SourceEnv     ConfigSource = "env"
+	SourceFlag    ConfigSource = "flag"
+)
+
+type ConfigSetting struct {
+	Value  string       `json:"value"`
+	Source ConfigSource `json:"source"`
+}
+
+type ConfigResponse struct {
+	// File is the config file that was loaded, if any.
+	File     string                   `json:"file,omitempty"`
+	Settings map[string]ConfigSetting `json:"settings"`
+	// Secrets lists the credentials set in the environment, without their
+	// values.
+	Secrets []string `json:"secrets"`
+}
+
+func configEnvName(flagName string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// parseConfigFile reads a config file of flag names and values:
+//
+//	store: postgres
+//	fraud: flag
+//	shutdown-timeout: 1m # comments are fine
+//
+// This is the subset of YAML made of top-level scalars, which covers every
+// setting; lists and nesting are refused rather than misread.
+func parseConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line != trimmed {
+			return nil, fmt.Errorf("%s:%d: nested settings aren't supported", path, n)
+		}
+		key, value, found := strings.Cut(trimmed, ":")
+		key = strings.TrimSpace(key)
+		if !found || key == "" || strings.HasPrefix(key, "-") {
+			return nil, fmt.Errorf("%s:%d: settings must look like \"name: value\"", path, n)
+		}
+		value, err := yamlScalar(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, key, err)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, n, key)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// yamlScalar decodes a plain, single-quoted or double-quoted scalar,
+// dropping a trailing comment.
+func yamlScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := strings.LastIndex(s, `"`)
+		if end == 0 || !isComment(s[end+1:]) {
+			return "", errors.New("unterminated quoted value")
+		}
+		return strconv.Unquote(s[:end+1])
+	case strings.HasPrefix(s, "'"):
+		end := strings.LastIndex(s, "'")
+		if end == 0 || !isComment(s[end+1:]) {
+			return "", errors.New("unterminated quoted value")
+		}
+		return strings.ReplaceAll(s[1:end], "''", "'"), nil
+	case strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") || strings.HasPrefix(s, "|") || strings.HasPrefix(s, ">"):
+		return "", errors.New("only single values are supported")
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
+
+// loadConfig layers the config file and the environment under the flags
+// given on the command line: defaults < file < environment < flags. Values
+// go through the flags' own parsing, so they are validated the same way
+// wherever they come from. It returns the effective settings.
+func loadConfig(fs *flag.FlagSet, path string) (map[string]ConfigSetting, error) {
+	fromFile := map[string]string{}
+	if path != "" {
+		var err error
+		if fromFile, err = parseConfigFile(path); err != nil {
+			return nil, fmt.Errorf("read config file: %w", err)
+		}
+		for name := range fromFile {
+			if fs.Lookup(name) == nil {
+				return nil, fmt.Errorf("config file %s: unknown setting %q", path, name)
+			}
+		}
+	}
+
+	settings := make(map[string]ConfigSetting)
+	fs.Visit(func(f *flag.Flag) {
+		settings[f.Name] = ConfigSetting{Source: SourceFlag}
+	})
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, set := settings[f.Name]; set {
+			return
+		}
+		source := SourceDefault
+		if value, found := os.LookupEnv(configEnvName(f.Name)); found {
+			source = SourceEnv
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", configEnvName(f.Name), err))
+			}
+		} else if value, found := fromFile[f.Name]; found {
+			source = SourceFile
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, f.Name, err))
+			}
+		}
+		settings[f.Name] = ConfigSetting{Source: source}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		setting := settings[f.Name]
+		setting.Value = redactURL(f.Value.String())
+		settings[f.Name] = setting
+	})
+	return settings, nil
+}
+
+// redactURL hides the password of URLs carrying credentials.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
+
+// validate checks the settings that flag parsing alone can't.
+func (cfg ServerConfig) validate() error {
+	var errs []error
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"batch-max-size", cfg.BatchMaxSize},
+		{"batch-workers", cfg.BatchWorkers},
+		{"async-batch-max-size", cfg.AsyncBatchMaxSize},
+		{"job-workers", cfg.JobWorkers},
+		{"import-workers", cfg.ImportWorkers},
+	} {
+		if setting.value < 1 {
+			errs = append(errs, fmt.Errorf("-%s must be at least 1", setting.name))
+		}
+	}
+	if cfg.JobQueueSize < 0 {
+		errs = append(errs, errors.New("-job-queue-size must not be negative"))
+	}
+	if cfg.MaxBodyBytes < 1 || cfg.MaxBatchBodyBytes < 1 {
+		errs = append(errs, errors.New("-max-body-bytes and -max-batch-body-bytes must be positive"))
+	}
+	if cfg.PointsExpiry < 0 || cfg.PointsExpiryWarning < 0 {
+		errs = append(errs, errors.New("-points-expiry and -points-expiry-warning must not be negative"))
+	}
+	if cfg.StreamIdleTimeout < 0 {
+		errs = append(errs, errors.New("-stream-idle-timeout must not be negative"))
+	}
+	if cfg.Anomaly.ZScore < 0 {
+		errs = append(errs, errors.New("-anomaly-z-score must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// EnableConfigEndpoint serves the effective settings loaded from file.
+func (s *Server) EnableConfigEndpoint(file string, settings map[string]ConfigSetting) {
+	s.config = &ConfigResponse{File: file, Settings: settings, Secrets: []string{}}
+	for _, name := range secretEnvVars {
+		if os.Getenv(name) != "" {
+			s.config.Secrets = append(s.config.Secrets, name)
+		}
+	}
+}
+
+func (s *Server) GetConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.config)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// csvColumns are the columns of a CSV import, named like the fields of a
+// JSON receipt. userId is optional.
+var csvColumns = []string{"retailer", "purchaseDate", "purchaseTime", "total", "userId", "shortDescription", "price"}
+
+// csvReceiptColumns start a receipt when any of them has a value.
+var csvReceiptColumns = []string{"retailer", "purchaseDate", "purchaseTime", "total", "userId"}
+
+// CSVRowResult reports the outcome for the receipt starting on Line of a
+// CSV import, counting the header as line 1.
+type CSVRowResult struct {
+	Line int `json:"line"`
+	BatchResult
+}
+
+// CSVImportReport is the response of a CSV import.
+type CSVImportReport struct {
+	Receipts  int            `json:"receipts"`
+	Processed int            `json:"processed"`
+	Failed    int            `json:"failed"`
+	Results   []CSVRowResult `json:"results"`
+}
+
+// csvReceipt is a receipt read from a CSV import, or the error of a row
+// that can't be part of one.
+type csvReceipt struct {
+	line    int
+	receipt Receipt
+	err     string
+}
+
+// readCSVReceipts reads the receipts of a CSV import. The first row names
+// the columns. A row with a value in any of the receipt columns starts a
+// receipt, and the rows after it with only item columns add items to it;
+// the row starting a receipt may hold its first item too.
+func readCSVReceipts(r io.Reader) ([]csvReceipt, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("it is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(csvColumns, name) {
+			return nil, fmt.Errorf("unknown column %q: the columns are %s", name, strings.Join(csvColumns, ", "))
+		}
+		columns[name] = i
+	}
+	for _, name := range csvColumns {
+		if _, found := columns[name]; !found && name != "userId" {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+	cell := func(record []string, name string) string {
+		if i, found := columns[name]; found {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var receipts []csvReceipt
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return receipts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(record, func(v string) bool { return strings.TrimSpace(v) != "" }) {
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+
+		startsReceipt := slices.ContainsFunc(csvReceiptColumns, func(name string) bool { return cell(record, name) != "" })
+		if startsReceipt {
+			receipts = append(receipts, csvReceipt{line: line, receipt: Receipt{
+				Retailer:     cell(record, "retailer"),
+				PurchaseDate: cell(record, "purchaseDate"),
+				PurchaseTime: cell(record, "purchaseTime"),
+				Total:        cell(record, "total"),
+				UserID:       cell(record, "userId"),
+				Items:        []Item{},
+			}})
+		} else if len(receipts) == 0 || receipts[len(receipts)-1].err != "" {
+			receipts = append(receipts, csvReceipt{line: line, err: "Item rows must follow the row of their receipt"})
+			continue
+		}
+		description, price := cell(record, "shortDescription"), cell(record, "price")
+		if description == "" && price == "" {
+			continue
+		}
+		last := &receipts[len(receipts)-1].receipt
+		last.Items = append(last.Items, Item{ShortDescription: description, Price: price})
+	}
+}
+
+// uploadedFile returns the file uploaded with a request, and its media
+// type: the file part of a multipart form, or else the body itself.
+func uploadedFile(r *http.Request) (io.Reader, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, r.Header.Get("Content-Type"), nil
+	}
+	form, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := form.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, "", errors.New("the form has no file part")
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FormName() == "file" {
+			return part, part.Header.Get("Content-Type"), nil
+		}
+	}
+}
+
+// ImportCSVHandler processes the receipts of a CSV file and reports the
+// outcome for each, by the line it starts on. Like in batches, invalid
+// receipts don't fail the import.
+func (s *Server) ImportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	body, _, err := uploadedFile(r)
+	var receipts []csvReceipt
+	if err == nil {
+		receipts, err = readCSVReceipts(body)
+	}
+	if err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		http.Error(w, "The CSV file can't be read: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(receipts) == 0 || len(receipts) > s.cfg.BatchMaxSize {
+		http.Error(w, fmt.Sprintf("The CSV file must contain between 1 and %d receipts", s.cfg.BatchMaxSize), http.StatusBadRequest)
+		return
+	}
+
+	if !s.chargeQuota(w, r, len(receipts)) {
+		return
+	}
+	from := submitterOf(r)
+	results := s.processBatch(len(receipts), func(i int) BatchResult {
+		return s.processCSVReceipt(from, receipts[i])
+	})
+
+	report := CSVImportReport{Receipts: len(receipts), Results: make([]CSVRowResult, len(results))}
+	for i, result := range results {
+		report.Results[i] = CSVRowResult{Line: receipts[i].line, BatchResult: result}
+		if result.Error != "" {
+			report.Failed++
+		} else {
+			report.Processed++
+		}
+	}
+	s.refundQuota(r, report.Failed)
+	logAttrs(r, slog.Int("receipts", report.Receipts))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *Server) processCSVReceipt(from submitter, c csvReceipt) BatchResult {
+	if c.err != "" {
+		return BatchResult{Error: c.err}
+	}
+	receipt := c.receipt
+	if err := s.checkReceipt(&receipt); err != nil {
+		return invalidReceiptResult(err)
+	}
+	return s.processBatchReceipt(from, receipt)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDuplicatesArePerOwner(t *testing.T) {
+	rules, err := NewRulesEngine(RulesConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(NewMemoryStore(), rules, systemClock{}, uuidGenerator{}, ServerConfig{Dedup: DedupReject})
+	receipt := Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Total:        "6.49",
+		Items:        []Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+	}
+	alice := submitter{ctx: context.Background(), owner: "alice"}
+	bob := submitter{ctx: context.Background(), owner: "bob"}
+
+	first, err := s.processReceipt(receipt, alice)
+	if err != nil {
+		t.Fatalf("alice's receipt: %v", err)
+	}
+	// Bob's copy is stored after alice's, and must not hide it.
+	second, err := s.processReceipt(receipt, bob)
+	if err != nil {
+		t.Fatalf("bob's copy of alice's receipt: %v", err)
+	}
+	if second.ID == first.ID {
+		t.Fatalf("bob's copy was stored as alice's receipt %s", first.ID)
+	}
+
+	for _, tt := range []struct {
+		from submitter
+		want string
+	}{
+		{alice, first.ID},
+		{bob, second.ID},
+	} {
+		_, err := s.processReceipt(receipt, tt.from)
+		var duplicate *duplicateReceiptError
+		if !errors.As(err, &duplicate) || duplicate.ID != tt.want {
+			t.Errorf("%s's duplicate: error = %v, want a duplicate of %s", tt.from.owner, err, tt.want)
+		}
+	}
+}
+
+// slowHashStore takes its time answering lookups by content hash, as a
+// database would, so that receipts can be stored in the meantime.
+type slowHashStore struct {
+	Store
+}
+
+func (s slowHashStore) FindByContentHash(hash string) (ReceiptRecord, error) {
+	record, err := s.Store.FindByContentHash(hash)
+	time.Sleep(5 * time.Millisecond)
+	return record, err
+}
+
+func TestDuplicatesSubmittedTogether(t *testing.T) {
+	rules, err := NewRulesEngine(RulesConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	s := NewServer(slowHashStore{store}, rules, systemClock{}, uuidGenerator{}, ServerConfig{Dedup: DedupReject})
+	receipt := Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Total:        "6.49",
+		Items:        []Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+	}
+	from := submitter{ctx: context.Background(), owner: "alice"}
+
+	const copies = 8
+	errs := make(chan error, copies)
+	for i := 0; i < copies; i++ {
+		go func() {
+			_, err := s.processReceipt(receipt, from)
+			errs <- err
+		}()
+	}
+	var stored, duplicates int
+	for i := 0; i < copies; i++ {
+		var duplicate *duplicateReceiptError
+		switch err := <-errs; {
+		case err == nil:
+			stored++
+		case errors.As(err, &duplicate):
+			duplicates++
+		default:
+			t.Errorf("copy %d: %v", i, err)
+		}
+	}
+	if stored != 1 || duplicates != copies-1 {
+		t.Errorf("%d of %d copies stored, %d rejected as duplicates", stored, copies, duplicates)
+	}
+	if records, err := store.List(ListOptions{}); err != nil || len(records) != 1 {
+		t.Errorf("List = %d receipts, %v; want 1", len(records), err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// IMAPConfig names the mailbox receipts are read from, and how often it is
+// checked for new email.
+type IMAPConfig struct {
+	// Addr is the host:port of the IMAP server, which must use TLS.
+	Addr     string
+	Username string
+	Password string
+	Mailbox  string
+	Interval time.Duration
+	// Tenant is the tenant the receipts are processed for.
+	Tenant string
+}
+
+var (
+	// htmlHidden matches the elements whose text isn't shown.
+	htmlHidden = regexp.MustCompile(`(?is)<(head|script|style)\b.*?</(head|script|style)\s*>`)
+	// htmlLineEnds matches the tags that end a line of text.
+	htmlLineEnds = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li|/h[1-6]|/table)\b[^>]*>`)
+	htmlTags     = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// htmlText renders HTML as lines of text, as far as reading receipts from
+// it with templates goes: table cells end up on one line, separated by
+// spaces.
+func htmlText(s string) string {
+	s = htmlHidden.ReplaceAllString(s, "")
+	s = htmlLineEnds.ReplaceAllString(s, "\n")
+	s = htmlTags.ReplaceAllString(s, " ")
+	s = html.UnescapeString(s)
+
+	var b strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			b.WriteString(strings.Join(fields, " "))
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// emailText returns the Message-ID of an email, and the text its receipt
+// is read from: the From and Subject headers, then the body. The HTML body
+// is preferred over the plain text one.
+func emailText(raw []byte) (messageID, text string, err error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", "", err
+	}
+	body, isHTML, err := emailBody(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if isHTML {
+		body = htmlText(body)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	text = "From: " + msg.Header.Get("From") + "\nSubject: " + subject + "\n" + body
+	return msg.Header.Get("Message-Id"), text, nil
+}
+
+// emailBody returns the body of a part of an email with the given
+// Content-Type and Content-Transfer-Encoding, looking into multipart ones
+// for an HTML or else a plain text part.
+func emailBody(contentType, encoding string, r io.Reader) (string, bool, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Email without a Content-Type is plain text.
+		mediaType = "text/plain"
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		parts := multipart.NewReader(r, params["boundary"])
+		var plain string
+		for {
+			part, err := parts.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return "", false, err
+			}
+			// Quoted-printable parts are decoded by the reader.
+			body, isHTML, err := emailBody(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", false, err
+			}
+			if isHTML {
+				return body, true, nil
+			}
+			if plain == "" {
+				plain = body
+			}
+		}
+		if plain == "" {
+			return "", false, errors.New("the email has no text")
+		}
+		return plain, false, nil
+	case mediaType == "text/html", mediaType == "text/plain":
+		switch strings.ToLower(encoding) {
+		case "base64":
+			r = base64.NewDecoder(base64.StdEncoding, r)
+		case "quoted-printable":
+			r = quotedprintable.NewReader(r)
+		}
+		data, err := io.ReadAll(r)
+		return string(data), mediaType == "text/html", err
+	}
+	// Attachments and the like.
+	return "", false, nil
+}
+
+// ingestEmail processes the receipt read from an email with the receipt
+// templates, the way ingest does for JSON receipts. The receipt's source
+// is the email's Message-ID, and the email is its attachment.
+func (s *Server) ingestEmail(ctx context.Context, tenant string, raw []byte) (BatchResult, error) {
+	messageID, text, err := emailText(raw)
+	if err != nil {
+		ingested.Add("invalid", 1)
+		return BatchResult{Error: fmt.Sprintf("The email can't be read: %v", err)}, nil
+	}
+	receipt, _, err := s.templates.Parse(text)
+	if err == nil {
+		err = s.checkReceipt(&receipt)
+	}
+	if err != nil {
+		ingested.Add("invalid", 1)
+		if errors.Is(err, errNoTemplate) {
+			return BatchResult{Error: "No receipt template matches the email"}, nil
+		}
+		return invalidReceiptResult(err), nil
+	}
+	result, err := s.ingestReceipt(ctx, submitter{tenant: tenant, source: "email:" + messageID}, receipt)
+	if err == nil && result.Error == "" {
+		s.attachArtifact(context.WithoutCancel(ctx), tenant, result.ID, "message/rfc822", raw)
+	}
+	return result, err
+}
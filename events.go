@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ReceiptEvent announces a processed receipt.
+type ReceiptEvent struct {
+	ID          string    `json:"id"`
+	Retailer    string    `json:"retailer"`
+	Points      int       `json:"points"`
+	Flagged     bool      `json:"flagged,omitempty"`
+	ProcessedAt time.Time `json:"processedAt"`
+
+	tenant string
+	owner  string
+	// userID is the user the points were credited to, if any.
+	userID string
+}
+
+func newReceiptEvent(record ReceiptRecord, tenant string) ReceiptEvent {
+	return ReceiptEvent{
+		ID:          record.ID,
+		Retailer:    record.Receipt.Retailer,
+		Points:      record.Points,
+		Flagged:     len(record.Flags) > 0,
+		ProcessedAt: record.ProcessedAt,
+		tenant:      tenant,
+		owner:       record.Owner,
+		userID:      record.Receipt.UserID,
+	}
+}
+
+var eventsDropped = expvar.NewInt("eventsDropped")
+
+// EventBus hands receipt events to the subscribers that want them and to
+// its sinks. Publishing never waits: subscribers that fall behind miss
+// events, which the eventsDropped counter counts.
+type EventBus struct {
+	mu     sync.Mutex
+	subs   map[*subscription]struct{}
+	sinks  []func(ReceiptEvent)
+	closed bool
+}
+
+type subscription struct {
+	events chan ReceiptEvent
+	wants  func(ReceiptEvent) bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*subscription]struct{})}
+}
+
+// Subscribe returns a channel of the events wants accepts, buffering up
+// to buffer of them, and a function ending the subscription. The channel
+// is closed when the subscription ends or the bus closes.
+func (b *EventBus) Subscribe(buffer int, wants func(ReceiptEvent) bool) (<-chan ReceiptEvent, func()) {
+	sub := &subscription{events: make(chan ReceiptEvent, buffer), wants: wants}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.events)
+		return sub.events, func() {}
+	}
+	b.subs[sub] = struct{}{}
+	return sub.events, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, found := b.subs[sub]; found {
+			delete(b.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// AddSink hands every event to sink, such as for delivering them to
+// other services. Sinks are called while publishing, so they must not
+// block. Unlike subscriptions, they outlast Close, so that they get the
+// events of the requests still being served at shutdown.
+func (b *EventBus) AddSink(sink func(ReceiptEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sinks = append(b.sinks, sink)
+}
+
+func (b *EventBus) Publish(event ReceiptEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sink := range b.sinks {
+		sink(event)
+	}
+	for sub := range b.subs {
+		if !sub.wants(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			eventsDropped.Add(1)
+		}
+	}
+}
+
+// Close ends every subscription, so that streams of events finish before
+// the server shuts down. Sinks carry on.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
+
+const (
+	// eventsBuffer is how many events a stream may fall behind by before
+	// it misses some.
+	eventsBuffer = 64
+	// eventsKeepAlive is how often streams without events get a comment,
+	// so that proxies don't take them for dead.
+	eventsKeepAlive = 15 * time.Second
+	// eventsWriteTimeout bounds each write to a stream.
+	eventsWriteTimeout = 10 * time.Second
+)
+
+// EventsHandler streams the receipts processed for the caller's tenant as
+// server-sent events, from the time of the request on. Callers limited to
+// their own receipts only get theirs.
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFrom(r)
+	events, unsubscribe := s.events.Subscribe(eventsBuffer, func(e ReceiptEvent) bool {
+		return e.tenant == tenant && ownedBy(r, e.owner)
+	})
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's timeouts; writes get their own.
+	rc.SetReadDeadline(time.Time{})
+	write := func(format string, args ...any) bool {
+		rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tells nginx not to buffer the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	// A first comment tells clients they're connected.
+	if !write(": listening for receipts\n\n") {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if !write(": keep-alive\n\n") {
+				return
+			}
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			data, _ := json.Marshal(event)
+			if !write("id: %s\nevent: receipt\ndata: %s\n\n", event.ID, data) {
+				return
+			}
+		}
+	}
+}
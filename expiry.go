@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// expiresAt is when the points of a receipt credited to a user expire, or
+// the zero time when they don't. Receipts stored before processing times
+// were recorded never expire.
+func (s *Server) expiresAt(record ReceiptRecord) time.Time {
+	if s.cfg.PointsExpiry <= 0 || record.Receipt.UserID == "" || record.ProcessedAt.IsZero() {
+		return time.Time{}
+	}
+	return record.ProcessedAt.Add(s.cfg.PointsExpiry)
+}
+
+// sweepExpiredPoints expires the points that are due every interval.
+func (s *Server) sweepExpiredPoints(interval time.Duration) {
+	for range time.Tick(interval) {
+		expired, err := s.expirePoints(s.clock.Now())
+		if err != nil {
+			slog.Error("Failed to expire points", "err", err)
+		}
+		if expired > 0 {
+			slog.Info("Expired points", "receipts", expired)
+		}
+	}
+}
+
+// expirePoints marks the receipts whose points expired by now, which takes
+// their points off their users' balances, and returns how many it marked.
+func (s *Server) expirePoints(now time.Time) (int, error) {
+	var expired int
+	err := s.forEachReceipt(func(record ReceiptRecord) {
+		if record.ExpiredAt != nil {
+			return
+		}
+		if at := s.expiresAt(record); at.IsZero() || at.After(now) {
+			return
+		}
+		points, err := s.expire(record.ID, now)
+		if err != nil {
+			slog.Error("Failed to expire the points of a receipt", "receiptId", record.ID, "err", err)
+			return
+		}
+		auditEvent("action=expire-points receipt=%s user=%s points=%d", record.ID, record.Receipt.UserID, points)
+		expired++
+	})
+	return expired, err
+}
+
+// expire marks a stored receipt as expired and returns the points it
+// took off the balance.
+func (s *Server) expire(id string, now time.Time) (int, error) {
+	s.amendMu.Lock()
+	defer s.amendMu.Unlock()
+
+	// Re-read under the lock so a concurrent amendment isn't overwritten.
+	record, err := s.store.Get(id)
+	if err != nil || record.ExpiredAt != nil {
+		return 0, err
+	}
+	at := now.UTC()
+	record.ExpiredAt = &at
+	return record.Points, s.store.Put(record)
+}
+
+// expiringPoints adds up the points credited to a user that expire before
+// the given time and haven't expired yet.
+func (s *Server) expiringPoints(store Store, user string, before time.Time) (int, error) {
+	var points int
+	opts := ListOptions{Filter: ListFilter{UserID: user}, Limit: 500}
+	for {
+		records, err := store.List(opts)
+		if err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			at := s.expiresAt(record)
+			if record.ExpiredAt == nil && !at.IsZero() && at.Before(before) {
+				points += record.Points
+			}
+		}
+		if len(records) < opts.Limit {
+			return points, nil
+		}
+		opts.After = positionOf(records[len(records)-1])
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportPageSize is how many receipts an export reads from the store at a
+// time, which bounds its memory whatever the number of receipts.
+const exportPageSize = 500
+
+// exportColumns are the columns of CSV exports, one row per receipt. Items
+// are only counted; NDJSON exports have them in full.
+var exportColumns = []string{
+	"id", "retailer", "canonicalRetailer", "purchaseDate", "purchaseTime",
+	"total", "items", "points", "processedAt", "rulesVersion", "flagged", "source",
+}
+
+// receiptExporter writes a stream of receipts in one format.
+type receiptExporter interface {
+	write(ReceiptRecord) error
+	// flush sends what was written so far on to the response.
+	flush() error
+}
+
+type ndjsonExporter struct{ encoder *json.Encoder }
+
+func (e ndjsonExporter) write(record ReceiptRecord) error {
+	return e.encoder.Encode(newReceiptResponse(record))
+}
+
+func (e ndjsonExporter) flush() error { return nil }
+
+type csvExporter struct{ writer *csv.Writer }
+
+func (e csvExporter) write(record ReceiptRecord) error {
+	return e.writer.Write([]string{
+		record.ID,
+		record.Receipt.Retailer,
+		record.Retailer,
+		record.Receipt.PurchaseDate,
+		record.Receipt.PurchaseTime,
+		record.Receipt.Total,
+		strconv.Itoa(len(record.Receipt.Items)),
+		strconv.Itoa(record.Points),
+		record.ProcessedAt.UTC().Format(time.RFC3339),
+		record.RulesVersion,
+		strconv.FormatBool(len(record.Flags) > 0),
+		record.Source,
+	})
+}
+
+func (e csvExporter) flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// ExportReceiptsHandler streams every receipt matching the filters of
+// ListReceiptsHandler, with its points, as NDJSON or, with format=csv, as
+// CSV. Receipts are read and sent a page at a time, so the response is
+// chunked and the server doesn't hold the export in memory.
+//
+// The status goes out with the first page, so an export that fails after
+// it is cut short rather than answered with an error.
+func (s *Server) ExportReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	opts, _, problem := parseListOptions(r, SortByID, false)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+	var contentType string
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "ndjson":
+		format, contentType = "ndjson", "application/x-ndjson"
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+	default:
+		http.Error(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	opts.Filter.Owner = ownerFilter(r)
+	opts.Limit = exportPageSize
+	store := s.tenantStore(r.Context(), tenantFrom(r))
+	records, err := store.List(opts)
+	if err != nil {
+		http.Error(w, "Failed to list receipts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="receipts.`+format+`"`)
+	var exporter receiptExporter = ndjsonExporter{encoder: json.NewEncoder(w)}
+	if format == "csv" {
+		writer := csv.NewWriter(w)
+		writer.Write(exportColumns)
+		exporter = csvExporter{writer: writer}
+	}
+	rc := http.NewResponseController(w)
+	exported := 0
+	for {
+		// Slow clients get -stream-idle-timeout per page rather than the
+		// server's write timeout for the whole export.
+		s.extendStreamDeadlines(rc)
+		for _, record := range records {
+			if err := exporter.write(record); err != nil {
+				return
+			}
+		}
+		exported += len(records)
+		if err := exporter.flush(); err != nil || rc.Flush() != nil {
+			return
+		}
+		if len(records) < opts.Limit {
+			break
+		}
+		opts.After = positionOf(records[len(records)-1])
+		if records, err = store.List(opts); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to list receipts for an export", "exported", exported, "err", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	logAttrs(r, slog.Int("exported", exported))
+}
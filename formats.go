@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// bodyFormat is an encoding of request and response bodies besides JSON.
+// Formats work on the values encoding/json decodes into any, with
+// json.Number for numbers, so bodies keep the JSON field names whatever
+// their format and handlers only ever see JSON.
+type bodyFormat struct {
+	// mediaTypes are recognized in Content-Type and Accept headers.
+	// Responses use the first.
+	mediaTypes       []string
+	problemMediaType string
+	marshal          func(v any, problem bool) ([]byte, error)
+	unmarshal        func(data []byte) (any, error)
+}
+
+var bodyFormats = []*bodyFormat{
+	{
+		mediaTypes:       []string{"application/xml", "text/xml"},
+		problemMediaType: "application/problem+xml",
+		marshal:          marshalXML,
+		unmarshal:        unmarshalXML,
+	},
+	{
+		mediaTypes:       []string{"application/msgpack", "application/vnd.msgpack", "application/x-msgpack"},
+		problemMediaType: "application/msgpack",
+		marshal: func(v any, problem bool) ([]byte, error) {
+			return appendMsgpack(nil, v)
+		},
+		unmarshal: unmarshalMsgpack,
+	},
+	{
+		mediaTypes:       []string{"application/cbor"},
+		problemMediaType: "application/cbor",
+		marshal: func(v any, problem bool) ([]byte, error) {
+			return appendCBOR(nil, v)
+		},
+		unmarshal: unmarshalCBOR,
+	},
+}
+
+// maxFormatDepth bounds how deeply the values of a body may nest, so that
+// a small body can't exhaust the stack.
+const maxFormatDepth = 64
+
+var errFormatTooDeep = errors.New("the body nests too deeply")
+
+func formatFloat(f float64) json.Number {
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// formatOf returns the format of the media type, nil for JSON or one that
+// isn't known.
+func formatOf(mediaType string) *bodyFormat {
+	for _, format := range bodyFormats {
+		if slices.Contains(format.mediaTypes, mediaType) {
+			return format
+		}
+	}
+	return nil
+}
+
+// negotiateFormat returns the format the Accept header of r prefers, nil
+// for JSON. Media types that aren't known are ignored, so clients that
+// accept nothing we produce still get JSON.
+func negotiateFormat(r *http.Request) *bodyFormat {
+	return formatOf(preferredMediaType(r, func(mediaType string) bool {
+		return formatOf(mediaType) != nil
+	}))
+}
+
+// preferredMediaType returns the media type the Accept header of r
+// prefers among JSON and those known reports on, or "" for JSON.
+func preferredMediaType(r *http.Request, known func(mediaType string) bool) string {
+	best, bestQ := "", 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, found := params["q"]; found {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		if q <= bestQ {
+			continue
+		}
+		switch {
+		case mediaType == "application/json", mediaType == "application/problem+json",
+			mediaType == "application/*", mediaType == "*/*":
+			best, bestQ = "", q
+		case known(mediaType):
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
+
+// requestFormat is the "requestFormat" middleware, which turns request
+// bodies in another format than JSON into JSON. It runs after the body
+// limit, which applies to the body as sent.
+func requestFormat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		format := formatOf(mediaType)
+		if format == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if replaceBody(w, r, mediaType, format.unmarshal) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// replaceBody replaces the body of r, in the media type, with its JSON
+// encoding after decode. If the body can't be read or decoded, it writes a
+// problem and returns false.
+func replaceBody(w http.ResponseWriter, r *http.Request, mediaType string, decode func(data []byte) (any, error)) bool {
+	data, err := io.ReadAll(r.Body)
+	if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+		writeProblem(w, r, problem)
+		return false
+	}
+	var v any
+	if err == nil {
+		v, err = decode(data)
+	}
+	if err == nil {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		writeProblem(w, r, Problem{
+			Type:   "/problems/malformed-body",
+			Title:  "The request body can't be decoded",
+			Status: http.StatusBadRequest,
+			Detail: fmt.Sprintf("The body isn't valid %s: %v", mediaType, err),
+		})
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.Header.Set("Content-Type", "application/json")
+	return true
+}
+
+// responseFormat is the "responseFormat" middleware, which writes JSON
+// responses in the format the client prefers. Other responses, such as
+// plain text errors, are left alone.
+func responseFormat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		format := negotiateFormat(r)
+		if format == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fw := &formatResponseWriter{ResponseWriter: w, encode: format.encode}
+		defer fw.finish(r)
+		next.ServeHTTP(fw, r)
+	})
+}
+
+// encode writes a JSON body in the format, returning its media type.
+func (f *bodyFormat) encode(body []byte, problem bool) (string, []byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return "", nil, err
+	}
+	data, err := f.marshal(v, problem)
+	if problem {
+		return f.problemMediaType, data, err
+	}
+	return f.mediaTypes[0], data, err
+}
+
+// formatResponseWriter holds back JSON responses until they're complete,
+// then writes them as encode returns them.
+type formatResponseWriter struct {
+	http.ResponseWriter
+	// encode rewrites a complete JSON body, or a problem, returning its
+	// media type. An empty media type leaves the body as it is.
+	encode      func(body []byte, problem bool) (string, []byte, error)
+	wroteHeader bool
+	// transcode is set for JSON responses, whose status and body are held
+	// back.
+	transcode bool
+	problem   bool
+	status    int
+	body      bytes.Buffer
+}
+
+func (w *formatResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		w.transcode = true
+	case "application/problem+json":
+		w.transcode, w.problem = true, true
+	}
+	if !w.transcode {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *formatResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.transcode {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush passes on flushes of the responses that aren't held back.
+func (w *formatResponseWriter) Flush() {
+	if w.transcode {
+		return
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *formatResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *formatResponseWriter) finish(r *http.Request) {
+	if !w.transcode {
+		return
+	}
+	if w.body.Len() == 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+		return
+	}
+	mediaType, data, err := w.encode(w.body.Bytes(), w.problem)
+	if err != nil {
+		// The handler wrote the JSON, so it can still be sent as it is.
+		slog.ErrorContext(r.Context(), "can't transcode response", "error", err)
+	}
+	if err != nil || mediaType == "" {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", mediaType)
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(data)
+}
+
+// XML has no arrays and no types, so values map onto it by convention:
+// objects are elements with a child per field, arrays are elements with a
+// child named "item" per element, and everything else is text. Fields
+// whose names aren't XML names are written as <entry key="name">. The
+// root element is <response>, or <problem> in the namespace of RFC 7807.
+//
+// Decoding reverses this, except that every scalar becomes a string: an
+// element whose children are all named "item" is an array, any other
+// element with children is an object and the root element's name is
+// ignored.
+
+var xmlName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+const problemNamespace = "urn:ietf:rfc:7807"
+
+func marshalXML(v any, problem bool) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	root := xml.StartElement{Name: xml.Name{Local: "response"}}
+	if problem {
+		root.Name = xml.Name{Space: problemNamespace, Local: "problem"}
+	}
+	if err := encodeXML(encoder, root, v); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeXML(encoder *xml.Encoder, start xml.StartElement, v any) error {
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case nil:
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			child := xml.StartElement{Name: xml.Name{Local: key}}
+			if !xmlName.MatchString(key) {
+				child = xml.StartElement{
+					Name: xml.Name{Local: "entry"},
+					Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+				}
+			}
+			if err := encodeXML(encoder, child, v[key]); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, elem := range v {
+			if err := encodeXML(encoder, xml.StartElement{Name: xml.Name{Local: "item"}}, elem); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := encoder.EncodeToken(xml.CharData(fmt.Sprint(v))); err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+// xmlElement is an element being decoded.
+type xmlElement struct {
+	name     string
+	text     strings.Builder
+	children []*xmlElement
+	value    any
+}
+
+func unmarshalXML(data []byte) (any, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var stack []*xmlElement
+	var root *xmlElement
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if root != nil {
+				return nil, errors.New("XML data continues after the root element")
+			}
+			if len(stack) > maxFormatDepth {
+				return nil, errFormatTooDeep
+			}
+			e := &xmlElement{name: token.Name.Local}
+			if e.name == "entry" {
+				for _, attr := range token.Attr {
+					if attr.Name.Local == "key" {
+						e.name = attr.Value
+					}
+				}
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, e)
+			}
+			stack = append(stack, e)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(token)
+			}
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if e.value, err = e.decode(); err != nil {
+				return nil, err
+			}
+			// The children's values are all that's needed from now on.
+			e.children = nil
+			if len(stack) == 0 {
+				root = e
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("no root element")
+	}
+	return root.value, nil
+}
+
+// decode returns the value of an element whose children are decoded.
+func (e *xmlElement) decode() (any, error) {
+	if len(e.children) == 0 {
+		return strings.TrimSpace(e.text.String()), nil
+	}
+	if !slices.ContainsFunc(e.children, func(child *xmlElement) bool { return child.name != "item" }) {
+		elems := make([]any, len(e.children))
+		for i, child := range e.children {
+			elems[i] = child.value
+		}
+		return elems, nil
+	}
+	fields := make(map[string]any, len(e.children))
+	for _, child := range e.children {
+		if _, repeated := fields[child.name]; repeated {
+			return nil, fmt.Errorf("<%s> repeats <%s>; the elements of a list must be named <item>", e.name, child.name)
+		}
+		fields[child.name] = child.value
+	}
+	return fields, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flags set on receipts that look fraudulent.
+const (
+	// FlagVelocity is set when a user submits more receipts in an hour
+	// than allowed.
+	FlagVelocity = "fraud-velocity"
+	// FlagRepeatedTotal is set when a user submits the same total at the
+	// same retailer in quick succession.
+	FlagRepeatedTotal = "fraud-repeated-total"
+	// FlagFuturePurchase is set on receipts purchased in the future.
+	FlagFuturePurchase = "fraud-future-purchase"
+)
+
+// fraudReasons describes the fraud flags to clients.
+var fraudReasons = map[string]string{
+	FlagVelocity:       "too many receipts were submitted for this user in the last hour",
+	FlagRepeatedTotal:  "a receipt with the same total at the same retailer was just submitted",
+	FlagFuturePurchase: "the purchase time is in the future",
+}
+
+type FraudMode string
+
+const (
+	FraudOff FraudMode = "off"
+	// FraudFlag stores suspicious receipts with fraud flags for review.
+	FraudFlag FraudMode = "flag"
+	// FraudReject refuses them.
+	FraudReject FraudMode = "reject"
+)
+
+func (m *FraudMode) String() string { return string(*m) }
+
+func (m *FraudMode) Set(v string) error {
+	switch FraudMode(v) {
+	case FraudOff, FraudFlag, FraudReject:
+		*m = FraudMode(v)
+		return nil
+	default:
+		return fmt.Errorf("must be %s, %s or %s", FraudOff, FraudFlag, FraudReject)
+	}
+}
+
+type FraudConfig struct {
+	Mode FraudMode
+	// MaxReceiptsPerHour caps the receipts submitted for one user in any
+	// hour; zero means no cap.
+	MaxReceiptsPerHour int
+	// RepeatedTotalWindow is how soon after a receipt another one from the
+	// same user and retailer with the same total is suspicious; zero turns
+	// the check off.
+	RepeatedTotalWindow time.Duration
+	// FutureTolerance is how far past the current time purchases may be.
+	// Purchase times carry no time zone, so it should cover the offsets of
+	// the stores' time zones.
+	FutureTolerance time.Duration
+}
+
+// suspectedFraudError rejects a receipt in FraudReject mode.
+type suspectedFraudError struct {
+	flags []string
+}
+
+func (e *suspectedFraudError) Error() string {
+	return "the receipt looks fraudulent: " + e.reasons()
+}
+
+func (e *suspectedFraudError) reasons() string {
+	reasons := make([]string, len(e.flags))
+	for i, flag := range e.flags {
+		reasons[i] = fraudReasons[flag]
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// FraudDetector remembers recent submissions to spot suspicious patterns.
+// Its history is kept in memory, so each instance only sees the receipts
+// it processed itself.
+type FraudDetector struct {
+	cfg FraudConfig
+
+	mu sync.Mutex
+	// submissions holds the submission times within the last hour, by
+	// user.
+	submissions map[string][]time.Time
+	// totals holds when each total was last submitted, by user, retailer
+	// and total.
+	totals   map[string]time.Time
+	prunedAt time.Time
+}
+
+func NewFraudDetector(cfg FraudConfig) *FraudDetector {
+	return &FraudDetector{
+		cfg:         cfg,
+		submissions: make(map[string][]time.Time),
+		totals:      make(map[string]time.Time),
+	}
+}
+
+// Check returns the fraud flags of a receipt submitted for user at now,
+// who is qualified with their tenant. Unless the receipt is about to be
+// rejected, it is remembered for checking later ones.
+func (d *FraudDetector) Check(user string, receipt *Receipt, retailer string, now time.Time) []string {
+	if d.cfg.Mode == FraudOff {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(now)
+
+	var flags []string
+	hourAgo := now.Add(-time.Hour)
+	recent := d.submissions[user]
+	for len(recent) > 0 && !recent[0].After(hourAgo) {
+		recent = recent[1:]
+	}
+	// Receipts that aren't credited to anyone can't be told apart by user.
+	if d.cfg.MaxReceiptsPerHour > 0 && user != "" && len(recent) >= d.cfg.MaxReceiptsPerHour {
+		flags = append(flags, FlagVelocity)
+	}
+
+	total, _ := parseCents(receipt.Total)
+	totalKey := user + "\x00" + retailer + "\x00" + total.String()
+	if at, found := d.totals[totalKey]; found && d.cfg.RepeatedTotalWindow > 0 && now.Sub(at) < d.cfg.RepeatedTotalWindow {
+		flags = append(flags, FlagRepeatedTotal)
+	}
+
+	purchased, err := time.Parse("2006-01-02 15:04", receipt.PurchaseDate+" "+receipt.PurchaseTime)
+	if err == nil && purchased.After(now.Add(d.cfg.FutureTolerance)) {
+		flags = append(flags, FlagFuturePurchase)
+	}
+
+	if len(flags) > 0 && d.cfg.Mode == FraudReject {
+		d.submissions[user] = recent
+		return flags
+	}
+	if user != "" {
+		d.submissions[user] = append(recent, now)
+	}
+	if d.cfg.RepeatedTotalWindow > 0 {
+		d.totals[totalKey] = now
+	}
+	return flags
+}
+
+// prune forgets the users without submissions in the last hour and the
+// totals outside the repeated total window. It runs at most once a minute
+// and must be called with d.mu held.
+func (d *FraudDetector) prune(now time.Time) {
+	if now.Sub(d.prunedAt) < time.Minute {
+		return
+	}
+	d.prunedAt = now
+	for user, times := range d.submissions {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= time.Hour {
+			delete(d.submissions, user)
+		}
+	}
+	for key, at := range d.totals {
+		if now.Sub(at) >= d.cfg.RepeatedTotalWindow {
+			delete(d.totals, key)
+		}
+	}
+}
+
+// checkFraud returns the fraud flags of a receipt about to be stored, or a
+// suspectedFraudError when it should be rejected.
+func (s *Server) checkFraud(receipt *Receipt, from submitter, retailer string, now time.Time) ([]string, error) {
+	user := receipt.UserID
+	if user == "" {
+		user = from.owner
+	}
+	if user != "" {
+		user = from.tenant + tenantSeparator + user
+	}
+	flags := s.fraud.Check(user, receipt, retailer, now)
+	if len(flags) > 0 && s.cfg.Fraud.Mode == FraudReject {
+		return nil, &suspectedFraudError{flags: flags}
+	}
+	return flags, nil
+}
+
+func suspectedFraudProblem(err *suspectedFraudError) Problem {
+	return Problem{
+		Type:   "/problems/suspected-fraud",
+		Title:  "Suspected fraud",
+		Status: http.StatusUnprocessableEntity,
+		Detail: "The receipt was refused because " + err.reasons() + ".",
+	}
+}
+
+// FlaggedReceipt is a flagged receipt awaiting review.
+type FlaggedReceipt struct {
+	ID           string    `json:"id"`
+	Retailer     string    `json:"retailer"`
+	PurchaseDate string    `json:"purchaseDate"`
+	PurchaseTime string    `json:"purchaseTime"`
+	Total        string    `json:"total"`
+	Points       int       `json:"points"`
+	ProcessedAt  time.Time `json:"processedAt"`
+	Flags        []string  `json:"flags"`
+	AnomalyScore float64   `json:"anomalyScore,omitempty"`
+	Review       *Review   `json:"review,omitempty"`
+	UserID       string    `json:"userId,omitempty"`
+	Owner        string    `json:"owner,omitempty"`
+}
+
+type FlaggedReceiptsResponse struct {
+	Receipts []FlaggedReceipt `json:"receipts"`
+	// NextCursor is omitted on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ListFlaggedReceiptsHandler lists the receipts with flags, or with the
+// flag given as ?flag=, for review. ?status=pending lists the ones still
+// awaiting review. It takes the same filter, sort and
+// paging parameters as the receipt listing.
+func (s *Server) ListFlaggedReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	opts, limit, problem := parseListOptions(r, SortByID, false)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	opts.Filter.Flagged = true
+	opts.Filter.Flag = r.URL.Query().Get("flag")
+	switch status := ReviewStatus(r.URL.Query().Get("status")); status {
+	case "", ReviewPending, ReviewApproved, ReviewRejected:
+		opts.Filter.ReviewStatus = status
+	default:
+		http.Error(w, "status must be pending, approved or rejected", http.StatusBadRequest)
+		return
+	}
+	records, next, err := listPage(s.tenantStore(r.Context(), tenantFrom(r)), opts, limit)
+	if err != nil {
+		http.Error(w, "Failed to list receipts", http.StatusInternalServerError)
+		return
+	}
+
+	response := FlaggedReceiptsResponse{Receipts: []FlaggedReceipt{}, NextCursor: next}
+	for _, record := range records {
+		response.Receipts = append(response.Receipts, FlaggedReceipt{
+			ID:           record.ID,
+			Retailer:     record.Receipt.Retailer,
+			PurchaseDate: record.Receipt.PurchaseDate,
+			PurchaseTime: record.Receipt.PurchaseTime,
+			Total:        record.Receipt.Total,
+			Points:       record.Points,
+			ProcessedAt:  record.ProcessedAt,
+			Flags:        record.Flags,
+			AnomalyScore: record.AnomalyScore,
+			Review:       record.Review,
+			UserID:       record.Receipt.UserID,
+			Owner:        record.Owner,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,67 @@
+//go:build gcs
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsBucket opens the Google Cloud Storage bucket name, with the
+// application default credentials.
+func gcsBucket(ctx context.Context, name string) (ObjectStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create GCS client: %w", err)
+	}
+	return &gcsStore{client: client, bucket: client.Bucket(name)}, nil
+}
+
+type gcsStore struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+}
+
+func (b *gcsStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	objects := b.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := objects.Next()
+		if errors.Is(err, iterator.Done) {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, attrs.Name)
+	}
+}
+
+func (b *gcsStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return b.bucket.Object(key).NewReader(ctx)
+}
+
+func (b *gcsStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	w := b.bucket.Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (b *gcsStore) Delete(ctx context.Context, key string) error {
+	err := b.bucket.Object(key).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *gcsStore) Close() error { return b.client.Close() }
@@ -0,0 +1,12 @@
+//go:build !gcs
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func gcsBucket(ctx context.Context, name string) (ObjectStore, error) {
+	return nil, errors.New("GCS is not compiled in; rebuild with -tags gcs")
+}
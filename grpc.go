@@ -0,0 +1,190 @@
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// protoCodec marshals the hand-encoded messages of receipts.proto in place
+// of grpc's codec, which needs generated ones.
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a receipts.v1 message", v)
+	}
+	return m.marshalProto(), nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return fmt.Errorf("%T is not a receipts.v1 message", v)
+	}
+	return m.unmarshalProto(data)
+}
+
+func (protoCodec) Name() string { return "proto" }
+
+// grpcListener serves receipts.v1.ReceiptService on addr, over TLS when
+// tlsConfig isn't nil.
+func grpcListener(addr string, s *Server, tlsConfig *tls.Config) (listener, error) {
+	ln, err := listen(addr)
+	if err != nil {
+		return listener{}, err
+	}
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(protoCodec{}), grpc.UnaryInterceptor(logRPCs)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&receiptServiceDesc, s)
+	return listener{
+		name:  "gRPC on " + addr,
+		serve: func() error { return srv.Serve(ln) },
+		shutdown: func(ctx context.Context) error {
+			stopped := make(chan struct{})
+			go func() {
+				srv.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				srv.Stop()
+				return ctx.Err()
+			}
+		},
+	}, nil
+}
+
+var receiptServiceDesc = grpc.ServiceDesc{
+	ServiceName: "receipts.v1.ReceiptService",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("ProcessReceipt", ScopeProcess, (*Server).rpcProcessReceipt),
+		unaryMethod("GetPoints", ScopeRead, (*Server).rpcGetPoints),
+		unaryMethod("BatchProcess", ScopeProcess, (*Server).rpcBatchProcess),
+	},
+	Metadata: "proto/receipts/v1/receipts.proto",
+}
+
+// unaryMethod describes an RPC answered by call, for callers with the
+// scope.
+func unaryMethod[Req any, PReq interface {
+	*Req
+	protoMessage
+}, Resp protoMessage](name string, scope Scope, call func(*Server, http.ResponseWriter, *http.Request, PReq) (Resp, error)) grpc.MethodDesc {
+	fullMethod := "/receipts.v1.ReceiptService/" + name
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := PReq(new(Req))
+			if err := dec(req); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			s := srv.(*Server)
+			handle := func(ctx context.Context, req any) (any, error) {
+				resp, err := serveRPC(s, ctx, fullMethod, incomingHeader(ctx), scope, req.(PReq),
+					func(w http.ResponseWriter, r *http.Request, req PReq) (Resp, error) { return call(s, w, r, req) })
+				return resp, rpcStatus(ctx, err)
+			}
+			if interceptor == nil {
+				return handle(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}, handle)
+		},
+	}
+}
+
+// incomingHeader returns the metadata of an RPC as HTTP headers, for the
+// authenticators to find credentials in.
+func incomingHeader(ctx context.Context) http.Header {
+	header := make(http.Header)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		header[http.CanonicalHeaderKey(key)] = values
+	}
+	return header
+}
+
+// rpcStatus turns an error into the status of an RPC, the way writeError
+// turns it into a problem.
+func rpcStatus(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	var refusal *rpcRefusal
+	var problem Problem
+	if errors.As(err, &refusal) {
+		problem = refusal.problem
+	} else {
+		var known bool
+		if problem, known = errorProblem(err); !known {
+			slog.ErrorContext(ctx, "RPC failed", "err", err)
+		}
+	}
+	return status.Error(grpcCode(problem.Status), problem.Detail)
+}
+
+// grpcCode maps the status of a problem to the closest gRPC code.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusUnprocessableEntity:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// logRPCs logs a line for each RPC once it has been answered, like
+// logRequests does for HTTP requests.
+func logRPCs(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err)
+	level := slog.LevelInfo
+	if code == codes.Internal || code == codes.Unknown {
+		level = slog.LevelError
+	}
+	peerAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		peerAddr = p.Addr.String()
+	}
+	slog.LogAttrs(ctx, level, "rpc",
+		slog.String("method", info.FullMethod),
+		slog.String("code", code.String()),
+		slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+		slog.String("peer", peerAddr))
+	return resp, err
+}
@@ -0,0 +1,12 @@
+//go:build !grpc
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+func grpcListener(addr string, s *Server, tlsConfig *tls.Config) (listener, error) {
+	return listener{}, errors.New("gRPC is not compiled in; rebuild with -tags grpc")
+}
@@ -0,0 +1,18 @@
+//go:build h2c
+
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// h2cHandler serves HTTP/2 connections made without TLS, with prior
+// knowledge or by upgrading, as well as HTTP/1. Connections taken over for
+// HTTP/2 aren't tracked by http.Server, so a graceful shutdown doesn't wait
+// for them.
+func h2cHandler(handler http.Handler, cfg HTTPConfig) (http.Handler, error) {
+	return h2c.NewHandler(handler, &http2.Server{IdleTimeout: cfg.IdleTimeout}), nil
+}
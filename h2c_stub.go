@@ -0,0 +1,12 @@
+//go:build !h2c
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+func h2cHandler(handler http.Handler, cfg HTTPConfig) (http.Handler, error) {
+	return nil, errors.New("h2c is not compiled in; rebuild with -tags h2c")
+}
@@ -0,0 +1,26 @@
+//go:build http3
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Listener serves handler over QUIC on the UDP address addr. Closing
+// it drops the connections rather than draining them.
+func http3Listener(addr string, handler http.Handler, tlsConfig *tls.Config) (listener, error) {
+	srv := &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+	return listener{
+		name:     "HTTP/3 on " + addr,
+		serve:    srv.ListenAndServe,
+		shutdown: func(context.Context) error { return srv.Close() },
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !http3
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+)
+
+func http3Listener(addr string, handler http.Handler, tlsConfig *tls.Config) (listener, error) {
+	return listener{}, errors.New("HTTP/3 is not compiled in; rebuild with -tags http3")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// HTTPConfig bounds how long clients may take over each part of a request
+// and how much header they may send. Without them a client trickling in
+// headers a byte at a time holds a connection open forever.
+type HTTPConfig struct {
+	// ReadHeaderTimeout is how long a client has to send the request
+	// headers.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a client has to send the whole request,
+	// body included. It must leave time for the largest batch bodies.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long handling a request and writing the response
+	// may take, counted from the end of the request headers.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a keep-alive connection may wait for its
+	// next request.
+	IdleTimeout    time.Duration
+	MaxHeaderBytes int
+	// H2C serves HTTP/2 over plain TCP, for service meshes that encrypt
+	// traffic themselves.
+	H2C bool
+	// HTTP3Addr is the UDP address of an HTTP/3 listener, served alongside
+	// HTTPS.
+	HTTP3Addr string
+}
+
+func (cfg HTTPConfig) validate() error {
+	var errs []error
+	if cfg.ReadHeaderTimeout < 0 || cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.IdleTimeout < 0 {
+		errs = append(errs, errors.New("-http-read-header-timeout, -http-read-timeout, -http-write-timeout and -http-idle-timeout must not be negative"))
+	}
+	if cfg.MaxHeaderBytes < 1 {
+		errs = append(errs, errors.New("-http-max-header-bytes must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// listener is a server accepting connections for the service.
+type listener struct {
+	// name describes it in errors, such as "HTTPS on :443".
+	name     string
+	serve    func() error
+	shutdown func(ctx context.Context) error
+}
+
+// httpListener serves srv on ln, over TLS with the certificate and key
+// files when it has a TLS configuration. The files may be empty when the
+// configuration supplies the certificates.
+func httpListener(srv *http.Server, ln net.Listener, certFile, keyFile string) listener {
+	if srv.TLSConfig != nil {
+		return listener{
+			name:     "HTTPS on " + srv.Addr,
+			serve:    func() error { return srv.ServeTLS(ln, certFile, keyFile) },
+			shutdown: srv.Shutdown,
+		}
+	}
+	return listener{
+		name:     "HTTP on " + srv.Addr,
+		serve:    func() error { return srv.Serve(ln) },
+		shutdown: srv.Shutdown,
+	}
+}
+
+// unixAddrPrefix marks listen addresses that are Unix socket paths, as in
+// unix:/run/receipts.sock.
+const unixAddrPrefix = "unix:"
+
+// splitAddrs splits a comma-separated list of listen addresses.
+func splitAddrs(list string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" || addr == unixAddrPrefix {
+			return nil, fmt.Errorf("empty address in %q", list)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// listen binds addr, a TCP address or a Unix socket path after "unix:". A
+// socket left behind by an earlier run is replaced, but one still in use
+// isn't. Sockets are made group-writable so that sidecars running as
+// another user of the group can connect.
+func listen(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, unixAddrPrefix)
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: socket is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// firstTCPAddr returns the first of addrs that isn't a Unix socket, or ""
+// when there is none.
+func firstTCPAddr(addrs []string) string {
+	for _, addr := range addrs {
+		if !strings.HasPrefix(addr, unixAddrPrefix) {
+			return addr
+		}
+	}
+	return ""
+}
+
+func newHTTPServer(addr string, handler http.Handler, tlsConfig *tls.Config, cfg HTTPConfig) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// httpsRedirect sends plain HTTP requests to the same URL over HTTPS, on
+// the port of httpsAddr. 308 keeps the method and body of the request.
+func httpsRedirect(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := (&url.URL{Host: r.Host}).Hostname()
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if net.ParseIP(host).To4() == nil && net.ParseIP(host) != nil {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// advertiseHTTP3 tells clients of handler that HTTP/3 is served on the
+// port of http3Addr.
+func advertiseHTTP3(http3Addr string, handler http.Handler) http.Handler {
+	_, port, _ := net.SplitHostPort(http3Addr)
+	altSvc := fmt.Sprintf(`h3=":%s"; ma=86400`, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errIdempotencyKeyReused = errors.New("idempotency key was already used for a different receipt")
+
+type idempotencyEntry struct {
+	fingerprint string
+	done        chan struct{}
+	record      ReceiptRecord
+	expires     time.Time
+}
+
+// IdempotencyCache remembers which receipt was created for each
+// Idempotency-Key, so a client retrying after a timeout gets the original
+// receipt back instead of a duplicate.
+type IdempotencyCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastPrune time.Time
+}
+
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{ttl: ttl, entries: make(map[string]*idempotencyEntry)}
+}
+
+// Do runs process once per key. Concurrent and later calls with the same key
+// wait for the first one and share its record; replayed reports whether
+// that happened. fingerprint identifies the request payload, and reusing a
+// key for a different payload is an error. Failed attempts are forgotten so
+// the client can retry them.
+func (c *IdempotencyCache) Do(key, fingerprint string, process func() (ReceiptRecord, error)) (record ReceiptRecord, replayed bool, err error) {
+	c.mu.Lock()
+	c.prune()
+	entry, found := c.entries[key]
+	if !found {
+		entry = &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	if found {
+		if entry.fingerprint != fingerprint {
+			return ReceiptRecord{}, false, errIdempotencyKeyReused
+		}
+		<-entry.done
+		if entry.record.ID == "" {
+			// The first attempt failed; let this one take over.
+			return c.Do(key, fingerprint, process)
+		}
+		return entry.record, true, nil
+	}
+
+	// A panicking process fails the attempt too, or the key's waiters
+	// would block forever.
+	returned := false
+	defer func() {
+		c.mu.Lock()
+		if returned && err == nil {
+			entry.record = record
+			entry.expires = time.Now().Add(c.ttl)
+		} else {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+		close(entry.done)
+	}()
+	record, err = process()
+	returned = true
+	return record, false, err
+}
+
+// prune drops expired keys, at most once a minute so that busy services
+// don't rescan the cache on every request. It must be called with c.mu held.
+func (c *IdempotencyCache) prune() {
+	now := time.Now()
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = now
+	for key, entry := range c.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
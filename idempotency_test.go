@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotencyPanicFailsTheAttempt(t *testing.T) {
+	c := NewIdempotencyCache(time.Minute)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	panicked := make(chan any)
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.Do("key", "receipt", func() (ReceiptRecord, error) {
+			close(started)
+			<-release
+			panic("store exploded")
+		})
+	}()
+
+	<-started
+	type result struct {
+		record   ReceiptRecord
+		replayed bool
+		err      error
+	}
+	waiter := make(chan result)
+	go func() {
+		record, replayed, err := c.Do("key", "receipt", func() (ReceiptRecord, error) {
+			return ReceiptRecord{ID: "r2"}, nil
+		})
+		waiter <- result{record, replayed, err}
+	}()
+	close(release)
+
+	if recovered := <-panicked; recovered != "store exploded" {
+		t.Fatalf("recovered %v, want the panic of process", recovered)
+	}
+	select {
+	case got := <-waiter:
+		if got.err != nil || got.replayed || got.record.ID != "r2" {
+			t.Errorf("waiter got %+v, want to take over and store r2", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiter is still blocked after the first attempt panicked")
+	}
+
+	record, replayed, err := c.Do("key", "receipt", func() (ReceiptRecord, error) {
+		t.Error("process ran again for a stored key")
+		return ReceiptRecord{}, nil
+	})
+	if err != nil || !replayed || record.ID != "r2" {
+		t.Errorf("Do() = %+v, %v, %v, want a replay of r2", record, replayed, err)
+	}
+}
@@ -0,0 +1,179 @@
+//go:build imap
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// imapBatchSize is how many emails each check of the mailbox fetches at
+// most.
+const imapBatchSize = 10
+
+// imapListener reads receipts from the unread email of cfg.Mailbox with
+// the receipt templates, checking for new email every cfg.Interval. Emails
+// are marked read once handled, whether they held a receipt or not.
+func imapListener(cfg IMAPConfig, s *Server) (listener, error) {
+	src := &imapSource{cfg: cfg}
+	// Fail at startup rather than at the first check when the mailbox
+	// can't be opened.
+	if err := src.connect(); err != nil {
+		return listener{}, err
+	}
+	name := fmt.Sprintf("IMAP poller of %s on %s", cfg.Mailbox, cfg.Addr)
+	return consumeListener(name, src, func(ctx context.Context, data []byte) (BatchResult, error) {
+		return s.ingestEmail(ctx, cfg.Tenant, data)
+	}), nil
+}
+
+type imapSource struct {
+	cfg IMAPConfig
+	// c is the connection to the server, nil after it failed.
+	c *client.Client
+	// fetched holds the emails of the last check not yet handed out.
+	fetched []*imapMessage
+}
+
+func (p *imapSource) connect() error {
+	c, err := client.DialTLS(p.cfg.Addr, nil)
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", p.cfg.Addr, err)
+	}
+	if err := c.Login(p.cfg.Username, p.cfg.Password); err != nil {
+		c.Logout()
+		return fmt.Errorf("log in to %s: %w", p.cfg.Addr, err)
+	}
+	if _, err := c.Select(p.cfg.Mailbox, false); err != nil {
+		c.Logout()
+		return fmt.Errorf("select %s: %w", p.cfg.Mailbox, err)
+	}
+	p.c = c
+	return nil
+}
+
+// Receive hands out the emails of the last check before checking again,
+// even once ctx is done. Failed checks reconnect and are retried.
+func (p *imapSource) Receive(ctx context.Context) (SourceMessage, error) {
+	wait := time.Second
+	for len(p.fetched) == 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		next := p.cfg.Interval
+		if err := p.check(); err != nil {
+			slog.Error("Failed to check the mailbox for receipts, retrying", "mailbox", p.cfg.Mailbox, "err", err, "in", wait.String())
+			p.disconnect()
+			next = wait
+			wait = min(2*wait, ingestRetryWait)
+		} else if len(p.fetched) > 0 {
+			break
+		} else {
+			wait = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(next):
+		}
+	}
+	m := p.fetched[0]
+	p.fetched = p.fetched[1:]
+	return m, nil
+}
+
+// check fetches unread emails, up to imapBatchSize of them.
+func (p *imapSource) check() error {
+	if p.c == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uids, err := p.c.UidSearch(criteria)
+	if err != nil || len(uids) == 0 {
+		return err
+	}
+	uids = uids[:min(len(uids), imapBatchSize)]
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	// Peeking leaves the emails unread until they're handled.
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, len(uids))
+	if err := p.c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, messages); err != nil {
+		return err
+	}
+	for msg := range messages {
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		p.fetched = append(p.fetched, &imapMessage{source: p, uid: msg.Uid, data: data})
+	}
+	return nil
+}
+
+// disconnect drops the connection, to connect again at the next check.
+func (p *imapSource) disconnect() {
+	if p.c != nil {
+		p.c.Logout()
+		p.c = nil
+	}
+}
+
+func (p *imapSource) Close() error {
+	if p.c == nil {
+		return nil
+	}
+	return p.c.Logout()
+}
+
+type imapMessage struct {
+	source *imapSource
+	uid    uint32
+	data   []byte
+}
+
+func (m *imapMessage) ID() string { return fmt.Sprintf("%s/%d", m.source.cfg.Mailbox, m.uid) }
+
+func (m *imapMessage) Data() []byte { return m.data }
+
+// Ack marks the email read. Failing to is only logged: the email will be
+// read again, and deduplication can tell its receipt was stored.
+func (m *imapMessage) Ack(ctx context.Context, result BatchResult) error {
+	if err := m.markRead(); err != nil {
+		slog.Error("Failed to mark an email read", "message", m.ID(), "receipt", result.ID, "err", err)
+	}
+	return nil
+}
+
+// Reject marks an email without a valid receipt read, so that it isn't
+// read again.
+func (m *imapMessage) Reject(ctx context.Context, result BatchResult) error {
+	return m.Ack(ctx, result)
+}
+
+// Nack leaves the email unread, to be read again at the next check.
+func (m *imapMessage) Nack() {}
+
+func (m *imapMessage) markRead() error {
+	c := m.source.c
+	if c == nil {
+		return fmt.Errorf("not connected to %s", m.source.cfg.Addr)
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(m.uid)
+	return c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag}, nil)
+}
@@ -0,0 +1,9 @@
+//go:build !imap
+
+package main
+
+import "errors"
+
+func imapListener(cfg IMAPConfig, s *Server) (listener, error) {
+	return listener{}, errors.New("IMAP is not compiled in; rebuild with -tags imap")
+}
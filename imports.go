@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ImportJob processes the receipt files under a prefix of an object store
+// and writes a manifest of the results next to them.
+type ImportJob struct {
+	ID     string    `json:"id"`
+	Status JobStatus `json:"status"`
+	Source string    `json:"source"`
+	// Manifest is the URL the results are written to when the job
+	// completes.
+	Manifest string `json:"manifest,omitempty"`
+	Files    int    `json:"files"`
+	// Processed counts the receipts processed so far, Failed those of them
+	// that weren't stored.
+	Processed   int        `json:"processed"`
+	Failed      int        `json:"failed"`
+	StartedAt   time.Time  `json:"startedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+
+	// from is who started the job.
+	from submitter
+}
+
+// ImportFileResult reports the outcome for each receipt of a file, by the
+// line it starts on. Error is why the file, or the rest of it, couldn't be
+// read.
+type ImportFileResult struct {
+	Key       string         `json:"key"`
+	Processed int            `json:"processed"`
+	Failed    int            `json:"failed"`
+	Error     string         `json:"error,omitempty"`
+	Results   []StreamResult `json:"results"`
+}
+
+// ImportManifest is what an import job writes to its manifest.
+type ImportManifest struct {
+	ImportJob
+	Files []ImportFileResult `json:"files"`
+}
+
+type ImportRequest struct {
+	// Source is an s3://bucket/prefix, gs://bucket/prefix or
+	// file:///prefix URL.
+	Source string `json:"source"`
+}
+
+type importJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*ImportJob
+}
+
+// importFormat is the format of the receipts of a file, by its extension,
+// or "" if it isn't one to import.
+func importFormat(key string) string {
+	switch path.Ext(key) {
+	case ".ndjson", ".jsonl":
+		return "ndjson"
+	case ".csv":
+		return "csv"
+	}
+	return ""
+}
+
+// StartImportHandler starts importing the receipt files under a prefix of
+// an object store and responds with 202 Accepted and the job to poll.
+func (s *Server) StartImportHandler(w http.ResponseWriter, r *http.Request) {
+	var request ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		http.Error(w, "The request must be a JSON object with a source", http.StatusBadRequest)
+		return
+	}
+	// The job outlives the request, but stays part of its trace.
+	from := submitterOf(r)
+	from.ctx = context.WithoutCancel(from.ctx)
+	bucket, prefix, err := openObjectStore(from.ctx, request.Source, s.cfg.ImportDir)
+	if err != nil {
+		http.Error(w, "The source can't be opened: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job := &ImportJob{
+		ID:        s.ids.NewID(),
+		Status:    JobRunning,
+		Source:    request.Source,
+		StartedAt: s.clock.Now().UTC(),
+		from:      from,
+	}
+	s.imports.mu.Lock()
+	s.imports.jobs[job.ID] = job
+	s.imports.mu.Unlock()
+
+	audit(r, "action=import job=%s source=%s", job.ID, job.Source)
+	go s.runImport(job, bucket, prefix)
+
+	response := map[string]string{"id": job.ID}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/imports/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) GetImportHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	s.imports.mu.Lock()
+	job, found := s.imports.jobs[id]
+	var response ImportJob
+	if found {
+		response = *job
+	}
+	s.imports.mu.Unlock()
+
+	if !found || response.from.tenant != tenantFrom(r) {
+		http.Error(w, "No import found for that id", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// runImport processes the files of job and writes its manifest under
+// prefix, named after the job.
+func (s *Server) runImport(job *ImportJob, bucket ObjectStore, prefix string) {
+	defer bucket.Close()
+	ctx := job.from.ctx
+	files, err := s.importFiles(ctx, job, bucket, prefix)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to import receipts", "job", job.ID, "source", job.Source, "err", err)
+	}
+
+	now := s.clock.Now().UTC()
+	s.imports.mu.Lock()
+	manifest := ImportManifest{ImportJob: *job, Files: files}
+	s.imports.mu.Unlock()
+	manifest.Status = JobCompleted
+	manifest.CompletedAt = &now
+	if err != nil {
+		manifest.Error = err.Error()
+	}
+
+	// The manifest goes under the prefix, but isn't a file to import.
+	key := prefix + "import-" + job.ID + ".json"
+	data, _ := json.Marshal(manifest)
+	putErr := bucket.Put(ctx, key, data, "application/json")
+	if putErr != nil {
+		slog.ErrorContext(ctx, "Failed to write the manifest of an import", "job", job.ID, "key", key, "err", putErr)
+	}
+
+	s.imports.mu.Lock()
+	defer s.imports.mu.Unlock()
+	job.Status = JobCompleted
+	job.CompletedAt = &now
+	if putErr == nil {
+		job.Manifest = manifestURL(job.Source, key)
+	}
+	if err := errors.Join(err, putErr); err != nil {
+		job.Error = err.Error()
+	}
+}
+
+// manifestURL is the URL of key in the bucket of source.
+func manifestURL(source, key string) string {
+	u, _ := url.Parse(source)
+	u.Path = "/" + key
+	return u.String()
+}
+
+// importFiles processes the receipts of the files under prefix with
+// -import-workers workers, and returns the results of each file.
+func (s *Server) importFiles(ctx context.Context, job *ImportJob, bucket ObjectStore, prefix string) ([]ImportFileResult, error) {
+	keys, err := bucket.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("list the files: %w", err)
+	}
+	keys = slices.DeleteFunc(keys, func(key string) bool { return importFormat(key) == "" })
+	files := make([]ImportFileResult, len(keys))
+	for i, key := range keys {
+		files[i] = ImportFileResult{Key: key, Results: []StreamResult{}}
+	}
+	s.imports.mu.Lock()
+	job.Files = len(keys)
+	s.imports.mu.Unlock()
+
+	type importReceipt struct {
+		file, line int
+		process    func() BatchResult
+	}
+	receipts := make(chan importReceipt)
+	var wg sync.WaitGroup
+	for w := 0; w < s.cfg.ImportWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for receipt := range receipts {
+				result := receipt.process()
+
+				s.imports.mu.Lock()
+				file := &files[receipt.file]
+				file.Results = append(file.Results, StreamResult{Line: receipt.line, BatchResult: result})
+				file.Processed++
+				job.Processed++
+				if result.Error != "" {
+					file.Failed++
+					job.Failed++
+				}
+				s.imports.mu.Unlock()
+			}
+		}()
+	}
+
+	for i, key := range keys {
+		err := s.readImportFile(ctx, bucket, key, job.from, func(line int, process func() BatchResult) {
+			receipts <- importReceipt{file: i, line: line, process: process}
+		})
+		if err != nil {
+			s.imports.mu.Lock()
+			files[i].Error = err.Error()
+			s.imports.mu.Unlock()
+		}
+	}
+	close(receipts)
+	wg.Wait()
+
+	// Workers finish receipts out of order.
+	for _, file := range files {
+		slices.SortFunc(file.Results, func(a, b StreamResult) int { return cmp.Compare(a.Line, b.Line) })
+	}
+	return files, nil
+}
+
+// readImportFile reads the receipts of an NDJSON or CSV file and hands
+// each to add, with the line it starts on and how to process it. NDJSON
+// lines are limited by -max-body-bytes, and a longer line ends the file.
+func (s *Server) readImportFile(ctx context.Context, bucket ObjectStore, key string, from submitter, add func(line int, process func() BatchResult)) error {
+	body, err := bucket.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if importFormat(key) == "csv" {
+		receipts, err := readCSVReceipts(body)
+		if err != nil {
+			return err
+		}
+		for _, receipt := range receipts {
+			receipt := receipt
+			add(receipt.line, func() BatchResult { return s.processCSVReceipt(from, receipt) })
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, int(s.cfg.MaxBodyBytes))
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		data = bytes.Clone(data)
+		add(line, func() BatchResult { return s.processBatchItem(from, data) })
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return fmt.Errorf("line %d is longer than %d bytes", line+1, s.cfg.MaxBodyBytes)
+	}
+	return scanner.Err()
+}
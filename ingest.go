@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// MessageSource is a message broker receipts are ingested from, such as a
+// Kafka topic or an SQS queue.
+type MessageSource interface {
+	// Receive waits for the next message. Once ctx is done, it returns
+	// ctx's error, unless it still has messages at hand to return.
+	Receive(ctx context.Context) (SourceMessage, error)
+	// Close releases the source once receiving has ended.
+	Close() error
+}
+
+// SourceMessage is a message from a MessageSource. It is settled with
+// exactly one of Ack, Reject or Nack.
+type SourceMessage interface {
+	// ID identifies the message as the broker knows it.
+	ID() string
+	Data() []byte
+	// Ack settles a message whose receipt was processed, or refused as a
+	// duplicate, publishing the result if the source does.
+	Ack(ctx context.Context, result BatchResult) error
+	// Reject settles a message that isn't a valid receipt, such as by
+	// dead-lettering it.
+	Reject(ctx context.Context, result BatchResult) error
+	// Nack has the broker deliver the message again later.
+	Nack()
+}
+
+// IngestResult is published for each receipt that arrived on a message
+// broker, when there is somewhere to publish it.
+type IngestResult struct {
+	// MessageID identifies the message the receipt came in, as the broker
+	// knows it.
+	MessageID string `json:"messageId"`
+	BatchResult
+}
+
+// ingested counts the receipts that arrived on message brokers by
+// outcome: processed, invalid, and retried after failing for reasons of
+// the service's own, such as the store being down.
+var ingested = expvar.NewMap("ingestedReceipts")
+
+// ingestListener processes the receipts of src for tenant until it is
+// shut down. Messages are only settled once their receipt is stored, so
+// that they are processed at least once. Settling them finishes even when
+// shutting down. Errors receiving or settling stop the listener.
+func ingestListener(name string, src MessageSource, tenant string, s *Server) listener {
+	return consumeListener(name, src, func(ctx context.Context, data []byte) (BatchResult, error) {
+		return s.ingest(ctx, tenant, data)
+	})
+}
+
+// consumeListener is ingestListener for sources whose messages are read
+// with ingest, which is like Server.ingest.
+func consumeListener(name string, src MessageSource, ingest func(ctx context.Context, data []byte) (BatchResult, error)) listener {
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	consume := func() error {
+		defer close(done)
+		for {
+			msg, err := src.Receive(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			result, err := ingest(ctx, msg.Data())
+			if err != nil {
+				// Stopped before the receipt could be stored.
+				msg.Nack()
+				return nil
+			}
+			settleCtx := context.WithoutCancel(ctx)
+			if result.Error != "" && result.ID == "" {
+				slog.Warn("Refused a receipt from a message broker", "source", name, "message", msg.ID(), "err", result.Error)
+				err = msg.Reject(settleCtx, result)
+			} else {
+				err = msg.Ack(settleCtx, result)
+			}
+			if err != nil {
+				return fmt.Errorf("settle message %s: %w", msg.ID(), err)
+			}
+		}
+	}
+
+	return listener{
+		name:  name,
+		serve: consume,
+		shutdown: func(shutdownCtx context.Context) error {
+			stop()
+			var err error
+			select {
+			case <-done:
+			case <-shutdownCtx.Done():
+				err = shutdownCtx.Err()
+			}
+			return errors.Join(err, src.Close())
+		},
+	}
+}
+
+// ingestRetryWait bounds how long ingestion waits before retrying a
+// receipt that failed to be stored.
+const ingestRetryWait = time.Minute
+
+// ingest processes a receipt that arrived on a message broker the way the
+// process endpoint does, for tenant. Invalid receipts and duplicates come
+// back as results with an error, like they do in batches. Failures that
+// retrying may fix are retried until they stop or ctx is done, in which
+// case ingest returns ctx's error: the message then wasn't handled and
+// should be delivered again.
+func (s *Server) ingest(ctx context.Context, tenant string, data []byte) (BatchResult, error) {
+	if int64(len(data)) > s.cfg.MaxBodyBytes {
+		ingested.Add("invalid", 1)
+		return BatchResult{Error: fmt.Sprintf("Messages are limited to %d bytes", s.cfg.MaxBodyBytes)}, nil
+	}
+	receipt, err := s.parseReceipt(data)
+	if err != nil {
+		ingested.Add("invalid", 1)
+		return invalidReceiptResult(err), nil
+	}
+
+	return s.ingestReceipt(ctx, submitter{tenant: tenant}, receipt)
+}
+
+// ingestReceipt processes a valid receipt for from the way ingest does.
+func (s *Server) ingestReceipt(ctx context.Context, from submitter, receipt Receipt) (BatchResult, error) {
+	// Stopping ingestion doesn't cut short a receipt being stored.
+	from.ctx = context.WithoutCancel(ctx)
+	wait := time.Second
+	for {
+		record, err := s.processReceipt(receipt, from)
+		if err == nil {
+			ingested.Add("processed", 1)
+			return BatchResult{ID: record.ID, Points: &record.Points, Flagged: len(record.Flags) > 0}, nil
+		}
+		if problem, known := errorProblem(err); known {
+			ingested.Add("invalid", 1)
+			// Duplicates come with the ID they were stored under.
+			return BatchResult{ID: record.ID, Error: problem.Detail}, nil
+		}
+
+		ingested.Add("retried", 1)
+		slog.ErrorContext(ctx, "Failed to process a receipt from a message broker, retrying", "err", err, "in", wait.String())
+		select {
+		case <-ctx.Done():
+			return BatchResult{}, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, ingestRetryWait)
+	}
+}
+
+// KafkaConfig names the Kafka topic receipts are consumed from, and the
+// topic the results are produced to, if any.
+type KafkaConfig struct {
+	Brokers     []string
+	Topic       string
+	Group       string
+	OutputTopic string
+	// Tenant is the tenant the receipts are processed for.
+	Tenant string
+}
+
+// NATSConfig names the JetStream subject receipts are consumed from and
+// the subjects results and invalid receipts are published to, if any.
+type NATSConfig struct {
+	URL     string
+	Subject string
+	// Durable names the consumer, which instances share.
+	Durable       string
+	ResultSubject string
+	// DeadLetterSubject gets the messages that aren't valid receipts.
+	DeadLetterSubject string
+	// Tenant is the tenant the receipts are processed for.
+	Tenant string
+}
+
+// SQSConfig names the SQS queue receipts are polled from.
+type SQSConfig struct {
+	QueueURL string
+	// Tenant is the tenant the receipts are processed for.
+	Tenant string
+}
+
+// PubSubConfig names the Google Cloud Pub/Sub subscription receipts are
+// pulled from.
+type PubSubConfig struct {
+	Project      string
+	Subscription string
+	// Tenant is the tenant the receipts are processed for.
+	Tenant string
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "pending"
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+)
+
+var errQueueFull = errors.New("job queue is full")
+
+// Job is an asynchronously processed batch of receipts.
+type Job struct {
+	ID          string        `json:"id"`
+	Status      JobStatus     `json:"status"`
+	Total       int           `json:"total"`
+	Processed   int           `json:"processed"`
+	Results     []BatchResult `json:"results,omitempty"`
+	SubmittedAt time.Time     `json:"submittedAt"`
+	CompletedAt *time.Time    `json:"completedAt,omitempty"`
+
+	receipts []json.RawMessage
+	// from is who submitted the job.
+	from submitter
+}
+
+// JobQueue runs submitted jobs on a fixed pool of background workers.
+// Finished jobs are kept for the retention period so clients can poll them.
+type JobQueue struct {
+	process   func(from submitter, receipt json.RawMessage) BatchResult
+	clock     Clock
+	ids       IDGenerator
+	retention time.Duration
+	queue     chan *Job
+	workers   sync.WaitGroup
+
+	mu     sync.RWMutex
+	jobs   map[string]*Job
+	closed bool
+}
+
+func NewJobQueue(process func(from submitter, receipt json.RawMessage) BatchResult, clock Clock, ids IDGenerator, workers, capacity int, retention time.Duration) *JobQueue {
+	q := &JobQueue{
+		process:   process,
+		clock:     clock,
+		ids:       ids,
+		retention: retention,
+		queue:     make(chan *Job, capacity),
+		jobs:      make(map[string]*Job),
+	}
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *JobQueue) Submit(from submitter, receipts []json.RawMessage) (*Job, error) {
+	job := &Job{
+		ID:          q.ids.NewID(),
+		Status:      JobPending,
+		Total:       len(receipts),
+		SubmittedAt: q.clock.Now().UTC(),
+		receipts:    receipts,
+		from:        from,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+
+	// A closing queue is as good as full: the client should retry,
+	// presumably against another instance.
+	if q.closed {
+		return nil, errQueueFull
+	}
+	select {
+	case q.queue <- job:
+	default:
+		return nil, errQueueFull
+	}
+	q.jobs[job.ID] = job
+	return job, nil
+}
+
+// Get returns a snapshot of the job, safe to encode while workers keep
+// updating the original.
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	job, found := q.jobs[id]
+	if !found {
+		return Job{}, false
+	}
+	snapshot := *job
+	snapshot.receipts = nil
+	if job.Status != JobCompleted {
+		// Results are only reported once the whole job is done.
+		snapshot.Results = nil
+	}
+	return snapshot, true
+}
+
+// Close stops accepting jobs and waits until the queued ones are done or
+// ctx is.
+func (q *JobQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	unfinished := 0
+	for _, job := range q.jobs {
+		if job.Status != JobCompleted {
+			unfinished++
+		}
+	}
+	q.mu.Unlock()
+	if unfinished == 0 {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *JobQueue) work() {
+	defer q.workers.Done()
+	for job := range q.queue {
+		q.mu.Lock()
+		job.Status = JobRunning
+		q.mu.Unlock()
+
+		results := make([]BatchResult, len(job.receipts))
+		for i, receipt := range job.receipts {
+			results[i] = q.process(job.from, receipt)
+
+			q.mu.Lock()
+			job.Processed++
+			q.mu.Unlock()
+		}
+
+		now := q.clock.Now().UTC()
+		q.mu.Lock()
+		job.Status = JobCompleted
+		job.Results = results
+		job.CompletedAt = &now
+		job.receipts = nil
+		q.mu.Unlock()
+	}
+}
+
+// prune drops completed jobs older than the retention period. It must be
+// called with q.mu held.
+func (q *JobQueue) prune() {
+	cutoff := q.clock.Now().Add(-q.retention)
+	for id, job := range q.jobs {
+		if job.CompletedAt != nil && job.CompletedAt.Before(cutoff) {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// ProcessAsyncHandler queues a batch of receipts for background scoring and
+// responds with 202 Accepted and the job to poll.
+func (s *Server) ProcessAsyncHandler(w http.ResponseWriter, r *http.Request) {
+	var batch []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		http.Error(w, "The batch must be a JSON array of receipts", http.StatusBadRequest)
+		return
+	}
+	if len(batch) == 0 || len(batch) > s.cfg.AsyncBatchMaxSize {
+		http.Error(w, fmt.Sprintf("The batch must contain between 1 and %d receipts", s.cfg.AsyncBatchMaxSize), http.StatusBadRequest)
+		return
+	}
+
+	if !s.chargeQuota(w, r, len(batch)) {
+		return
+	}
+	// The job outlives the request, but stays part of its trace.
+	from := submitterOf(r)
+	from.ctx = context.WithoutCancel(from.ctx)
+	job, err := s.jobs.Submit(from, batch)
+	if errors.Is(err, errQueueFull) {
+		s.refundQuota(r, len(batch))
+		w.Header().Set("Retry-After", "30")
+		writeError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"id": job.ID}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	job, found := s.jobs.Get(id)
+	if !found || job.from.tenant != tenantFrom(r) || !ownedBy(r, job.from.owner) {
+		http.Error(w, "No job found for that id", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JWTConfig struct {
+	// Issuer and Audience must match the iss and aud claims of tokens.
+	Issuer   string
+	Audience string
+	// JWKSURL serves the keys that sign tokens.
+	JWKSURL string
+	// RolesClaim names the claim listing the roles of the token, in
+	// addition to its scope claim.
+	RolesClaim string
+}
+
+// jwtLeeway allows for clock skew when checking exp and nbf.
+const jwtLeeway = time.Minute
+
+// jwksMinRefresh keeps tokens with unknown key IDs from making us fetch the
+// key set over and over.
+const jwksMinRefresh = time.Minute
+
+// jwksMaxAge is how long fetched keys are used before fetching them again.
+const jwksMaxAge = time.Hour
+
+// JWTAuthenticator accepts bearer tokens signed with RS256, RS384, RS512,
+// ES256 or ES384 by a key from the JWKS URL. The token's subject becomes the
+// principal, with the scopes listed in its scope claim and the roles in its
+// roles claim.
+type JWTAuthenticator struct {
+	cfg    JWTConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func NewJWTAuthenticator(cfg JWTConfig) (*JWTAuthenticator, error) {
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("JWT authentication needs an issuer and an audience")
+	}
+	a := &JWTAuthenticator{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := a.refresh(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *int64      `json:"exp"`
+	NotBefore *int64      `json:"nbf"`
+	Scope     string      `json:"scope"`
+
+	// raw holds every claim, for callers that look at claims beyond these.
+	raw map[string]json.RawMessage
+}
+
+// jwtAudience accepts both forms of the aud claim: a string or an array.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !a.addressedTo(strings.TrimSpace(token)) {
+		return nil, nil
+	}
+	claims, err := a.verify(strings.TrimSpace(token), time.Now())
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+
+	principal := &Principal{ID: claims.Subject, Name: claims.Subject}
+	for _, scope := range strings.Fields(claims.Scope) {
+		if Scope(scope).valid() {
+			principal.Scopes = append(principal.Scopes, Scope(scope))
+		}
+	}
+	for _, role := range claimStrings(claims.raw, a.cfg.RolesClaim) {
+		if Role(role).valid() {
+			principal.Roles = append(principal.Roles, Role(role))
+		}
+	}
+	return principal, nil
+}
+
+// addressedTo reports whether the claims of token, unverified, name the
+// issuer and audience of a. OIDC tokens are bearer tokens too, so each
+// authenticator leaves the tokens of the other to it rather than refuse
+// them.
+func (a *JWTAuthenticator) addressedTo(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		// Malformed tokens are refused by whichever authenticator sees
+		// them first.
+		return true
+	}
+	var claims jwtClaims
+	if decodeJWTPart(parts[1], &claims) != nil {
+		return true
+	}
+	return claims.Issuer == a.cfg.Issuer && claims.Audience.contains(a.cfg.Audience)
+}
+
+func (a *JWTAuthenticator) verify(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("decode signature: %w", err)
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := decodeJWTPart(parts[1], &claims.raw); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != a.cfg.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if !claims.Audience.contains(a.cfg.Audience) {
+		return nil, errors.New("token is for another audience")
+	}
+	if claims.ExpiresAt == nil || now.After(time.Unix(*claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return &claims, nil
+}
+
+func (a jwtAudience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings returns the values of the claim at path, where dots reach
+// into nested objects. Providers send lists such as roles either as an
+// array or as a space-separated string.
+func claimStrings(claims map[string]json.RawMessage, path string) []string {
+	names := strings.Split(path, ".")
+	value, found := claims[names[0]]
+	for _, name := range names[1:] {
+		var nested map[string]json.RawMessage
+		if !found || json.Unmarshal(value, &nested) != nil {
+			return nil
+		}
+		value, found = nested[name]
+	}
+	if !found {
+		return nil
+	}
+
+	var values []string
+	if json.Unmarshal(value, &values) != nil {
+		var joined string
+		if json.Unmarshal(value, &joined) != nil {
+			return nil
+		}
+		values = strings.Fields(joined)
+	}
+	return values
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("decode token: %w", err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWTSignature checks the signature with the key, which must suit the
+// algorithm; in particular, "none" is never accepted.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s doesn't suit an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if (alg == "ES256") != (key.Curve == elliptic.P256()) || (alg == "ES384") != (key.Curve == elliptic.P384()) {
+			return fmt.Errorf("algorithm %s doesn't suit the key's curve", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key type")
+	}
+}
+
+// key returns the signing key with the given ID, refreshing the key set
+// when the ID is unknown or the keys are old.
+func (a *JWTAuthenticator) key(kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	key, found := a.keys[kid]
+	stale := time.Since(a.fetchedAt) > jwksMaxAge
+	canRefresh := time.Since(a.fetchedAt) > jwksMinRefresh
+	a.mu.Unlock()
+
+	if (!found || stale) && canRefresh {
+		if err := a.refresh(); err != nil && !found {
+			return nil, err
+		}
+		a.mu.Lock()
+		key, found = a.keys[kid]
+		a.mu.Unlock()
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (a *JWTAuthenticator) refresh() error {
+	resp, err := a.client.Get(a.cfg.JWKSURL)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: %s", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return fmt.Errorf("parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys we can't use, such as symmetric ones, are skipped.
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = keys
+	a.fetchedAt = time.Now()
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > 4 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// EnableJWT accepts bearer tokens checked by a.
+func (s *Server) EnableJWT(a *JWTAuthenticator) {
+	s.authenticators = append(s.authenticators, a)
+}
@@ -0,0 +1,115 @@
+//go:build kafka
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaListener consumes receipts from cfg.Topic as a member of cfg.Group.
+// Each message's result is produced to cfg.OutputTopic under the message's
+// key before the message is committed.
+func kafkaListener(cfg KafkaConfig, s *Server) (listener, error) {
+	src := &kafkaSource{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: cfg.Brokers,
+			Topic:   cfg.Topic,
+			GroupID: cfg.Group,
+		}),
+	}
+	if cfg.OutputTopic != "" {
+		src.writer = &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.OutputTopic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		}
+	}
+	name := "Kafka consumer of " + cfg.Topic + " on " + strings.Join(cfg.Brokers, ",")
+	return ingestListener(name, src, cfg.Tenant, s), nil
+}
+
+type kafkaSource struct {
+	reader *kafka.Reader
+	writer *kafka.Writer
+}
+
+func (k *kafkaSource) Receive(ctx context.Context) (SourceMessage, error) {
+	m, err := k.reader.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaMessage{source: k, m: m}, nil
+}
+
+func (k *kafkaSource) Close() error {
+	err := k.reader.Close()
+	if k.writer != nil {
+		err = errors.Join(err, k.writer.Close())
+	}
+	return err
+}
+
+type kafkaMessage struct {
+	source *kafkaSource
+	m      kafka.Message
+}
+
+func (m *kafkaMessage) ID() string {
+	return fmt.Sprintf("%s/%d/%d", m.m.Topic, m.m.Partition, m.m.Offset)
+}
+
+func (m *kafkaMessage) Data() []byte { return m.m.Value }
+
+func (m *kafkaMessage) Ack(ctx context.Context, result BatchResult) error {
+	if w := m.source.writer; w != nil {
+		value, _ := json.Marshal(IngestResult{MessageID: m.ID(), BatchResult: result})
+		if err := w.WriteMessages(ctx, kafka.Message{Key: m.m.Key, Value: value}); err != nil {
+			return fmt.Errorf("produce result: %w", err)
+		}
+	}
+	return m.source.reader.CommitMessages(ctx, m.m)
+}
+
+// Reject commits the message, producing its result like any other.
+func (m *kafkaMessage) Reject(ctx context.Context, result BatchResult) error {
+	return m.Ack(ctx, result)
+}
+
+// Nack leaves the message uncommitted, so that it is consumed again when
+// the partition is next assigned.
+func (m *kafkaMessage) Nack() {}
+
+// kafkaOutboxPublisher produces events to cfg.Topic, keyed by receipt ID.
+func kafkaOutboxPublisher(cfg OutboxConfig) (OutboxPublisher, error) {
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(cfg.Addr, ",")...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}}, nil
+}
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func (k *kafkaPublisher) Publish(ctx context.Context, events []OutboxEvent) error {
+	messages := make([]kafka.Message, len(events))
+	for i, event := range events {
+		value, err := encodeOutboxEvent(event)
+		if err != nil {
+			return err
+		}
+		messages[i] = kafka.Message{Key: []byte(event.Data.ID), Value: value}
+	}
+	return k.writer.WriteMessages(ctx, messages...)
+}
+
+func (k *kafkaPublisher) Close() error { return k.writer.Close() }
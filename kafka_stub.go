@@ -0,0 +1,13 @@
+//go:build !kafka
+
+package main
+
+import "errors"
+
+func kafkaListener(cfg KafkaConfig, s *Server) (listener, error) {
+	return listener{}, errors.New("Kafka is not compiled in; rebuild with -tags kafka")
+}
+
+func kafkaOutboxPublisher(cfg OutboxConfig) (OutboxPublisher, error) {
+	return nil, errors.New("Kafka is not compiled in; rebuild with -tags kafka")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// bodyLimit is the "bodyLimit" middleware, which caps the size of request
+// bodies. Reads past the limit fail with an *http.MaxBytesError.
+func bodyLimit(limit int64) Middleware {
+	return Middleware{Name: "bodyLimit", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}}
+}
+
+// bodyTooLargeProblem describes err if it came from exceeding the body
+// limit.
+func bodyTooLargeProblem(err error) (Problem, bool) {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return Problem{}, false
+	}
+	return Problem{
+		Type:   "/problems/payload-too-large",
+		Title:  "The request body is too large",
+		Status: http.StatusRequestEntityTooLarge,
+		Detail: fmt.Sprintf("Request bodies are limited to %d bytes.", maxErr.Limit),
+	}, true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+type ReceiptSummary struct {
+	ID           string `json:"id"`
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	Points       int    `json:"points"`
+}
+
+type ListReceiptsResponse struct {
+	Receipts []ReceiptSummary `json:"receipts"`
+	// NextCursor is omitted on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// listCursor is handed to clients base64-encoded so its layout can change
+// without breaking them. It remembers the order it was issued for, since a
+// position is meaningless under a different one.
+type listCursor struct {
+	SortBy     SortField    `json:"sortBy"`
+	Descending bool         `json:"desc,omitempty"`
+	After      ListPosition `json:"after"`
+}
+
+func encodeCursor(c listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (listCursor, bool) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &c) != nil {
+		return listCursor{}, false
+	}
+	return c, true
+}
+
+// parseListOptions reads the filter, sort and paging query parameters,
+// ordering by sortBy unless the request asks otherwise. It returns a
+// client-facing message when a parameter is invalid.
+func parseListOptions(r *http.Request, sortBy SortField, descending bool) (ListOptions, int, string) {
+	query := r.URL.Query()
+	opts := ListOptions{SortBy: sortBy, Descending: descending}
+
+	limit := defaultListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return opts, 0, "limit must be between 1 and " + strconv.Itoa(maxListLimit)
+		}
+		limit = n
+	}
+
+	opts.Filter.Retailer = query.Get("retailer")
+	for param, dst := range map[string]*string{
+		"purchasedFrom": &opts.Filter.PurchasedFrom,
+		"purchasedTo":   &opts.Filter.PurchasedTo,
+	} {
+		if v := query.Get(param); v != "" {
+			if _, err := time.Parse("2006-01-02", v); err != nil {
+				return opts, 0, param + " must be a date in YYYY-MM-DD format"
+			}
+			*dst = v
+		}
+	}
+	for param, dst := range map[string]**int{
+		"minPoints": &opts.Filter.MinPoints,
+		"maxPoints": &opts.Filter.MaxPoints,
+	} {
+		if v := query.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return opts, 0, param + " must be an integer"
+			}
+			*dst = &n
+		}
+	}
+
+	switch field := SortField(query.Get("sort")); field {
+	case "":
+	case SortByID, SortByPurchaseDate, SortByPoints:
+		opts.SortBy = field
+	default:
+		return opts, 0, "sort must be one of id, purchaseDate or points"
+	}
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		opts.Descending = false
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, 0, "order must be asc or desc"
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		cursor, ok := decodeCursor(v)
+		if !ok || cursor.SortBy != opts.SortBy || cursor.Descending != opts.Descending {
+			return opts, 0, "The cursor is invalid"
+		}
+		opts.After = cursor.After
+	}
+	return opts, limit, ""
+}
+
+// listPage returns a page of up to limit receipts, and the cursor of the
+// next page when there is one.
+func listPage(store Store, opts ListOptions, limit int) ([]ReceiptRecord, string, error) {
+	// Fetch one extra record to find out whether another page follows.
+	opts.Limit = limit + 1
+	records, err := store.List(opts)
+	if err != nil || len(records) <= limit {
+		return records, "", err
+	}
+	records = records[:limit]
+	return records, encodeCursor(listCursor{
+		SortBy:     opts.SortBy,
+		Descending: opts.Descending,
+		After:      positionOf(records[limit-1]),
+	}), nil
+}
+
+func (s *Server) ListReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	opts, limit, problem := parseListOptions(r, SortByID, false)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	opts.Filter.Owner = ownerFilter(r)
+	records, next, err := listPage(s.tenantStore(r.Context(), tenantFrom(r)), opts, limit)
+	if err != nil {
+		http.Error(w, "Failed to list receipts", http.StatusInternalServerError)
+		return
+	}
+
+	response := ListReceiptsResponse{Receipts: []ReceiptSummary{}, NextCursor: next}
+	for _, record := range records {
+		response.Receipts = append(response.Receipts, ReceiptSummary{
+			ID:           record.ID,
+			Retailer:     record.Receipt.Retailer,
+			PurchaseDate: record.Receipt.PurchaseDate,
+			Points:       record.Points,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
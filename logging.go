@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// logLevel is the minimum level logged. It can be changed while the
+// service runs through /admin/log-level.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging sends log lines, including those of the log package, to
+// stderr as JSON or, for reading in a terminal, as text.
+func setupLogging(format string) error {
+	newHandler := func(opts *slog.HandlerOptions) slog.Handler {
+		if format == "text" {
+			return requestIDHandler{slog.NewTextHandler(os.Stderr, opts)}
+		}
+		return requestIDHandler{slog.NewJSONHandler(os.Stderr, opts)}
+	}
+	if format != "json" && format != "text" {
+		return fmt.Errorf("-log-format must be json or text, not %q", format)
+	}
+	slog.SetDefault(slog.New(newHandler(&slog.HandlerOptions{Level: logLevel})))
+	auditLogger = slog.New(newHandler(nil)).With(slog.String("log", "audit"))
+	return nil
+}
+
+// fatal logs an error that keeps the service from starting and exits.
+func fatal(v any) {
+	slog.Error(fmt.Sprint(v))
+	os.Exit(1)
+}
+
+// requestLog collects the fields of a request's log line that are only
+// known deep inside its handling, such as its client. Only the goroutine
+// handling the request may add to it.
+type requestLog struct {
+	// client is the ID of the authenticated caller.
+	client string
+	attrs  []slog.Attr
+}
+
+type requestLogKey struct{}
+
+func requestLogFrom(ctx context.Context) *requestLog {
+	entry, _ := ctx.Value(requestLogKey{}).(*requestLog)
+	return entry
+}
+
+// logAttrs adds attrs to the log line of r.
+func logAttrs(r *http.Request, attrs ...slog.Attr) {
+	if entry := requestLogFrom(r.Context()); entry != nil {
+		entry.attrs = append(entry.attrs, attrs...)
+	}
+}
+
+// logClient records the authenticated caller of r.
+func logClient(r *http.Request, id string) {
+	if entry := requestLogFrom(r.Context()); entry != nil {
+		entry.client = id
+	}
+}
+
+// logRequests logs a line for each request once it has been answered,
+// with the request ID when it runs inside withRequestID.
+// Server errors are logged at the error level.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &requestLog{}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, entry)))
+
+		level := slog.LevelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+		}
+		if entry.client != "" {
+			attrs = append(attrs, slog.String("clientId", entry.client))
+		}
+		attrs = append(attrs, entry.attrs...)
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// logReceiptIDs adds the receipt that requests to /receipts/{id} and the
+// routes below it are about to their log line.
+func logReceiptIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ := route.GetPathTemplate()
+			if id, found := mux.Vars(r)["id"]; found && strings.Contains(template, "receipts/{id}") {
+				logAttrs(r, slog.String("receiptId", id))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type LogLevelResponse struct {
+	Level string `json:"level"`
+}
+
+func GetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LogLevelResponse{Level: logLevel.Level().String()})
+}
+
+// SetLogLevelHandler changes the minimum level logged, such as to DEBUG
+// while investigating a problem. The level isn't kept across restarts.
+func SetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	var request LogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "The request must be a JSON object with a level", http.StatusBadRequest)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(request.Level)); err != nil {
+		http.Error(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+		return
+	}
+	logLevel.Set(level)
+	audit(r, "action=set-log-level level=%s", level)
+	GetLogLevelHandler(w, r)
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
-	"log"
-	"math"
+	"io"
+	"log/slog"
 	"net/http"
-	"regexp"
-	"strconv"
+	"os"
+	"os/signal"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
@@ -26,127 +34,1503 @@ type Receipt struct {
 	PurchaseTime string `json:"purchaseTime"`
 	Items        []Item `json:"items"`
 	Total        string `json:"total"`
+	// UserID credits the receipt's points to a user's balance.
+	UserID string `json:"userId,omitempty"`
+}
+
+type ProcessResponse struct {
+	ID string `json:"id"`
+	// Flagged is set when the receipt was stored with flags for review.
+	Flagged bool `json:"flagged"`
 }
 
 type PointsResponse struct {
-	Points int `json:"points"`
+	Points       int    `json:"points"`
+	RulesVersion string `json:"rulesVersion,omitempty"`
 }
 
-var receiptMap map[string]int
+type ReceiptResponse struct {
+	ID           string      `json:"id"`
+	Receipt      Receipt     `json:"receipt"`
+	Points       int         `json:"points"`
+	ProcessedAt  time.Time   `json:"processedAt"`
+	Amendments   []Amendment `json:"amendments,omitempty"`
+	Flags        []string    `json:"flags,omitempty"`
+	RulesVersion string      `json:"rulesVersion,omitempty"`
+	Campaigns    []string    `json:"campaigns,omitempty"`
+	// CanonicalRetailer is the normalized retailer name.
+	CanonicalRetailer string `json:"canonicalRetailer,omitempty"`
+	Owner             string `json:"owner,omitempty"`
+	// ExpiredAt is when the receipt's points expired.
+	ExpiredAt    *time.Time  `json:"expiredAt,omitempty"`
+	AnomalyScore float64     `json:"anomalyScore,omitempty"`
+	Review       *Review     `json:"review,omitempty"`
+	Source       string      `json:"source,omitempty"`
+	Attachment   *Attachment `json:"attachment,omitempty"`
+}
 
-func ProcessReceiptHandler(w http.ResponseWriter, r *http.Request) {
-	var receipt Receipt
-	err := json.NewDecoder(r.Body).Decode(&receipt)
-	if err != nil {
-		http.Error(w, "The receipt is invalid", http.StatusBadRequest)
-		return
+func newReceiptResponse(record ReceiptRecord) ReceiptResponse {
+	return ReceiptResponse{
+		ID:           record.ID,
+		Receipt:      record.Receipt,
+		Points:       record.Points,
+		ProcessedAt:  record.ProcessedAt,
+		Amendments:   record.Amendments,
+		Flags:        record.Flags,
+		RulesVersion: record.RulesVersion,
+		Campaigns:    record.Campaigns,
+
+		CanonicalRetailer: record.Retailer,
+		Owner:             record.Owner,
+		ExpiredAt:         record.ExpiredAt,
+		AnomalyScore:      record.AnomalyScore,
+		Review:            record.Review,
+		Source:            record.Source,
+		Attachment:        record.Attachment,
 	}
+}
 
-	// Validate the receipt
-	if receipt.Retailer == "" ||
-		receipt.PurchaseDate == "" ||
-		receipt.PurchaseTime == "" ||
-		len(receipt.Items) == 0 ||
-		receipt.Total == "" {
-		http.Error(w, "The receipt is invalid", http.StatusBadRequest)
-		return
+type ServerConfig struct {
+	// TenantHeader names the request header that selects a tenant; empty
+	// means tenants only come from API keys.
+	TenantHeader string
+	// BatchMaxSize caps the number of receipts accepted by the batch endpoint.
+	BatchMaxSize int
+	// BatchWorkers bounds how many receipts of one batch are processed
+	// concurrently.
+	BatchWorkers int
+	// StreamIdleTimeout is how long the streaming endpoint waits for the
+	// next receipt, or for the client to take a result; zero waits forever.
+	StreamIdleTimeout time.Duration
+
+	// AsyncBatchMaxSize caps the number of receipts in one async job.
+	AsyncBatchMaxSize int
+	JobWorkers        int
+	JobQueueSize      int
+	// JobRetention is how long finished jobs can still be polled.
+	JobRetention time.Duration
+
+	// PointsExpiry is how long after processing the points of receipts
+	// credited to users expire; zero keeps them forever. The balance
+	// endpoint reports the points expiring within PointsExpiryWarning.
+	PointsExpiry        time.Duration
+	PointsExpiryWarning time.Duration
+	// Retention is how long after processing receipts are kept; zero keeps
+	// them forever.
+	Retention time.Duration
+
+	// Fraud configures the checks for suspicious receipts.
+	Fraud FraudConfig
+	// Anomaly configures the flagging of unusual totals.
+	Anomaly AnomalyConfig
+
+	// TransferMaxPoints caps the points of a single transfer between users
+	// and TransferDailyMaxPoints the points a user may transfer in a day;
+	// zero means no limit.
+	TransferMaxPoints      int
+	TransferDailyMaxPoints int
+
+	// IdempotencyTTL is how long an Idempotency-Key is remembered.
+	IdempotencyTTL time.Duration
+
+	// StrictJSON rejects receipts containing keys outside the schema, such
+	// as misspelled field names.
+	StrictJSON bool
+
+	// TotalCheck controls whether item prices must add up to the total,
+	// within TotalTolerance.
+	TotalCheck     TotalCheckMode
+	TotalTolerance Cents
+
+	// Dedup controls what happens when a receipt with the same contents as
+	// a stored one is submitted.
+	Dedup DedupMode
+
+	// NegativePrices controls whether items may have negative prices.
+	NegativePrices NegativePriceMode
+
+	// MaxBodyBytes limits request bodies, except for the batch endpoints,
+	// which are limited by MaxBatchBodyBytes.
+	MaxBodyBytes      int64
+	MaxBatchBodyBytes int64
+	// MaxItems and MaxDescriptionLength limit the size of each receipt.
+	MaxItems             int
+	MaxDescriptionLength int
+
+	// ImportWorkers bounds how many receipts of one import job are
+	// processed concurrently. ImportDir is the directory file:// import
+	// sources are read from; without it, they're refused.
+	ImportWorkers int
+	ImportDir     string
+
+	// CacheControl is the Cache-Control header of successful GET
+	// responses that don't set their own; empty sends none.
+	CacheControl string
+}
+
+type TotalCheckMode string
+
+const (
+	TotalCheckOff TotalCheckMode = "off"
+	// TotalCheckReject refuses receipts whose items don't add up.
+	TotalCheckReject TotalCheckMode = "reject"
+	// TotalCheckFlag stores them with FlagTotalMismatch.
+	TotalCheckFlag TotalCheckMode = "flag"
+)
+
+func (m *TotalCheckMode) String() string { return string(*m) }
+
+func (m *TotalCheckMode) Set(v string) error {
+	switch TotalCheckMode(v) {
+	case TotalCheckOff, TotalCheckReject, TotalCheckFlag:
+		*m = TotalCheckMode(v)
+		return nil
+	default:
+		return fmt.Errorf("must be %s, %s or %s", TotalCheckOff, TotalCheckReject, TotalCheckFlag)
+	}
+}
+
+type NegativePriceMode string
+
+const (
+	// NegativePricesReject refuses receipts with negative item prices.
+	NegativePricesReject NegativePriceMode = "reject"
+	// NegativePricesRefund accepts them as refund lines, which count
+	// against the item total but earn no item points.
+	NegativePricesRefund NegativePriceMode = "refund"
+)
+
+func (m *NegativePriceMode) String() string { return string(*m) }
+
+func (m *NegativePriceMode) Set(v string) error {
+	switch NegativePriceMode(v) {
+	case NegativePricesReject, NegativePricesRefund:
+		*m = NegativePriceMode(v)
+		return nil
+	default:
+		return fmt.Errorf("must be %s or %s", NegativePricesReject, NegativePricesRefund)
+	}
+}
+
+type DedupMode string
+
+const (
+	// DedupOff stores duplicates as new receipts.
+	DedupOff DedupMode = "off"
+	// DedupReject refuses duplicates with 409 Conflict.
+	DedupReject DedupMode = "reject"
+	// DedupReturnExisting answers duplicates with the stored receipt.
+	DedupReturnExisting DedupMode = "return-existing"
+)
+
+func (m *DedupMode) String() string { return string(*m) }
+
+func (m *DedupMode) Set(v string) error {
+	switch DedupMode(v) {
+	case DedupOff, DedupReject, DedupReturnExisting:
+		*m = DedupMode(v)
+		return nil
+	default:
+		return fmt.Errorf("must be %s, %s or %s", DedupOff, DedupReject, DedupReturnExisting)
+	}
+}
+
+type Server struct {
+	store       Store
+	rules       *RulesEngine
+	clock       Clock
+	ids         IDGenerator
+	cfg         ServerConfig
+	jobs        *JobQueue
+	idempotency *IdempotencyCache
+
+	// amendMu serializes read-modify-write cycles on stored receipts.
+	amendMu sync.Mutex
+	// dedupLocks serializes the processing of receipts with the same
+	// content hash, so that duplicates submitted together are caught.
+	dedupLocks keyedMutex
+	recalcs    recalculations
+	imports    importJobs
+
+	transfers transferLimits
+
+	// authenticators identify callers; without any, authentication is
+	// off.
+	authenticators []Authenticator
+	apiKeys        *APIKeyStore
+	limiter        *RateLimiter
+	fraud          *FraudDetector
+	anomalies      *AnomalyDetector
+	// events announces processed receipts.
+	events *EventBus
+	// upgradeWebSocket serves /ws when set.
+	upgradeWebSocket webSocketUpgrader
+	// webhooks are notified of processed receipts by webhookDispatcher.
+	webhooks          *WebhookStore
+	webhookDispatcher *WebhookDispatcher
+	// templates read receipts from documents; they are nil when no
+	// templates are configured.
+	templates ReceiptTemplates
+	// attachments keeps the original artifacts of receipts; it is nil when
+	// attachments are off.
+	attachments *AttachmentStore
+	// parquet writes Parquet exports; it is nil when they are off.
+	parquet *ParquetExport
+	// archive keeps the receipts removed past their retention; it is nil
+	// when they aren't archived.
+	archive *RetentionArchive
+	// pointsCache caches the points of receipts; it is nil when it's off.
+	pointsCache *pointsCache
+	// responseCache caches the responses of receipt lookups; it is nil
+	// when it's off.
+	responseCache *responseCache
+	// raft is the store replicated across a Raft cluster; it is nil
+	// unless the store is.
+	raft *RaftStore
+	// shards routes requests to the node owning their receipt or user; it
+	// is nil unless receipts are sharded.
+	shards *ShardRouter
+	// outbox relays the events recorded with processed receipts; it is nil
+	// when the outbox is off.
+	outbox *OutboxRelay
+	// tracer records spans; it is nil when tracing is off.
+	tracer Tracer
+	// config is the effective configuration served at /admin/config.
+	config *ConfigResponse
+}
+
+func NewServer(store Store, rules *RulesEngine, clock Clock, ids IDGenerator, cfg ServerConfig) *Server {
+	s := &Server{
+		store:       store,
+		rules:       rules,
+		clock:       clock,
+		ids:         ids,
+		cfg:         cfg,
+		idempotency: NewIdempotencyCache(cfg.IdempotencyTTL),
+		recalcs:     recalculations{runs: make(map[string]*Recalculation)},
+		imports:     importJobs{jobs: make(map[string]*ImportJob)},
+		fraud:       NewFraudDetector(cfg.Fraud),
+		anomalies:   NewAnomalyDetector(cfg.Anomaly),
+		events:      NewEventBus(),
+	}
+	s.jobs = NewJobQueue(s.processBatchItem, clock, ids, cfg.JobWorkers, cfg.JobQueueSize, cfg.JobRetention)
+	return s
+}
+
+// duplicateReceiptError is returned for a receipt that was already
+// processed, with the ID it was stored under.
+type duplicateReceiptError struct {
+	ID string
+}
+
+func (e *duplicateReceiptError) Error() string {
+	return "the receipt was already processed as " + e.ID
+}
+
+// decodeReceipt reads a receipt from the request body and validates it.
+func (s *Server) decodeReceipt(r *http.Request) (Receipt, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return Receipt{}, err
 	}
+	return s.parseReceipt(data)
+}
 
-	// Validate the items
-	for _, item := range receipt.Items {
-		if item.ShortDescription == "" || item.Price == "" {
-			http.Error(w, "The receipt is invalid", http.StatusBadRequest)
-			return
+// parseReceipt decodes and validates a single JSON receipt. In strict mode,
+// keys that are not part of the receipt schema are rejected.
+func (s *Server) parseReceipt(data []byte) (Receipt, error) {
+	var receipt Receipt
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		return Receipt{}, decodeError(err)
+	}
+	if s.cfg.StrictJSON {
+		if err := checkUnknownFields(data); err != nil {
+			return Receipt{}, err
 		}
 	}
+	if err := s.checkReceipt(&receipt); err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
+}
+
+// checkReceipt validates a decoded receipt, normalizing it on the way.
+func (s *Server) checkReceipt(receipt *Receipt) error {
+	opts := validationOptions{
+		UnicodeRetailerNames: s.rules.Current().UnicodeRetailerNames,
+		Refunds:              s.cfg.NegativePrices == NegativePricesRefund,
+		MaxItems:             s.cfg.MaxItems,
+		MaxDescriptionLength: s.cfg.MaxDescriptionLength,
+	}
+	if err := validateReceipt(receipt, opts); err != nil {
+		return err
+	}
+	if s.cfg.TotalCheck == TotalCheckReject && !s.totalMatches(receipt) {
+		return &ValidationError{Fields: []FieldError{{
+			Field:  "total",
+			Reason: "must equal the sum of the item prices (" + itemsTotal(receipt).String() + ")",
+			Value:  receipt.Total,
+		}}}
+	}
+	return nil
+}
+
+func (s *Server) totalMatches(receipt *Receipt) bool {
+	total, _ := parseCents(receipt.Total)
+	diff := total - itemsTotal(receipt)
+	return diff <= s.cfg.TotalTolerance && -diff <= s.cfg.TotalTolerance
+}
+
+// flagsFor lists the flags a receipt should be stored with.
+func (s *Server) flagsFor(receipt *Receipt) []string {
+	var flags []string
+	if s.cfg.TotalCheck == TotalCheckFlag && !s.totalMatches(receipt) {
+		flags = append(flags, FlagTotalMismatch)
+	}
+	return flags
+}
+
+// receiptFingerprint hashes the canonical JSON encoding of a receipt, so
+// equal receipts match regardless of how the client formatted them.
+func receiptFingerprint(receipt Receipt) string {
+	// The same receipt is a duplicate whoever it is credited to.
+	receipt.UserID = ""
+	data, _ := json.Marshal(receipt)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// contentHash is the ContentHash of a receipt stored for owner. Users
+// don't get to see each other's receipts, so only a duplicate submitted by
+// the same owner counts, and the stores index one receipt per hash.
+func contentHash(owner string, receipt Receipt) string {
+	sum := sha256.Sum256([]byte(owner + "\x00" + receiptFingerprint(receipt)))
+	return hex.EncodeToString(sum[:])
+}
+
+// dedups reports whether submitted receipts are checked for duplicates.
+func (s *Server) dedups() bool {
+	return s.cfg.Dedup == DedupReject || s.cfg.Dedup == DedupReturnExisting
+}
 
-	// Generate a unique ID for the receipt
-	receiptID := uuid.New().String()
+// duplicateOf answers the submission of a receipt that duplicates the
+// stored existing one, as the dedup mode says.
+func (s *Server) duplicateOf(existing ReceiptRecord) (ReceiptRecord, error) {
+	if s.cfg.Dedup == DedupReject {
+		return existing, &duplicateReceiptError{ID: existing.ID}
+	}
+	return existing, nil
+}
+
+// submitter describes who submitted receipts, for crediting and storing
+// them.
+type submitter struct {
+	// ctx carries the trace of the submitting request.
+	ctx    context.Context
+	owner  string
+	tenant string
+	// user is set when the owner is an end user rather than a client, so
+	// their receipts are credited to them.
+	user bool
+	// source is recorded as the receipts' source, see ReceiptRecord.
+	source string
+}
+
+func submitterOf(r *http.Request) submitter {
+	from := submitter{ctx: r.Context(), owner: ownerOf(r), tenant: tenantFrom(r)}
+	if p := principalFrom(r); p != nil && p.OwnReceiptsOnly {
+		from.user = true
+	}
+	return from
+}
+
+var errForeignUser = errors.New("receipts can only be credited to their submitter")
+
+// processReceipt scores a validated receipt and stores it under a new ID.
+// When deduplication is enabled and the same receipt was already stored,
+// it returns the stored record instead, together with a *duplicateReceiptError
+// in reject mode.
+func (s *Server) processReceipt(receipt Receipt, from submitter) (ReceiptRecord, error) {
+	if from.user && receipt.UserID == "" {
+		receipt.UserID = from.owner
+	}
+	if from.user && receipt.UserID != from.owner {
+		return ReceiptRecord{}, errForeignUser
+	}
+	// A user's receipts are all kept by the node owning them, for their
+	// balance and listings.
+	if s.shards != nil && receipt.UserID != "" && !s.shards.owns(receipt.UserID) {
+		return s.shards.processOnShard(receipt, from)
+	}
+	owner := from.owner
+	store := s.tenantStore(from.ctx, from.tenant)
+	// Content hashes are only stored with deduplication on. The SQL stores
+	// keep them unique.
+	var hash string
+	if s.dedups() {
+		hash = contentHash(owner, receipt)
+		// Held until the receipt is stored, so that a duplicate submitted
+		// meanwhile finds it.
+		unlock := s.dedupLocks.lock(from.tenant + "\x00" + hash)
+		defer unlock()
+		existing, err := store.FindByContentHash(hash)
+		if err == nil {
+			return s.duplicateOf(existing)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return ReceiptRecord{}, err
+		}
+	}
 
 	// Calculate the points for the receipt
-	points := calculatePoints(&receipt)
+	now := s.clock.Now().UTC()
+	rules := s.rules.Current()
+	retailer := canonicalRetailer(receipt.Retailer, rules.RetailerAliases)
+	fraudFlags, err := s.checkFraud(&receipt, from, retailer, now)
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	breakdown := s.score(from.ctx, rules, &receipt, now)
+	total, _ := parseCents(receipt.Total)
+	anomalyScore, anomalous := s.anomalies.Score(anomalyKey(from.tenant, retailer), total)
+
+	record := ReceiptRecord{
+		// Generate a unique ID for the receipt
+		ID:           s.newReceiptID(),
+		Receipt:      receipt,
+		Points:       breakdown.Points,
+		RulesVersion: breakdown.RulesVersion,
+		Campaigns:    breakdown.Campaigns,
+		ProcessedAt:  now,
+		Retailer:     retailer,
+		Owner:        owner,
+		ContentHash:  hash,
+		Flags:        append(s.flagsFor(&receipt), fraudFlags...),
+		Source:       from.source,
+	}
+	if anomalous {
+		record.Flags = append(record.Flags, FlagAnomalousTotal)
+		record.AnomalyScore = anomalyScore
+	}
+	// Flagged receipts award no points until a reviewer approves them.
+	if len(record.Flags) > 0 {
+		record.Review = &Review{Status: ReviewPending}
+	}
+	if s.outbox != nil {
+		err = store.(OutboxStore).PutWithEvent(record, s.newOutboxEvent(record, from.tenant))
+	} else {
+		err = store.Put(record)
+	}
+	if errors.Is(err, ErrDuplicateContent) {
+		// Another instance stored the same receipt meanwhile.
+		if existing, findErr := store.FindByContentHash(hash); findErr == nil {
+			return s.duplicateOf(existing)
+		}
+	}
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	if s.outbox != nil {
+		s.outbox.Notify()
+	}
+	s.events.Publish(newReceiptEvent(record, from.tenant))
+	return record, nil
+}
+
+func (s *Server) ProcessReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	receipt, err := s.decodeReceipt(r)
+	if err != nil {
+		writeProblem(w, r, invalidReceiptProblem(err))
+		return
+	}
 
-	receiptMap[receiptID] = points
+	if !s.chargeQuota(w, r, 1) {
+		return
+	}
+	from := submitterOf(r)
+	var record ReceiptRecord
+	var replayed bool
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		// A retry with the same key gets the receipt created the first time.
+		// Keys are per caller, so callers can't see each other's receipts.
+		record, replayed, err = s.idempotency.Do(from.tenant+"\x00"+from.owner+"\x00"+key, receiptFingerprint(receipt), func() (ReceiptRecord, error) {
+			return s.processReceipt(receipt, from)
+		})
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+	} else {
+		record, err = s.processReceipt(receipt, from)
+	}
+	// Only receipts that were newly processed count against the quota.
+	if err != nil || replayed {
+		s.refundQuota(r, 1)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
+	logAttrs(r, slog.String("receiptId", record.ID))
 	// Return the ID of the receipt
-	response := map[string]string{"id": receiptID}
+	response := ProcessResponse{ID: record.ID, Flagged: len(record.Flags) > 0}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func GetPointsHandler(w http.ResponseWriter, r *http.Request) {
+// PreviewPointsHandler scores a receipt without storing it. Pass
+// ?breakdown=true to include the per-rule breakdown.
+func (s *Server) PreviewPointsHandler(w http.ResponseWriter, r *http.Request) {
+	receipt, err := s.decodeReceipt(r)
+	if err != nil {
+		writeProblem(w, r, invalidReceiptProblem(err))
+		return
+	}
+
+	breakdown := s.rules.Current().Score(&receipt, s.clock.Now().UTC())
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("breakdown") == "true" {
+		json.NewEncoder(w).Encode(breakdown)
+		return
+	}
+	json.NewEncoder(w).Encode(PointsResponse{Points: breakdown.Points, RulesVersion: breakdown.RulesVersion})
+}
+
+func (s *Server) GetPointsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
 	// Look up the receipt by ID
-	points, found := receiptMap[id]
-	if !found {
-		http.Error(w, "No receipt found for that id", http.StatusNotFound)
+	points, err := s.lookupPoints(r.Context(), tenantFrom(r), id)
+	if err == nil && !ownedBy(r, points.owner) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	// Calculate and return the points for the receipt
-	response := PointsResponse{Points: points}
+	// Clients polling for the points get them again only when they change
+	if setValidators(w, r, pointsETag(points.response), points.modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Return the points for the receipt
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(points.response)
+}
+
+// GetPointsBreakdownHandler re-runs the scoring rules over the stored
+// receipt to explain how its points were earned. It uses the rule set the
+// receipt was scored with when that version is still known, and the current
+// rules otherwise.
+func (s *Server) GetPointsBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// Look up the receipt by ID
+	record, err := s.tenantStore(r.Context(), tenantFrom(r)).Get(id)
+	if err == nil && !ownedBy(r, record.Owner) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	rules, found := s.rules.Version(record.RulesVersion)
+	if !found {
+		rules = s.rules.Current()
+	}
+	// Breakdowns by the current rules change with them, so only those by
+	// the receipt's own rules are as old as the receipt.
+	if found && setValidators(w, r, "", lastModified(record)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	response := rules.Score(&record.Receipt, record.ProcessedAt)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func calculatePoints(receipt *Receipt) int {
-	points := 0
+func (s *Server) GetReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// Look up the receipt by ID
+	record, err := s.tenantStore(r.Context(), tenantFrom(r)).Get(id)
+	if err == nil && !ownedBy(r, record.Owner) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if setValidators(w, r, "", lastModified(record)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Return the original receipt along with its score
+	response := newReceiptResponse(record)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
-	// Rule 1: One point for every alphanumeric character in the retailer name.
-	points += len(regexp.MustCompile(`[a-zA-Z0-9]`).FindAllString(receipt.Retailer, -1))
+// AmendReceiptHandler replaces a stored receipt, for example to fix a typo,
+// and rescores it. The points it had before are kept in its amendment
+// history.
+func (s *Server) AmendReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
 
-	// Rule 2: 50 points if the total is a round dollar amount with no cents.
-	totalFloat, _ := strconv.ParseFloat(receipt.Total, 64)
-	if math.Mod(totalFloat, 1) == 0 {
-		points += 50
+	receipt, err := s.decodeReceipt(r)
+	if err != nil {
+		writeProblem(w, r, invalidReceiptProblem(err))
+		return
 	}
 
-	// Rule 3: 25 points if the total is a multiple of 0.25.
-	if math.Mod(totalFloat, 0.25) == 0 {
-		points += 25
+	s.amendMu.Lock()
+	defer s.amendMu.Unlock()
+
+	record, err := s.tenantStore(r.Context(), tenantFrom(r)).Get(id)
+	if err == nil && !ownedBy(r, record.Owner) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// Amending would drop the flags a reviewer is looking at, or restore
+	// the points of a rejected receipt.
+	if !record.Review.awardsPoints() {
+		http.Error(w, "The receipt can't be amended while it is "+string(record.Review.Status), http.StatusConflict)
+		return
 	}
 
-	// Rule 4: 5 points for every two items on the receipt.
-	points += len(receipt.Items) / 2 * 5
+	// Amendments stay credited to the same user unless they name another.
+	if receipt.UserID == "" {
+		receipt.UserID = record.Receipt.UserID
+	}
+	if from := submitterOf(r); from.user && receipt.UserID != from.owner {
+		writeError(w, r, errForeignUser)
+		return
+	}
 
-	// Rule 5: If the trimmed length of the item description is a multiple of 3,
-	// multiply the price by 0.2 and round up to the nearest integer.
-	for _, item := range receipt.Items {
-		description := strings.TrimSpace(item.ShortDescription)
-		if len(description)%3 == 0 {
-			priceFloat, _ := strconv.ParseFloat(item.Price, 64)
-			roundedPoints := int(math.Ceil(priceFloat * 0.2))
-			points += roundedPoints
-		}
+	record.Amendments = append(record.Amendments, Amendment{
+		AmendedAt:            s.clock.Now().UTC(),
+		PreviousPoints:       record.Points,
+		PreviousRulesVersion: record.RulesVersion,
+	})
+	// Campaigns are judged by when the receipt was first submitted.
+	rules := s.rules.Current()
+	breakdown := s.score(r.Context(), rules, &receipt, record.ProcessedAt)
+	record.Receipt = receipt
+	record.Retailer = canonicalRetailer(receipt.Retailer, rules.RetailerAliases)
+	record.Points = breakdown.Points
+	record.RulesVersion = breakdown.RulesVersion
+	record.Campaigns = breakdown.Campaigns
+	record.ContentHash = ""
+	if s.dedups() {
+		record.ContentHash = contentHash(record.Owner, receipt)
+	}
+	record.Flags = s.flagsFor(&receipt)
+	if len(record.Flags) > 0 {
+		record.Review = &Review{Status: ReviewPending}
 	}
 
-	// Rule 6: 6 points if the day in the purchase date is odd.
-	purchaseDate, _ := time.Parse("2006-01-02", receipt.PurchaseDate)
-	if purchaseDate.Day()%2 == 1 {
-		points += 6
+	if err := s.tenantStore(r.Context(), tenantFrom(r)).Put(record); err != nil {
+		writeError(w, r, err)
+		return
 	}
+	audit(r, "action=amend receipt=%s previous_points=%d points=%d",
+		id, record.Amendments[len(record.Amendments)-1].PreviousPoints, record.Points)
+
+	response := newReceiptResponse(record)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) DeleteReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
 
-	// Rule 7: 10 points if the time of purchase is after 2:00pm and before 4:00pm.
-	purchaseTime, _ := time.Parse("15:04", receipt.PurchaseTime)
-	if purchaseTime.After(time.Date(0, 1, 1, 14, 0, 0, 0, time.UTC)) &&
-		purchaseTime.Before(time.Date(0, 1, 1, 16, 0, 0, 0, time.UTC)) {
-		points += 10
+	if err := s.tenantStore(r.Context(), tenantFrom(r)).Delete(id); err != nil {
+		writeError(w, r, err)
+		return
 	}
 
-	return points
+	s.deleteAttachment(r.Context(), id)
+	audit(r, "action=delete receipt=%s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type storeConfig struct {
+	backend        string
+	memorySnapshot MemorySnapshotConfig
+	sqlitePath     string
+	boltPath       string
+	postgresDSN    string
+	postgresPool   PostgresPoolConfig
+	redis          RedisConfig
+	raft           RaftConfig
+	raftPeers      string
+}
+
+func newStore(cfg storeConfig) (Store, error) {
+	switch cfg.backend {
+	case "memory":
+		if cfg.memorySnapshot.Path == "" {
+			if cfg.memorySnapshot.WAL != "" {
+				return nil, errors.New("-memory-wal needs -memory-snapshot")
+			}
+			return NewMemoryStore(), nil
+		}
+		if cfg.memorySnapshot.Interval <= 0 {
+			return nil, errors.New("-memory-snapshot-interval must be positive")
+		}
+		return NewSnapshottedMemoryStore(cfg.memorySnapshot)
+	case "sqlite":
+		return NewSQLiteStore(cfg.sqlitePath)
+	case "bolt":
+		return NewBoltStore(cfg.boltPath)
+	case "postgres":
+		return NewPostgresStore(cfg.postgresDSN, cfg.postgresPool)
+	case "redis":
+		return NewRedisStore(cfg.redis)
+	case "raft":
+		peers, err := parseRaftPeers(cfg.raftPeers)
+		if err != nil {
+			return nil, fmt.Errorf("-raft-peers: %w", err)
+		}
+		cfg.raft.Peers = peers
+		return NewRaftStore(cfg.raft)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", cfg.backend)
+	}
 }
 
 func main() {
-	receiptMap = make(map[string]int)
+	var cfg storeConfig
+	var serverCfg ServerConfig
+	var rulesCfg RulesConfig
+	var configFile, addr string
+	flag.StringVar(&configFile, "config", "", "config file of flag names and values, as \"name: value\" lines; environment variables and flags override it")
+	var logFormat string
+	accessLogCfg := AccessLogConfig{Format: AccessLogOff}
+	var accessLogExclude string
+	flag.Var(&accessLogCfg.Format, "access-log", "access log format: off, common, combined or json")
+	flag.StringVar(&accessLogCfg.File, "access-log-file", "", "file the access log is appended to (stdout if unset); reopened on SIGHUP")
+	flag.Float64Var(&accessLogCfg.SampleRate, "access-log-sample-rate", 1, "share of requests in the access log, from 0 to 1; server errors are always logged")
+	flag.StringVar(&accessLogExclude, "access-log-exclude", "", "comma-separated paths left out of the access log, such as health checks")
+	flag.StringVar(&logFormat, "log-format", "json", "format of log lines: json, or text for reading in a terminal")
+	flag.TextVar(logLevel, "log-level", new(slog.LevelVar), "minimum level logged: debug, info, warn or error; can be changed at /admin/log-level")
+	var debugAddr string
+	var fixedTime string
+	var idSeed int64
+	flag.StringVar(&fixedTime, "fixed-time", "", "RFC 3339 time the clock is pinned at, for replaying requests while debugging")
+	flag.Int64Var(&idSeed, "id-seed", 0, "seed IDs are derived from, for replaying requests while debugging (0 keeps them random)")
+	var webhookCfg WebhookConfig
+	flag.StringVar(&webhookCfg.File, "webhooks-file", "", "JSON file persisting the webhooks (kept in memory if unset)")
+	flag.IntVar(&webhookCfg.Workers, "webhook-workers", 4, "webhook notifications sent concurrently")
+	flag.DurationVar(&webhookCfg.Timeout, "webhook-timeout", 10*time.Second, "how long a webhook has to answer a notification")
+	flag.IntVar(&webhookCfg.MaxAttempts, "webhook-max-attempts", 10, "attempts at a webhook notification before giving up on it")
+	var webSocket bool
+	var webSocketOrigins string
+	flag.BoolVar(&webSocket, "websocket", false, "serve the WebSocket API at /ws")
+	flag.StringVar(&webSocketOrigins, "websocket-origins", "", "comma-separated origins of web pages allowed to open WebSockets, such as https://dashboard.example.com (same origin only if unset)")
+	var kafkaCfg KafkaConfig
+	var kafkaBrokers string
+	flag.StringVar(&kafkaBrokers, "kafka-brokers", "", "comma-separated Kafka brokers to consume receipts from, such as kafka-1:9092,kafka-2:9092")
+	flag.StringVar(&kafkaCfg.Topic, "kafka-topic", "receipts", "Kafka topic receipts are consumed from")
+	flag.StringVar(&kafkaCfg.Group, "kafka-group", "receipt-processor", "Kafka consumer group")
+	flag.StringVar(&kafkaCfg.OutputTopic, "kafka-output-topic", "", "Kafka topic the results of consumed receipts are produced to (none if unset)")
+	flag.StringVar(&kafkaCfg.Tenant, "kafka-tenant", "", "tenant receipts consumed from Kafka are processed for (the default tenant if unset)")
+	var natsCfg NATSConfig
+	flag.StringVar(&natsCfg.URL, "nats-url", "", "NATS server to consume receipts from with JetStream, such as nats://localhost:4222")
+	flag.StringVar(&natsCfg.Subject, "nats-subject", "receipts", "subject receipts are consumed from; a JetStream stream must capture it")
+	flag.StringVar(&natsCfg.Durable, "nats-durable", "receipt-processor", "name of the durable JetStream consumer")
+	flag.StringVar(&natsCfg.ResultSubject, "nats-result-subject", "", "subject the results of consumed receipts are published to (none if unset)")
+	flag.StringVar(&natsCfg.DeadLetterSubject, "nats-dead-letter-subject", "", "subject invalid receipts are published to (they are dropped if unset)")
+	flag.StringVar(&natsCfg.Tenant, "nats-tenant", "", "tenant receipts consumed from NATS are processed for (the default tenant if unset)")
+	var sqsCfg SQSConfig
+	flag.StringVar(&sqsCfg.QueueURL, "sqs-queue-url", "", "URL of an SQS queue to poll for receipts, with the AWS credentials and region of the environment")
+	flag.StringVar(&sqsCfg.Tenant, "sqs-tenant", "", "tenant receipts polled from SQS are processed for (the default tenant if unset)")
+	var pubsubCfg PubSubConfig
+	flag.StringVar(&pubsubCfg.Project, "pubsub-project", "", "Google Cloud project of the Pub/Sub subscription")
+	flag.StringVar(&pubsubCfg.Subscription, "pubsub-subscription", "", "Pub/Sub subscription to pull receipts from, with the application default credentials")
+	flag.StringVar(&pubsubCfg.Tenant, "pubsub-tenant", "", "tenant receipts pulled from Pub/Sub are processed for (the default tenant if unset)")
+	var imapCfg IMAPConfig
+	flag.StringVar(&imapCfg.Addr, "imap-addr", "", "host:port of an IMAP server to read emailed receipts from over TLS, such as imap.example.com:993; needs -receipt-templates")
+	flag.StringVar(&imapCfg.Username, "imap-username", "", "user to log in to the IMAP server as, with the password in RECEIPTS_IMAP_PASSWORD")
+	flag.StringVar(&imapCfg.Mailbox, "imap-mailbox", "INBOX", "mailbox whose unread email is read for receipts")
+	flag.DurationVar(&imapCfg.Interval, "imap-interval", time.Minute, "how often the mailbox is checked for new email")
+	flag.StringVar(&imapCfg.Tenant, "imap-tenant", "", "tenant emailed receipts are processed for (the default tenant if unset)")
+	var outboxCfg OutboxConfig
+	flag.StringVar(&outboxCfg.Broker, "outbox", "", "broker the events of processed receipts are relayed to through the store's outbox: kafka or nats (off if unset)")
+	flag.StringVar(&outboxCfg.Addr, "outbox-addr", "", "comma-separated Kafka brokers or NATS URL of the outbox broker")
+	flag.StringVar(&outboxCfg.Topic, "outbox-topic", "receipt-events", "Kafka topic or NATS subject the outbox events are published to")
+	flag.DurationVar(&outboxCfg.Interval, "outbox-interval", 5*time.Second, "how often the outbox is checked for events not published right away")
+	var grpcAddr string
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "address of a gRPC listener serving receipts.v1.ReceiptService, such as :9090")
+	flag.StringVar(&debugAddr, "debug-addr", "", "loopback address of a listener serving pprof profiles and expvar counters, such as localhost:6060")
+	flag.StringVar(&addr, "addr", ":8080", "comma-separated addresses to listen on: host:port, or unix: and a socket path")
+	flag.StringVar(&rulesCfg.RulesFile, "rules-file", "", "JSON file with scoring rule parameters (defaults to the standard rules)")
+	flag.StringVar(&rulesCfg.PluginsDir, "plugins-dir", "", "directory of WASM scoring plugins to load at startup")
+	flag.StringVar(&rulesCfg.RetailerOverridesFile, "retailer-overrides-file", "", "JSON file persisting the retailer overrides (kept in memory if unset)")
+	flag.StringVar(&rulesCfg.RetailerAliasesFile, "retailer-aliases-file", "", "JSON file persisting the retailer aliases (kept in memory if unset)")
+	var templatesFile string
+	flag.StringVar(&templatesFile, "receipt-templates", "", "JSON file of the templates receipts are read from documents with; enables the PDF endpoint")
+	var attachmentStore string
+	flag.StringVar(&attachmentStore, "attachment-store", "", "directory, or s3://bucket/prefix/ or gs://bucket/prefix/ URL, to keep the original artifacts of receipts in; enables attachments")
+	var parquetExport string
+	var parquetExportInterval time.Duration
+	flag.StringVar(&parquetExport, "parquet-export", "", "directory, or s3://bucket/prefix/ or gs://bucket/prefix/ URL, to write Parquet exports of the receipts to; enables them")
+	flag.DurationVar(&parquetExportInterval, "parquet-export-interval", 0, "how often receipts are exported as Parquet (0 for only on demand)")
+	flag.IntVar(&serverCfg.BatchMaxSize, "batch-max-size", 100, "maximum number of receipts in one batch request")
+	flag.IntVar(&serverCfg.BatchWorkers, "batch-workers", runtime.NumCPU(), "receipts of a batch processed concurrently")
+	flag.DurationVar(&serverCfg.StreamIdleTimeout, "stream-idle-timeout", time.Minute, "how long a receipt stream may go without a receipt or a read of its results (0 for no limit)")
+	flag.IntVar(&serverCfg.AsyncBatchMaxSize, "async-batch-max-size", 10000, "maximum number of receipts in one async job")
+	flag.IntVar(&serverCfg.JobWorkers, "job-workers", runtime.NumCPU(), "background workers processing async jobs")
+	flag.IntVar(&serverCfg.JobQueueSize, "job-queue-size", 100, "async jobs that may wait for a worker")
+	flag.IntVar(&serverCfg.ImportWorkers, "import-workers", runtime.NumCPU(), "receipts of an import job processed concurrently")
+	flag.StringVar(&serverCfg.ImportDir, "import-dir", "", "directory file:// import sources are read from (refused if unset)")
+	flag.BoolVar(&serverCfg.StrictJSON, "strict-json", false, "reject receipts with unrecognized JSON fields")
+	serverCfg.TotalCheck = TotalCheckOff
+	flag.Var(&serverCfg.TotalCheck, "total-check", "check that item prices add up to the total: off, reject or flag")
+	flag.Var(&serverCfg.TotalTolerance, "total-tolerance", "allowed difference between the total and the item prices, e.g. 0.05")
+	serverCfg.Dedup = DedupOff
+	flag.Var(&serverCfg.Dedup, "dedup", "handling of duplicate receipts: off, reject or return-existing")
+	flag.Int64Var(&serverCfg.MaxBodyBytes, "max-body-bytes", 1<<20, "maximum size of a request body")
+	flag.Int64Var(&serverCfg.MaxBatchBodyBytes, "max-batch-body-bytes", 32<<20, "maximum size of a batch request body")
+	flag.IntVar(&serverCfg.MaxItems, "max-items", 1000, "maximum number of items on a receipt (0 for no limit)")
+	flag.IntVar(&serverCfg.MaxDescriptionLength, "max-description-length", 200, "maximum length of an item description (0 for no limit)")
+	serverCfg.NegativePrices = NegativePricesReject
+	flag.Var(&serverCfg.NegativePrices, "negative-prices", "handling of negative item prices: reject, or refund to accept them as refund lines")
+	flag.DurationVar(&serverCfg.IdempotencyTTL, "idempotency-ttl", 24*time.Hour, "how long Idempotency-Key values are remembered")
+	flag.DurationVar(&serverCfg.JobRetention, "job-retention", time.Hour, "how long finished async jobs can be polled")
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait for requests in flight when shutting down")
+	var httpCfg HTTPConfig
+	flag.DurationVar(&httpCfg.ReadHeaderTimeout, "http-read-header-timeout", 10*time.Second, "how long clients have to send the request headers (0 for no limit)")
+	flag.DurationVar(&httpCfg.ReadTimeout, "http-read-timeout", time.Minute, "how long clients have to send a whole request, body included (0 for no limit)")
+	flag.DurationVar(&httpCfg.WriteTimeout, "http-write-timeout", 2*time.Minute, "how long handling a request and writing its response may take (0 for no limit)")
+	flag.DurationVar(&httpCfg.IdleTimeout, "http-idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open (0 for no limit)")
+	flag.IntVar(&httpCfg.MaxHeaderBytes, "http-max-header-bytes", 64<<10, "maximum size of the request headers")
+	flag.BoolVar(&httpCfg.H2C, "h2c", false, "serve HTTP/2 without TLS (h2c), for service meshes")
+	flag.StringVar(&httpCfg.HTTP3Addr, "http3-addr", "", "UDP address of an experimental HTTP/3 listener, such as :443; needs TLS")
+	var tracingCfg TracingConfig
+	flag.StringVar(&tracingCfg.Endpoint, "otlp-endpoint", "", "host:port of the OTLP/HTTP collector to export traces to; enables tracing")
+	flag.BoolVar(&tracingCfg.Insecure, "otlp-insecure", false, "export traces over plain HTTP")
+	flag.StringVar(&tracingCfg.ServiceName, "otel-service-name", "receipt-processor", "service name traces are recorded under")
+	flag.Float64Var(&tracingCfg.SampleRatio, "trace-sample-ratio", 1, "share of new traces recorded, from 0 to 1")
+	flag.DurationVar(&serverCfg.PointsExpiry, "points-expiry", 0, "how long after processing users' points expire, e.g. 8760h for a year (0 keeps them forever)")
+	flag.DurationVar(&serverCfg.PointsExpiryWarning, "points-expiry-warning", 30*24*time.Hour, "how far ahead the balance endpoint reports expiring points")
+	serverCfg.Fraud.Mode = FraudOff
+	flag.Var(&serverCfg.Fraud.Mode, "fraud", "handling of suspicious receipts: off, flag or reject")
+	flag.IntVar(&serverCfg.Fraud.MaxReceiptsPerHour, "fraud-max-receipts-per-hour", 20, "receipts a user may submit in an hour before they are suspicious (0 for no limit)")
+	flag.DurationVar(&serverCfg.Fraud.RepeatedTotalWindow, "fraud-repeated-total-window", 10*time.Minute, "how soon a user repeating a total at the same retailer is suspicious (0 to not check)")
+	flag.DurationVar(&serverCfg.Fraud.FutureTolerance, "fraud-future-tolerance", 14*time.Hour, "how far in the future purchase times may be, to allow for time zones")
+	flag.Float64Var(&serverCfg.Anomaly.ZScore, "anomaly-z-score", 0, "flag totals this many standard deviations from their retailer's mean (0 to not score totals)")
+	flag.IntVar(&serverCfg.Anomaly.MinSamples, "anomaly-min-samples", 30, "receipts of a retailer needed before its totals are scored")
+	flag.IntVar(&serverCfg.TransferMaxPoints, "transfer-max-points", 0, "maximum points of a single transfer between users (0 for no limit)")
+	flag.IntVar(&serverCfg.TransferDailyMaxPoints, "transfer-daily-max-points", 0, "maximum points a user may transfer per UTC day (0 for no limit)")
+	var expirySweepInterval time.Duration
+	flag.DurationVar(&expirySweepInterval, "points-expiry-sweep-interval", time.Hour, "how often expired points are taken off balances")
+	flag.DurationVar(&serverCfg.Retention, "retention", 0, "how long after processing receipts are kept, e.g. 17520h for two years (0 keeps them forever)")
+	var retentionSweepInterval time.Duration
+	flag.DurationVar(&retentionSweepInterval, "retention-sweep-interval", time.Hour, "how often receipts past their retention are removed")
+	var pointsCacheSize int
+	flag.IntVar(&pointsCacheSize, "points-cache-size", 0, "receipts whose points are cached in memory in front of a database store (0 for no cache)")
+	var responseCacheSize int
+	var responseCacheTTL time.Duration
+	flag.IntVar(&responseCacheSize, "response-cache-size", 0, "responses of receipt lookups cached in memory per URL and caller (0 for no cache)")
+	flag.DurationVar(&responseCacheTTL, "response-cache-ttl", 30*time.Second, "how long a response of a receipt lookup stays cached")
+	flag.StringVar(&serverCfg.CacheControl, "cache-control", "", "Cache-Control header of successful GET responses, such as \"private, max-age=60\" (none if empty)")
+	var retentionArchive string
+	flag.StringVar(&retentionArchive, "retention-archive", "", "directory, or s3://bucket/prefix/ or gs://bucket/prefix/ URL, to archive receipts to before they are removed past their retention")
+	var apiKeyAuth bool
+	var apiKeysFile string
+	flag.BoolVar(&apiKeyAuth, "api-key-auth", false, "require an API key in the "+APIKeyHeader+" header")
+	flag.StringVar(&apiKeysFile, "api-keys-file", "", "JSON file persisting the API keys (kept in memory if unset)")
+	var apiKeyQuota int
+	flag.IntVar(&apiKeyQuota, "api-key-monthly-quota", 0, "receipts each API key may submit per calendar month unless it has its own quota (0 is unlimited)")
+	tlsCfg := TLSConfig{ClientRole: RoleSubmitter}
+	flag.StringVar(&tlsCfg.CertFile, "tls-cert", "", "PEM certificate to serve HTTPS with")
+	flag.StringVar(&tlsCfg.KeyFile, "tls-key", "", "PEM private key of the certificate")
+	flag.StringVar(&tlsCfg.ClientCAFile, "tls-client-ca", "", "PEM CAs that client certificates must chain to; requires client certificates and identifies clients by them")
+	flag.Var(&tlsCfg.ClientRole, "tls-client-role", "role of clients identified by their certificate: reader, submitter or admin")
+	var autocertDomains string
+	flag.StringVar(&autocertDomains, "tls-autocert-domains", "", "comma-separated domains to get certificates for from Let's Encrypt, instead of -tls-cert and -tls-key")
+	flag.StringVar(&tlsCfg.AutocertCacheDir, "tls-autocert-cache-dir", "autocert-cache", "directory caching the certificates from Let's Encrypt")
+	flag.StringVar(&tlsCfg.AutocertEmail, "tls-autocert-email", "", "contact email given to Let's Encrypt")
+	flag.StringVar(&tlsCfg.RedirectAddr, "tls-redirect-addr", "", "plain HTTP address redirecting to HTTPS, such as :80; also answers ACME challenges with autocert")
+	flag.StringVar(&serverCfg.TenantHeader, "tenant-header", "", "request header naming the tenant to act for, such as X-Tenant-ID (tenants only come from API keys if unset)")
+	var rateLimitRPS float64
+	var rateLimitBurst int
+	flag.Float64Var(&rateLimitRPS, "rate-limit-rps", 0, "requests per second allowed per API key, user or client IP (0 disables rate limiting)")
+	flag.IntVar(&rateLimitBurst, "rate-limit-burst", 20, "requests a client may make at once before being rate limited")
+	var hmacAuth bool
+	hmacCfg := HMACConfig{Role: RoleSubmitter}
+	flag.BoolVar(&hmacAuth, "hmac-auth", false, "accept requests signed with the client secrets in RECEIPTS_HMAC_SECRETS")
+	flag.Var(&hmacCfg.Role, "hmac-role", "role of clients signing requests: reader, submitter or admin")
+	flag.DurationVar(&hmacCfg.ReplayWindow, "hmac-replay-window", 5*time.Minute, "how far the timestamp of a signed request may be from the server's clock")
+	var oidcCfg OIDCConfig
+	flag.StringVar(&oidcCfg.Issuer, "oidc-issuer", "", "OpenID Connect issuer URL; enables user tokens and per-user receipts")
+	flag.StringVar(&oidcCfg.ClientID, "oidc-client-id", "", "client ID that user tokens must be issued to")
+	flag.StringVar(&oidcCfg.RolesClaim, "oidc-roles-claim", "roles", "claim of user tokens listing the user's roles (dots reach into nested claims)")
+	flag.StringVar(&oidcCfg.AdminRole, "oidc-admin-role", "admin", "provider role that grants users the admin role")
+	oidcCfg.DefaultRole = RoleSubmitter
+	flag.Var(&oidcCfg.DefaultRole, "oidc-default-role", "role every user has: reader, submitter, admin, or empty for none")
+	var jwtCfg JWTConfig
+	flag.StringVar(&jwtCfg.JWKSURL, "jwt-jwks-url", "", "JWKS URL of the keys signing bearer tokens; enables JWT authentication")
+	flag.StringVar(&jwtCfg.Issuer, "jwt-issuer", "", "required iss claim of bearer tokens")
+	flag.StringVar(&jwtCfg.Audience, "jwt-audience", "", "required aud claim of bearer tokens")
+	flag.StringVar(&jwtCfg.RolesClaim, "jwt-roles-claim", "roles", "claim of bearer tokens listing their roles (dots reach into nested claims)")
+	flag.StringVar(&cfg.backend, "store", "memory", "receipt store backend: memory, sqlite, bolt, postgres, redis or raft")
+	flag.StringVar(&cfg.memorySnapshot.Path, "memory-snapshot", "", "file the memory store writes snapshots of its receipts to, and loads them from at startup")
+	flag.DurationVar(&cfg.memorySnapshot.Interval, "memory-snapshot-interval", 5*time.Minute, "how often the memory store writes a snapshot, if it has changed")
+	flag.StringVar(&cfg.memorySnapshot.WAL, "memory-wal", "", "file the memory store logs its writes to before acknowledging them, replayed on top of the snapshot at startup")
+	flag.StringVar(&cfg.sqlitePath, "sqlite-path", "receipts.db", "path to the SQLite database file")
+	flag.StringVar(&cfg.boltPath, "bolt-path", "receipts.bolt", "path to the embedded bolt database file")
+	flag.IntVar(&cfg.postgresPool.MaxOpenConns, "pg-max-open-conns", 20, "maximum open PostgreSQL connections")
+	flag.IntVar(&cfg.postgresPool.MaxIdleConns, "pg-max-idle-conns", 5, "maximum idle PostgreSQL connections")
+	flag.DurationVar(&cfg.postgresPool.ConnMaxLifetime, "pg-conn-max-lifetime", 30*time.Minute, "maximum lifetime of a PostgreSQL connection")
+	flag.StringVar(&cfg.redis.Addr, "redis-addr", "localhost:6379", "Redis server address")
+	flag.IntVar(&cfg.redis.DB, "redis-db", 0, "Redis database number")
+	flag.StringVar(&cfg.redis.KeyPrefix, "redis-key-prefix", "receipt-processor:", "prefix for all Redis keys")
+	flag.DurationVar(&cfg.redis.TTL, "redis-ttl", 0, "how long receipts are kept in Redis (0 keeps them forever)")
+	flag.StringVar(&cfg.raft.NodeID, "raft-node-id", "", "ID of this node among the -raft-peers")
+	flag.StringVar(&cfg.raftPeers, "raft-peers", "", "comma-separated id=host:port=url nodes of the Raft cluster, this one included: their Raft address and HTTP base URL")
+	flag.StringVar(&cfg.raft.Dir, "raft-dir", "raft", "directory of this node's Raft log and snapshots")
+	flag.DurationVar(&cfg.raft.Timeout, "raft-timeout", 5*time.Second, "how long a write has to be replicated, and a node to catch up with a Raft-Index")
+	var shardCfg ShardConfig
+	var shardNodes string
+	flag.StringVar(&shardCfg.NodeID, "shard-node-id", "", "ID of this node among the -shard-nodes")
+	flag.StringVar(&shardNodes, "shard-nodes", "", "comma-separated id=url nodes partitioning receipts by consistent hashing, this one included; enables sharding")
+	flag.DurationVar(&shardCfg.Timeout, "shard-timeout", 10*time.Second, "how long a receipt forwarded to the node owning its user may take")
+	flag.Parse()
+	if configFile == "" {
+		configFile = os.Getenv(configEnvName("config"))
+	}
+	settings, err := loadConfig(flag.CommandLine, configFile)
+	if err != nil {
+		fatal(err)
+	}
+	if err := setupLogging(logFormat); err != nil {
+		fatal(err)
+	}
+	if err := errors.Join(serverCfg.validate(), httpCfg.validate(), tracingCfg.validate(), accessLogCfg.validate()); err != nil {
+		fatal(err)
+	}
+
+	// The DSN and passwords usually carry credentials, so they are only read
+	// from the environment and never from the command line.
+	cfg.postgresDSN = os.Getenv("RECEIPTS_POSTGRES_DSN")
+	cfg.redis.Password = os.Getenv("RECEIPTS_REDIS_PASSWORD")
+	cfg.raft.Secret = os.Getenv("RECEIPTS_RAFT_SECRET")
+	shardCfg.Secret = os.Getenv("RECEIPTS_SHARD_SECRET")
+	imapCfg.Password = os.Getenv("RECEIPTS_IMAP_PASSWORD")
+
+	store, err := newStore(cfg)
+	if err != nil {
+		fatal(err)
+	}
+	rules, err := NewRulesEngine(rulesCfg)
+	if err != nil {
+		fatal(err)
+	}
+	var clock Clock = systemClock{}
+	if fixedTime != "" {
+		at, err := time.Parse(time.RFC3339, fixedTime)
+		if err != nil {
+			fatal(fmt.Errorf("-fixed-time: %w", err))
+		}
+		slog.Warn("The clock is pinned; don't use -fixed-time in production", "at", at)
+		clock = fixedClock(at)
+	}
+	var ids IDGenerator = uuidGenerator{}
+	if idSeed != 0 {
+		slog.Warn("IDs are predictable; don't use -id-seed in production", "seed", idSeed)
+		ids = newSeededIDs(idSeed)
+	}
+	server := NewServer(store, rules, clock, ids, serverCfg)
+	if raftStore, ok := store.(*RaftStore); ok {
+		server.EnableRaft(raftStore)
+	}
+	if shardNodes != "" {
+		nodes, err := parseShardNodes(shardNodes)
+		if err != nil {
+			fatal(fmt.Errorf("-shard-nodes: %w", err))
+		}
+		shardCfg.Nodes = nodes
+		router, err := NewShardRouter(shardCfg)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableSharding(router)
+	}
+	// Memory stores are as fast as the cache, and Raft stores are written
+	// to by the other nodes too.
+	if pointsCacheSize > 0 && cfg.backend != "memory" && cfg.backend != "raft" {
+		server.EnablePointsCache(pointsCacheSize)
+	}
+	if responseCacheSize > 0 && cfg.backend != "raft" {
+		server.EnableResponseCache(responseCacheSize, responseCacheTTL)
+	}
+	if tracingCfg.Endpoint != "" {
+		tracer, err := newTracer(tracingCfg)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableTracing(tracer)
+	}
+	server.EnableConfigEndpoint(configFile, settings)
+	if apiKeyAuth {
+		// The bootstrap key is a credential, so like the DSN it only comes
+		// from the environment.
+		keys, err := NewAPIKeyStore(apiKeysFile, os.Getenv("RECEIPTS_BOOTSTRAP_API_KEY"), apiKeyQuota)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableAPIKeys(keys)
+	}
+	if jwtCfg.JWKSURL != "" {
+		a, err := NewJWTAuthenticator(jwtCfg)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableJWT(a)
+	}
+	if hmacAuth {
+		// Like the bootstrap key, the shared secrets only come from the
+		// environment.
+		secrets, err := parseHMACSecrets(os.Getenv("RECEIPTS_HMAC_SECRETS"))
+		if err != nil {
+			fatal(err)
+		}
+		hmacCfg.Secrets = secrets
+		hmacCfg.MaxBodyBytes = serverCfg.MaxBatchBodyBytes
+		a, err := NewHMACAuthenticator(hmacCfg)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableHMAC(a)
+	}
+	if oidcCfg.Issuer != "" {
+		a, err := NewOIDCAuthenticator(oidcCfg)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableOIDC(a)
+	}
+	if webhookCfg.Workers < 1 || webhookCfg.MaxAttempts < 1 {
+		fatal("-webhook-workers and -webhook-max-attempts must be at least 1")
+	}
+	hooks, err := NewWebhookStore(webhookCfg.File)
+	if err != nil {
+		fatal(err)
+	}
+	server.EnableWebhooks(hooks, webhookCfg)
+	if attachmentStore != "" {
+		attachments, err := OpenAttachmentStore(attachmentStore)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableAttachments(attachments)
+	}
+	if parquetExport != "" {
+		export, err := OpenParquetExport(parquetExport)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableParquetExport(export, parquetExportInterval)
+	}
+	if retentionArchive != "" {
+		if serverCfg.Retention <= 0 {
+			fatal("-retention-archive needs -retention")
+		}
+		archive, err := OpenRetentionArchive(retentionArchive)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableRetentionArchive(archive)
+	}
+	if templatesFile != "" {
+		templates, err := loadReceiptTemplates(templatesFile)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableReceiptTemplates(templates)
+	}
+	if webSocket {
+		var origins []string
+		for _, origin := range strings.Split(webSocketOrigins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, origin)
+			}
+		}
+		upgrade, err := newWebSocketUpgrader(origins)
+		if err != nil {
+			fatal(err)
+		}
+		server.EnableWebSocket(upgrade)
+	}
+	if rateLimitRPS > 0 {
+		if rateLimitBurst < 1 {
+			fatal("-rate-limit-burst must be at least 1")
+		}
+		server.EnableRateLimit(rateLimitRPS, rateLimitBurst)
+	}
+	var certs certManager
+	if autocertDomains != "" {
+		for _, domain := range strings.Split(autocertDomains, ",") {
+			tlsCfg.AutocertDomains = append(tlsCfg.AutocertDomains, strings.TrimSpace(domain))
+		}
+		if certs, err = newCertManager(tlsCfg); err != nil {
+			fatal(err)
+		}
+	}
+	tlsServerCfg, err := serverTLSConfig(tlsCfg, certs)
+	if err != nil {
+		fatal(err)
+	}
+	if tlsCfg.ClientCAFile != "" {
+		server.EnableClientCerts(tlsCfg.ClientRole)
+	}
+
+	if serverCfg.Anomaly.ZScore > 0 {
+		go server.seedAnomalies()
+	}
+	if serverCfg.PointsExpiry > 0 {
+		go server.sweepExpiredPoints(expirySweepInterval)
+	}
+	if serverCfg.Retention > 0 {
+		go server.sweepRetention(retentionSweepInterval)
+	}
+
+	var accessLog *AccessLog
+	if accessLogCfg.Format != AccessLogOff {
+		for _, path := range strings.Split(accessLogExclude, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				accessLogCfg.Exclude = append(accessLogCfg.Exclude, path)
+			}
+		}
+		if accessLog, err = NewAccessLog(accessLogCfg); err != nil {
+			fatal(err)
+		}
+	}
+
+	// Reload the scoring rules and reopen the access log on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if accessLog != nil {
+				if err := accessLog.Reopen(); err != nil {
+					slog.Error("Failed to reopen the access log", "err", err)
+				}
+			}
+			if _, err := rules.Reload(); err != nil {
+				slog.Error("Keeping the current scoring rules", "err", err)
+				continue
+			}
+			slog.Info("Reloaded the scoring rules", "file", rulesCfg.RulesFile)
+		}
+	}()
 
 	r := mux.NewRouter()
-	r.HandleFunc("/receipts/process", ProcessReceiptHandler).Methods("POST")
-	r.HandleFunc("/receipts/{id}/points", GetPointsHandler).Methods("GET")
+	// api holds the middleware of each route, outermost first. Routes
+	// require the admin scope and take bodies up to -max-body-bytes unless
+	// they override "auth" and "bodyLimit". Compression and the response
+	// format come before auth so that its problems are encoded too. Receipt
+	// lookups override "responseCache" to be cached when that's on. Routes
+	// of a receipt or user override "shard" to be proxied to the node
+	// owning it when sharded, which does the rest.
+	api := routes{router: r, chain: Chain{
+		{Name: "tracing", Wrap: server.traceRequests},
+		{Name: "receiptIds", Wrap: logReceiptIDs},
+		{Name: "shard"},
+		{Name: "compression", Wrap: compress},
+		{Name: "responseFormat", Wrap: responseFormat},
+		server.requireScope(ScopeAdmin),
+		{Name: "rateLimit", Wrap: server.rateLimited},
+		{Name: "tenant", Wrap: server.withTenant},
+		{Name: "raft", Wrap: server.raftConsistency},
+		cacheControl(serverCfg.CacheControl),
+		{Name: "metrics", Wrap: countRequests},
+		{Name: "responseCache"},
+		bodyLimit(serverCfg.MaxBodyBytes),
+		{Name: "requestFormat", Wrap: requestFormat},
+	}}
+	api.handle("GET", "/receipts", server.ListReceiptsHandler, server.requireScope(ScopeRead))
+	api.handle("GET", "/receipts/export", server.ExportReceiptsHandler, server.requireScope(ScopeRead))
+	api.handle("POST", "/receipts/process", server.ProcessReceiptHandler, server.requireScope(ScopeProcess), protobuf(processReceiptProto))
+	api.handle("POST", "/receipts/process/batch", server.ProcessBatchHandler, server.requireScope(ScopeProcess), bodyLimit(serverCfg.MaxBatchBodyBytes), protobuf(batchProcessProto))
+	// Streams limit each line rather than the body.
+	api.handle("POST", "/receipts/process/stream", server.ProcessStreamHandler, server.requireScope(ScopeProcess), skip("bodyLimit"))
+	api.handle("POST", "/receipts/import/csv", server.ImportCSVHandler, server.requireScope(ScopeProcess), bodyLimit(serverCfg.MaxBatchBodyBytes))
+	api.handle("POST", "/receipts/points:batchGet", server.BatchGetPointsHandler, server.requireScope(ScopeRead))
+	api.handle("POST", "/receipts/process/async", server.ProcessAsyncHandler, server.requireScope(ScopeProcess), bodyLimit(serverCfg.MaxBatchBodyBytes))
+	api.handle("GET", "/jobs/{id}", server.GetJobHandler, server.requireScope(ScopeRead))
+	// Streams last as long as clients listen, which would swamp the
+	// latency metrics.
+	api.handle("GET", "/events", server.EventsHandler, server.requireScope(ScopeRead), skip("metrics"))
+	api.handle("POST", "/admin/rules/reload", server.ReloadRulesHandler)
+	api.handle("GET", "/admin/rules/versions", server.ListRuleVersionsHandler)
+	api.handle("POST", "/admin/recalculate", server.StartRecalculationHandler)
+	api.handle("GET", "/admin/recalculate/{id}", server.GetRecalculationHandler)
+	api.handle("POST", "/admin/imports", server.StartImportHandler)
+	api.handle("GET", "/admin/imports/{id}", server.GetImportHandler)
+	api.handle("POST", "/admin/backup", server.BackupHandler)
+	// Archives hold the whole store, so they aren't limited.
+	api.handle("POST", "/admin/restore", server.RestoreHandler, skip("bodyLimit"))
+	api.handle("GET", "/admin/retailer-overrides", server.ListRetailerOverridesHandler)
+	api.handle("POST", "/admin/retailer-overrides", server.CreateRetailerOverrideHandler)
+	api.handle("GET", "/admin/retailer-overrides/{id}", server.GetRetailerOverrideHandler)
+	api.handle("PUT", "/admin/retailer-overrides/{id}", server.UpdateRetailerOverrideHandler)
+	api.handle("DELETE", "/admin/retailer-overrides/{id}", server.DeleteRetailerOverrideHandler)
+	api.handle("GET", "/admin/retailer-aliases", server.ListRetailerAliasesHandler)
+	api.handle("PUT", "/admin/retailer-aliases/{alias}", server.PutRetailerAliasHandler)
+	api.handle("DELETE", "/admin/retailer-aliases/{alias}", server.DeleteRetailerAliasHandler)
+	api.handle("GET", "/retailers/canonical", server.CanonicalRetailerHandler, server.requireScope(ScopeRead))
+	api.handle("GET", "/receipts/{id}", server.GetReceiptHandler, server.requireScope(ScopeRead), server.shardBy("id"), server.cacheResponses())
+	api.handle("PUT", "/receipts/{id}", server.AmendReceiptHandler, server.requireScope(ScopeProcess), server.shardBy("id"))
+	api.handle("DELETE", "/receipts/{id}", server.DeleteReceiptHandler, server.shardBy("id"))
+	api.handle("GET", "/receipts/{id}/points", server.GetPointsHandler, server.requireScope(ScopeRead), protobuf(getPointsProto), server.shardBy("id"), server.cacheResponses())
+	api.handle("GET", "/receipts/{id}/points/breakdown", server.GetPointsBreakdownHandler, server.requireScope(ScopeRead), server.shardBy("id"), server.cacheResponses())
+	api.handle("POST", "/users/{id}/transfer", server.TransferPointsHandler, server.requireScope(ScopeProcess), server.shardBy("id"))
+	api.handle("GET", "/users/{id}/receipts", server.ListUserReceiptsHandler, server.requireScope(ScopeRead), server.shardBy("id"))
+	api.handle("GET", "/users/{id}/points", server.GetUserPointsHandler, server.requireScope(ScopeRead), server.shardBy("id"))
+	api.handle("GET", "/admin/flagged-receipts", server.ListFlaggedReceiptsHandler)
+	api.handle("POST", "/admin/flagged-receipts/{id}/approve", server.ApproveReceiptHandler, server.shardBy("id"))
+	api.handle("POST", "/admin/flagged-receipts/{id}/reject", server.RejectReceiptHandler, server.shardBy("id"))
+	api.handle("GET", "/admin/config", server.GetConfigHandler)
+	api.handle("GET", "/admin/log-level", GetLogLevelHandler)
+	api.handle("PUT", "/admin/log-level", SetLogLevelHandler)
+	// Monitors polling the counters would otherwise swamp them.
+	api.handle("GET", "/debug/vars", expvar.Handler().ServeHTTP, skip("metrics"))
+	api.handle("POST", "/points/preview", server.PreviewPointsHandler, server.requireScope(ScopeRead))
+
+	if server.webhooks != nil {
+		api.handle("GET", "/admin/webhooks", server.ListWebhooksHandler)
+		api.handle("POST", "/admin/webhooks", server.CreateWebhookHandler)
+		api.handle("GET", "/admin/webhooks/{id}", server.GetWebhookHandler)
+		api.handle("PUT", "/admin/webhooks/{id}", server.UpdateWebhookHandler)
+		api.handle("DELETE", "/admin/webhooks/{id}", server.DeleteWebhookHandler)
+		api.handle("GET", "/admin/webhooks/{id}/deliveries", server.WebhookDeliveriesHandler)
+		api.handle("POST", "/admin/webhooks/{id}/deliveries/{delivery}/redeliver", server.RedeliverWebhookHandler)
+	}
+	if server.templates != nil {
+		api.handle("POST", "/receipts/process/pdf", server.ProcessPDFHandler, server.requireScope(ScopeProcess), bodyLimit(serverCfg.MaxBatchBodyBytes))
+	}
+	if server.attachments != nil {
+		api.handle("PUT", "/receipts/{id}/attachment", server.PutAttachmentHandler, server.requireScope(ScopeProcess), bodyLimit(serverCfg.MaxBatchBodyBytes), server.shardBy("id"))
+		api.handle("GET", "/receipts/{id}/attachment", server.GetAttachmentHandler, server.requireScope(ScopeRead), server.shardBy("id"))
+	}
+	if server.parquet != nil {
+		api.handle("POST", "/admin/exports/parquet", server.StartParquetExportHandler)
+		api.handle("GET", "/admin/exports/parquet/{id}", server.GetParquetExportHandler)
+	}
+	if server.upgradeWebSocket != nil {
+		// Connections are hijacked from the server, so the middleware that
+		// wraps responses has nothing to do, and they last too long for
+		// the latency metrics.
+		api.handle("GET", "/ws", server.WebSocketHandler, server.requireScope(ScopeProcess),
+			skip("compression"), skip("responseFormat"), skip("metrics"), skip("raft"), skip("cacheControl"))
+	}
+
+	if server.raft != nil {
+		// Nodes authenticate with the cluster's secret rather than as
+		// clients.
+		api.handle("POST", "/internal/raft/apply", server.RaftApplyHandler,
+			skip("auth"), skip("rateLimit"), skip("raft"), bodyLimit(serverCfg.MaxBatchBodyBytes))
+	}
+
+	if server.shards != nil {
+		// Nodes authenticate with the cluster's secret, and pass on the
+		// submitter they authenticated.
+		api.handle("POST", "/internal/shard/process", server.ShardProcessHandler,
+			skip("auth"), skip("rateLimit"), skip("tenant"), bodyLimit(serverCfg.MaxBatchBodyBytes))
+	}
+
+	if server.apiKeys != nil {
+		api.handle("GET", "/admin/api-keys", server.ListAPIKeysHandler)
+		api.handle("POST", "/admin/api-keys", server.CreateAPIKeyHandler)
+		api.handle("DELETE", "/admin/api-keys/{id}", server.RevokeAPIKeyHandler)
+		api.handle("GET", "/admin/keys/{id}/usage", server.GetAPIKeyUsageHandler)
+		// Usage was first served next to the other API key routes.
+		api.handle("GET", "/admin/api-keys/{id}/usage", server.GetAPIKeyUsageHandler)
+	}
 
-	port := ":8080"
-	fmt.Printf("Server listening on port %s...\n", port)
-	log.Fatal(http.ListenAndServe(port, r))
+	addrs, err := splitAddrs(addr)
+	if err != nil {
+		fatal(fmt.Errorf("-addr: %w", err))
+	}
+	// Every request goes through these, whether it matches a route or not.
+	// Recovery runs inside the request ID and logs so that panics are
+	// logged with the ID and answered before the request is.
+	outer := Chain{
+		{Name: "requestId", Wrap: withRequestID},
+		{Name: "logging", Wrap: logRequests},
+	}
+	if accessLog != nil {
+		outer = outer.Append(Middleware{Name: "accessLog", Wrap: accessLog.Wrap})
+	}
+	handler := outer.Append(Middleware{Name: "recovery", Wrap: recoverPanics}).Then(r)
+	var listeners []listener
+	if httpCfg.HTTP3Addr != "" {
+		if tlsServerCfg == nil {
+			fatal("HTTP/3 needs TLS; set the certificate and key too")
+		}
+		l, err := http3Listener(httpCfg.HTTP3Addr, handler, tlsServerCfg)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Serving HTTP/3", "addr", httpCfg.HTTP3Addr)
+		listeners = append(listeners, l)
+		handler = advertiseHTTP3(httpCfg.HTTP3Addr, handler)
+	}
+	if httpCfg.H2C {
+		if tlsServerCfg != nil {
+			fatal("-h2c is for plain HTTP; HTTPS negotiates HTTP/2 already")
+		}
+		if handler, err = h2cHandler(handler, httpCfg); err != nil {
+			fatal(err)
+		}
+	}
+	if tlsCfg.RedirectAddr != "" {
+		redirect := httpsRedirect(firstTCPAddr(addrs))
+		if certs != nil {
+			redirect = certs.HTTPHandler(redirect)
+		}
+		ln, err := listen(tlsCfg.RedirectAddr)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Redirecting to HTTPS", "addr", tlsCfg.RedirectAddr)
+		listeners = append(listeners, httpListener(newHTTPServer(tlsCfg.RedirectAddr, redirect, nil, httpCfg), ln, "", ""))
+	}
+	if grpcAddr != "" {
+		l, err := grpcListener(grpcAddr, server, tlsServerCfg)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Serving gRPC", "addr", grpcAddr)
+		listeners = append(listeners, l)
+	}
+	if outboxCfg.Broker != "" {
+		if outboxCfg.Addr == "" || outboxCfg.Topic == "" {
+			fatal("-outbox needs -outbox-addr and -outbox-topic")
+		}
+		if outboxCfg.Interval <= 0 {
+			fatal("-outbox-interval must be positive")
+		}
+		publisher, err := outboxPublisher(outboxCfg)
+		if err != nil {
+			fatal(err)
+		}
+		l, err := server.EnableOutbox(publisher, outboxCfg)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Relaying receipt events through the outbox", "broker", outboxCfg.Broker, "topic", outboxCfg.Topic)
+		listeners = append(listeners, l)
+	}
+	if kafkaBrokers != "" {
+		kafkaCfg.Brokers = strings.Split(kafkaBrokers, ",")
+		if kafkaCfg.Tenant != "" && !tenantPattern.MatchString(kafkaCfg.Tenant) {
+			fatal("-kafka-tenant must be a valid tenant name")
+		}
+		l, err := kafkaListener(kafkaCfg, server)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Consuming receipts from Kafka", "brokers", kafkaBrokers, "topic", kafkaCfg.Topic)
+		listeners = append(listeners, l)
+	}
+	if natsCfg.URL != "" {
+		if natsCfg.Tenant != "" && !tenantPattern.MatchString(natsCfg.Tenant) {
+			fatal("-nats-tenant must be a valid tenant name")
+		}
+		l, err := natsListener(natsCfg, server)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Consuming receipts from NATS", "url", natsCfg.URL, "subject", natsCfg.Subject)
+		listeners = append(listeners, l)
+	}
+	if sqsCfg.QueueURL != "" {
+		if sqsCfg.Tenant != "" && !tenantPattern.MatchString(sqsCfg.Tenant) {
+			fatal("-sqs-tenant must be a valid tenant name")
+		}
+		l, err := sqsListener(sqsCfg, server)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Polling SQS for receipts", "queue", sqsCfg.QueueURL)
+		listeners = append(listeners, l)
+	}
+	if pubsubCfg.Subscription != "" {
+		if pubsubCfg.Project == "" {
+			fatal("-pubsub-subscription needs -pubsub-project")
+		}
+		if pubsubCfg.Tenant != "" && !tenantPattern.MatchString(pubsubCfg.Tenant) {
+			fatal("-pubsub-tenant must be a valid tenant name")
+		}
+		l, err := pubsubListener(pubsubCfg, server)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Pulling receipts from Pub/Sub", "project", pubsubCfg.Project, "subscription", pubsubCfg.Subscription)
+		listeners = append(listeners, l)
+	}
+	if imapCfg.Addr != "" {
+		if server.templates == nil {
+			fatal("-imap-addr needs -receipt-templates")
+		}
+		if imapCfg.Interval <= 0 {
+			fatal("-imap-interval must be positive")
+		}
+		if imapCfg.Tenant != "" && !tenantPattern.MatchString(imapCfg.Tenant) {
+			fatal("-imap-tenant must be a valid tenant name")
+		}
+		l, err := imapListener(imapCfg, server)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Reading receipts from email", "addr", imapCfg.Addr, "mailbox", imapCfg.Mailbox)
+		listeners = append(listeners, l)
+	}
+	if debugAddr != "" {
+		if err := checkLoopback(debugAddr); err != nil {
+			fatal(err)
+		}
+		ln, err := listen(debugAddr)
+		if err != nil {
+			fatal(err)
+		}
+		// CPU profiles and traces take as long as the caller asks.
+		debugCfg := httpCfg
+		debugCfg.WriteTimeout = 0
+		slog.Info("Serving debug endpoints", "addr", debugAddr)
+		listeners = append(listeners, httpListener(newHTTPServer(debugAddr, debugHandler(), nil, debugCfg), ln, "", ""))
+	}
+	for _, addr := range addrs {
+		ln, err := listen(addr)
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Server listening", "addr", addr)
+		listeners = append(listeners, httpListener(newHTTPServer(addr, handler, tlsServerCfg, httpCfg), ln, tlsCfg.CertFile, tlsCfg.KeyFile))
+	}
+	if err := server.serve(listeners, shutdownTimeout); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(err)
+	}
+	slog.Info("Server stopped")
 }
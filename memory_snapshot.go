@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemorySnapshotConfig has the memory store write its contents to Path
+// every Interval and at shutdown, and load them back at startup. Snapshots
+// are backup archives, so they can also be restored into other stores.
+type MemorySnapshotConfig struct {
+	Path     string
+	Interval time.Duration
+	// WAL, if set, is the write-ahead log of the writes since the last
+	// snapshot, replayed on top of it at startup.
+	WAL string
+}
+
+type memorySnapshots struct {
+	cfg  MemorySnapshotConfig
+	stop chan struct{}
+	done chan struct{}
+
+	// mu serializes writing snapshots.
+	mu sync.Mutex
+	// written is the store's count of changes as of the last snapshot.
+	written uint64
+}
+
+// NewSnapshottedMemoryStore returns a memory store loaded from the snapshot
+// at cfg.Path, if there is one, and its write-ahead log, that writes
+// snapshots there. Close writes the last one.
+func NewSnapshottedMemoryStore(cfg MemorySnapshotConfig) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	if err := s.loadSnapshot(cfg.Path); err != nil {
+		return nil, fmt.Errorf("load memory snapshot %s: %w", cfg.Path, err)
+	}
+	// The writes replayed from the log go into the next snapshot.
+	snapshotted := s.changes.Load()
+	if cfg.WAL != "" {
+		wal, err := s.replayWAL(cfg.WAL)
+		if err != nil {
+			return nil, fmt.Errorf("replay write-ahead log %s: %w", cfg.WAL, err)
+		}
+		s.wal = wal
+	}
+	s.snapshots = &memorySnapshots{
+		cfg:     cfg,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		written: snapshotted,
+	}
+	go s.snapshotEvery(cfg.Interval)
+	return s, nil
+}
+
+func (s *MemoryStore) loadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, loaded, err := readBackup(bufio.NewReader(f), s, func() {})
+	if err != nil {
+		return err
+	}
+	// The write-ahead log counts on from the snapshot, however many writes
+	// loading it took.
+	s.changes.Store(info.Changes)
+	slog.Info("Loaded the memory snapshot", "path", path, "receipts", loaded.Receipts)
+	return nil
+}
+
+// memoryState is a copy of the contents of a MemoryStore.
+type memoryState struct {
+	records  []ReceiptRecord
+	balances map[string]int
+	// changes counts the writes the copy includes, and logged is the
+	// length of the write-ahead log that has them.
+	changes uint64
+	logged  int64
+	// outbox is what's left to publish, which snapshots of the store
+	// leave out but Raft snapshots keep.
+	outbox  []OutboxEvent
+	lastSeq int64
+}
+
+// state copies the receipts and balances, holding the lock exclusively
+// so that no write is halfway done.
+func (s *MemoryStore) state() memoryState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := memoryState{
+		balances: s.balances.clone(),
+		changes:  s.changes.Load(),
+	}
+	s.receipts.scan(ListOptions{}, func(record ReceiptRecord) bool {
+		state.records = append(state.records, record)
+		return true
+	})
+	s.outboxMu.Lock()
+	state.outbox = slices.Clone(s.outbox)
+	state.lastSeq = s.lastSeq
+	s.outboxMu.Unlock()
+	if s.wal != nil {
+		state.logged = s.wal.size
+	}
+	return state
+}
+
+func (m memoryState) Snapshot(receipt func(ReceiptRecord) error) (map[string]int, error) {
+	for _, record := range m.records {
+		if err := receipt(record); err != nil {
+			return nil, err
+		}
+	}
+	return m.balances, nil
+}
+
+func (s *MemoryStore) snapshotEvery(interval time.Duration) {
+	defer close(s.snapshots.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.snapshots.stop:
+			return
+		case <-ticker.C:
+			if err := s.writeSnapshot(); err != nil {
+				slog.Error("Failed to write the memory snapshot", "path", s.snapshots.cfg.Path, "err", err)
+			}
+		}
+	}
+}
+
+// writeSnapshot replaces the snapshot file with the current contents of
+// the store, unless nothing changed since the last one. The snapshot is
+// written to a temporary file that is synced before it replaces the old
+// one, so a crash leaves one or the other whole. The write-ahead log then
+// drops the writes the snapshot has.
+func (s *MemoryStore) writeSnapshot() error {
+	s.snapshots.mu.Lock()
+	defer s.snapshots.mu.Unlock()
+	state := s.state()
+	if state.changes == s.snapshots.written {
+		return nil
+	}
+
+	path := s.snapshots.cfg.Path
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	buffered := bufio.NewWriter(tmp)
+	receipts, err := writeBackup(buffered, state, BackupInfo{CreatedAt: time.Now().UTC(), Changes: state.changes}, func() {})
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	s.snapshots.written = state.changes
+	slog.Debug("Wrote the memory snapshot", "path", path, "receipts", receipts)
+	if s.wal != nil {
+		return s.compactWAL(state.logged)
+	}
+	return nil
+}
+
+// Close writes the last snapshot, if the store writes them.
+func (s *MemoryStore) Close() error {
+	if s.snapshots == nil {
+		return nil
+	}
+	close(s.snapshots.stop)
+	<-s.snapshots.done
+	err := s.writeSnapshot()
+	if s.wal != nil {
+		err = errors.Join(err, s.wal.file.Close())
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	walPut      = "put"
+	walDelete   = "delete"
+	walTransfer = "transfer"
+	// walDeleteEvents drops the outbox events up to EventSeq. Only the
+	// Raft store replicates it, with the events of puts.
+	walDeleteEvents = "deleteEvents"
+)
+
+// walEntry is a line of the memory store's write-ahead log. Seq is the
+// store's count of writes once the entry is applied, which tells replays
+// which entries a snapshot already has.
+type walEntry struct {
+	Seq      uint64         `json:"seq"`
+	Op       string         `json:"op"`
+	Record   *ReceiptRecord `json:"record,omitempty"`
+	Event    *OutboxEvent   `json:"event,omitempty"`
+	ID       string         `json:"id,omitempty"`
+	From     string         `json:"from,omitempty"`
+	To       string         `json:"to,omitempty"`
+	Points   int            `json:"points,omitempty"`
+	EventSeq int64          `json:"eventSeq,omitempty"`
+	// Versioned makes a Raft put conditional on Record.Version being the
+	// stored receipt's version. Puts logged before there were versions
+	// don't have it.
+	Versioned bool `json:"versioned,omitempty"`
+}
+
+// memoryWAL appends the writes of a MemoryStore to a file, one JSON line
+// each, and syncs them before they are applied, so that acknowledged
+// writes survive a crash.
+type memoryWAL struct {
+	path string
+	// mu serializes appending to the log, so writes logged at the same
+	// time wait for each other's sync.
+	mu   sync.Mutex
+	file *os.File
+	// size is the length of the log, which ends with a whole entry, and
+	// seq the Seq of its last entry.
+	size int64
+	seq  uint64
+}
+
+// log appends entry to the write-ahead log, if there is one. It must be
+// called with s.mu held and what the write changes locked, before the
+// write is applied.
+func (s *MemoryStore) log(entry walEntry) error {
+	if s.wal == nil {
+		return nil
+	}
+	s.wal.mu.Lock()
+	defer s.wal.mu.Unlock()
+	entry.Seq = s.wal.seq + 1
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	n, err := s.wal.file.Write(data)
+	if err == nil {
+		err = s.wal.file.Sync()
+	}
+	if err != nil {
+		// Whatever part of the entry made it out is dropped, so the next
+		// one doesn't follow a torn line.
+		if n > 0 {
+			s.wal.file.Truncate(s.wal.size)
+		}
+		return fmt.Errorf("log %s: %w", entry.Op, err)
+	}
+	s.wal.size += int64(n)
+	s.wal.seq++
+	return nil
+}
+
+// apply makes a write read back from the log. It must be called with s.mu
+// held exclusively.
+func (s *MemoryStore) apply(entry walEntry) error {
+	switch entry.Op {
+	case walPut:
+		if entry.Record == nil {
+			return errors.New("put without a record")
+		}
+		shard := s.receipts.shard(entry.Record.ID)
+		shard.mu.Lock()
+		s.put(shard, *entry.Record)
+		shard.mu.Unlock()
+		if entry.Event != nil {
+			s.appendEvent(*entry.Event)
+		}
+	case walDelete:
+		shard := s.receipts.shard(entry.ID)
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		if _, found := shard.records[entry.ID]; !found {
+			return fmt.Errorf("delete of unknown receipt %s", entry.ID)
+		}
+		s.delete(shard, entry.ID)
+	case walTransfer:
+		unlock := s.balances.lock(entry.From, entry.To)
+		s.transfer(entry.From, entry.To, entry.Points)
+		unlock()
+	case walDeleteEvents:
+		s.deleteEvents(entry.EventSeq)
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+	return nil
+}
+
+// replayWAL applies the writes of the log at path that came after those
+// the store has, and opens the log for appending. A last line without its
+// newline is a write that was never acknowledged, and is dropped.
+func (s *MemoryStore) replayWAL(path string) (*memoryWAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reader := bufio.NewReader(f)
+	var size int64
+	replayed := 0
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(data) > 0 {
+				slog.Warn("Dropped a torn write at the end of the write-ahead log", "path", path, "line", line)
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var entry walEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		size += int64(len(data))
+		if entry.Seq <= s.changes.Load() {
+			// The snapshot has it already.
+			continue
+		}
+		if entry.Seq != s.changes.Load()+1 {
+			f.Close()
+			return nil, fmt.Errorf("line %d: write %d follows write %d", line, entry.Seq, s.changes.Load())
+		}
+		if err := s.apply(entry); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		replayed++
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if replayed > 0 {
+		slog.Info("Replayed the write-ahead log", "path", path, "writes", replayed)
+	}
+	return &memoryWAL{path: path, file: f, size: size, seq: s.changes.Load()}, nil
+}
+
+// compactWAL drops the first logged bytes of the log, which a snapshot
+// has, by moving the rest to a new log that replaces it. Writes wait
+// meanwhile, but there are only those that came during the snapshot to
+// move.
+func (s *MemoryStore) compactWAL(logged int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wal := s.wal
+
+	rest, err := os.Open(wal.path)
+	if err != nil {
+		return err
+	}
+	defer rest.Close()
+	if _, err := rest.Seek(logged, io.SeekStart); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(wal.path), "."+filepath.Base(wal.path)+"-*")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, io.LimitReader(rest, wal.size-logged))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), wal.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("compact write-ahead log: %w", err)
+	}
+
+	// The new log is appended to where the copy left off.
+	wal.file.Close()
+	wal.file = tmp
+	wal.size = n
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requestMetrics are published through expvar at /debug/vars. Requests
+// are counted by route and status, as in "GET /receipts/{id} 404", and
+// their latency summed by route.
+var (
+	requestMetrics = expvar.NewMap("requests")
+	latencyMetrics = expvar.NewMap("requestLatencyMs")
+)
+
+// countRequests counts the requests of each route. It must run inside the
+// router to know the route.
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route += " " + template
+			}
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		requestMetrics.Add(fmt.Sprintf("%s %d", route, recorder.status), 1)
+		latencyMetrics.AddFloat(route, float64(time.Since(start).Microseconds())/1000)
+	})
+}
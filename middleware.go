@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+// Middleware adds behaviour shared by many routes, such as authentication,
+// around a handler. Its name identifies it in a Chain, so that a route can
+// replace it or leave it out.
+type Middleware struct {
+	Name string
+	// Wrap returns next wrapped. Nil leaves the middleware out.
+	Wrap func(next http.Handler) http.Handler
+}
+
+// skip leaves the named middleware out of a route's chain.
+func skip(name string) Middleware {
+	return Middleware{Name: name}
+}
+
+// Chain is an ordered list of middleware. The first one sees requests
+// first and responses last.
+type Chain []Middleware
+
+// Then returns h wrapped in the middleware of c.
+func (c Chain) Then(h http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i].Wrap != nil {
+			h = c[i].Wrap(h)
+		}
+	}
+	return h
+}
+
+// Append returns c followed by m.
+func (c Chain) Append(m ...Middleware) Chain {
+	return append(slices.Clip(c), m...)
+}
+
+// Replace returns c with each middleware of overrides in place of the one
+// of the same name. Overrides without a counterpart in c are appended.
+func (c Chain) Replace(overrides ...Middleware) Chain {
+	c = slices.Clone(c)
+	for _, m := range overrides {
+		i := slices.IndexFunc(c, func(existing Middleware) bool { return existing.Name == m.Name })
+		if i < 0 {
+			c = append(c, m)
+			continue
+		}
+		c[i] = m
+	}
+	return c
+}
+
+// routes registers handlers on a router, each behind the chain with the
+// route's own overrides.
+type routes struct {
+	router *mux.Router
+	chain  Chain
+}
+
+func (rs routes) handle(method, path string, h http.HandlerFunc, overrides ...Middleware) {
+	rs.router.Handle(path, rs.chain.Replace(overrides...).Then(h)).Methods(method)
+}
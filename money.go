@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Cents is an exact money amount. Amounts are never parsed into floats,
+// which cannot represent most decimal fractions exactly.
+type Cents int64
+
+// maxCents is the largest amount accepted, 99,999,999,999.99. It leaves
+// room for the sums and the multiplications by rule multipliers that
+// amounts go through when receipts are scored.
+const maxCents Cents = 1e13 - 1
+
+// parseCents parses an amount with exactly two decimal places, such as
+// "35.35", as used by the API. Amounts above maxCents are refused.
+func parseCents(s string) (Cents, error) {
+	dollars, cents, ok := strings.Cut(s, ".")
+	if !ok || dollars == "" || len(cents) != 2 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	c, err := strconv.ParseUint(cents, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	// Leading zeros are fine, so the dollars are bounded by their value
+	// rather than their length.
+	d, err := strconv.ParseUint(dollars, 10, 64)
+	if errors.Is(err, strconv.ErrRange) || err == nil && d > uint64(maxCents/100) {
+		return 0, fmt.Errorf("amount %q is above %s", s, maxCents)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return Cents(d*100 + c), nil
+}
+
+// parseSignedCents is parseCents for amounts that may be negative, such as
+// refund lines.
+func parseSignedCents(s string) (Cents, error) {
+	if amount, ok := strings.CutPrefix(s, "-"); ok {
+		c, err := parseCents(amount)
+		return -c, err
+	}
+	return parseCents(s)
+}
+
+func (c Cents) String() string {
+	if c < 0 {
+		return "-" + (-c).String()
+	}
+	return fmt.Sprintf("%d.%02d", c/100, c%100)
+}
+
+// Set parses a flag value, letting amounts be configured on the command line.
+func (c *Cents) Set(s string) error {
+	v, err := parseCents(s)
+	if err != nil {
+		return err
+	}
+	*c = v
+	return nil
+}
+
+// itemsTotal sums the item prices of a validated receipt. Refund lines
+// count against it.
+func itemsTotal(receipt *Receipt) Cents {
+	var sum Cents
+	for _, item := range receipt.Items {
+		price, _ := parseSignedCents(item.Price)
+		sum += price
+	}
+	return sum
+}
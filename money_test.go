@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCents(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Cents
+		wantErr bool
+	}{
+		{in: "35.35", want: 3535},
+		{in: "0.00", want: 0},
+		{in: "0001.25", want: 125},
+		{in: "99999999999.99", want: maxCents},
+		{in: "000000000000000000000099999999999.99", want: maxCents},
+		{in: "100000000000.00", wantErr: true},
+		{in: "99999999999999999999.13", wantErr: true},
+		{in: "184467440737095516.15", wantErr: true},
+		{in: "35", wantErr: true},
+		{in: "35.3", wantErr: true},
+		{in: ".35", wantErr: true},
+		{in: "-1.00", wantErr: true},
+		{in: "1.0a", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCents(tt.in)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("parseCents(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCents(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateReceiptAmountLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		total      string
+		price      string
+		wantFields []string
+	}{
+		{name: "largest amounts", total: "99999999999.99", price: "99999999999.99"},
+		{name: "total too large", total: "99999999999999999999.13", price: "1.00", wantFields: []string{"total"}},
+		{name: "price too large", total: "1.00", price: "100000000000.00", wantFields: []string{"items[0].price"}},
+		{name: "refund too large", total: "1.00", price: "-100000000000.00", wantFields: []string{"items[0].price"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := Receipt{
+				Retailer:     "Target",
+				PurchaseDate: "2022-01-01",
+				PurchaseTime: "13:01",
+				Total:        tt.total,
+				Items:        []Item{{ShortDescription: "Mountain Dew 12PK", Price: tt.price}},
+			}
+			err := validateReceipt(&receipt, validationOptions{Refunds: true})
+			var got []string
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				for _, field := range verr.Fields {
+					got = append(got, field.Field)
+				}
+			} else if err != nil {
+				t.Fatalf("validateReceipt() error = %v", err)
+			}
+			if len(got) != len(tt.wantFields) || len(got) > 0 && got[0] != tt.wantFields[0] {
+				t.Errorf("validateReceipt() invalid fields = %v, want %v", got, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestScoreIgnoresUnparseableAmounts(t *testing.T) {
+	rules := DefaultRuleSet()
+	// Stored before amounts were limited.
+	receipt := Receipt{
+		Retailer:     "A",
+		PurchaseDate: "2022-01-02",
+		PurchaseTime: "13:01",
+		Total:        "99999999999999999999.00",
+		Items:        []Item{{ShortDescription: "abc", Price: "99999999999999999999.00"}},
+	}
+	breakdown := rules.Score(&receipt, time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC))
+	for _, rule := range breakdown.Rules {
+		switch rule.Rule {
+		case "round-total", "quarter-multiple-total", "item-description":
+			if rule.Points != 0 {
+				t.Errorf("rule %s awarded %d points for an unparseable amount", rule.Rule, rule.Points)
+			}
+		}
+	}
+	if breakdown.Points != 1 {
+		t.Errorf("Score() = %d points, want 1 for the retailer name", breakdown.Points)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// MessagePack, for the values encoding/json decodes into any. Maps are
+// encoded with their keys sorted.
+
+func appendMsgpack(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f)), nil
+	case string:
+		switch n := len(v); {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+		}
+		return append(b, v...), nil
+	case []any:
+		switch n := len(v); {
+		case n < 16:
+			b = append(b, 0x90|byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+		}
+		var err error
+		for _, elem := range v {
+			if b, err = appendMsgpack(b, elem); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		switch n := len(v); {
+		case n < 16:
+			b = append(b, 0x80|byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		var err error
+		for _, key := range keys {
+			if b, err = appendMsgpack(b, key); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgpack(b, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("can't encode %T as MessagePack", v)
+	}
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i < 128, i < 0 && i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(i))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+	}
+}
+
+var errMsgpackTruncated = errors.New("MessagePack data is truncated")
+
+// msgpackDecoder decodes MessagePack into the values encoding/json decodes
+// into any. Binary data becomes a string; extension types are refused.
+type msgpackDecoder struct {
+	data []byte
+}
+
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data) < n {
+		return nil, errMsgpackTruncated
+	}
+	p := d.data[:n]
+	d.data = d.data[n:]
+	return p, nil
+}
+
+// uint reads a big-endian unsigned integer of n bytes.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	p, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range p {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (any, error) {
+	if depth > maxFormatDepth {
+		return nil, errFormatTooDeep
+	}
+	p, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	c := p[0]
+	switch {
+	case c <= 0x7f:
+		return json.Number(strconv.Itoa(int(c))), nil
+	case c >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(c)))), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return d.object(int(c&0x0f), depth)
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (c - 0xcc))
+		return json.Number(strconv.FormatUint(u, 10)), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		width := 1 << (c - 0xd0)
+		u, err := d.uint(width)
+		// Sign-extend from the width read.
+		shift := 64 - 8*width
+		return json.Number(strconv.FormatInt(int64(u<<shift)>>shift, 10)), err
+	case 0xca:
+		u, err := d.uint(4)
+		return formatFloat(float64(math.Float32frombits(uint32(u)))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return formatFloat(math.Float64frombits(u)), err
+	case 0xd9, 0xc4:
+		n, err := d.uint(1)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xda, 0xc5:
+		n, err := d.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdb, 0xc6:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(int(n), depth)
+	}
+	return nil, fmt.Errorf("unsupported MessagePack type 0x%02x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (any, error) {
+	p, err := d.take(n)
+	return string(p), err
+}
+
+func (d *msgpackDecoder) array(n int, depth int) (any, error) {
+	// Each element takes at least a byte, which bounds what a forged
+	// length can make us allocate.
+	if n > len(d.data) {
+		return nil, errMsgpackTruncated
+	}
+	elems := make([]any, n)
+	for i := range elems {
+		var err error
+		if elems[i], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return elems, nil
+}
+
+func (d *msgpackDecoder) object(n int, depth int) (any, error) {
+	if n > len(d.data) {
+		return nil, errMsgpackTruncated
+	}
+	m := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := key.(string)
+		if !ok {
+			return nil, errors.New("MessagePack map keys must be strings")
+		}
+		if m[s], err = d.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func unmarshalMsgpack(data []byte) (any, error) {
+	d := &msgpackDecoder{data: data}
+	v, err := d.decode(0)
+	if err == nil && len(d.data) > 0 {
+		err = errors.New("MessagePack data continues after the value")
+	}
+	return v, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile holds the CAs that client certificates must chain to.
+	// Setting it requires every client to present a certificate.
+	ClientCAFile string
+	// ClientRole is granted to clients identified by their certificate.
+	ClientRole Role
+	// AutocertDomains are the domains to obtain certificates for from
+	// Let's Encrypt, instead of serving CertFile and KeyFile.
+	AutocertDomains  []string
+	AutocertCacheDir string
+	// AutocertEmail is given to Let's Encrypt to warn about expiring
+	// certificates.
+	AutocertEmail string
+	// RedirectAddr is a plain HTTP address redirecting to HTTPS. With
+	// autocert it also answers the ACME HTTP challenges.
+	RedirectAddr string
+}
+
+// certManager obtains certificates on demand, as autocert.Manager does.
+type certManager interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	// HTTPHandler answers ACME HTTP challenges and passes other requests
+	// to fallback.
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+// serverTLSConfig builds the TLS configuration for serving cfg, or returns
+// nil when TLS isn't enabled. certs supplies the certificates in autocert
+// mode.
+func serverTLSConfig(cfg TLSConfig, certs certManager) (*tls.Config, error) {
+	autocert := len(cfg.AutocertDomains) > 0
+	if cfg.CertFile == "" && cfg.KeyFile == "" && !autocert {
+		if cfg.ClientCAFile != "" {
+			return nil, errors.New("client certificates need TLS; set the certificate and key too")
+		}
+		if cfg.RedirectAddr != "" {
+			return nil, errors.New("redirecting to HTTPS needs TLS; set the certificate and key too")
+		}
+		return nil, nil
+	}
+	if autocert && (cfg.CertFile != "" || cfg.KeyFile != "") {
+		return nil, errors.New("use either a certificate and key or autocert, not both")
+	}
+	if !autocert && (cfg.CertFile == "" || cfg.KeyFile == "") {
+		return nil, errors.New("TLS needs both a certificate and a key")
+	}
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if autocert {
+		tlsCfg.GetCertificate = certs.GetCertificate
+		// acme-tls/1 lets Let's Encrypt validate the domains over this
+		// listener when there is no plain HTTP one.
+		tlsCfg.NextProtos = []string{"h2", "http/1.1", "acme-tls/1"}
+	}
+	if cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// ClientCertAuthenticator identifies callers by the verified certificate
+// they presented during the TLS handshake.
+type ClientCertAuthenticator struct {
+	role Role
+}
+
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	identity := certificateIdentity(r.TLS.VerifiedChains[0][0])
+	if identity == "" {
+		return nil, errUnauthenticated
+	}
+	return &Principal{ID: identity, Name: identity, Roles: []Role{a.role}}, nil
+}
+
+// certificateIdentity names the client a certificate was issued to. SANs
+// are preferred over the common name, which is deprecated for naming
+// hosts but still how many internal CAs name clients.
+func certificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	default:
+		return cert.Subject.CommonName
+	}
+}
+
+// EnableClientCerts identifies callers by their client certificates. It
+// is meant to be enabled after the other authenticators, so credentials
+// sent with a request take precedence over the connection's certificate.
+func (s *Server) EnableClientCerts(role Role) {
+	s.authenticators = append(s.authenticators, &ClientCertAuthenticator{role: role})
+}
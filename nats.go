@@ -0,0 +1,174 @@
+//go:build nats
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Headers of the messages published to the dead-letter subject.
+const (
+	natsSubjectHeader = "Receipt-Subject"
+	natsErrorHeader   = "Receipt-Error"
+)
+
+// natsListener consumes receipts from the JetStream stream capturing
+// cfg.Subject with the durable consumer cfg.Durable. Messages are acked
+// explicitly once their result is published to cfg.ResultSubject.
+// Messages that aren't valid receipts go to cfg.DeadLetterSubject, or are
+// terminated without one.
+func natsListener(cfg NATSConfig, s *Server) (listener, error) {
+	nc, err := nats.Connect(cfg.URL, nats.Name("receipt-processor"))
+	if err != nil {
+		return listener{}, fmt.Errorf("connect to NATS: %w", err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return listener{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := js.StreamNameBySubject(ctx, cfg.Subject)
+	if err != nil {
+		nc.Close()
+		return listener{}, fmt.Errorf("find the stream of %s: %w", cfg.Subject, err)
+	}
+	consumer, err := js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+		Durable:       cfg.Durable,
+		FilterSubject: cfg.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		nc.Close()
+		return listener{}, fmt.Errorf("create consumer %s: %w", cfg.Durable, err)
+	}
+	messages, err := consumer.Messages()
+	if err != nil {
+		nc.Close()
+		return listener{}, err
+	}
+
+	src := &natsSource{cfg: cfg, nc: nc, js: js, messages: messages}
+	return ingestListener("NATS consumer of "+cfg.Subject+" on "+cfg.URL, src, cfg.Tenant, s), nil
+}
+
+type natsSource struct {
+	cfg      NATSConfig
+	nc       *nats.Conn
+	js       jetstream.JetStream
+	messages jetstream.MessagesContext
+}
+
+func (n *natsSource) Receive(ctx context.Context) (SourceMessage, error) {
+	// Stopping the iterator is the only way to interrupt it.
+	defer context.AfterFunc(ctx, n.messages.Stop)()
+	msg, err := n.messages.Next()
+	if err != nil {
+		if errors.Is(err, jetstream.ErrMsgIteratorClosed) && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return &natsMessage{source: n, msg: msg}, nil
+}
+
+func (n *natsSource) Close() error {
+	n.messages.Stop()
+	return n.nc.Drain()
+}
+
+type natsMessage struct {
+	source *natsSource
+	msg    jetstream.Msg
+}
+
+func (m *natsMessage) ID() string {
+	if meta, err := m.msg.Metadata(); err == nil {
+		return fmt.Sprintf("%s/%d", meta.Stream, meta.Sequence.Stream)
+	}
+	return m.msg.Subject()
+}
+
+func (m *natsMessage) Data() []byte { return m.msg.Data() }
+
+// Ack publishes the result, if there's a subject for results, and acks
+// the message. When publishing fails the message is nakked instead.
+func (m *natsMessage) Ack(ctx context.Context, result BatchResult) error {
+	if subject := m.source.cfg.ResultSubject; subject != "" {
+		data, _ := json.Marshal(IngestResult{MessageID: m.ID(), BatchResult: result})
+		if _, err := m.source.js.Publish(ctx, subject, data); err != nil {
+			// The receipt is stored, so a redelivery gets the same result
+			// when deduplication is on.
+			slog.Error("Failed to publish the result of a receipt from NATS", "message", m.ID(), "err", err)
+			return m.msg.Nak()
+		}
+	}
+	return m.msg.DoubleAck(ctx)
+}
+
+// Reject publishes the message to the dead-letter subject and acks it, or
+// terminates it without a dead-letter subject. When publishing fails the
+// message is nakked instead.
+func (m *natsMessage) Reject(ctx context.Context, result BatchResult) error {
+	subject := m.source.cfg.DeadLetterSubject
+	if subject == "" {
+		return m.msg.Term()
+	}
+	dead := nats.NewMsg(subject)
+	dead.Data = m.msg.Data()
+	dead.Header.Set(natsSubjectHeader, m.msg.Subject())
+	dead.Header.Set(natsErrorHeader, result.Error)
+	if _, err := m.source.js.PublishMsg(ctx, dead); err != nil {
+		slog.Error("Failed to dead-letter a receipt from NATS", "message", m.ID(), "err", err)
+		return m.msg.Nak()
+	}
+	return m.msg.DoubleAck(ctx)
+}
+
+func (m *natsMessage) Nack() { m.msg.Nak() }
+
+// natsOutboxPublisher publishes events to cfg.Topic with JetStream. Each
+// carries its ID as the Nats-Msg-Id header, so that the stream drops the
+// duplicates of events published again within its duplicate window.
+func natsOutboxPublisher(cfg OutboxConfig) (OutboxPublisher, error) {
+	nc, err := nats.Connect(cfg.Addr, nats.Name("receipt-processor"))
+	if err != nil {
+		return nil, fmt.Errorf("connect to NATS: %w", err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &natsPublisher{nc: nc, js: js, subject: cfg.Topic}, nil
+}
+
+type natsPublisher struct {
+	nc      *nats.Conn
+	js      jetstream.JetStream
+	subject string
+}
+
+func (n *natsPublisher) Publish(ctx context.Context, events []OutboxEvent) error {
+	for _, event := range events {
+		data, err := encodeOutboxEvent(event)
+		if err != nil {
+			return err
+		}
+		if _, err := n.js.Publish(ctx, n.subject, data, jetstream.WithMsgID(event.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *natsPublisher) Close() error { return n.nc.Drain() }
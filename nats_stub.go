@@ -0,0 +1,13 @@
+//go:build !nats
+
+package main
+
+import "errors"
+
+func natsListener(cfg NATSConfig, s *Server) (listener, error) {
+	return listener{}, errors.New("NATS is not compiled in; rebuild with -tags nats")
+}
+
+func natsOutboxPublisher(cfg OutboxConfig) (OutboxPublisher, error) {
+	return nil, errors.New("NATS is not compiled in; rebuild with -tags nats")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectStore is a bucket of an object store such as S3 or GCS, with
+// slash-separated keys.
+type ObjectStore interface {
+	// List returns the keys starting with prefix, in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Delete removes key. Removing a key that doesn't exist isn't an
+	// error.
+	Delete(ctx context.Context, key string) error
+	Close() error
+}
+
+// openObjectStore opens the bucket of an s3://bucket/prefix,
+// gs://bucket/prefix or file:///prefix URL and returns it with the prefix.
+// File URLs are paths under dir, and are refused without one.
+func openObjectStore(ctx context.Context, rawURL, dir string) (ObjectStore, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" {
+		return nil, "", errors.New("the source must be a URL such as s3://bucket/prefix/")
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "s3", "gs":
+		if u.Host == "" {
+			return nil, "", fmt.Errorf("%s URLs must name a bucket", u.Scheme)
+		}
+		var bucket ObjectStore
+		if u.Scheme == "s3" {
+			bucket, err = s3Bucket(ctx, u.Host)
+		} else {
+			bucket, err = gcsBucket(ctx, u.Host)
+		}
+		return bucket, prefix, err
+	case "file":
+		if dir == "" {
+			return nil, "", errors.New("file URLs need -import-dir")
+		}
+		if u.Host != "" {
+			return nil, "", errors.New("file URLs are paths under -import-dir, such as file:///2024-06/")
+		}
+		if prefix != "" && !filepath.IsLocal(filepath.FromSlash(prefix)) {
+			return nil, "", errors.New("file URLs can't leave -import-dir")
+		}
+		return dirBucket{root: dir}, prefix, nil
+	}
+	return nil, "", fmt.Errorf("unknown scheme %q: use s3, gs or file", u.Scheme)
+}
+
+// openLocation opens a local directory, created if need be, or the bucket
+// of an s3://bucket/prefix or gs://bucket/prefix URL, for the server to
+// write to. It returns the bucket with the prefix.
+func openLocation(location string) (ObjectStore, string, error) {
+	if dir, isFile := strings.CutPrefix(location, "file://"); isFile || !strings.Contains(location, "://") {
+		if !isFile {
+			dir = location
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, "", err
+		}
+		return dirBucket{root: dir}, "", nil
+	}
+	return openObjectStore(context.Background(), location, "")
+}
+
+// dirBucket is an ObjectStore of the files under a local directory.
+type dirBucket struct {
+	root string
+}
+
+// path returns the file of key, which can't be outside the directory.
+func (d dirBucket) path(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%q is outside the directory", key)
+	}
+	return filepath.Join(d.root, name), nil
+}
+
+func (d dirBucket) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (d dirBucket) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (d dirBucket) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (d dirBucket) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d dirBucket) Close() error { return nil }
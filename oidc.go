@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL; its discovery document names the
+	// JWKS.
+	Issuer string
+	// ClientID is the audience of the ID and access tokens we accept.
+	ClientID string
+	// RolesClaim names the claim listing the user's roles. Dots reach into
+	// nested objects, as in "realm_access.roles".
+	RolesClaim string
+	// AdminRole is the provider's name for the admin role, which lets a
+	// user see every receipt and use the admin endpoints. The reader and
+	// submitter roles are recognized by their own names.
+	AdminRole string
+	// DefaultRole is granted to every user on top of the roles in their
+	// token.
+	DefaultRole Role
+}
+
+// OIDCAuthenticator accepts bearer tokens an OpenID Connect provider issued
+// to users of the client. Users have the roles their token lists and only
+// see the receipts they submitted, unless they have the admin role.
+type OIDCAuthenticator struct {
+	cfg OIDCConfig
+	jwt *JWTAuthenticator
+}
+
+func NewOIDCAuthenticator(cfg OIDCConfig) (*OIDCAuthenticator, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("OIDC authentication needs an issuer and a client ID")
+	}
+	discovery, err := discoverOIDC(cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	jwt, err := NewJWTAuthenticator(JWTConfig{
+		Issuer:   discovery.Issuer,
+		Audience: cfg.ClientID,
+		JWKSURL:  discovery.JWKSURI,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCAuthenticator{cfg: cfg, jwt: jwt}, nil
+}
+
+type oidcDiscovery struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// discoverOIDC fetches the provider's configuration from its well-known
+// location.
+func discoverOIDC(issuer string) (oidcDiscovery, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return oidcDiscovery{}, fmt.Errorf("fetch OIDC discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return oidcDiscovery{}, fmt.Errorf("fetch OIDC discovery document: %s", resp.Status)
+	}
+
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&discovery); err != nil {
+		return oidcDiscovery{}, fmt.Errorf("parse OIDC discovery document: %w", err)
+	}
+	// The spec requires the document to name the issuer it was fetched
+	// for, so a misconfigured provider can't vouch for another.
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return oidcDiscovery{}, fmt.Errorf("OIDC discovery document is for issuer %q", discovery.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return oidcDiscovery{}, errors.New("OIDC discovery document has no jwks_uri")
+	}
+	return discovery, nil
+}
+
+func (a *OIDCAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !a.jwt.addressedTo(strings.TrimSpace(token)) {
+		return nil, nil
+	}
+	claims, err := a.jwt.verify(strings.TrimSpace(token), time.Now())
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+
+	principal := &Principal{
+		ID:              claims.Subject,
+		Name:            claims.Subject,
+		OwnReceiptsOnly: true,
+	}
+	if a.cfg.DefaultRole != "" {
+		principal.Roles = append(principal.Roles, a.cfg.DefaultRole)
+	}
+	for _, name := range []string{"preferred_username", "email"} {
+		var value string
+		if json.Unmarshal(claims.raw[name], &value) == nil && value != "" {
+			principal.Name = value
+			break
+		}
+	}
+	for _, name := range claimStrings(claims.raw, a.cfg.RolesClaim) {
+		switch {
+		case a.cfg.AdminRole != "" && name == a.cfg.AdminRole:
+			principal.Roles = append(principal.Roles, RoleAdmin)
+		case Role(name) == RoleReader || Role(name) == RoleSubmitter:
+			principal.Roles = append(principal.Roles, Role(name))
+		}
+	}
+	return principal, nil
+}
+
+// EnableOIDC accepts user tokens checked by a.
+func (s *Server) EnableOIDC(a *OIDCAuthenticator) {
+	s.authenticators = append(s.authenticators, a)
+}
@@ -0,0 +1,9 @@
+//go:build !otel
+
+package main
+
+import "errors"
+
+func newTracer(cfg TracingConfig) (Tracer, error) {
+	return nil, errors.New("tracing is not compiled in; rebuild with -tags otel")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// OutboxEvent is an event recorded in the outbox when a receipt is stored,
+// to be published to a message broker by the OutboxRelay.
+type OutboxEvent struct {
+	// Seq orders the events of the outbox. The store assigns it.
+	Seq int64 `json:"-"`
+	// ID identifies the event, so that consumers can skip the duplicates
+	// at-least-once delivery brings.
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	Tenant    string       `json:"tenant,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Data      ReceiptEvent `json:"data"`
+}
+
+// OutboxStore is a Store with an outbox: events recorded in the same
+// transaction as the receipts they're about, so that a crash can't store
+// one without the other.
+type OutboxStore interface {
+	// PutWithEvent stores a receipt like Put does and adds event to the
+	// outbox along with it.
+	PutWithEvent(record ReceiptRecord, event OutboxEvent) error
+	// OutboxEvents returns up to limit events, oldest first.
+	OutboxEvents(limit int) ([]OutboxEvent, error)
+	// DeleteOutboxEvents removes the events up to and including seq.
+	DeleteOutboxEvents(seq int64) error
+}
+
+// errNoOutbox is returned by the outbox methods of store wrappers whose
+// store has no outbox.
+var errNoOutbox = errors.New("the store has no outbox")
+
+// outboxOf returns the outbox of store, which wrappers of stores use rather
+// than assume the store they wrap has one.
+func outboxOf(store Store) (OutboxStore, error) {
+	outbox, ok := store.(OutboxStore)
+	if !ok {
+		return nil, errNoOutbox
+	}
+	return outbox, nil
+}
+
+// OutboxPublisher publishes the events of the outbox to a message broker.
+type OutboxPublisher interface {
+	// Publish returns once the broker has all of events, in order.
+	Publish(ctx context.Context, events []OutboxEvent) error
+	Close() error
+}
+
+type OutboxConfig struct {
+	// Broker is the kind of broker events are published to: kafka or nats.
+	Broker string
+	// Addr is the comma-separated Kafka brokers or the NATS URL.
+	Addr string
+	// Topic is the Kafka topic or NATS subject events are published to.
+	Topic string
+	// Interval is how often the outbox is checked for events that weren't
+	// published right away.
+	Interval time.Duration
+}
+
+const (
+	// outboxBatchSize is how many events are published at once.
+	outboxBatchSize = 100
+	// outboxRetryWait bounds how long the relay waits before retrying a
+	// failed publish.
+	outboxRetryWait = time.Minute
+)
+
+// outboxEvents counts the events of the outbox that were published.
+var outboxEvents = expvar.NewMap("outboxEvents")
+
+// outboxPublisher connects to the broker of cfg.
+func outboxPublisher(cfg OutboxConfig) (OutboxPublisher, error) {
+	switch cfg.Broker {
+	case "kafka":
+		return kafkaOutboxPublisher(cfg)
+	case "nats":
+		return natsOutboxPublisher(cfg)
+	}
+	return nil, fmt.Errorf("unknown outbox broker %q: want kafka or nats", cfg.Broker)
+}
+
+// OutboxRelay publishes the events of an outbox in order and deletes them
+// once they are, so that every event is published at least once, even if
+// the service crashes in between.
+type OutboxRelay struct {
+	store     OutboxStore
+	publisher OutboxPublisher
+	interval  time.Duration
+	// wake is signaled when an event was added.
+	wake chan struct{}
+}
+
+func NewOutboxRelay(store OutboxStore, publisher OutboxPublisher, interval time.Duration) *OutboxRelay {
+	return &OutboxRelay{
+		store:     store,
+		publisher: publisher,
+		interval:  interval,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Notify tells the relay an event was added. It never waits.
+func (o *OutboxRelay) Notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// relay publishes events until ctx is done.
+func (o *OutboxRelay) relay(ctx context.Context) {
+	wait := time.Second
+	for {
+		published, err := o.publish(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		var next time.Duration
+		switch {
+		case err != nil:
+			slog.Error("Failed to publish the events of the outbox, retrying", "err", err, "in", wait.String())
+			next = wait
+			wait = min(2*wait, outboxRetryWait)
+		case published == outboxBatchSize:
+			// There may be more.
+			wait = time.Second
+			continue
+		default:
+			wait = time.Second
+			next = o.interval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-time.After(next):
+		}
+	}
+}
+
+// publish publishes a batch of events and returns how many there were.
+func (o *OutboxRelay) publish(ctx context.Context) (int, error) {
+	events, err := o.store.OutboxEvents(outboxBatchSize)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	if err := o.publisher.Publish(ctx, events); err != nil {
+		return 0, err
+	}
+	outboxEvents.Add("published", int64(len(events)))
+	// Failing to delete them only publishes them again.
+	if err := o.store.DeleteOutboxEvents(events[len(events)-1].Seq); err != nil {
+		return 0, fmt.Errorf("delete published events: %w", err)
+	}
+	return len(events), nil
+}
+
+// relayListener runs the relay alongside the service's other listeners.
+func (o *OutboxRelay) relayListener(name string) listener {
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	return listener{
+		name: name,
+		serve: func() error {
+			defer close(done)
+			o.relay(ctx)
+			return nil
+		},
+		shutdown: func(shutdownCtx context.Context) error {
+			stop()
+			var err error
+			select {
+			case <-done:
+			case <-shutdownCtx.Done():
+				err = shutdownCtx.Err()
+			}
+			return errors.Join(err, o.publisher.Close())
+		},
+	}
+}
+
+// EnableOutbox records an event in the outbox of the store for each
+// receipt processed, and returns the listener relaying them to publisher.
+func (s *Server) EnableOutbox(publisher OutboxPublisher, cfg OutboxConfig) (listener, error) {
+	// The caches' wrappers have the outbox's methods whether their store
+	// has an outbox or not.
+	if _, ok := unwrapStore(s.store).(OutboxStore); !ok {
+		return listener{}, errors.New("the store has no outbox; use the memory, sqlite or postgres store")
+	}
+	store := s.store.(OutboxStore)
+	s.outbox = NewOutboxRelay(store, publisher, cfg.Interval)
+	return s.outbox.relayListener(fmt.Sprintf("outbox relay to %s %s", cfg.Broker, cfg.Topic)), nil
+}
+
+// newOutboxEvent is the event recorded when record is stored for tenant.
+func (s *Server) newOutboxEvent(record ReceiptRecord, tenant string) OutboxEvent {
+	return OutboxEvent{
+		ID:        s.ids.NewID(),
+		Type:      "receipt.processed",
+		Tenant:    tenant,
+		CreatedAt: s.clock.Now().UTC(),
+		Data:      newReceiptEvent(record, tenant),
+	}
+}
+
+// encodeOutboxEvent is how events are kept in outboxes and published.
+func encodeOutboxEvent(event OutboxEvent) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func decodeOutboxEvent(seq int64, data []byte) (OutboxEvent, error) {
+	var event OutboxEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return OutboxEvent{}, fmt.Errorf("decode outbox event %d: %w", seq, err)
+	}
+	event.Seq = seq
+	return event, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// storeWithoutOutbox hides the outbox of the store it wraps, as the redis
+// and bolt stores have none.
+type storeWithoutOutbox struct {
+	Store
+}
+
+type discardPublisher struct{}
+
+func (discardPublisher) Publish(context.Context, []OutboxEvent) error { return nil }
+func (discardPublisher) Close() error                                 { return nil }
+
+func TestEnableOutboxBehindCaches(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   Store
+		wantErr bool
+	}{
+		{"store with an outbox", NewMemoryStore(), false},
+		{"store without an outbox", storeWithoutOutbox{NewMemoryStore()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(tt.store, nil, systemClock{}, uuidGenerator{}, ServerConfig{})
+			s.EnablePointsCache(10)
+			s.EnableResponseCache(10, time.Minute)
+
+			_, err := s.EnableOutbox(discardPublisher{}, OutboxConfig{Interval: time.Second})
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("EnableOutbox() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			record := ReceiptRecord{ID: "r1", Points: 5}
+			if err := s.store.(OutboxStore).PutWithEvent(record, OutboxEvent{ID: "e1"}); err != nil {
+				t.Fatalf("PutWithEvent() error = %v", err)
+			}
+			events, err := s.outbox.store.OutboxEvents(10)
+			if err != nil || len(events) != 1 {
+				t.Fatalf("OutboxEvents() = %v, %v, want 1 event", events, err)
+			}
+		})
+	}
+}
+
+func TestWrappersOfStoresWithoutOutbox(t *testing.T) {
+	var wrapped Store = storeWithoutOutbox{NewMemoryStore()}
+	wrapped = invalidatingStore{Store: wrapped, invalidate: func(string) {}}
+	wrappers := map[string]OutboxStore{
+		"invalidatingStore": wrapped.(OutboxStore),
+		"tenantStore":       tenantStore{store: wrapped, tenant: "acme"},
+	}
+	for name, store := range wrappers {
+		if err := store.PutWithEvent(ReceiptRecord{ID: "r1"}, OutboxEvent{}); !errors.Is(err, errNoOutbox) {
+			t.Errorf("%s: PutWithEvent() error = %v, want %v", name, err, errNoOutbox)
+		}
+		if _, err := store.OutboxEvents(1); !errors.Is(err, errNoOutbox) {
+			t.Errorf("%s: OutboxEvents() error = %v, want %v", name, err, errNoOutbox)
+		}
+		if err := store.DeleteOutboxEvents(1); !errors.Is(err, errNoOutbox) {
+			t.Errorf("%s: DeleteOutboxEvents() error = %v, want %v", name, err, errNoOutbox)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build parquet
+
+package main
+
+import (
+	"io"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// newParquetWriter writes rows of T to w as a Zstandard-compressed Parquet
+// file, with the columns of T's parquet struct tags.
+func newParquetWriter[T any](w io.Writer) (parquetWriter[T], error) {
+	return parquet.NewGenericWriter[T](w, parquet.Compression(&parquet.Zstd)), nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// parquetWriter writes the rows of a Parquet file; the file is complete
+// once it is closed.
+type parquetWriter[T any] interface {
+	Write(rows []T) (int, error)
+	Close() error
+}
+
+// ParquetReceipt is a row of receipts.parquet. Receipts of every tenant
+// are exported, with their plain IDs.
+type ParquetReceipt struct {
+	Tenant            string `parquet:"tenant"`
+	ID                string `parquet:"id"`
+	Retailer          string `parquet:"retailer"`
+	CanonicalRetailer string `parquet:"canonical_retailer"`
+	UserID            string `parquet:"user_id"`
+	Owner             string `parquet:"owner"`
+	// PurchaseDate counts days since 1970-01-01, as Parquet dates do.
+	PurchaseDate int32     `parquet:"purchase_date,date"`
+	PurchaseTime string    `parquet:"purchase_time"`
+	TotalCents   int64     `parquet:"total_cents"`
+	Items        int32     `parquet:"items"`
+	Points       int64     `parquet:"points"`
+	RulesVersion string    `parquet:"rules_version"`
+	ProcessedAt  time.Time `parquet:"processed_at,timestamp"`
+	Flagged      bool      `parquet:"flagged"`
+	Expired      bool      `parquet:"expired"`
+	Source       string    `parquet:"source"`
+}
+
+// ParquetRulePoints is a row of receipt_rules.parquet: the points one rule
+// awarded a receipt, as GET /receipts/{id}/points/breakdown reports them.
+type ParquetRulePoints struct {
+	Tenant       string `parquet:"tenant"`
+	ReceiptID    string `parquet:"receipt_id"`
+	RulesVersion string `parquet:"rules_version"`
+	Rule         string `parquet:"rule"`
+	Points       int64  `parquet:"points"`
+}
+
+func newParquetReceipt(record ReceiptRecord) ParquetReceipt {
+	tenant := tenantOfID(record.ID)
+	row := ParquetReceipt{
+		Tenant:            tenant,
+		ID:                strings.TrimPrefix(record.ID, tenant+tenantSeparator),
+		Retailer:          record.Receipt.Retailer,
+		CanonicalRetailer: record.Retailer,
+		UserID:            record.Receipt.UserID,
+		Owner:             record.Owner,
+		PurchaseTime:      record.Receipt.PurchaseTime,
+		Items:             int32(len(record.Receipt.Items)),
+		Points:            int64(record.Points),
+		RulesVersion:      record.RulesVersion,
+		ProcessedAt:       record.ProcessedAt,
+		Flagged:           len(record.Flags) > 0,
+		Expired:           record.ExpiredAt != nil,
+		Source:            record.Source,
+	}
+	// Stored receipts were validated, so both parse.
+	if date, err := time.Parse("2006-01-02", record.Receipt.PurchaseDate); err == nil {
+		row.PurchaseDate = int32(date.Unix() / (24 * 60 * 60))
+	}
+	if total, err := parseCents(record.Receipt.Total); err == nil {
+		row.TotalCents = int64(total)
+	}
+	return row
+}
+
+// ParquetExportRun writes every stored receipt, and the points each rule
+// awarded it, as Parquet files under a directory of its own.
+type ParquetExportRun struct {
+	ID     string    `json:"id"`
+	Status JobStatus `json:"status"`
+	// Files are the keys of the files written, under the export location.
+	Files       []string   `json:"files"`
+	Receipts    int        `json:"receipts"`
+	RuleRows    int        `json:"ruleRows"`
+	StartedAt   time.Time  `json:"startedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+var errParquetExportRunning = errors.New("a Parquet export is already running")
+
+// ParquetExport writes Parquet exports to a local directory or an object
+// store, for data warehouses to load.
+type ParquetExport struct {
+	bucket ObjectStore
+	prefix string
+
+	mu      sync.Mutex
+	runs    map[string]*ParquetExportRun
+	running bool
+}
+
+// OpenParquetExport opens a local directory, or the bucket of an
+// s3://bucket/prefix or gs://bucket/prefix URL, to export to.
+func OpenParquetExport(location string) (*ParquetExport, error) {
+	// Fail at startup rather than at the first export when Parquet isn't
+	// compiled in.
+	if _, err := newParquetWriter[ParquetReceipt](io.Discard); err != nil {
+		return nil, err
+	}
+	bucket, prefix, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	return &ParquetExport{bucket: bucket, prefix: prefix, runs: make(map[string]*ParquetExportRun)}, nil
+}
+
+func (e *ParquetExport) Close() error { return e.bucket.Close() }
+
+// EnableParquetExport exports receipts as Parquet to export on demand and,
+// if interval is positive, every interval.
+func (s *Server) EnableParquetExport(export *ParquetExport, interval time.Duration) {
+	s.parquet = export
+	if interval > 0 {
+		go s.exportParquetEvery(interval)
+	}
+}
+
+func (s *Server) exportParquetEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		run, err := s.startParquetExport()
+		if err != nil {
+			slog.Warn("Skipped a scheduled Parquet export", "err", err)
+			continue
+		}
+		slog.Info("Started a scheduled Parquet export", "run", run.ID)
+	}
+}
+
+// startParquetExport starts an export in the background. Only one export
+// can run at a time.
+func (s *Server) startParquetExport() (*ParquetExportRun, error) {
+	run := &ParquetExportRun{
+		ID:        s.ids.NewID(),
+		Status:    JobRunning,
+		Files:     []string{},
+		StartedAt: s.clock.Now().UTC(),
+	}
+
+	s.parquet.mu.Lock()
+	defer s.parquet.mu.Unlock()
+	if s.parquet.running {
+		return nil, errParquetExportRunning
+	}
+	s.parquet.running = true
+	s.parquet.runs[run.ID] = run
+	go s.exportParquet(run)
+	return run, nil
+}
+
+// StartParquetExportHandler starts a Parquet export and responds with 202
+// Accepted and the run to poll.
+func (s *Server) StartParquetExportHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	run, err := s.startParquetExport()
+	if err != nil {
+		http.Error(w, "A Parquet export is already running", http.StatusConflict)
+		return
+	}
+
+	audit(r, "action=parquet-export run=%s", run.ID)
+	response := map[string]string{"id": run.ID}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/exports/parquet/"+run.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) GetParquetExportHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	s.parquet.mu.Lock()
+	run, found := s.parquet.runs[id]
+	var response ParquetExportRun
+	if found {
+		response = *run
+	}
+	s.parquet.mu.Unlock()
+
+	if !found {
+		http.Error(w, "No Parquet export found for that id", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// exportParquet writes receipts.parquet and receipt_rules.parquet under
+// the run's ID. The files are built in memory, compressed, before they're
+// stored, since objects are stored whole.
+func (s *Server) exportParquet(run *ParquetExportRun) {
+	ctx := context.Background()
+	files, err := s.writeParquetFiles(ctx, run)
+	if err != nil {
+		slog.Error("Failed to export receipts as Parquet", "run", run.ID, "err", err)
+	}
+
+	now := s.clock.Now().UTC()
+	s.parquet.mu.Lock()
+	defer s.parquet.mu.Unlock()
+	run.Status = JobCompleted
+	run.CompletedAt = &now
+	run.Files = append(run.Files, files...)
+	if err != nil {
+		run.Error = err.Error()
+	}
+	s.parquet.running = false
+}
+
+func (s *Server) writeParquetFiles(ctx context.Context, run *ParquetExportRun) ([]string, error) {
+	var receiptsFile, rulesFile bytes.Buffer
+	receipts, err := newParquetWriter[ParquetReceipt](&receiptsFile)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := newParquetWriter[ParquetRulePoints](&rulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var writeErr error
+	err = s.forEachReceipt(func(record ReceiptRecord) {
+		if writeErr != nil {
+			return
+		}
+		row := newParquetReceipt(record)
+		ruleSet, found := s.rules.Version(record.RulesVersion)
+		if !found {
+			ruleSet = s.rules.Current()
+		}
+		breakdown := ruleSet.Score(&record.Receipt, record.ProcessedAt)
+		ruleRows := make([]ParquetRulePoints, len(breakdown.Rules))
+		for i, rule := range breakdown.Rules {
+			ruleRows[i] = ParquetRulePoints{
+				Tenant:       row.Tenant,
+				ReceiptID:    row.ID,
+				RulesVersion: breakdown.RulesVersion,
+				Rule:         rule.Rule,
+				Points:       int64(rule.Points),
+			}
+		}
+
+		if _, writeErr = receipts.Write([]ParquetReceipt{row}); writeErr != nil {
+			return
+		}
+		if _, writeErr = rules.Write(ruleRows); writeErr != nil {
+			return
+		}
+		s.parquet.mu.Lock()
+		run.Receipts++
+		run.RuleRows += len(ruleRows)
+		s.parquet.mu.Unlock()
+	})
+	if err = errors.Join(err, writeErr, receipts.Close(), rules.Close()); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"receipts.parquet", receiptsFile.Bytes()},
+		{"receipt_rules.parquet", rulesFile.Bytes()},
+	} {
+		key := s.parquet.prefix + run.ID + "/" + file.name
+		if err := s.parquet.bucket.Put(ctx, key, file.data, "application/vnd.apache.parquet"); err != nil {
+			return files, fmt.Errorf("store %s: %w", key, err)
+		}
+		files = append(files, key)
+	}
+	return files, nil
+}
@@ -0,0 +1,12 @@
+//go:build !parquet
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func newParquetWriter[T any](w io.Writer) (parquetWriter[T], error) {
+	return nil, errors.New("Parquet is not compiled in; rebuild with -tags parquet")
+}
@@ -0,0 +1,43 @@
+//go:build pdf
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// pdfText extracts the text of a PDF, a line per row of text.
+func pdfText(data []byte) (text string, err error) {
+	// The reader panics on some malformed PDFs.
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("malformed PDF: %v", v)
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		rows, err := page.GetTextByRow()
+		if err != nil {
+			return "", fmt.Errorf("page %d: %w", i, err)
+		}
+		for _, row := range rows {
+			for _, word := range row.Content {
+				b.WriteString(word.S)
+			}
+			b.WriteByte('\n')
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,9 @@
+//go:build !pdf
+
+package main
+
+import "errors"
+
+func pdfText(data []byte) (string, error) {
+	return "", errors.New("PDF is not compiled in; rebuild with -tags pdf")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// scoringPlugin awards bonus points computed outside the service, such as
+// by a WASM module from the plugins directory.
+type scoringPlugin interface {
+	Name() string
+	// Digest identifies the plugin's code, so that rule set versions change
+	// when a plugin does.
+	Digest() string
+	// Score receives the receipt as JSON and returns the bonus points.
+	Score(receipt []byte) (int, error)
+}
+
+// withPlugins adds the plugins to the rule set, after the custom rules.
+// The plugins are folded into the version, which becomes
+// "<version>+<plugins digest>".
+func (rs *RuleSet) withPlugins(plugins []scoringPlugin) {
+	// Only the loaded plugins count, whatever the rules file says.
+	rs.Plugins = nil
+	if len(plugins) == 0 {
+		return
+	}
+	h := sha256.New()
+	for _, plugin := range plugins {
+		rs.Plugins = append(rs.Plugins, plugin.Name())
+		h.Write([]byte(plugin.Digest()))
+	}
+	rs.plugins = plugins
+	rs.Version += "+" + hex.EncodeToString(h.Sum(nil)[:4])
+}
@@ -0,0 +1,128 @@
+//go:build wasm
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wasmPlugin runs a scoring plugin compiled to WASM. The module must
+// export its memory and two functions:
+//
+//	alloc(size i32) i32         reserve size bytes and return their offset
+//	score(ptr i32, len i32) i32 score the receipt JSON at ptr
+//
+// and may export free(ptr i32, size i32) to release the receipt afterwards.
+// WASI is available to plugins built with TinyGo or Rust's wasm32-wasi
+// target.
+type wasmPlugin struct {
+	name   string
+	digest string
+
+	// mu serializes calls, as a module instance isn't safe for concurrent
+	// use.
+	mu     sync.Mutex
+	module api.Module
+	alloc  api.Function
+	score  api.Function
+	free   api.Function
+}
+
+// loadPlugins compiles and instantiates every .wasm file in dir, in name
+// order.
+func loadPlugins(dir string) ([]scoringPlugin, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.wasm"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	var plugins []scoringPlugin
+	for _, path := range paths {
+		plugin, err := loadWASMPlugin(ctx, runtime, path)
+		if err != nil {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("load plugin %s: %w", path, err)
+		}
+		plugins = append(plugins, plugin)
+	}
+	return plugins, nil
+}
+
+func loadWASMPlugin(ctx context.Context, runtime wazero.Runtime, path string) (*wasmPlugin, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), ".wasm")
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	module, err := runtime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName(name))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(code)
+	plugin := &wasmPlugin{
+		name:   name,
+		digest: hex.EncodeToString(sum[:]),
+		module: module,
+		alloc:  module.ExportedFunction("alloc"),
+		score:  module.ExportedFunction("score"),
+		free:   module.ExportedFunction("free"),
+	}
+	if plugin.alloc == nil || plugin.score == nil || module.Memory() == nil {
+		module.Close(ctx)
+		return nil, errors.New("module must export memory, alloc and score")
+	}
+	return plugin, nil
+}
+
+func (p *wasmPlugin) Name() string   { return p.name }
+func (p *wasmPlugin) Digest() string { return p.digest }
+
+func (p *wasmPlugin) Score(receipt []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx := context.Background()
+	results, err := p.alloc.Call(ctx, uint64(len(receipt)))
+	if err != nil {
+		return 0, err
+	}
+	ptr := uint32(results[0])
+	if !p.module.Memory().Write(ptr, receipt) {
+		return 0, fmt.Errorf("alloc returned %d, outside of memory", ptr)
+	}
+	if p.free != nil {
+		defer p.free.Call(ctx, uint64(ptr), uint64(len(receipt)))
+	}
+
+	results, err = p.score.Call(ctx, uint64(ptr), uint64(len(receipt)))
+	if err != nil {
+		return 0, err
+	}
+	return int(api.DecodeI32(results[0])), nil
+}
@@ -0,0 +1,12 @@
+//go:build !wasm
+
+package main
+
+import "errors"
+
+func loadPlugins(dir string) ([]scoringPlugin, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	return nil, errors.New("WASM plugins are not compiled in; rebuild with -tags wasm")
+}
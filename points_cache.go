@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// pointsCacheMetrics counts the hits, misses, evictions and invalidations
+// of the points cache.
+var pointsCacheMetrics = expvar.NewMap("pointsCache")
+
+// cachedPoints is what GET /receipts/{id}/points needs of a receipt.
+type cachedPoints struct {
+	owner    string
+	modified time.Time
+	response PointsResponse
+}
+
+// pointsCache keeps the points of the receipts most recently looked up, by
+// stored ID, evicting the least recently used beyond size.
+type pointsCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order has the most recently used entry at the front.
+	order *list.List
+	// generation counts invalidations, so that a lookup that raced with
+	// one doesn't cache what it read before it.
+	generation uint64
+}
+
+type pointsCacheEntry struct {
+	id     string
+	points cachedPoints
+}
+
+func newPointsCache(size int) *pointsCache {
+	return &pointsCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the cached points of id and the generation to add them
+// under if they aren't cached.
+func (c *pointsCache) get(id string) (cachedPoints, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, found := c.entries[id]
+	if !found {
+		pointsCacheMetrics.Add("misses", 1)
+		return cachedPoints{}, c.generation, false
+	}
+	pointsCacheMetrics.Add("hits", 1)
+	c.order.MoveToFront(element)
+	return element.Value.(*pointsCacheEntry).points, 0, true
+}
+
+// add caches the points of id read at generation, unless the cache was
+// invalidated since.
+func (c *pointsCache) add(id string, points cachedPoints, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if element, found := c.entries[id]; found {
+		element.Value.(*pointsCacheEntry).points = points
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[id] = c.order.PushFront(&pointsCacheEntry{id: id, points: points})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*pointsCacheEntry).id)
+		pointsCacheMetrics.Add("evictions", 1)
+	}
+}
+
+// invalidate drops the points of id, which was stored or deleted.
+func (c *pointsCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if element, found := c.entries[id]; found {
+		c.order.Remove(element)
+		delete(c.entries, id)
+	}
+	pointsCacheMetrics.Add("invalidations", 1)
+}
+
+// EnablePointsCache caches the points of up to size receipts for
+// GET /receipts/{id}/points, in front of a store that is slow to read. The
+// store is wrapped so that every write through the server invalidates
+// them; writes by other processes sharing the store aren't seen.
+func (s *Server) EnablePointsCache(size int) {
+	s.pointsCache = newPointsCache(size)
+	s.store = invalidatingStore{Store: s.store, invalidate: s.pointsCache.invalidate}
+}
+
+// lookupPoints returns the points of the receipt id of tenant, and its
+// owner, from the points cache when it's on.
+func (s *Server) lookupPoints(ctx context.Context, tenant, id string) (cachedPoints, error) {
+	store := s.tenantStore(ctx, tenant)
+	var generation uint64
+	if s.pointsCache != nil {
+		points, gen, found := s.pointsCache.get(tenantStore{tenant: tenant}.qualify(id))
+		if found {
+			return points, nil
+		}
+		generation = gen
+	}
+
+	record, err := store.Get(id)
+	if err != nil {
+		return cachedPoints{}, err
+	}
+	points := cachedPoints{
+		owner:    record.Owner,
+		modified: lastModified(record),
+		response: PointsResponse{Points: record.Points, RulesVersion: record.RulesVersion},
+	}
+	if s.pointsCache != nil {
+		s.pointsCache.add(tenantStore{tenant: tenant}.qualify(id), points, generation)
+	}
+	return points, nil
+}
+
+// invalidatingStore calls invalidate with the ID of every receipt written
+// to the store it wraps, after the write, failed or not, for the caches of
+// receipts. A lookup that read the receipt before the write either cached
+// it before the invalidation, which drops it, or is refused for its older
+// generation.
+type invalidatingStore struct {
+	Store
+	invalidate func(id string)
+}
+
+func (p invalidatingStore) Put(record ReceiptRecord) error {
+	defer p.invalidate(record.ID)
+	return p.Store.Put(record)
+}
+
+func (p invalidatingStore) PutWithEvent(record ReceiptRecord, event OutboxEvent) error {
+	defer p.invalidate(record.ID)
+	outbox, err := outboxOf(p.Store)
+	if err != nil {
+		return err
+	}
+	return outbox.PutWithEvent(record, event)
+}
+
+func (p invalidatingStore) Delete(id string) error {
+	defer p.invalidate(id)
+	return p.Store.Delete(id)
+}
+
+func (p invalidatingStore) GetMany(ids []string) (map[string]ReceiptRecord, error) {
+	return getMany(p.Store, ids)
+}
+
+func (p invalidatingStore) OutboxEvents(limit int) ([]OutboxEvent, error) {
+	outbox, err := outboxOf(p.Store)
+	if err != nil {
+		return nil, err
+	}
+	return outbox.OutboxEvents(limit)
+}
+
+func (p invalidatingStore) DeleteOutboxEvents(seq int64) error {
+	outbox, err := outboxOf(p.Store)
+	if err != nil {
+		return err
+	}
+	return outbox.DeleteOutboxEvents(seq)
+}
+
+// Unwrap returns the wrapped store, for the interfaces only some stores
+// implement.
+func (p invalidatingStore) Unwrap() Store { return p.Store }
+
+// unwrapStore returns the store under any wrappers of store.
+func unwrapStore(store Store) Store {
+	for {
+		wrapper, ok := store.(interface{ Unwrap() Store })
+		if !ok {
+			return store
+		}
+		store = wrapper.Unwrap()
+	}
+}
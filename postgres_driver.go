@@ -0,0 +1,6 @@
+//go:build postgres
+
+package main
+
+// Registers the "pgx" database/sql driver used by PostgresStore.
+import _ "github.com/jackc/pgx/v5/stdlib"
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Problem is an RFC 7807 problem details response body.
+type Problem struct {
+	Type          string       `json:"type"`
+	Title         string       `json:"title"`
+	Status        int          `json:"status"`
+	Detail        string       `json:"detail,omitempty"`
+	Instance      string       `json:"instance,omitempty"`
+	InvalidParams []FieldError `json:"invalid-params,omitempty"`
+	// RequestID identifies the request in the service's logs.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	if problem.Instance == "" {
+		problem.Instance = r.URL.Path
+	}
+	problem.RequestID = requestIDFrom(r.Context())
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// sentinelProblems describes the sentinel errors of the store and the
+// domain to clients. More specific errors come first.
+var sentinelProblems = []struct {
+	err     error
+	problem Problem
+}{
+	{errUserNotFound, notFoundProblem("No user found for that id.")},
+	{errOverrideNotFound, notFoundProblem("No retailer override found for that id.")},
+	{errAliasNotFound, notFoundProblem("No retailer alias found for that name.")},
+	{errAPIKeyNotFound, notFoundProblem("No API key found for that id.")},
+	{errWebhookNotFound, notFoundProblem("No webhook found for that id.")},
+	{errDeliveryNotFound, notFoundProblem("No delivery of that webhook found for that id.")},
+	{errAttachmentNotFound, notFoundProblem("The receipt has no attachment.")},
+	{ErrNotFound, notFoundProblem("No receipt found for that id.")},
+	{errForeignUser, Problem{
+		Type:   "/problems/forbidden",
+		Title:  "Not allowed",
+		Status: http.StatusForbidden,
+		Detail: "Receipts can only be credited to your own user.",
+	}},
+	{errAllTenants, Problem{
+		Type:   "/problems/forbidden",
+		Title:  "Not allowed",
+		Status: http.StatusForbidden,
+		Detail: "Credentials bound to a tenant can't act on every tenant's receipts or settings.",
+	}},
+	{errIdempotencyKeyReused, Problem{
+		Type:   "/problems/idempotency-key-reused",
+		Title:  "The Idempotency-Key was already used",
+		Status: http.StatusUnprocessableEntity,
+		Detail: "The Idempotency-Key was already used for a different receipt.",
+	}},
+	{ErrDuplicateContent, Problem{
+		Type:   "/problems/duplicate-receipt",
+		Title:  "The receipt was already processed",
+		Status: http.StatusConflict,
+		Detail: "Another stored receipt has the same contents.",
+	}},
+	{errStaleWrite, Problem{
+		Type:   "/problems/concurrent-update",
+		Title:  "The receipt was changed meanwhile",
+		Status: http.StatusConflict,
+		Detail: "Another request changed the receipt at the same time. Try again.",
+	}},
+	{ErrNoBalances, Problem{
+		Type:   "/problems/no-balances",
+		Title:  "Balances aren't kept",
+		Status: http.StatusNotImplemented,
+		Detail: "Receipts expire from the store, so it doesn't keep balances.",
+	}},
+	{errNotPendingReview, Problem{
+		Type:   "/problems/not-pending-review",
+		Title:  "Not awaiting review",
+		Status: http.StatusConflict,
+		Detail: "The receipt isn't awaiting review.",
+	}},
+	{errDeliveryPending, Problem{
+		Type:   "/problems/delivery-pending",
+		Title:  "Delivery still pending",
+		Status: http.StatusConflict,
+		Detail: "The notification is still being delivered.",
+	}},
+	{errNoTemplate, Problem{
+		Type:   "/problems/unrecognized-document",
+		Title:  "The document isn't recognized",
+		Status: http.StatusUnprocessableEntity,
+		Detail: "No receipt template matches the document.",
+	}},
+	{errQueueFull, Problem{
+		Type:   "/problems/queue-full",
+		Title:  "Too many jobs are queued",
+		Status: http.StatusServiceUnavailable,
+		Detail: "Too many jobs are queued, try again later.",
+	}},
+}
+
+// internalErrorProblem answers requests that failed for reasons clients
+// can't do anything about.
+var internalErrorProblem = Problem{
+	Type:   "/problems/internal-error",
+	Title:  "Internal server error",
+	Status: http.StatusInternalServerError,
+	Detail: "The request failed unexpectedly. Quote the requestId when reporting it.",
+}
+
+func notFoundProblem(detail string) Problem {
+	return Problem{Type: "/problems/not-found", Title: "Not found", Status: http.StatusNotFound, Detail: detail}
+}
+
+// errorProblem maps an error from the store or the domain to the problem
+// describing it, so that every handler answers an error the same way. It
+// reports false for errors it doesn't know, which are internal errors whose
+// message isn't shown to clients.
+func errorProblem(err error) (Problem, bool) {
+	var verr *ValidationError
+	var duplicate *duplicateReceiptError
+	var fraud *suspectedFraudError
+	var forwarded *shardProblemError
+	if errors.As(err, &forwarded) {
+		return forwarded.problem, true
+	}
+	if _, tooLarge := bodyTooLargeProblem(err); tooLarge || errors.As(err, &verr) {
+		return invalidReceiptProblem(err), true
+	}
+	if errors.As(err, &duplicate) {
+		return Problem{
+			Type:   "/problems/duplicate-receipt",
+			Title:  "The receipt was already processed",
+			Status: http.StatusConflict,
+			Detail: fmt.Sprintf("The receipt was already processed as %s.", duplicate.ID),
+		}, true
+	}
+	if errors.As(err, &fraud) {
+		return suspectedFraudProblem(fraud), true
+	}
+	for _, sentinel := range sentinelProblems {
+		if errors.Is(err, sentinel.err) {
+			return sentinel.problem, true
+		}
+	}
+	return internalErrorProblem, false
+}
+
+// writeError answers r with the problem describing err, logging errors
+// that errorProblem doesn't know.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	problem, known := errorProblem(err)
+	if !known {
+		slog.ErrorContext(r.Context(), "Request failed", "err", err)
+	}
+	writeProblem(w, r, problem)
+}
+
+// invalidReceiptProblem describes why a submitted receipt was rejected,
+// down to the individual fields when validation got that far.
+func invalidReceiptProblem(err error) Problem {
+	if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+		return problem
+	}
+	problem := Problem{
+		Type:   "/problems/invalid-receipt",
+		Title:  "The receipt is invalid",
+		Status: http.StatusBadRequest,
+		Detail: err.Error(),
+	}
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		problem.Detail = "One or more fields failed validation."
+		problem.InvalidParams = verr.Fields
+	}
+	return problem
+}
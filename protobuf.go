@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"slices"
+)
+
+// protobufMediaTypes are recognized for protobuf bodies. Responses use the
+// first.
+var protobufMediaTypes = []string{"application/x-protobuf", "application/protobuf"}
+
+// protoBinding converts the bodies of a REST route between JSON and the
+// messages of receipts.proto.
+type protoBinding struct {
+	// request decodes a protobuf request body into the value whose JSON
+	// the handler takes. Nil for routes that take no body.
+	request func(data []byte) (any, error)
+	// response decodes the JSON the handler wrote into a message.
+	response func(data []byte) (protoMessage, error)
+}
+
+// The routes the messages fit. The REST bodies of the batch endpoint are
+// arrays, which the messages wrap.
+var (
+	processReceiptProto = protoBinding{
+		request: func(data []byte) (any, error) {
+			var receipt Receipt
+			return receipt, receipt.unmarshalProto(data)
+		},
+		response: func(data []byte) (protoMessage, error) {
+			var m ProcessResponse
+			return &m, json.Unmarshal(data, &m)
+		},
+	}
+	getPointsProto = protoBinding{
+		response: func(data []byte) (protoMessage, error) {
+			var m PointsResponse
+			return &m, json.Unmarshal(data, &m)
+		},
+	}
+	batchProcessProto = protoBinding{
+		request: func(data []byte) (any, error) {
+			var m BatchProcessRequest
+			err := m.unmarshalProto(data)
+			if m.Receipts == nil {
+				m.Receipts = []Receipt{}
+			}
+			return m.Receipts, err
+		},
+		response: func(data []byte) (protoMessage, error) {
+			var m BatchProcessResponse
+			return &m, json.Unmarshal(data, &m.Results)
+		},
+	}
+)
+
+// protobuf is the "protobuf" middleware of routes whose bodies have
+// messages in receipts.proto, which lets clients send and receive those
+// in the protobuf wire format. Problems are still JSON.
+func protobuf(binding protoBinding) Middleware {
+	return Middleware{Name: "protobuf", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if binding.request != nil && slices.Contains(protobufMediaTypes, mediaType) {
+				if !replaceBody(w, r, mediaType, binding.request) {
+					return
+				}
+			}
+
+			accepted := preferredMediaType(r, func(mediaType string) bool {
+				return slices.Contains(protobufMediaTypes, mediaType) || formatOf(mediaType) != nil
+			})
+			if !slices.Contains(protobufMediaTypes, accepted) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			pw := &formatResponseWriter{ResponseWriter: w, encode: binding.encode}
+			defer pw.finish(r)
+			next.ServeHTTP(pw, r)
+		})
+	}}
+}
+
+func (b protoBinding) encode(body []byte, problem bool) (string, []byte, error) {
+	if problem {
+		return "", nil, nil
+	}
+	m, err := b.response(body)
+	if err != nil {
+		return "", nil, err
+	}
+	return protobufMediaTypes[0], m.marshalProto(), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The protobuf wire format, as far as the messages of
+// proto/receipts/v1/receipts.proto need it. Encoding them by hand keeps
+// protoc and the protobuf runtime out of the build.
+
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireBytes  = 2
+	wireI32    = 5
+)
+
+// protoMessage is a message of receipts.proto.
+type protoMessage interface {
+	marshalProto() []byte
+	unmarshalProto(data []byte) error
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendString leaves out empty strings, which proto3 decodes as the
+// default.
+func appendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendInt64(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendOptionalInt64(b, field, v)
+}
+
+// appendOptionalInt64 encodes v even when it is zero, for fields with
+// presence.
+func appendOptionalInt64(b []byte, field int, v int64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func appendBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return append(b, 1)
+}
+
+// appendMessage encodes m as a field, even when it is empty, so that
+// repeated fields keep their length.
+func appendMessage(b []byte, field int, m protoMessage) []byte {
+	data := m.marshalProto()
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+var errProtoTruncated = errors.New("protobuf message is truncated")
+
+// protoField is a field read by readProtoFields. Varints are in varint;
+// length-delimited fields in bytes.
+type protoField struct {
+	num      int
+	wireType int
+	varint   uint64
+	bytes    []byte
+}
+
+func (f protoField) string() string { return string(f.bytes) }
+
+// readProtoFields calls fn with each field of data in turn. Fields of the
+// fixed-width types are skipped, since no message uses them.
+func readProtoFields(data []byte, fn func(f protoField) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		data = data[n:]
+		f := protoField{num: int(tag >> 3), wireType: int(tag & 7)}
+		switch f.wireType {
+		case wireVarint:
+			if f.varint, n = binary.Uvarint(data); n <= 0 {
+				return errProtoTruncated
+			}
+			data = data[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errProtoTruncated
+			}
+			f.bytes = data[n : n+int(size)]
+			data = data[n+int(size):]
+		case wireI64, wireI32:
+			width := 8
+			if f.wireType == wireI32 {
+				width = 4
+			}
+			if len(data) < width {
+				return errProtoTruncated
+			}
+			data = data[width:]
+			continue
+		default:
+			return fmt.Errorf("protobuf field %d has unsupported wire type %d", f.num, f.wireType)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// want checks that a known field was encoded the way its
+// declaration says.
+func (f protoField) want(wireType int) error {
+	if f.wireType != wireType {
+		return fmt.Errorf("protobuf field %d has wire type %d, want %d", f.num, f.wireType, wireType)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+//go:build pubsub
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// pubsubListener pulls receipts from cfg.Subscription, with the
+// application default credentials. Messages are acked once their receipt
+// is stored. Invalid receipts are nacked for the subscription's
+// dead-letter policy to move them to a dead-letter topic.
+func pubsubListener(cfg PubSubConfig, s *Server) (listener, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := pubsub.NewClient(ctx, cfg.Project)
+	if err != nil {
+		return listener{}, fmt.Errorf("create Pub/Sub client: %w", err)
+	}
+	sub := client.Subscription(cfg.Subscription)
+	// Receipts are handled one at a time, so leasing more would only keep
+	// them from other instances.
+	sub.ReceiveSettings.MaxOutstandingMessages = 1
+	sub.ReceiveSettings.NumGoroutines = 1
+
+	receiving, stop := context.WithCancel(context.Background())
+	src := &pubsubSource{
+		client:   client,
+		stop:     stop,
+		messages: make(chan *pubsubMessage),
+		ended:    make(chan struct{}),
+	}
+	go func() {
+		defer close(src.ended)
+		src.err = sub.Receive(receiving, src.handle)
+	}()
+	name := fmt.Sprintf("Pub/Sub subscriber of projects/%s/subscriptions/%s", cfg.Project, cfg.Subscription)
+	return ingestListener(name, src, cfg.Tenant, s), nil
+}
+
+// pubsubSource turns the callbacks of Subscription.Receive into messages
+// to receive. Each callback waits until its message is settled, so that
+// Receive doesn't end with a message still being handled unless the
+// source is closed.
+type pubsubSource struct {
+	client   *pubsub.Client
+	stop     context.CancelFunc
+	messages chan *pubsubMessage
+	// ended is closed when Subscription.Receive ends, with err.
+	ended chan struct{}
+	err   error
+}
+
+func (p *pubsubSource) handle(ctx context.Context, m *pubsub.Message) {
+	msg := &pubsubMessage{m: m, settled: make(chan struct{})}
+	select {
+	case p.messages <- msg:
+	case <-ctx.Done():
+		m.Nack()
+		return
+	}
+	select {
+	case <-msg.settled:
+	case <-ctx.Done():
+		// Closed while the message was being handled, after the shutdown
+		// timed out. Its lease runs out and it is delivered again.
+	}
+}
+
+func (p *pubsubSource) Receive(ctx context.Context) (SourceMessage, error) {
+	select {
+	case msg := <-p.messages:
+		return msg, nil
+	case <-p.ended:
+		if p.err == nil {
+			return nil, errors.New("subscription stopped receiving")
+		}
+		return nil, p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *pubsubSource) Close() error {
+	p.stop()
+	<-p.ended
+	return p.client.Close()
+}
+
+type pubsubMessage struct {
+	m       *pubsub.Message
+	settled chan struct{}
+}
+
+func (m *pubsubMessage) ID() string { return m.m.ID }
+
+func (m *pubsubMessage) Data() []byte { return m.m.Data }
+
+func (m *pubsubMessage) Ack(ctx context.Context, result BatchResult) error {
+	m.m.Ack()
+	close(m.settled)
+	return nil
+}
+
+// Reject nacks the message for the subscription's dead-letter policy.
+func (m *pubsubMessage) Reject(ctx context.Context, result BatchResult) error {
+	m.Nack()
+	return nil
+}
+
+func (m *pubsubMessage) Nack() {
+	m.m.Nack()
+	close(m.settled)
+}
@@ -0,0 +1,9 @@
+//go:build !pubsub
+
+package main
+
+import "errors"
+
+func pubsubListener(cfg PubSubConfig, s *Server) (listener, error) {
+	return listener{}, errors.New("Pub/Sub is not compiled in; rebuild with -tags pubsub")
+}
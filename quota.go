@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// usageSaveInterval is how often counted usage is written to the keys
+// file. Usage counted since the last save is lost if the process dies.
+const usageSaveInterval = 30 * time.Second
+
+var errQuotaExceeded = errors.New("monthly quota exceeded")
+
+// APIKeyUsage reports how many receipts a key submitted this month.
+type APIKeyUsage struct {
+	KeyID    string `json:"keyId"`
+	Month    string `json:"month"`
+	Receipts int    `json:"receipts"`
+	// MonthlyQuota and Remaining are left out for keys without a quota.
+	MonthlyQuota int       `json:"monthlyQuota,omitempty"`
+	Remaining    *int      `json:"remaining,omitempty"`
+	ResetsAt     time.Time `json:"resetsAt"`
+	// History counts the receipts of every month the key was used in.
+	History map[string]int `json:"history"`
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// nextMonth is when the quota of the month containing t resets.
+func nextMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// usage describes key's usage in the month containing now. It must be
+// called with s.mu held.
+func (s *APIKeyStore) usage(key *APIKey, now time.Time) APIKeyUsage {
+	u := APIKeyUsage{
+		KeyID:    key.ID,
+		Month:    usageMonth(now),
+		Receipts: key.Usage[usageMonth(now)],
+		ResetsAt: nextMonth(now),
+		History:  key.public().Usage,
+	}
+	if u.History == nil {
+		u.History = map[string]int{}
+	}
+	if quota := s.quotaOf(key); quota > 0 {
+		remaining := max(quota-u.Receipts, 0)
+		u.MonthlyQuota = quota
+		u.Remaining = &remaining
+	}
+	return u
+}
+
+func (s *APIKeyStore) quotaOf(key *APIKey) int {
+	if key.MonthlyQuota > 0 {
+		return key.MonthlyQuota
+	}
+	return s.defaultQuota
+}
+
+func (s *APIKeyStore) byID(id string) *APIKey {
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// Charge counts n receipts against the key's quota for the month
+// containing now. It fails with errQuotaExceeded, counting nothing, when
+// they don't all fit. Callers that aren't API keys, such as the bootstrap
+// key, aren't metered.
+func (s *APIKeyStore) Charge(id string, n int, now time.Time) (APIKeyUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.byID(id)
+	if key == nil {
+		return APIKeyUsage{}, nil
+	}
+	month := usageMonth(now)
+	if quota := s.quotaOf(key); quota > 0 && key.Usage[month]+n > quota {
+		return s.usage(key, now), errQuotaExceeded
+	}
+	if key.Usage == nil {
+		key.Usage = make(map[string]int)
+	}
+	key.Usage[month] += n
+	s.usageChanged = true
+	return s.usage(key, now), nil
+}
+
+// Refund gives back receipts charged for a request that wasn't carried
+// out.
+func (s *APIKeyStore) Refund(id string, n int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key := s.byID(id); key != nil && key.Usage[usageMonth(now)] >= n {
+		key.Usage[usageMonth(now)] -= n
+		s.usageChanged = true
+	}
+}
+
+// Usage reports the usage of a key of tenant, or of any tenant when tenant
+// is "".
+func (s *APIKeyStore) Usage(id, tenant string, now time.Time) (APIKeyUsage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := s.byID(id)
+	if key == nil || tenant != "" && key.Tenant != tenant {
+		return APIKeyUsage{}, errAPIKeyNotFound
+	}
+	return s.usage(key, now), nil
+}
+
+// saveUsage flushes the usage counts every interval.
+func (s *APIKeyStore) saveUsage(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.Flush(); err != nil {
+			slog.Error("Failed to save API key usage", "err", err)
+		}
+	}
+}
+
+// Flush writes the keys file if usage was counted since the last save.
+func (s *APIKeyStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.usageChanged || s.path == "" {
+		return nil
+	}
+	if err := saveJSONFile(s.path, s.keys); err != nil {
+		return err
+	}
+	s.usageChanged = false
+	return nil
+}
+
+// chargeQuota counts n receipts against the quota of the caller's API key.
+// When they don't fit, it responds with 429 Too Many Requests and returns
+// false.
+func (s *Server) chargeQuota(w http.ResponseWriter, r *http.Request, n int) bool {
+	p := principalFrom(r)
+	if s.apiKeys == nil || p == nil {
+		return true
+	}
+	now := s.clock.Now()
+	usage, err := s.apiKeys.Charge(p.ID, n, now)
+	if !errors.Is(err, errQuotaExceeded) {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(usage.ResetsAt.Sub(now).Seconds())+1))
+	writeProblem(w, r, Problem{
+		Type:   "/problems/quota-exceeded",
+		Title:  "Monthly quota exceeded",
+		Status: http.StatusTooManyRequests,
+		Detail: fmt.Sprintf("This API key may submit %d receipts in %s and has %d left, so these %d receipts can't be processed. The quota resets on %s.",
+			usage.MonthlyQuota, usage.Month, *usage.Remaining, n, usage.ResetsAt.Format("2006-01-02")),
+	})
+	return false
+}
+
+// refundQuota gives back receipts charged by chargeQuota.
+func (s *Server) refundQuota(r *http.Request, n int) {
+	if p := principalFrom(r); s.apiKeys != nil && p != nil {
+		s.apiKeys.Refund(p.ID, n, s.clock.Now())
+	}
+}
+
+func (s *Server) GetAPIKeyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	usage, err := s.apiKeys.Usage(id, boundTenant(r), s.clock.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
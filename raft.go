@@ -0,0 +1,141 @@
+//go:build raft
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// hashicorpRaft is a raftNode of hashicorp/raft, keeping its log in a bolt
+// file and its snapshots as files under the node's directory.
+type hashicorpRaft struct {
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	logs      *raftboltdb.BoltStore
+}
+
+func newRaftNode(cfg RaftConfig, store *MemoryStore) (raftNode, error) {
+	var self RaftPeer
+	servers := make([]raft.Server, len(cfg.Peers))
+	for i, peer := range cfg.Peers {
+		if peer.ID == cfg.NodeID {
+			self = peer
+		}
+		servers[i] = raft.Server{ID: raft.ServerID(peer.ID), Address: raft.ServerAddress(peer.Addr)}
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(cfg.NodeID)
+	config.LogLevel = "INFO"
+	advertise, err := net.ResolveTCPAddr("tcp", self.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", self.Addr, err)
+	}
+	transport, err := raft.NewTCPTransport(self.Addr, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", self.Addr, err)
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		transport.Close()
+		return nil, fmt.Errorf("open the Raft log: %w", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(cfg.Dir, 2, os.Stderr)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, fmt.Errorf("open the Raft snapshots: %w", err)
+	}
+	existing, err := raft.HasExistingState(logs, logs, snapshots)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, err
+	}
+
+	r, err := raft.NewRaft(config, raftFSM{store: store}, logs, logs, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, err
+	}
+	// Every node forms the cluster from the same peers the first time, which
+	// Raft allows; the ones that lose the race join the winner's.
+	if !existing {
+		err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			r.Shutdown()
+			transport.Close()
+			logs.Close()
+			return nil, fmt.Errorf("form the Raft cluster: %w", err)
+		}
+	}
+	return &hashicorpRaft{raft: r, transport: transport, logs: logs}, nil
+}
+
+func (h *hashicorpRaft) Apply(command []byte, timeout time.Duration) (raftResult, uint64, error) {
+	future := h.raft.Apply(command, timeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return raftResult{}, 0, errRaftNotLeader
+		}
+		return raftResult{}, 0, err
+	}
+	return future.Response().(raftResult), future.Index(), nil
+}
+
+func (h *hashicorpRaft) Leader() string {
+	_, id := h.raft.LeaderWithID()
+	return string(id)
+}
+
+func (h *hashicorpRaft) AppliedIndex() uint64 { return h.raft.AppliedIndex() }
+
+func (h *hashicorpRaft) Shutdown() error {
+	return errors.Join(h.raft.Shutdown().Error(), h.transport.Close(), h.logs.Close())
+}
+
+// raftFSM applies the Raft log to a MemoryStore.
+type raftFSM struct {
+	store *MemoryStore
+}
+
+func (f raftFSM) Apply(entry *raft.Log) any {
+	return f.store.applyCommand(entry.Data)
+}
+
+func (f raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return raftSnapshot{state: f.store.state()}, nil
+}
+
+func (f raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	return f.store.restoreRaftSnapshot(snapshot)
+}
+
+// raftSnapshot is a copy of the store, written out as Raft persists it.
+type raftSnapshot struct {
+	state memoryState
+}
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := writeRaftSnapshot(sink, s.state); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (raftSnapshot) Release() {}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// raftSecretHeader carries the cluster's secret on writes forwarded
+	// to the leader.
+	raftSecretHeader = "Raft-Secret"
+	// raftIndexHeader is the Raft log index a node applied when it
+	// answered, which clients send back to read their writes on another
+	// node.
+	raftIndexHeader = "Raft-Index"
+)
+
+var (
+	errRaftNotLeader = errors.New("this node isn't the Raft leader")
+	errRaftNoLeader  = errors.New("the Raft cluster has no leader")
+	errStaleWrite    = errors.New("the receipt was changed since it was read")
+)
+
+// RaftPeer is a node of a Raft cluster.
+type RaftPeer struct {
+	ID string
+	// Addr is the host:port of its Raft transport, which it listens on
+	// and the other nodes reach it at.
+	Addr string
+	// URL is the base URL of its HTTP API, which writes are forwarded to
+	// while it leads.
+	URL string
+}
+
+// RaftConfig replicates the receipts of a memory store across the nodes of
+// a Raft cluster.
+type RaftConfig struct {
+	NodeID string
+	// Dir keeps the node's Raft log and snapshots.
+	Dir string
+	// Peers are the nodes of the cluster, this one included. They form
+	// the cluster the first time it starts.
+	Peers []RaftPeer
+	// Secret authenticates the writes nodes forward to the leader.
+	Secret string
+	// Timeout bounds replicating a write, and waiting for a node to catch
+	// up with one.
+	Timeout time.Duration
+}
+
+// parseRaftPeers parses a comma-separated list of id=host:port=url peers.
+func parseRaftPeers(list string) ([]RaftPeer, error) {
+	var peers []RaftPeer
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("peer %q must be id=host:port=url", entry)
+		}
+		peers = append(peers, RaftPeer{ID: parts[0], Addr: parts[1], URL: strings.TrimSuffix(parts[2], "/")})
+	}
+	return peers, nil
+}
+
+// raftNode is a member of a Raft cluster whose state machine is a
+// MemoryStore.
+type raftNode interface {
+	// Apply replicates a write and returns its result and log index once
+	// this node, which must lead, applied it.
+	Apply(command []byte, timeout time.Duration) (raftResult, uint64, error)
+	// Leader returns the ID of the node leading, or "" if there is none.
+	Leader() string
+	// AppliedIndex is the index of the last write this node applied.
+	AppliedIndex() uint64
+	Shutdown() error
+}
+
+// raftResult is what applying a write returns: the sender's balance for
+// transfers, and the error the write was refused with.
+type raftResult struct {
+	Balance int
+	Err     error
+}
+
+// raftErrors are the errors a replicated write can be refused with, by the
+// code they are forwarded with.
+var raftErrors = map[string]error{
+	"not-found":           ErrNotFound,
+	"insufficient-points": ErrInsufficientPoints,
+	"stale-write":         errStaleWrite,
+}
+
+func raftErrorCode(err error) string {
+	for code, known := range raftErrors {
+		if errors.Is(err, known) {
+			return code
+		}
+	}
+	return err.Error()
+}
+
+// applyCommand applies a write of the Raft log: a walEntry. Writes are
+// checked here rather than before they are replicated, so that every node
+// refuses the same ones.
+//
+// Puts store the next version of the receipt, and versioned puts are
+// refused unless they were made from the stored version. The amendment
+// lock only serializes the read-modify-write cycles of one node, so this
+// keeps nodes from overwriting each other's changes.
+func (s *MemoryStore) applyCommand(command []byte) raftResult {
+	var entry walEntry
+	if err := json.Unmarshal(command, &entry); err != nil {
+		return raftResult{Err: err}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch entry.Op {
+	case walPut:
+		if entry.Record == nil {
+			break
+		}
+		stored, _ := s.receipts.get(entry.Record.ID)
+		if entry.Versioned && entry.Record.Version != stored.Version {
+			return raftResult{Err: errStaleWrite}
+		}
+		entry.Record.Version = stored.Version + 1
+	case walDelete:
+		if _, found := s.receipts.get(entry.ID); !found {
+			return raftResult{Err: ErrNotFound}
+		}
+	case walTransfer:
+		balance, found := s.balances.get(entry.From)
+		if !found {
+			return raftResult{Err: ErrNotFound}
+		}
+		if balance < entry.Points {
+			return raftResult{Balance: balance, Err: ErrInsufficientPoints}
+		}
+	}
+	if err := s.apply(entry); err != nil {
+		return raftResult{Err: err}
+	}
+	balance, _ := s.balances.get(entry.From)
+	return raftResult{Balance: balance}
+}
+
+// raftOutbox starts Raft snapshots, ahead of a backup archive of the
+// receipts and balances.
+type raftOutbox struct {
+	LastSeq int64 `json:"lastSeq"`
+	// Events keeps the sequence numbers that OutboxEvent leaves out.
+	Events []raftOutboxEvent `json:"events"`
+}
+
+type raftOutboxEvent struct {
+	Seq   int64       `json:"seq"`
+	Event OutboxEvent `json:"event"`
+}
+
+// writeRaftSnapshot writes state as a Raft snapshot: its outbox as a line
+// of JSON, then a backup archive.
+func writeRaftSnapshot(w io.Writer, state memoryState) error {
+	outbox := raftOutbox{LastSeq: state.lastSeq, Events: make([]raftOutboxEvent, len(state.outbox))}
+	for i, event := range state.outbox {
+		outbox.Events[i] = raftOutboxEvent{Seq: event.Seq, Event: event}
+	}
+	if err := json.NewEncoder(w).Encode(outbox); err != nil {
+		return err
+	}
+	_, err := writeBackup(w, state, BackupInfo{CreatedAt: time.Now().UTC(), Changes: state.changes}, func() {})
+	return err
+}
+
+// restoreRaftSnapshot replaces the contents of the store with those of a
+// Raft snapshot.
+func (s *MemoryStore) restoreRaftSnapshot(snapshot io.Reader) error {
+	reader := bufio.NewReader(snapshot)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var outbox raftOutbox
+	if err := json.Unmarshal(line, &outbox); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	restored := NewMemoryStore()
+	info, _, err := readBackup(reader, restored, func() {})
+	if err != nil {
+		return err
+	}
+	state := restored.state()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receipts.clear()
+	s.hashMu.Lock()
+	clear(s.byHash)
+	s.hashMu.Unlock()
+	for _, record := range state.records {
+		shard := s.receipts.shard(record.ID)
+		shard.mu.Lock()
+		s.put(shard, record)
+		shard.mu.Unlock()
+	}
+	s.balances.replace(state.balances)
+	s.outboxMu.Lock()
+	s.outbox = s.outbox[:0]
+	for _, event := range outbox.Events {
+		event.Event.Seq = event.Seq
+		s.outbox = append(s.outbox, event.Event)
+	}
+	s.lastSeq = outbox.LastSeq
+	s.outboxMu.Unlock()
+	s.changes.Store(info.Changes)
+	return nil
+}
+
+// RaftStore replicates a memory store across a Raft cluster. Every node
+// reads its own copy. Writes go through the leader, which they are
+// forwarded to from the other nodes, and return once this node applied
+// them, so that its reads see them. Only the leader hands out outbox
+// events to publish.
+type RaftStore struct {
+	*MemoryStore
+	node   raftNode
+	cfg    RaftConfig
+	client *http.Client
+}
+
+// NewRaftStore joins the Raft cluster of cfg, forming it if it's new.
+func NewRaftStore(cfg RaftConfig) (*RaftStore, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("the Raft store needs a secret for forwarded writes")
+	}
+	if cfg.Timeout <= 0 {
+		return nil, errors.New("the Raft timeout must be positive")
+	}
+	store := &RaftStore{MemoryStore: NewMemoryStore(), cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+	if _, found := store.peer(cfg.NodeID); !found {
+		return nil, fmt.Errorf("node %q isn't one of the Raft peers", cfg.NodeID)
+	}
+	node, err := newRaftNode(cfg, store.MemoryStore)
+	if err != nil {
+		return nil, err
+	}
+	store.node = node
+	return store, nil
+}
+
+func (r *RaftStore) peer(id string) (RaftPeer, bool) {
+	i := slices.IndexFunc(r.cfg.Peers, func(peer RaftPeer) bool { return peer.ID == id })
+	if i < 0 {
+		return RaftPeer{}, false
+	}
+	return r.cfg.Peers[i], true
+}
+
+func (r *RaftStore) leads() bool { return r.node.Leader() == r.cfg.NodeID }
+
+// write replicates entry through the leader. The error is the outcome of
+// the write, and result.Err why the store refused it.
+func (r *RaftStore) write(entry walEntry) (raftResult, error) {
+	command, err := json.Marshal(entry)
+	if err != nil {
+		return raftResult{}, err
+	}
+	result, _, err := r.node.Apply(command, r.cfg.Timeout)
+	if !errors.Is(err, errRaftNotLeader) {
+		return result, err
+	}
+
+	result, index, err := r.forward(command)
+	if err != nil {
+		return raftResult{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+	return result, r.awaitIndex(ctx, index)
+}
+
+// raftApplyResponse answers a write forwarded to the leader.
+type raftApplyResponse struct {
+	Index   uint64 `json:"index"`
+	Balance int    `json:"balance"`
+	// Error is the code of the error the write was refused with.
+	Error string `json:"error,omitempty"`
+}
+
+// forward sends a write to the leader to apply. A write that fails to be
+// forwarded may still have been applied.
+func (r *RaftStore) forward(command []byte) (raftResult, uint64, error) {
+	leader, found := r.peer(r.node.Leader())
+	if !found {
+		return raftResult{}, 0, errRaftNoLeader
+	}
+	req, err := http.NewRequest(http.MethodPost, leader.URL+"/internal/raft/apply", bytes.NewReader(command))
+	if err != nil {
+		return raftResult{}, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(raftSecretHeader, r.cfg.Secret)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return raftResult{}, 0, fmt.Errorf("forward the write to %s: %w", leader.ID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return raftResult{}, 0, fmt.Errorf("forward the write to %s: %s: %s", leader.ID, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var response raftApplyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return raftResult{}, 0, fmt.Errorf("forward the write to %s: %w", leader.ID, err)
+	}
+	result := raftResult{Balance: response.Balance}
+	if response.Error != "" {
+		if result.Err = raftErrors[response.Error]; result.Err == nil {
+			result.Err = errors.New(response.Error)
+		}
+	}
+	return result, response.Index, nil
+}
+
+// awaitIndex waits until this node applied the Raft log up to index.
+func (r *RaftStore) awaitIndex(ctx context.Context, index uint64) error {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for r.node.AppliedIndex() < index {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait for write %d to be applied: %w", index, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Put stores record unless the stored receipt changed since record was
+// read from it, which fails with errStaleWrite.
+func (r *RaftStore) Put(record ReceiptRecord) error {
+	result, err := r.write(walEntry{Op: walPut, Record: &record, Versioned: true})
+	if err != nil {
+		return err
+	}
+	return result.Err
+}
+
+func (r *RaftStore) PutWithEvent(record ReceiptRecord, event OutboxEvent) error {
+	result, err := r.write(walEntry{Op: walPut, Record: &record, Event: &event, Versioned: true})
+	if err != nil {
+		return err
+	}
+	return result.Err
+}
+
+func (r *RaftStore) Delete(id string) error {
+	result, err := r.write(walEntry{Op: walDelete, ID: id})
+	if err != nil {
+		return err
+	}
+	return result.Err
+}
+
+func (r *RaftStore) Transfer(from, to string, points int) (int, error) {
+	result, err := r.write(walEntry{Op: walTransfer, From: from, To: to, Points: points})
+	if err != nil {
+		return 0, err
+	}
+	return result.Balance, result.Err
+}
+
+// OutboxEvents returns the events to publish on the leader, and none on
+// the other nodes, so that each is published by one node.
+func (r *RaftStore) OutboxEvents(limit int) ([]OutboxEvent, error) {
+	if !r.leads() {
+		return nil, nil
+	}
+	return r.MemoryStore.OutboxEvents(limit)
+}
+
+func (r *RaftStore) DeleteOutboxEvents(seq int64) error {
+	result, err := r.write(walEntry{Op: walDeleteEvents, EventSeq: seq})
+	if err != nil {
+		return err
+	}
+	return result.Err
+}
+
+// Close leaves the cluster.
+func (r *RaftStore) Close() error {
+	return r.node.Shutdown()
+}
+
+// EnableRaft serves the writes other nodes of store's cluster forward, and
+// the Raft-Index of every response.
+func (s *Server) EnableRaft(store *RaftStore) {
+	s.raft = store
+}
+
+// RaftApplyHandler applies a write another node of the cluster forwarded,
+// which must come with the cluster's secret.
+func (s *Server) RaftApplyHandler(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(raftSecretHeader)), []byte(s.raft.cfg.Secret)) != 1 {
+		http.Error(w, "Forwarded writes need the cluster's secret", http.StatusForbidden)
+		return
+	}
+	command, err := io.ReadAll(r.Body)
+	if err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		http.Error(w, "The write can't be read: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, index, err := s.raft.node.Apply(command, s.raft.cfg.Timeout)
+	if errors.Is(err, errRaftNotLeader) {
+		http.Error(w, "This node doesn't lead the Raft cluster", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := raftApplyResponse{Index: index, Balance: result.Balance}
+	if result.Err != nil {
+		response.Error = raftErrorCode(result.Err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// raftConsistency lets clients of a Raft cluster read their writes on any
+// node: responses carry the Raft-Index the node applied, and requests that
+// send one back wait until the node applied as much.
+func (s *Server) raftConsistency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.raft == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if header := r.Header.Get(raftIndexHeader); header != "" {
+			index, err := strconv.ParseUint(header, 10, 64)
+			if err != nil {
+				http.Error(w, raftIndexHeader+" must be a Raft log index", http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), s.raft.cfg.Timeout)
+			err = s.raft.awaitIndex(ctx, index)
+			cancel()
+			if err != nil {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "This node hasn't caught up with the Raft log yet", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(&raftIndexWriter{ResponseWriter: w, node: s.raft.node}, r)
+	})
+}
+
+// raftIndexWriter sets the Raft-Index of a response as its status goes
+// out, after the handler's writes were applied.
+type raftIndexWriter struct {
+	http.ResponseWriter
+	node        raftNode
+	wroteHeader bool
+}
+
+func (w *raftIndexWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(raftIndexHeader, strconv.FormatUint(w.node.AppliedIndex(), 10))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *raftIndexWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *raftIndexWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
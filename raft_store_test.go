@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// localRaftNode applies writes to its store directly, as a one-node
+// cluster that always leads.
+type localRaftNode struct {
+	store   *MemoryStore
+	applied uint64
+}
+
+func (n *localRaftNode) Apply(command []byte, timeout time.Duration) (raftResult, uint64, error) {
+	n.applied++
+	return n.store.applyCommand(command), n.applied, nil
+}
+
+func (n *localRaftNode) Leader() string       { return "node1" }
+func (n *localRaftNode) AppliedIndex() uint64 { return n.applied }
+func (n *localRaftNode) Shutdown() error      { return nil }
+
+func newLocalRaftStore() *RaftStore {
+	store := &RaftStore{MemoryStore: NewMemoryStore(), cfg: RaftConfig{NodeID: "node1", Timeout: time.Second}}
+	store.node = &localRaftNode{store: store.MemoryStore}
+	return store
+}
+
+func TestRaftStoreRefusesStaleWrites(t *testing.T) {
+	store := newLocalRaftStore()
+	if err := store.Put(ReceiptRecord{ID: "r1", Points: 10}); err != nil {
+		t.Fatalf("Put() of a new receipt: %v", err)
+	}
+
+	// Two nodes read the receipt and change it at the same time.
+	first, _ := store.Get("r1")
+	second, _ := store.Get("r1")
+	first.Points = 20
+	if err := store.Put(first); err != nil {
+		t.Fatalf("Put() of the first change: %v", err)
+	}
+	second.Points = 30
+	if err := store.Put(second); !errors.Is(err, errStaleWrite) {
+		t.Fatalf("Put() of the second change: error = %v, want %v", err, errStaleWrite)
+	}
+	if record, _ := store.Get("r1"); record.Points != 20 || record.Version != 2 {
+		t.Errorf("stored points %d at version %d, want 20 at version 2", record.Points, record.Version)
+	}
+
+	// A change read before the receipt was deleted doesn't bring it back.
+	if err := store.Delete("r1"); err != nil {
+		t.Fatalf("Delete(): %v", err)
+	}
+	second.Version = 2
+	if err := store.Put(second); !errors.Is(err, errStaleWrite) {
+		t.Errorf("Put() of a deleted receipt: error = %v, want %v", err, errStaleWrite)
+	}
+}
+
+func TestRaftStoreAppliesUnversionedPuts(t *testing.T) {
+	// Puts logged before there were versions replay unconditionally.
+	store := NewMemoryStore()
+	for points := 1; points <= 2; points++ {
+		command := []byte(`{"op":"put","record":{"ID":"r1","Points":` + strconv.Itoa(points) + `}}`)
+		if result := store.applyCommand(command); result.Err != nil {
+			t.Fatalf("applyCommand() error = %v", result.Err)
+		}
+	}
+	if record, _ := store.Get("r1"); record.Points != 2 || record.Version != 2 {
+		t.Errorf("stored points %d at version %d, want 2 at version 2", record.Points, record.Version)
+	}
+}
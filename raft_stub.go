@@ -0,0 +1,9 @@
+//go:build !raft
+
+package main
+
+import "errors"
+
+func newRaftNode(cfg RaftConfig, store *MemoryStore) (raftNode, error) {
+	return nil, errors.New("raft is not compiled in; rebuild with -tags raft")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitMetrics are published through expvar at /debug/vars.
+var rateLimitMetrics = expvar.NewMap("rateLimit")
+
+// RateLimiter keeps a token bucket per client. Each bucket holds up to
+// burst tokens and refills at rps tokens a second; a request takes one.
+type RateLimiter struct {
+	rps   float64
+	burst float64
+
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	prunedAt time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	l := &RateLimiter{rps: rps, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+	rateLimitMetrics.Set("clients", expvar.Func(func() any {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.buckets)
+	}))
+	return l
+}
+
+// Allow takes a token from the client's bucket. When the bucket is empty
+// it reports how long until the next token is available.
+func (l *RateLimiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+
+	b, found := l.buckets[client]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, at: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rps)
+	b.at = now
+	if b.tokens < 1 {
+		rateLimitMetrics.Add("limited", 1)
+		return false, time.Duration((1 - b.tokens) / l.rps * float64(time.Second))
+	}
+	b.tokens--
+	rateLimitMetrics.Add("allowed", 1)
+	return true, 0
+}
+
+// prune drops the buckets that have refilled completely, since a new
+// bucket starts out full anyway. It runs at most once a minute and must be
+// called with l.mu held.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.prunedAt) < time.Minute {
+		return
+	}
+	l.prunedAt = now
+	full := time.Duration(l.burst / l.rps * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.at) >= full {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimitKey identifies the client of a request: its principal when
+// authenticated, and its IP address otherwise.
+func rateLimitKey(r *http.Request) string {
+	if p := principalFrom(r); p != nil {
+		return "principal:" + p.ID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// EnableRateLimit limits each client to rps requests a second, with bursts
+// of up to burst requests. It must be called before the routes are set up.
+func (s *Server) EnableRateLimit(rps float64, burst int) {
+	s.limiter = NewRateLimiter(rps, burst)
+}
+
+// rateLimited responds with 429 Too Many Requests to clients that ran out
+// of tokens instead of calling next. It must run inside the "auth"
+// middleware to tell authenticated clients apart.
+func (s *Server) rateLimited(next http.Handler) http.Handler {
+	if s.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, wait := s.limiter.Allow(rateLimitKey(r), s.clock.Now())
+		if !allowed {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeProblem(w, r, Problem{
+				Type:   "/problems/too-many-requests",
+				Title:  "Too many requests",
+				Status: http.StatusTooManyRequests,
+				Detail: fmt.Sprintf("At most %g requests a second are allowed, with bursts of %g.", s.limiter.rps, s.limiter.burst),
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRecalculationChanges caps how many individual changes a recalculation
+// reports; the counters stay exact beyond it.
+const maxRecalculationChanges = 1000
+
+type PointsChange struct {
+	ID                   string `json:"id"`
+	PreviousPoints       int    `json:"previousPoints"`
+	Points               int    `json:"points"`
+	PreviousRulesVersion string `json:"previousRulesVersion,omitempty"`
+}
+
+// Recalculation rescores every stored receipt under the current rules.
+type Recalculation struct {
+	ID           string     `json:"id"`
+	Status       JobStatus  `json:"status"`
+	RulesVersion string     `json:"rulesVersion"`
+	Processed    int        `json:"processed"`
+	Changed      int        `json:"changed"`
+	Failed       int        `json:"failed"`
+	StartedAt    time.Time  `json:"startedAt"`
+	CompletedAt  *time.Time `json:"completedAt,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	// Changes lists the receipts whose points changed, up to
+	// maxRecalculationChanges of them.
+	Changes          []PointsChange `json:"changes"`
+	ChangesTruncated bool           `json:"changesTruncated,omitempty"`
+}
+
+type recalculations struct {
+	mu      sync.Mutex
+	runs    map[string]*Recalculation
+	running bool
+}
+
+// StartRecalculationHandler kicks off a background rescoring of all stored
+// receipts and responds with 202 Accepted and the run to poll. Only one
+// recalculation can run at a time.
+func (s *Server) StartRecalculationHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	rules := s.rules.Current()
+	run := &Recalculation{
+		ID:           s.ids.NewID(),
+		Status:       JobRunning,
+		RulesVersion: rules.Version,
+		StartedAt:    s.clock.Now().UTC(),
+		Changes:      []PointsChange{},
+	}
+
+	s.recalcs.mu.Lock()
+	if s.recalcs.running {
+		s.recalcs.mu.Unlock()
+		http.Error(w, "A recalculation is already running", http.StatusConflict)
+		return
+	}
+	s.recalcs.running = true
+	s.recalcs.runs[run.ID] = run
+	s.recalcs.mu.Unlock()
+
+	audit(r, "action=recalculate run=%s rules_version=%s", run.ID, rules.Version)
+	go s.recalculate(run, rules)
+
+	response := map[string]string{"id": run.ID}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/recalculate/"+run.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) recalculate(run *Recalculation, rules *RuleSet) {
+	err := s.forEachReceipt(func(record ReceiptRecord) {
+		change, changed, err := s.rescore(record.ID, rules)
+
+		s.recalcs.mu.Lock()
+		defer s.recalcs.mu.Unlock()
+		run.Processed++
+		switch {
+		case err != nil:
+			run.Failed++
+			slog.Error("Failed to recalculate a receipt", "receiptId", record.ID, "err", err)
+		case changed:
+			run.Changed++
+			if len(run.Changes) < maxRecalculationChanges {
+				run.Changes = append(run.Changes, change)
+			} else {
+				run.ChangesTruncated = true
+			}
+		}
+	})
+
+	now := s.clock.Now().UTC()
+	s.recalcs.mu.Lock()
+	defer s.recalcs.mu.Unlock()
+	run.Status = JobCompleted
+	run.CompletedAt = &now
+	if err != nil {
+		run.Error = err.Error()
+	}
+	s.recalcs.running = false
+}
+
+// forEachReceipt walks the whole store a page at a time.
+func (s *Server) forEachReceipt(fn func(ReceiptRecord)) error {
+	opts := ListOptions{Limit: 500}
+	for {
+		records, err := s.store.List(opts)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			fn(record)
+		}
+		if len(records) < opts.Limit {
+			return nil
+		}
+		opts.After = positionOf(records[len(records)-1])
+	}
+}
+
+// rescore applies rules to a stored receipt, recording the old score as an
+// amendment when the points change.
+func (s *Server) rescore(id string, rules *RuleSet) (PointsChange, bool, error) {
+	s.amendMu.Lock()
+	defer s.amendMu.Unlock()
+
+	// Re-read under the lock so a concurrent amendment isn't overwritten.
+	record, err := s.store.Get(id)
+	if err != nil {
+		return PointsChange{}, false, err
+	}
+	// Rejected receipts keep their zero points.
+	if record.Review != nil && record.Review.Status == ReviewRejected {
+		return PointsChange{}, false, nil
+	}
+
+	breakdown := rules.Score(&record.Receipt, record.ProcessedAt)
+	change := PointsChange{
+		ID:                   id,
+		PreviousPoints:       record.Points,
+		Points:               breakdown.Points,
+		PreviousRulesVersion: record.RulesVersion,
+	}
+	if breakdown.Points == record.Points {
+		if record.RulesVersion != breakdown.RulesVersion {
+			record.RulesVersion = breakdown.RulesVersion
+			record.Campaigns = breakdown.Campaigns
+			record.Retailer = canonicalRetailer(record.Receipt.Retailer, rules.RetailerAliases)
+			err = s.store.Put(record)
+		}
+		return change, false, err
+	}
+
+	record.Amendments = append(record.Amendments, Amendment{
+		AmendedAt:            s.clock.Now().UTC(),
+		PreviousPoints:       record.Points,
+		PreviousRulesVersion: record.RulesVersion,
+	})
+	record.Points = breakdown.Points
+	record.RulesVersion = breakdown.RulesVersion
+	record.Campaigns = breakdown.Campaigns
+	record.Retailer = canonicalRetailer(record.Receipt.Retailer, rules.RetailerAliases)
+	return change, true, s.store.Put(record)
+}
+
+func (s *Server) GetRecalculationHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	s.recalcs.mu.Lock()
+	run, found := s.recalcs.runs[id]
+	var response Recalculation
+	if found {
+		response = *run
+		response.Changes = append([]PointsChange(nil), run.Changes...)
+	}
+	s.recalcs.mu.Unlock()
+
+	if !found {
+		http.Error(w, "No recalculation found for that id", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var errNoTemplate = errors.New("no receipt template matches the document")
+
+// ReceiptTemplate reads the receipts of one retailer from the text of its
+// documents, such as PDF e-receipts, with regular expressions. The first
+// group of Date, Time and Total is the value; values are taken as they
+// are, so the groups shouldn't include currency signs.
+type ReceiptTemplate struct {
+	Name string `json:"name"`
+	// Match tells the retailer's documents apart from others.
+	Match    string `json:"match"`
+	Retailer string `json:"retailer"`
+	Date     string `json:"date"`
+	// DateLayout is the Go layout of dates, 2006-01-02 by default.
+	DateLayout string `json:"dateLayout,omitempty"`
+	Time       string `json:"time"`
+	// TimeLayout is the Go layout of times, 15:04 by default.
+	TimeLayout string `json:"timeLayout,omitempty"`
+	Total      string `json:"total"`
+	// Item matches each item line, with its description and price in the
+	// groups named "description" and "price". Only the lines after the
+	// first match of ItemsFrom and before the next match of ItemsUntil are
+	// items, when those are set.
+	Item       string `json:"item"`
+	ItemsFrom  string `json:"itemsFrom,omitempty"`
+	ItemsUntil string `json:"itemsUntil,omitempty"`
+
+	matchRe, dateRe, timeRe, totalRe, itemRe, itemsFromRe, itemsUntilRe *regexp.Regexp
+}
+
+func (t *ReceiptTemplate) compile() error {
+	if t.Name == "" || t.Retailer == "" {
+		return errors.New("name and retailer must be set")
+	}
+	if t.DateLayout == "" {
+		t.DateLayout = "2006-01-02"
+	}
+	if t.TimeLayout == "" {
+		t.TimeLayout = "15:04"
+	}
+	for _, pattern := range []struct {
+		name     string
+		source   string
+		re       **regexp.Regexp
+		optional bool
+	}{
+		{"match", t.Match, &t.matchRe, false},
+		{"date", t.Date, &t.dateRe, false},
+		{"time", t.Time, &t.timeRe, false},
+		{"total", t.Total, &t.totalRe, false},
+		{"item", t.Item, &t.itemRe, false},
+		{"itemsFrom", t.ItemsFrom, &t.itemsFromRe, true},
+		{"itemsUntil", t.ItemsUntil, &t.itemsUntilRe, true},
+	} {
+		if pattern.source == "" {
+			if !pattern.optional {
+				return fmt.Errorf("%s must be set", pattern.name)
+			}
+			continue
+		}
+		// Patterns work line by line.
+		re, err := regexp.Compile("(?m)" + pattern.source)
+		if err != nil {
+			return fmt.Errorf("%s must be a regular expression: %w", pattern.name, err)
+		}
+		*pattern.re = re
+	}
+	if t.itemRe.SubexpIndex("description") < 0 || t.itemRe.SubexpIndex("price") < 0 {
+		return errors.New(`item must have the groups "description" and "price"`)
+	}
+	return nil
+}
+
+// parse reads a receipt from text. Values that aren't found are left
+// empty, and values that don't parse are left as they are, for validation
+// to report.
+func (t *ReceiptTemplate) parse(text string) Receipt {
+	receipt := Receipt{
+		Retailer:     t.Retailer,
+		PurchaseDate: reformat(firstGroup(t.dateRe, text), t.DateLayout, "2006-01-02"),
+		PurchaseTime: reformat(firstGroup(t.timeRe, text), t.TimeLayout, "15:04"),
+		Total:        firstGroup(t.totalRe, text),
+		Items:        []Item{},
+	}
+
+	items := text
+	if t.itemsFromRe != nil {
+		if loc := t.itemsFromRe.FindStringIndex(items); loc != nil {
+			items = items[loc[1]:]
+		}
+	}
+	if t.itemsUntilRe != nil {
+		if loc := t.itemsUntilRe.FindStringIndex(items); loc != nil {
+			items = items[:loc[0]]
+		}
+	}
+	description, price := t.itemRe.SubexpIndex("description"), t.itemRe.SubexpIndex("price")
+	for _, m := range t.itemRe.FindAllStringSubmatch(items, -1) {
+		receipt.Items = append(receipt.Items, Item{
+			ShortDescription: strings.TrimSpace(m[description]),
+			Price:            strings.TrimSpace(m[price]),
+		})
+	}
+	return receipt
+}
+
+func firstGroup(re *regexp.Regexp, text string) string {
+	m := re.FindStringSubmatch(text)
+	if len(m) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(m[1])
+}
+
+// reformat converts value from layout to the layout receipts use.
+func reformat(value, layout, to string) string {
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return value
+	}
+	return t.Format(to)
+}
+
+// ReceiptTemplates are the templates documents are read with, tried in
+// order.
+type ReceiptTemplates []*ReceiptTemplate
+
+func loadReceiptTemplates(path string) (ReceiptTemplates, error) {
+	templates := ReceiptTemplates{}
+	if err := loadJSONFile(path, &templates); err != nil {
+		return nil, err
+	}
+	for i, t := range templates {
+		if err := t.compile(); err != nil {
+			return nil, fmt.Errorf("receipt template %d (%s): %w", i, t.Name, err)
+		}
+	}
+	return templates, nil
+}
+
+// Parse reads a receipt from text with the first template matching it,
+// and returns the name of the template.
+func (ts ReceiptTemplates) Parse(text string) (Receipt, string, error) {
+	for _, t := range ts {
+		if t.matchRe.MatchString(text) {
+			return t.parse(text), t.Name, nil
+		}
+	}
+	return Receipt{}, "", errNoTemplate
+}
+
+// EnableReceiptTemplates reads documents, such as PDF receipts, with
+// templates.
+func (s *Server) EnableReceiptTemplates(templates ReceiptTemplates) {
+	s.templates = templates
+}
+
+// DocumentProcessResponse is the response to a document processed as a
+// receipt: the receipt read from it, and the template it was read with.
+type DocumentProcessResponse struct {
+	ProcessResponse
+	Template string  `json:"template"`
+	Receipt  Receipt `json:"receipt"`
+}
+
+// ProcessPDFHandler processes a PDF e-receipt, sent as the body or as the
+// file part of a multipart form. The receipt is read from the PDF's text
+// with the receipt templates, then validated and scored like any other.
+func (s *Server) ProcessPDFHandler(w http.ResponseWriter, r *http.Request) {
+	body, _, err := uploadedFile(r)
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(body)
+	}
+	if err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		http.Error(w, "The PDF can't be read: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	text, err := pdfText(data)
+	if err != nil {
+		http.Error(w, "The PDF can't be read: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.processDocument(w, r, text, "application/pdf", data)
+}
+
+// processDocument processes the receipt read from the text of a document,
+// attaching the document to it.
+func (s *Server) processDocument(w http.ResponseWriter, r *http.Request, text, contentType string, document []byte) {
+	receipt, template, err := s.templates.Parse(text)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	logAttrs(r, slog.String("template", template))
+	if err := s.checkReceipt(&receipt); err != nil {
+		writeProblem(w, r, invalidReceiptProblem(err))
+		return
+	}
+
+	if !s.chargeQuota(w, r, 1) {
+		return
+	}
+	record, err := s.processReceipt(receipt, submitterOf(r))
+	if err != nil {
+		s.refundQuota(r, 1)
+		writeError(w, r, err)
+		return
+	}
+
+	s.attachArtifact(r.Context(), tenantFrom(r), record.ID, contentType, document)
+
+	logAttrs(r, slog.String("receiptId", record.ID))
+	response := DocumentProcessResponse{
+		ProcessResponse: ProcessResponse{ID: record.ID, Flagged: len(record.Flags) > 0},
+		Template:        template,
+		Receipt:         record.Receipt,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// panics counts the handler panics recovered, published through expvar at
+// /debug/vars.
+var panics = expvar.NewInt("panics")
+
+// recoverPanics answers a request whose handler panicked with a 500
+// problem instead of dropping the connection, and logs the panic with its
+// stack. It must run inside withRequestID for the problem and the log line
+// to carry the request ID. http.ErrAbortHandler, which handlers panic with
+// to abort a response on purpose, is passed on.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			panics.Add(1)
+			slog.ErrorContext(r.Context(), "handler panicked",
+				slog.String("panic", fmt.Sprint(v)),
+				slog.String("stack", string(debug.Stack())))
+			if recorder.status != 0 || recorder.bytes > 0 {
+				// Part of the response is out already; all that's left is to
+				// cut it short.
+				panic(http.ErrAbortHandler)
+			}
+			writeProblem(recorder, r, internalErrorProblem)
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// responseCacheMetrics counts the hits, misses, evictions and
+// invalidations of the response cache.
+var responseCacheMetrics = expvar.NewMap("responseCache")
+
+// maxCachedResponseBytes is the largest response body the response cache
+// keeps.
+const maxCachedResponseBytes = 64 << 10
+
+// cachedHeaders are the headers of a response that are cached with it.
+// The rest, such as its request ID, belong to the request that got it.
+var cachedHeaders = []string{"Content-Type", "ETag", "Last-Modified"}
+
+// responseCache keeps the successful responses of receipt lookups for ttl,
+// by URL and caller, evicting the least recently used beyond size.
+type responseCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order has the most recently used entry at the front.
+	order *list.List
+	// receipts has the keys of the entries of each receipt, by stored ID,
+	// for invalidations.
+	receipts map[string]map[string]struct{}
+	// generation counts invalidations, so that a lookup that raced with
+	// one doesn't cache what it read before it.
+	generation uint64
+}
+
+type cachedResponse struct {
+	key     string
+	receipt string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		size:     size,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		receipts: make(map[string]map[string]struct{}),
+	}
+}
+
+// get returns the cached response for key and the generation to add one
+// under if there is none.
+func (c *responseCache) get(key string, now time.Time) (*cachedResponse, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, found := c.entries[key]
+	if found && now.After(element.Value.(*cachedResponse).expires) {
+		c.remove(element)
+		found = false
+	}
+	if !found {
+		responseCacheMetrics.Add("misses", 1)
+		return nil, c.generation, false
+	}
+	responseCacheMetrics.Add("hits", 1)
+	c.order.MoveToFront(element)
+	return element.Value.(*cachedResponse), 0, true
+}
+
+// add caches a response read at generation, unless the cache was
+// invalidated since.
+func (c *responseCache) add(response *cachedResponse, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if element, found := c.entries[response.key]; found {
+		c.remove(element)
+	}
+	c.entries[response.key] = c.order.PushFront(response)
+	keys := c.receipts[response.receipt]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		c.receipts[response.receipt] = keys
+	}
+	keys[response.key] = struct{}{}
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		responseCacheMetrics.Add("evictions", 1)
+	}
+}
+
+// invalidate drops the responses about the receipt id, which was stored
+// or deleted.
+func (c *responseCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key := range c.receipts[id] {
+		c.remove(c.entries[key])
+	}
+	responseCacheMetrics.Add("invalidations", 1)
+}
+
+// remove drops an entry. It must be called with c.mu held.
+func (c *responseCache) remove(element *list.Element) {
+	response := element.Value.(*cachedResponse)
+	c.order.Remove(element)
+	delete(c.entries, response.key)
+	if keys := c.receipts[response.receipt]; keys != nil {
+		delete(keys, response.key)
+		if len(keys) == 0 {
+			delete(c.receipts, response.receipt)
+		}
+	}
+}
+
+// EnableResponseCache caches up to size responses of receipt lookups for
+// ttl, for callers that read the same receipts again and again. The store
+// is wrapped so that every write through the server invalidates those of
+// the receipt written; writes by other processes sharing the store aren't
+// seen until the responses expire.
+func (s *Server) EnableResponseCache(size int, ttl time.Duration) {
+	s.responseCache = newResponseCache(size, ttl)
+	s.store = invalidatingStore{Store: s.store, invalidate: s.responseCache.invalidate}
+}
+
+// cacheResponses is the "responseCache" middleware of the routes of a
+// receipt, which answers from the response cache when it's on. Responses
+// are cached by URL, caller, tenant and accepted format, so that callers
+// never get each other's. It must run inside the "tenant" middleware.
+func (s *Server) cacheResponses() Middleware {
+	if s.responseCache == nil {
+		return Middleware{Name: "responseCache"}
+	}
+	return Middleware{Name: "responseCache", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := tenantFrom(r)
+			key := tenant + "\x00" + ownerOf(r) + "\x00" + r.Header.Get("Accept") + "\x00" + r.URL.RequestURI()
+			now := s.clock.Now()
+			cached, generation, found := s.responseCache.get(key, now)
+			if found {
+				for name, values := range cached.header {
+					w.Header()[name] = values
+				}
+				modified, _ := http.ParseTime(cached.header.Get("Last-Modified"))
+				if notModified(r, cached.header.Get("ETag"), modified) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Write(cached.body)
+				return
+			}
+
+			recorder := &responseRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+			if recorder.status != http.StatusOK || recorder.overflow {
+				return
+			}
+			header := make(http.Header)
+			for _, name := range cachedHeaders {
+				if values := recorder.header.Values(name); len(values) > 0 {
+					header[http.CanonicalHeaderKey(name)] = values
+				}
+			}
+			s.responseCache.add(&cachedResponse{
+				key:     key,
+				receipt: tenantStore{tenant: tenant}.qualify(mux.Vars(r)["id"]),
+				header:  header,
+				body:    recorder.body.Bytes(),
+				expires: now.Add(s.responseCache.ttl),
+			}, generation)
+		})
+	}}
+}
+
+// responseRecorder keeps a copy of the status, headers and body of a
+// response as it goes out, up to maxCachedResponseBytes of body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+	// overflow is set once the body outgrew maxCachedResponseBytes.
+	overflow bool
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if w.body.Len()+len(p) > maxCachedResponseBytes {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testClock is a Clock the test moves by hand.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func TestResponseCacheExpiresByServerClock(t *testing.T) {
+	clock := &testClock{now: time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)}
+	s := NewServer(NewMemoryStore(), nil, clock, uuidGenerator{}, ServerConfig{})
+	s.EnableResponseCache(10, 30*time.Second)
+
+	calls := 0
+	handler := s.cacheResponses().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"points":28}`))
+	}))
+	get := func() {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/r1/points", nil))
+		if w.Code != http.StatusOK || w.Body.String() != `{"points":28}` {
+			t.Fatalf("GET = %d %s", w.Code, w.Body)
+		}
+	}
+
+	get()
+	clock.now = clock.now.Add(29 * time.Second)
+	get()
+	if calls != 1 {
+		t.Fatalf("handler ran %d times within the TTL, want 1", calls)
+	}
+	clock.now = clock.now.Add(2 * time.Second)
+	get()
+	if calls != 2 {
+		t.Errorf("handler ran %d times after the TTL, want 2", calls)
+	}
+}
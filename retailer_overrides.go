@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+// RetailerOverride adjusts the points of receipts from one retailer, or
+// from every retailer matching a pattern. Overrides are managed through the
+// admin API and persisted to the retailer overrides file, if one is set.
+type RetailerOverride struct {
+	ID string `json:"id"`
+	// Retailer matches retailer names with the same canonical name, see
+	// canonicalRetailer. Pattern is a regular expression matched against the
+	// name as submitted, ignoring case. Exactly one of them must be set.
+	Retailer string `json:"retailer,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+	// Multiplier is a decimal with two places, such as "1.50", applied to
+	// the points from the scoring rules. Empty leaves them unchanged.
+	Multiplier string `json:"multiplier,omitempty"`
+	Bonus      int    `json:"bonus,omitempty"`
+
+	pattern    *regexp.Regexp
+	multiplier int64
+}
+
+func (o *RetailerOverride) compile() error {
+	if (o.Retailer == "") == (o.Pattern == "") {
+		return errors.New("exactly one of retailer and pattern must be set")
+	}
+	if o.Pattern != "" {
+		pattern, err := regexp.Compile("(?i)" + o.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern must be a regular expression: %w", err)
+		}
+		o.pattern = pattern
+	}
+	if o.Multiplier != "" {
+		multiplier, err := parseCents(o.Multiplier)
+		if err != nil {
+			return fmt.Errorf("multiplier must be a decimal with two places: %w", err)
+		}
+		o.multiplier = int64(multiplier)
+	}
+	return nil
+}
+
+func (o *RetailerOverride) matches(retailer, canonical string, aliases map[string]string) bool {
+	if o.pattern != nil {
+		return o.pattern.MatchString(retailer)
+	}
+	return canonicalRetailer(o.Retailer, aliases) == canonical
+}
+
+// applyRetailerOverride applies the first override matching the receipt's
+// retailer.
+func (rs *RuleSet) applyRetailerOverride(breakdown *PointsBreakdown, receipt *Receipt) {
+	canonical := canonicalRetailer(receipt.Retailer, rs.RetailerAliases)
+	for i := range rs.RetailerOverrides {
+		o := &rs.RetailerOverrides[i]
+		if !o.matches(receipt.Retailer, canonical, rs.RetailerAliases) {
+			continue
+		}
+		points := o.Bonus
+		if o.multiplier != 0 {
+			points += int(int64(breakdown.Points) * (o.multiplier - 100) / 100)
+		}
+		breakdown.add("retailer-override:"+o.ID, points)
+		return
+	}
+}
+
+// withRetailerConfig returns a copy of the rule set using the retailer
+// overrides and aliases. Like plugins, they are folded into the version.
+func (rs *RuleSet) withRetailerConfig(overrides []RetailerOverride, aliases map[string]string) *RuleSet {
+	rules := *rs
+	rules.RetailerOverrides = overrides
+	rules.RetailerAliases = aliases
+	if len(overrides) == 0 && len(aliases) == 0 {
+		return &rules
+	}
+	data, _ := json.Marshal(map[string]any{"overrides": overrides, "aliases": aliases})
+	sum := sha256.Sum256(data)
+	rules.Version += "+" + hex.EncodeToString(sum[:4])
+	return &rules
+}
+
+func loadRetailerOverrides(path string) ([]RetailerOverride, error) {
+	var overrides []RetailerOverride
+	if err := loadJSONFile(path, &overrides); err != nil {
+		return nil, err
+	}
+	for i := range overrides {
+		if err := overrides[i].compile(); err != nil {
+			return nil, fmt.Errorf("retailer override %s: %w", overrides[i].ID, err)
+		}
+	}
+	return overrides, nil
+}
+
+// loadJSONFile decodes the file at path into v. A missing file, or an
+// empty path, leaves v alone.
+func loadJSONFile(path string, v any) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// saveJSONFile replaces the file through a rename, so a crash never leaves
+// it half written. An empty path saves nothing.
+func saveJSONFile(path string, v any) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+var errOverrideNotFound = errors.New("retailer override not found")
+
+// RetailerOverrides lists the overrides in the order they are tried.
+func (e *RulesEngine) RetailerOverrides() []RetailerOverride {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]RetailerOverride{}, e.overrides...)
+}
+
+// updateRetailerOverrides replaces the overrides with the result of update,
+// saves them and swaps in rules that use them.
+func (e *RulesEngine) updateRetailerOverrides(update func([]RetailerOverride) ([]RetailerOverride, error)) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	overrides, err := update(append([]RetailerOverride{}, e.overrides...))
+	if err != nil {
+		return err
+	}
+	if err := saveJSONFile(e.overridesPath, overrides); err != nil {
+		return fmt.Errorf("save retailer overrides: %w", err)
+	}
+	e.overrides = overrides
+	e.activate(e.base.withRetailerConfig(overrides, e.aliases))
+	return nil
+}
+
+func retailerOverrideProblem(err error) Problem {
+	if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+		return problem
+	}
+	return Problem{
+		Type:   "/problems/invalid-retailer-override",
+		Title:  "The retailer override is invalid",
+		Status: http.StatusBadRequest,
+		Detail: err.Error(),
+	}
+}
+
+func decodeRetailerOverride(r *http.Request) (RetailerOverride, error) {
+	var override RetailerOverride
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&override); err != nil {
+		return RetailerOverride{}, err
+	}
+	if err := override.compile(); err != nil {
+		return RetailerOverride{}, err
+	}
+	return override, nil
+}
+
+func (s *Server) ListRetailerOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.rules.RetailerOverrides())
+}
+
+// CreateRetailerOverrideHandler adds an override, tried after the existing
+// ones.
+func (s *Server) CreateRetailerOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	override, err := decodeRetailerOverride(r)
+	if err != nil {
+		writeProblem(w, r, retailerOverrideProblem(err))
+		return
+	}
+	override.ID = s.ids.NewID()
+
+	err = s.rules.updateRetailerOverrides(func(overrides []RetailerOverride) ([]RetailerOverride, error) {
+		return append(overrides, override), nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=create-retailer-override override=%s", override.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/retailer-overrides/"+override.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(override)
+}
+
+func (s *Server) GetRetailerOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	for _, override := range s.rules.RetailerOverrides() {
+		if override.ID == id {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(override)
+			return
+		}
+	}
+	writeError(w, r, errOverrideNotFound)
+}
+
+// UpdateRetailerOverrideHandler replaces an override, keeping its place in
+// the order.
+func (s *Server) UpdateRetailerOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	override, err := decodeRetailerOverride(r)
+	if err != nil {
+		writeProblem(w, r, retailerOverrideProblem(err))
+		return
+	}
+	override.ID = id
+
+	err = s.rules.updateRetailerOverrides(func(overrides []RetailerOverride) ([]RetailerOverride, error) {
+		for i := range overrides {
+			if overrides[i].ID == id {
+				overrides[i] = override
+				return overrides, nil
+			}
+		}
+		return nil, errOverrideNotFound
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=update-retailer-override override=%s", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(override)
+}
+
+func (s *Server) DeleteRetailerOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	err := s.rules.updateRetailerOverrides(func(overrides []RetailerOverride) ([]RetailerOverride, error) {
+		for i := range overrides {
+			if overrides[i].ID == id {
+				return append(overrides[:i], overrides[i+1:]...), nil
+			}
+		}
+		return nil, errOverrideNotFound
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=delete-retailer-override override=%s", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	// storeNumberPattern matches branch numbers such as "#123", "store 45"
+	// or "no. 6".
+	storeNumberPattern = regexp.MustCompile(`(?:#|\bstore\s*|\bno\.?\s*)\d+`)
+	domainPattern      = regexp.MustCompile(`^www\.|\.(?:com|net|org|co|us|ca)\b`)
+	punctuationPattern = regexp.MustCompile(`[^\p{L}\p{N}\s]+`)
+)
+
+// retailerKey normalizes a retailer name: it is case-folded and loses store
+// numbers, web domains and punctuation, so "Wal-Mart #123" and "walmart.com"
+// both become "walmart".
+func retailerKey(name string) string {
+	key := strings.ToLower(name)
+	key = storeNumberPattern.ReplaceAllString(key, " ")
+	key = domainPattern.ReplaceAllString(key, " ")
+	key = punctuationPattern.ReplaceAllString(key, "")
+	return strings.Join(strings.Fields(key), " ")
+}
+
+// canonicalRetailer returns the canonical name for a retailer: the name its
+// key is aliased to, or the key itself.
+func canonicalRetailer(name string, aliases map[string]string) string {
+	key := retailerKey(name)
+	if canonical, ok := aliases[key]; ok {
+		return canonical
+	}
+	return key
+}
+
+func (e *RulesEngine) RetailerAliases() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	aliases := make(map[string]string, len(e.aliases))
+	for alias, canonical := range e.aliases {
+		aliases[alias] = canonical
+	}
+	return aliases
+}
+
+// updateRetailerAliases applies update to a copy of the aliases, saves
+// them and swaps in rules that use them.
+func (e *RulesEngine) updateRetailerAliases(update func(map[string]string) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	aliases := make(map[string]string, len(e.aliases))
+	for alias, canonical := range e.aliases {
+		aliases[alias] = canonical
+	}
+	if err := update(aliases); err != nil {
+		return err
+	}
+	if err := saveJSONFile(e.aliasesPath, aliases); err != nil {
+		return fmt.Errorf("save retailer aliases: %w", err)
+	}
+	e.aliases = aliases
+	e.activate(e.base.withRetailerConfig(e.overrides, aliases))
+	return nil
+}
+
+var errAliasNotFound = errors.New("retailer alias not found")
+
+type RetailerAlias struct {
+	Alias     string `json:"alias"`
+	Canonical string `json:"canonical"`
+}
+
+type CanonicalRetailerResponse struct {
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+	Canonical string `json:"canonical"`
+}
+
+// CanonicalRetailerHandler shows how a retailer name is normalized.
+func (s *Server) CanonicalRetailerHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "The name parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	response := CanonicalRetailerResponse{
+		Name:      name,
+		Key:       retailerKey(name),
+		Canonical: canonicalRetailer(name, s.rules.Current().RetailerAliases),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) ListRetailerAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.rules.RetailerAliases())
+}
+
+// PutRetailerAliasHandler maps a retailer name, once normalized, to a
+// canonical name.
+func (s *Server) PutRetailerAliasHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	var alias RetailerAlias
+	if err := json.NewDecoder(r.Body).Decode(&alias); err != nil {
+		http.Error(w, "Invalid alias", http.StatusBadRequest)
+		return
+	}
+	alias.Alias = retailerKey(mux.Vars(r)["alias"])
+	alias.Canonical = strings.TrimSpace(alias.Canonical)
+	if alias.Alias == "" || alias.Canonical == "" {
+		http.Error(w, "The alias and canonical name must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	err := s.rules.updateRetailerAliases(func(aliases map[string]string) error {
+		aliases[alias.Alias] = alias.Canonical
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=put-retailer-alias alias=%q canonical=%q", alias.Alias, alias.Canonical)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alias)
+}
+
+func (s *Server) DeleteRetailerAliasHandler(w http.ResponseWriter, r *http.Request) {
+	if boundTenant(r) != "" {
+		writeError(w, r, errAllTenants)
+		return
+	}
+	key := retailerKey(mux.Vars(r)["alias"])
+	err := s.rules.updateRetailerAliases(func(aliases map[string]string) error {
+		if _, found := aliases[key]; !found {
+			return errAliasNotFound
+		}
+		delete(aliases, key)
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=delete-retailer-alias alias=%q", key)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// RetentionArchive keeps the receipts the retention sweep removes in an
+// object store, as <id>.json with the receipt's attachment, if it has one,
+// beside it as <id>.attachment. Receipts of other tenants are under their
+// tenant.
+type RetentionArchive struct {
+	bucket ObjectStore
+	prefix string
+}
+
+// OpenRetentionArchive opens a local directory, or the bucket of an
+// s3://bucket/prefix or gs://bucket/prefix URL, to archive receipts to.
+func OpenRetentionArchive(location string) (*RetentionArchive, error) {
+	bucket, prefix, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	return &RetentionArchive{bucket: bucket, prefix: prefix}, nil
+}
+
+func (a *RetentionArchive) Close() error { return a.bucket.Close() }
+
+// EnableRetentionArchive archives the receipts past their retention to
+// archive before they are removed.
+func (s *Server) EnableRetentionArchive(archive *RetentionArchive) {
+	s.archive = archive
+}
+
+// retainedUntil is when a receipt is removed, or the zero time when it is
+// kept forever. Receipts stored before processing times were recorded are
+// kept.
+func (s *Server) retainedUntil(record ReceiptRecord) time.Time {
+	if s.cfg.Retention <= 0 || record.ProcessedAt.IsZero() {
+		return time.Time{}
+	}
+	return record.ProcessedAt.Add(s.cfg.Retention)
+}
+
+// sweepRetention removes the receipts past their retention every interval.
+func (s *Server) sweepRetention(interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := s.removeRetired(s.clock.Now())
+		if err != nil {
+			slog.Error("Failed to remove receipts past their retention", "err", err)
+		}
+		if removed > 0 {
+			slog.Info("Removed receipts past their retention", "receipts", removed)
+		}
+	}
+}
+
+// removeRetired removes the receipts whose retention ended by now, of
+// every tenant, archiving them first if archiving is on, and returns how
+// many it removed. A receipt that can't be archived is kept for the next
+// sweep.
+func (s *Server) removeRetired(now time.Time) (int, error) {
+	ctx := context.Background()
+	var removed int
+	err := s.forEachReceipt(func(record ReceiptRecord) {
+		if at := s.retainedUntil(record); at.IsZero() || at.After(now) {
+			return
+		}
+		if err := s.archiveReceipt(ctx, record); err != nil {
+			slog.Error("Failed to archive a receipt past its retention", "receiptId", record.ID, "err", err)
+			return
+		}
+		if err := s.retire(record.ID); err != nil {
+			slog.Error("Failed to remove a receipt past its retention", "receiptId", record.ID, "err", err)
+			return
+		}
+		// Attachments are keyed by the plain ID within the tenant.
+		s.deleteAttachment(ctx, strings.TrimPrefix(record.ID, tenantOfID(record.ID)+tenantSeparator))
+		auditEvent("action=retire receipt=%s archived=%t", record.ID, s.archive != nil)
+		removed++
+	})
+	return removed, err
+}
+
+// retire removes a stored receipt, under the amendment lock so that a
+// concurrent amendment doesn't store it again.
+func (s *Server) retire(id string) error {
+	s.amendMu.Lock()
+	defer s.amendMu.Unlock()
+	return s.store.Delete(id)
+}
+
+// archiveReceipt copies a receipt, and its attachment, to the archive, if
+// archiving is on.
+func (s *Server) archiveReceipt(ctx context.Context, record ReceiptRecord) error {
+	if s.archive == nil {
+		return nil
+	}
+	key := s.archive.prefix + record.ID
+	if record.Attachment != nil && s.attachments != nil {
+		plainID := strings.TrimPrefix(record.ID, tenantOfID(record.ID)+tenantSeparator)
+		attachment, err := s.attachments.bucket.Open(ctx, s.attachments.key(plainID))
+		if err != nil {
+			return fmt.Errorf("open the attachment: %w", err)
+		}
+		data, err := io.ReadAll(attachment)
+		attachment.Close()
+		if err != nil {
+			return fmt.Errorf("read the attachment: %w", err)
+		}
+		if err := s.archive.bucket.Put(ctx, key+".attachment", data, record.Attachment.ContentType); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.archive.bucket.Put(ctx, key+".json", data, "application/json")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type ReviewStatus string
+
+const (
+	// ReviewPending receipts were flagged and wait for a reviewer. Their
+	// points don't count toward their user's balance yet.
+	ReviewPending ReviewStatus = "pending"
+	// ReviewApproved receipts were found fine and award their points.
+	ReviewApproved ReviewStatus = "approved"
+	// ReviewRejected receipts were found invalid and award no points.
+	ReviewRejected ReviewStatus = "rejected"
+)
+
+// Review tracks the manual review of a flagged receipt.
+type Review struct {
+	Status ReviewStatus `json:"status"`
+	// Reason explains a rejection.
+	Reason     string     `json:"reason,omitempty"`
+	ReviewedBy string     `json:"reviewedBy,omitempty"`
+	ReviewedAt *time.Time `json:"reviewedAt,omitempty"`
+}
+
+// awardsPoints reports whether a receipt's points count toward its user's
+// balance as far as its review is concerned.
+func (r *Review) awardsPoints() bool {
+	return r == nil || r.Status == ReviewApproved
+}
+
+var errNotPendingReview = errors.New("the receipt isn't awaiting review")
+
+type RejectReceiptRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (s *Server) ApproveReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	s.reviewReceipt(w, r, ReviewApproved, "")
+}
+
+// RejectReceiptHandler rejects a flagged receipt, taking away its points.
+// A reason is required.
+func (s *Server) RejectReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	var request RejectReceiptRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "The request must be a JSON object with a reason", http.StatusBadRequest)
+		return
+	}
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.Reason == "" {
+		http.Error(w, "A reason is required to reject a receipt", http.StatusBadRequest)
+		return
+	}
+	s.reviewReceipt(w, r, ReviewRejected, request.Reason)
+}
+
+// reviewReceipt moves a receipt awaiting review to status.
+func (s *Server) reviewReceipt(w http.ResponseWriter, r *http.Request, status ReviewStatus, reason string) {
+	id := mux.Vars(r)["id"]
+	record, err := s.review(s.tenantStore(r.Context(), tenantFrom(r)), id, status, reason, ownerOf(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=review receipt=%s status=%s reason=%q", id, status, reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newReceiptResponse(record))
+}
+
+// review records the outcome of a receipt's review. Rejected receipts
+// lose their points, which is recorded as an amendment.
+func (s *Server) review(store Store, id string, status ReviewStatus, reason, reviewer string) (ReceiptRecord, error) {
+	s.amendMu.Lock()
+	defer s.amendMu.Unlock()
+
+	record, err := store.Get(id)
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	if record.Review == nil || record.Review.Status != ReviewPending {
+		return ReceiptRecord{}, errNotPendingReview
+	}
+
+	now := s.clock.Now().UTC()
+	record.Review = &Review{Status: status, Reason: reason, ReviewedBy: reviewer, ReviewedAt: &now}
+	if status == ReviewRejected {
+		record.Amendments = append(record.Amendments, Amendment{
+			AmendedAt:            now,
+			PreviousPoints:       record.Points,
+			PreviousRulesVersion: record.RulesVersion,
+		})
+		record.Points = 0
+	}
+	return record, store.Put(record)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The messages of receipts.v1.ReceiptService. The REST types are reused
+// where the messages have the same fields.
+
+type ProcessReceiptRequest struct {
+	Receipt Receipt
+}
+
+type GetPointsRequest struct {
+	ID string
+}
+
+type BatchProcessRequest struct {
+	Receipts []Receipt
+}
+
+type BatchProcessResponse struct {
+	Results []BatchResult
+}
+
+func (m *Item) marshalProto() []byte {
+	b := appendString(nil, 1, m.ShortDescription)
+	return appendString(b, 2, m.Price)
+}
+
+func (m *Item) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.ShortDescription = f.string()
+		case 2:
+			m.Price = f.string()
+		default:
+			return nil
+		}
+		return f.want(wireBytes)
+	})
+}
+
+func (m *Receipt) marshalProto() []byte {
+	b := appendString(nil, 1, m.Retailer)
+	b = appendString(b, 2, m.PurchaseDate)
+	b = appendString(b, 3, m.PurchaseTime)
+	for i := range m.Items {
+		b = appendMessage(b, 4, &m.Items[i])
+	}
+	b = appendString(b, 5, m.Total)
+	return appendString(b, 6, m.UserID)
+}
+
+func (m *Receipt) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		if f.num < 1 || f.num > 6 {
+			return nil
+		}
+		if err := f.want(wireBytes); err != nil {
+			return err
+		}
+		switch f.num {
+		case 1:
+			m.Retailer = f.string()
+		case 2:
+			m.PurchaseDate = f.string()
+		case 3:
+			m.PurchaseTime = f.string()
+		case 4:
+			var item Item
+			if err := item.unmarshalProto(f.bytes); err != nil {
+				return err
+			}
+			m.Items = append(m.Items, item)
+		case 5:
+			m.Total = f.string()
+		case 6:
+			m.UserID = f.string()
+		}
+		return nil
+	})
+}
+
+func (m *ProcessReceiptRequest) marshalProto() []byte {
+	return appendMessage(nil, 1, &m.Receipt)
+}
+
+func (m *ProcessReceiptRequest) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		if err := f.want(wireBytes); err != nil {
+			return err
+		}
+		return m.Receipt.unmarshalProto(f.bytes)
+	})
+}
+
+func (m *ProcessResponse) marshalProto() []byte {
+	b := appendString(nil, 1, m.ID)
+	return appendBool(b, 2, m.Flagged)
+}
+
+func (m *ProcessResponse) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.ID = f.string()
+			return f.want(wireBytes)
+		case 2:
+			m.Flagged = f.varint != 0
+			return f.want(wireVarint)
+		}
+		return nil
+	})
+}
+
+func (m *GetPointsRequest) marshalProto() []byte {
+	return appendString(nil, 1, m.ID)
+}
+
+func (m *GetPointsRequest) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		m.ID = f.string()
+		return f.want(wireBytes)
+	})
+}
+
+func (m *PointsResponse) marshalProto() []byte {
+	b := appendInt64(nil, 1, int64(m.Points))
+	return appendString(b, 2, m.RulesVersion)
+}
+
+func (m *PointsResponse) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.Points = int(int64(f.varint))
+			return f.want(wireVarint)
+		case 2:
+			m.RulesVersion = f.string()
+			return f.want(wireBytes)
+		}
+		return nil
+	})
+}
+
+func (m *BatchProcessRequest) marshalProto() []byte {
+	var b []byte
+	for i := range m.Receipts {
+		b = appendMessage(b, 1, &m.Receipts[i])
+	}
+	return b
+}
+
+func (m *BatchProcessRequest) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		if err := f.want(wireBytes); err != nil {
+			return err
+		}
+		var receipt Receipt
+		if err := receipt.unmarshalProto(f.bytes); err != nil {
+			return err
+		}
+		m.Receipts = append(m.Receipts, receipt)
+		return nil
+	})
+}
+
+func (m *FieldError) marshalProto() []byte {
+	b := appendString(nil, 1, m.Field)
+	b = appendString(b, 2, m.Reason)
+	return appendString(b, 3, m.Value)
+}
+
+func (m *FieldError) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.Field = f.string()
+		case 2:
+			m.Reason = f.string()
+		case 3:
+			m.Value = f.string()
+		default:
+			return nil
+		}
+		return f.want(wireBytes)
+	})
+}
+
+func (m *BatchResult) marshalProto() []byte {
+	b := appendString(nil, 1, m.ID)
+	if m.Points != nil {
+		b = appendOptionalInt64(b, 2, int64(*m.Points))
+	}
+	b = appendString(b, 3, m.Error)
+	b = appendBool(b, 4, m.Flagged)
+	for i := range m.InvalidParams {
+		b = appendMessage(b, 5, &m.InvalidParams[i])
+	}
+	return b
+}
+
+func (m *BatchResult) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.ID = f.string()
+			return f.want(wireBytes)
+		case 2:
+			points := int(int64(f.varint))
+			m.Points = &points
+			return f.want(wireVarint)
+		case 3:
+			m.Error = f.string()
+			return f.want(wireBytes)
+		case 4:
+			m.Flagged = f.varint != 0
+			return f.want(wireVarint)
+		case 5:
+			if err := f.want(wireBytes); err != nil {
+				return err
+			}
+			var fe FieldError
+			if err := fe.unmarshalProto(f.bytes); err != nil {
+				return err
+			}
+			m.InvalidParams = append(m.InvalidParams, fe)
+		}
+		return nil
+	})
+}
+
+func (m *BatchProcessResponse) marshalProto() []byte {
+	var b []byte
+	for i := range m.Results {
+		b = appendMessage(b, 1, &m.Results[i])
+	}
+	return b
+}
+
+func (m *BatchProcessResponse) unmarshalProto(data []byte) error {
+	return readProtoFields(data, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		if err := f.want(wireBytes); err != nil {
+			return err
+		}
+		var result BatchResult
+		if err := result.unmarshalProto(f.bytes); err != nil {
+			return err
+		}
+		m.Results = append(m.Results, result)
+		return nil
+	})
+}
+
+// rpcRefusal is a problem an RPC was refused with before it got to the
+// service, such as for missing credentials.
+type rpcRefusal struct {
+	problem Problem
+}
+
+func (e *rpcRefusal) Error() string { return e.problem.Detail }
+
+// rpcResponse keeps what the middleware of an RPC wrote in its place.
+type rpcResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *rpcResponse) Header() http.Header { return w.header }
+
+func (w *rpcResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *rpcResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// refusal returns the problem written, if any.
+func (w *rpcResponse) refusal() error {
+	if w.status == 0 {
+		return nil
+	}
+	var problem Problem
+	if json.Unmarshal(w.body.Bytes(), &problem) != nil || problem.Status == 0 {
+		// Written with http.Error.
+		problem = Problem{Status: w.status, Detail: strings.TrimSpace(w.body.String())}
+	}
+	return &rpcRefusal{problem}
+}
+
+// serveRPC runs call as if the RPC were a request to the REST API with
+// its metadata for headers, so that RPCs are authenticated, rate limited,
+// charged and given a tenant the same way. Refusals come back as an
+// *rpcRefusal.
+func serveRPC[Req, Resp any](s *Server, ctx context.Context, method string, header http.Header, scope Scope, req Req,
+	call func(w http.ResponseWriter, r *http.Request, req Req) (Resp, error)) (Resp, error) {
+	var resp Resp
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, method, http.NoBody)
+	if err != nil {
+		return resp, err
+	}
+	r.Header = header
+	w := &rpcResponse{header: make(http.Header)}
+	chain := Chain{
+		s.requireScope(scope),
+		{Name: "rateLimit", Wrap: s.rateLimited},
+		{Name: "tenant", Wrap: s.withTenant},
+	}
+	chain.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err = call(w, r, req)
+	})).ServeHTTP(w, r)
+	if refused := w.refusal(); refused != nil {
+		return resp, refused
+	}
+	return resp, err
+}
+
+func (s *Server) rpcProcessReceipt(w http.ResponseWriter, r *http.Request, req *ProcessReceiptRequest) (*ProcessResponse, error) {
+	receipt := req.Receipt
+	if err := s.checkReceipt(&receipt); err != nil {
+		return nil, err
+	}
+	if !s.chargeQuota(w, r, 1) {
+		return nil, nil
+	}
+	record, err := s.processReceipt(receipt, submitterOf(r))
+	if err != nil {
+		s.refundQuota(r, 1)
+		return nil, err
+	}
+	return &ProcessResponse{ID: record.ID, Flagged: len(record.Flags) > 0}, nil
+}
+
+func (s *Server) rpcGetPoints(w http.ResponseWriter, r *http.Request, req *GetPointsRequest) (*PointsResponse, error) {
+	record, err := s.tenantStore(r.Context(), tenantFrom(r)).Get(req.ID)
+	if err == nil && !ownedBy(r, record.Owner) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PointsResponse{Points: record.Points, RulesVersion: record.RulesVersion}, nil
+}
+
+func (s *Server) rpcBatchProcess(w http.ResponseWriter, r *http.Request, req *BatchProcessRequest) (*BatchProcessResponse, error) {
+	if len(req.Receipts) == 0 || len(req.Receipts) > s.cfg.BatchMaxSize {
+		return nil, &rpcRefusal{Problem{
+			Status: http.StatusBadRequest,
+			Detail: fmt.Sprintf("The batch must contain between 1 and %d receipts", s.cfg.BatchMaxSize),
+		}}
+	}
+	if !s.chargeQuota(w, r, len(req.Receipts)) {
+		return nil, nil
+	}
+	from := submitterOf(r)
+	results := s.processBatch(len(req.Receipts), func(i int) BatchResult {
+		receipt := req.Receipts[i]
+		if err := s.checkReceipt(&receipt); err != nil {
+			return invalidReceiptResult(err)
+		}
+		return s.processBatchReceipt(from, receipt)
+	})
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	s.refundQuota(r, failed)
+	return &BatchProcessResponse{Results: results}, nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+type RuleResult struct {
+	Rule   string `json:"rule"`
+	Points int    `json:"points"`
+}
+
+// PointsBreakdown lists the rules that awarded points for a receipt, in
+// evaluation order, along with their total.
+type PointsBreakdown struct {
+	Points       int          `json:"points"`
+	Rules        []RuleResult `json:"rules"`
+	RulesVersion string       `json:"rulesVersion"`
+	// Campaigns lists the IDs of the campaigns the receipt qualified for.
+	Campaigns []string `json:"campaigns,omitempty"`
+	// Items lists the category of every item, when item categories are
+	// configured.
+	Items []CategorizedItem `json:"items,omitempty"`
+}
+
+func (b *PointsBreakdown) add(rule string, points int) {
+	if points == 0 {
+		return
+	}
+	b.Rules = append(b.Rules, RuleResult{Rule: rule, Points: points})
+	b.Points += points
+}
+
+type TimeWindow struct {
+	// Name labels the window's points in breakdowns. It defaults to
+	// "purchase-time-<n>" for the nth window.
+	Name string `json:"name,omitempty"`
+	// Start and End are HH:MM times. By default a purchase must fall
+	// strictly between them, as in the specification.
+	Start          string `json:"start"`
+	End            string `json:"end"`
+	StartInclusive bool   `json:"startInclusive,omitempty"`
+	EndInclusive   bool   `json:"endInclusive,omitempty"`
+	Points         int    `json:"points"`
+
+	start, end time.Time
+}
+
+func (w *TimeWindow) compile() error {
+	var err error
+	if w.start, err = time.Parse("15:04", w.Start); err != nil {
+		return fmt.Errorf("start must be an HH:MM time")
+	}
+	if w.end, err = time.Parse("15:04", w.End); err != nil {
+		return fmt.Errorf("end must be an HH:MM time")
+	}
+	if !w.start.Before(w.end) {
+		return fmt.Errorf("start must be before end")
+	}
+	return nil
+}
+
+func (w *TimeWindow) contains(t time.Time) bool {
+	afterStart := t.After(w.start) || w.StartInclusive && t.Equal(w.start)
+	beforeEnd := t.Before(w.end) || w.EndInclusive && t.Equal(w.end)
+	return afterStart && beforeEnd
+}
+
+// CustomRule awards Points to receipts matching a CEL expression, such as
+// `retailer.contains("Target") && total > 50.0`. Expressions can refer to
+// retailer, purchaseDate, purchaseTime, total and items, whose elements
+// have a shortDescription and a price. Amounts are in dollars.
+type CustomRule struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	Points     int    `json:"points"`
+
+	expression ruleExpression
+}
+
+// ruleExpression is a compiled CustomRule expression.
+type ruleExpression interface {
+	Matches(receipt *Receipt) (bool, error)
+}
+
+// RuleSet holds the parameters of the scoring rules. Its zero values are not
+// meaningful; start from DefaultRuleSet.
+type RuleSet struct {
+	// Version names the rule set. When the rules file leaves it out, it is
+	// derived from the parameters so identical rules get the same version.
+	Version string `json:"version,omitempty"`
+
+	// Rule 1: points for every alphanumeric character in the retailer name.
+	// Only ASCII letters and digits count, as in the specification, unless
+	// UnicodeRetailerNames is set; then receipts may also use, and score
+	// for, letters and digits of any script.
+	// With NormalizeRetailerNames, the characters of the canonical retailer
+	// name are counted instead, so "WALMART" and "Wal-Mart #123" score the
+	// same.
+	RetailerCharacterPoints int  `json:"retailerCharacterPoints"`
+	UnicodeRetailerNames    bool `json:"unicodeRetailerNames,omitempty"`
+	NormalizeRetailerNames  bool `json:"normalizeRetailerNames,omitempty"`
+	// Rule 2: points if the total is a round dollar amount with no cents.
+	RoundTotalPoints int `json:"roundTotalPoints"`
+	// Rule 3: points if the total is a multiple of 0.25.
+	QuarterMultiplePoints int `json:"quarterMultiplePoints"`
+	// Rule 4: points for every ItemGroupSize items on the receipt.
+	ItemGroupSize   int `json:"itemGroupSize"`
+	ItemGroupPoints int `json:"itemGroupPoints"`
+	// Rule 5: if the trimmed length of an item description is a multiple of
+	// DescriptionLengthMultiple, the price times DescriptionPriceMultiplier
+	// (a decimal such as "0.20") rounded up.
+	DescriptionLengthMultiple  int    `json:"descriptionLengthMultiple"`
+	DescriptionPriceMultiplier string `json:"descriptionPriceMultiplier"`
+	// Rule 6: points if the day in the purchase date is odd.
+	OddDayPoints int `json:"oddDayPoints"`
+	// Rule 7: points for each window the time of purchase falls in.
+	PurchaseTimeWindows []TimeWindow `json:"purchaseTimeWindows"`
+	// PurchaseTimeWindow is the single window older rules files set. When
+	// present it replaces PurchaseTimeWindows.
+	PurchaseTimeWindow *TimeWindow `json:"purchaseTimeWindow,omitempty"`
+
+	// Points if the purchase date is a Saturday or a Sunday.
+	WeekendPoints int `json:"weekendPoints,omitempty"`
+	// Points if the purchase date is a holiday. Holidays are listed as
+	// YYYY-MM-DD dates and read from HolidayCalendar, a file or http(s) URL
+	// in the formats accepted by loadHolidayCalendar.
+	HolidayPoints   int      `json:"holidayPoints,omitempty"`
+	Holidays        []string `json:"holidays,omitempty"`
+	HolidayCalendar string   `json:"holidayCalendar,omitempty"`
+	holidays        HolidayCalendar
+
+	// ItemCategories are tried in order; an item belongs to the first one
+	// it matches.
+	ItemCategories []ItemCategory `json:"itemCategories,omitempty"`
+
+	// CustomRules run after the built-in rules, in order.
+	CustomRules []CustomRule `json:"customRules,omitempty"`
+
+	// Plugins names the scoring plugins loaded at startup, which run last.
+	// They aren't read from the rules file.
+	Plugins []string `json:"plugins,omitempty"`
+	plugins []scoringPlugin
+
+	// RetailerOverrides are managed through the admin API rather than the
+	// rules file. They apply after the plugins.
+	RetailerOverrides []RetailerOverride `json:"retailerOverrides,omitempty"`
+	// RetailerAliases maps retailer keys to canonical retailer names. Like
+	// the overrides, they are managed through the admin API.
+	RetailerAliases map[string]string `json:"retailerAliases,omitempty"`
+
+	// Campaigns are promotions applied after every other rule.
+	Campaigns []Campaign `json:"campaigns,omitempty"`
+
+	// descriptionMultiplier is DescriptionPriceMultiplier in hundredths.
+	descriptionMultiplier int64
+}
+
+var alphanumeric = regexp.MustCompile(`[a-zA-Z0-9]`)
+
+// DefaultRuleSet returns the rules from the receipt processor
+// specification.
+func DefaultRuleSet() *RuleSet {
+	rules := &RuleSet{
+		RetailerCharacterPoints:    1,
+		RoundTotalPoints:           50,
+		QuarterMultiplePoints:      25,
+		ItemGroupSize:              2,
+		ItemGroupPoints:            5,
+		DescriptionLengthMultiple:  3,
+		DescriptionPriceMultiplier: "0.20",
+		OddDayPoints:               6,
+		PurchaseTimeWindows: []TimeWindow{
+			{Name: "afternoon-purchase", Start: "14:00", End: "16:00", Points: 10},
+		},
+	}
+	if err := rules.compile(); err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+type RuleSetVersion struct {
+	Version  string    `json:"version"`
+	LoadedAt time.Time `json:"loadedAt"`
+	Current  bool      `json:"current"`
+	Rules    *RuleSet  `json:"rules"`
+}
+
+// LoadRuleSet reads rule parameters from a JSON file. Parameters missing
+// from the file keep their default values.
+func LoadRuleSet(path string) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open rules file: %w", err)
+	}
+	defer f.Close()
+
+	rules := DefaultRuleSet()
+	// The version of the defaults doesn't describe the file's rules.
+	rules.Version = ""
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(rules); err != nil {
+		return nil, fmt.Errorf("parse rules file %s: %w", path, err)
+	}
+	if err := rules.compile(); err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// compile validates the parameters and precomputes their parsed forms.
+func (rs *RuleSet) compile() error {
+	if rs.ItemGroupSize < 1 {
+		return fmt.Errorf("itemGroupSize must be at least 1")
+	}
+	if rs.DescriptionLengthMultiple < 1 {
+		return fmt.Errorf("descriptionLengthMultiple must be at least 1")
+	}
+	multiplier, err := parseCents(rs.DescriptionPriceMultiplier)
+	if err != nil {
+		return fmt.Errorf("descriptionPriceMultiplier must be a decimal with two places: %w", err)
+	}
+	rs.descriptionMultiplier = int64(multiplier)
+
+	if rs.PurchaseTimeWindow != nil {
+		w := *rs.PurchaseTimeWindow
+		if w.Name == "" {
+			w.Name = "afternoon-purchase"
+		}
+		rs.PurchaseTimeWindows = []TimeWindow{w}
+		rs.PurchaseTimeWindow = nil
+	}
+	windows := make(map[string]bool)
+	for i := range rs.PurchaseTimeWindows {
+		w := &rs.PurchaseTimeWindows[i]
+		if w.Name == "" {
+			w.Name = fmt.Sprintf("purchase-time-%d", i+1)
+		}
+		if windows[w.Name] {
+			return fmt.Errorf("purchaseTimeWindows[%d].name %q is used more than once", i, w.Name)
+		}
+		windows[w.Name] = true
+		if err := w.compile(); err != nil {
+			return fmt.Errorf("purchaseTimeWindows[%d]: %w", i, err)
+		}
+	}
+
+	var calendar holidaySet
+	if rs.HolidayCalendar != "" {
+		if calendar, err = loadHolidayCalendar(rs.HolidayCalendar); err != nil {
+			return fmt.Errorf("holidayCalendar: %w", err)
+		}
+	}
+	if rs.holidays, err = combineHolidays(rs.Holidays, calendar); err != nil {
+		return err
+	}
+
+	if rs.Version == "" {
+		// The calendar's dates count too, since its contents can change
+		// while its location stays the same.
+		params, _ := json.Marshal(rs)
+		h := sha256.New()
+		h.Write(params)
+		for _, date := range rs.holidays.Dates() {
+			h.Write([]byte(date))
+		}
+		rs.Version = hex.EncodeToString(h.Sum(nil)[:6])
+	}
+
+	names := make(map[string]bool)
+	for i := range rs.CustomRules {
+		rule := &rs.CustomRules[i]
+		if rule.Name == "" {
+			return fmt.Errorf("customRules[%d].name is required", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("customRules[%d].name %q is used more than once", i, rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.expression, err = compileExpression(rule.Expression); err != nil {
+			return fmt.Errorf("customRules[%d].expression: %w", i, err)
+		}
+	}
+
+	categories := make(map[string]bool)
+	for i := range rs.ItemCategories {
+		category := &rs.ItemCategories[i]
+		if err := category.compile(); err != nil {
+			return fmt.Errorf("itemCategories[%d]: %w", i, err)
+		}
+		if categories[category.Name] {
+			return fmt.Errorf("itemCategories[%d].name %q is used more than once", i, category.Name)
+		}
+		categories[category.Name] = true
+	}
+
+	ids := make(map[string]bool)
+	for i := range rs.Campaigns {
+		campaign := &rs.Campaigns[i]
+		if err := campaign.compile(); err != nil {
+			return fmt.Errorf("campaigns[%d]: %w", i, err)
+		}
+		if ids[campaign.ID] {
+			return fmt.Errorf("campaigns[%d].id %q is used more than once", i, campaign.ID)
+		}
+		ids[campaign.ID] = true
+	}
+	return nil
+}
+
+// RulesEngine serves the active RuleSet and can swap in a new one from the
+// rules file at runtime. Callers should fetch Current once per request so
+// that a reload never mixes two rule sets within one receipt.
+type RulesEngine struct {
+	path          string
+	overridesPath string
+	aliasesPath   string
+	plugins       []scoringPlugin
+	current       atomic.Pointer[RuleSet]
+
+	// mu guards the fields below and keeps concurrent reloads from
+	// finishing out of order.
+	mu sync.Mutex
+	// base is the last rule set loaded, before the retailer overrides and
+	// aliases.
+	base      *RuleSet
+	overrides []RetailerOverride
+	aliases   map[string]string
+	// versions records every rule set loaded since startup, oldest first,
+	// so that stored scores can be traced back to the rules behind them.
+	versions []RuleSetVersion
+}
+
+type RulesConfig struct {
+	// RulesFile holds the rule parameters; empty uses the default rules.
+	RulesFile string
+	// PluginsDir holds scoring plugins, which are only loaded once;
+	// reloads keep them.
+	PluginsDir string
+	// RetailerOverridesFile persists the retailer overrides. Empty keeps
+	// them in memory only.
+	RetailerOverridesFile string
+	// RetailerAliasesFile likewise persists the retailer aliases.
+	RetailerAliasesFile string
+}
+
+func NewRulesEngine(cfg RulesConfig) (*RulesEngine, error) {
+	plugins, err := loadPlugins(cfg.PluginsDir)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := loadRetailerOverrides(cfg.RetailerOverridesFile)
+	if err != nil {
+		return nil, err
+	}
+	var aliases map[string]string
+	if err := loadJSONFile(cfg.RetailerAliasesFile, &aliases); err != nil {
+		return nil, err
+	}
+	e := &RulesEngine{
+		path:          cfg.RulesFile,
+		overridesPath: cfg.RetailerOverridesFile,
+		aliasesPath:   cfg.RetailerAliasesFile,
+		plugins:       plugins,
+		overrides:     overrides,
+		aliases:       aliases,
+	}
+	if _, err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *RulesEngine) Current() *RuleSet {
+	return e.current.Load()
+}
+
+// Reload re-reads the rules file. The new rule set is only swapped in once
+// it has been validated, so a bad file leaves the current rules active.
+func (e *RulesEngine) Reload() (*RuleSet, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rules := DefaultRuleSet()
+	if e.path != "" {
+		var err error
+		if rules, err = LoadRuleSet(e.path); err != nil {
+			return nil, err
+		}
+	}
+	rules.withPlugins(e.plugins)
+	e.base = rules
+
+	rules = rules.withRetailerConfig(e.overrides, e.aliases)
+	e.activate(rules)
+	return rules, nil
+}
+
+// activate swaps in rules. The caller must hold mu.
+func (e *RulesEngine) activate(rules *RuleSet) {
+	// Reloading an unchanged file keeps the version's original load time.
+	if _, found := e.lookup(rules.Version); !found {
+		e.versions = append(e.versions, RuleSetVersion{
+			Version:  rules.Version,
+			LoadedAt: time.Now().UTC(),
+			Rules:    rules,
+		})
+	}
+	e.current.Store(rules)
+}
+
+// Version returns the rule set with the given version, if it was loaded
+// since startup.
+func (e *RulesEngine) Version(version string) (*RuleSet, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	v, found := e.lookup(version)
+	return v.Rules, found
+}
+
+func (e *RulesEngine) lookup(version string) (RuleSetVersion, bool) {
+	for _, v := range e.versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return RuleSetVersion{}, false
+}
+
+func (e *RulesEngine) Versions() []RuleSetVersion {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	current := e.Current().Version
+	versions := make([]RuleSetVersion, len(e.versions))
+	for i, v := range e.versions {
+		v.Current = v.Version == current
+		versions[i] = v
+	}
+	return versions
+}
+
+// purchasedItems leaves out refund lines, which have negative prices.
+func purchasedItems(items []Item) []Item {
+	purchased := make([]Item, 0, len(items))
+	for _, item := range items {
+		if !strings.HasPrefix(item.Price, "-") {
+			purchased = append(purchased, item)
+		}
+	}
+	return purchased
+}
+
+func (rs *RuleSet) countRetailerCharacters(retailer string) int {
+	if !rs.UnicodeRetailerNames {
+		return len(alphanumeric.FindAllString(retailer, -1))
+	}
+	count := 0
+	for _, r := range retailer {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			count++
+		}
+	}
+	return count
+}
+
+// Score runs every rule over a validated receipt. The time is when the
+// receipt was submitted, which decides the campaigns it qualifies for.
+func (rs *RuleSet) Score(receipt *Receipt, at time.Time) PointsBreakdown {
+	breakdown := PointsBreakdown{Rules: []RuleResult{}, RulesVersion: rs.Version}
+
+	// Rule 1: Points for every alphanumeric character in the retailer name.
+	retailer := receipt.Retailer
+	if rs.NormalizeRetailerNames {
+		retailer = canonicalRetailer(retailer, rs.RetailerAliases)
+	}
+	breakdown.add("retailer-name", rs.RetailerCharacterPoints*rs.countRetailerCharacters(retailer))
+
+	// Rule 2: Points if the total is a round dollar amount with no cents.
+	// Totals that can't be parsed, which validation refuses but older
+	// receipts may have, earn neither this nor rule 3.
+	total, totalErr := parseCents(receipt.Total)
+	if totalErr == nil && total%100 == 0 {
+		breakdown.add("round-total", rs.RoundTotalPoints)
+	}
+
+	// Rule 3: Points if the total is a multiple of 0.25.
+	if totalErr == nil && total%25 == 0 {
+		breakdown.add("quarter-multiple-total", rs.QuarterMultiplePoints)
+	}
+
+	// Rule 4: Points for every group of items on the receipt.
+	// Refund lines don't earn item points.
+	items := purchasedItems(receipt.Items)
+	breakdown.add("item-pairs", len(items)/rs.ItemGroupSize*rs.ItemGroupPoints)
+
+	// Rule 5: If the trimmed length of the item description is a multiple of
+	// the configured length, multiply the price and round up to the nearest
+	// integer.
+	descriptionPoints := 0
+	for _, item := range items {
+		description := strings.TrimSpace(item.ShortDescription)
+		if len(description)%rs.DescriptionLengthMultiple == 0 {
+			price, err := parseCents(item.Price)
+			if err != nil {
+				continue
+			}
+			// Both the price and the multiplier are in hundredths; round up.
+			descriptionPoints += int((int64(price)*rs.descriptionMultiplier + 9999) / 10000)
+		}
+	}
+	breakdown.add("item-description", descriptionPoints)
+
+	// Rule 6: Points if the day in the purchase date is odd.
+	purchaseDate, _ := time.Parse("2006-01-02", receipt.PurchaseDate)
+	if purchaseDate.Day()%2 == 1 {
+		breakdown.add("odd-purchase-day", rs.OddDayPoints)
+	}
+
+	// Rule 7: Points for each window the time of purchase falls inside.
+	purchaseTime, _ := time.Parse("15:04", receipt.PurchaseTime)
+	for i := range rs.PurchaseTimeWindows {
+		w := &rs.PurchaseTimeWindows[i]
+		if w.contains(purchaseTime) {
+			breakdown.add(w.Name, w.Points)
+		}
+	}
+
+	// Points for weekend and holiday purchases.
+	if weekday := purchaseDate.Weekday(); weekday == time.Saturday || weekday == time.Sunday {
+		breakdown.add("weekend-purchase", rs.WeekendPoints)
+	}
+	if rs.holidays.IsHoliday(purchaseDate) {
+		breakdown.add("holiday-purchase", rs.HolidayPoints)
+	}
+
+	rs.applyItemCategories(&breakdown, items)
+
+	// Custom rules: an expression that fails to evaluate awards nothing.
+	for _, rule := range rs.CustomRules {
+		matched, err := rule.expression.Matches(receipt)
+		if err != nil {
+			slog.Warn("Custom rule failed", "rule", rule.Name, "err", err)
+			continue
+		}
+		if matched {
+			breakdown.add(rule.Name, rule.Points)
+		}
+	}
+
+	// Plugins: likewise, a plugin that fails awards nothing.
+	if len(rs.plugins) > 0 {
+		data, _ := json.Marshal(receipt)
+		for _, plugin := range rs.plugins {
+			points, err := plugin.Score(data)
+			if err != nil {
+				slog.Warn("Scoring plugin failed", "plugin", plugin.Name(), "err", err)
+				continue
+			}
+			breakdown.add("plugin:"+plugin.Name(), points)
+		}
+	}
+
+	rs.applyRetailerOverride(&breakdown, receipt)
+	rs.applyCampaigns(&breakdown, receipt, at)
+
+	return breakdown
+}
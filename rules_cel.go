@@ -0,0 +1,72 @@
+//go:build cel
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+)
+
+// celEnv declares the receipt fields custom rule expressions can refer to.
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("retailer", cel.StringType),
+		cel.Variable("purchaseDate", cel.StringType),
+		cel.Variable("purchaseTime", cel.StringType),
+		cel.Variable("total", cel.DoubleType),
+		cel.Variable("items", cel.ListType(cel.MapType(cel.StringType, cel.DynType))),
+	)
+})
+
+type celExpression struct {
+	program cel.Program
+}
+
+func compileExpression(expression string) (ruleExpression, error) {
+	env, err := celEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expression must evaluate to a bool, not %s", ast.OutputType())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &celExpression{program: program}, nil
+}
+
+func (e *celExpression) Matches(receipt *Receipt) (bool, error) {
+	total, _ := parseCents(receipt.Total)
+	items := make([]map[string]any, len(receipt.Items))
+	for i, item := range receipt.Items {
+		price, _ := parseSignedCents(item.Price)
+		items[i] = map[string]any{
+			"shortDescription": item.ShortDescription,
+			"price":            float64(price) / 100,
+		}
+	}
+
+	out, _, err := e.program.Eval(map[string]any{
+		"retailer":     receipt.Retailer,
+		"purchaseDate": receipt.PurchaseDate,
+		"purchaseTime": receipt.PurchaseTime,
+		"total":        float64(total) / 100,
+		"items":        items,
+	})
+	if err != nil {
+		return false, err
+	}
+	matched, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %T, not bool", out.Value())
+	}
+	return matched, nil
+}
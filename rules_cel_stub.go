@@ -0,0 +1,9 @@
+//go:build !cel
+
+package main
+
+import "errors"
+
+func compileExpression(expression string) (ruleExpression, error) {
+	return nil, errors.New("custom rules are not compiled in; rebuild with -tags cel")
+}
@@ -0,0 +1,12 @@
+//go:build !s3
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func s3Bucket(ctx context.Context, name string) (ObjectStore, error) {
+	return nil, errors.New("S3 is not compiled in; rebuild with -tags s3")
+}
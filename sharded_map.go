@@ -0,0 +1,252 @@
+package main
+
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+)
+
+// recordShards is how many shards a shardedRecords splits receipts into.
+// It is a power of two so that a hash picks its shard with a mask.
+const recordShards = 64
+
+// shardedRecords maps receipt IDs to records across shards picked by a
+// hash of the ID, each with its own lock and indexes, so that neither
+// lookups nor writes of different receipts wait for one another.
+type shardedRecords struct {
+	seed   maphash.Seed
+	shards [recordShards]recordShard
+}
+
+type recordShard struct {
+	mu      sync.RWMutex
+	records map[string]ReceiptRecord
+	// indexes order the shard's receipts by each sort field. Listings
+	// merge those of every shard.
+	indexes map[SortField]*recordIndex
+}
+
+func newShardedRecords() *shardedRecords {
+	m := &shardedRecords{seed: maphash.MakeSeed()}
+	for i := range m.shards {
+		m.shards[i].reset()
+	}
+	return m
+}
+
+func (shard *recordShard) reset() {
+	shard.records = make(map[string]ReceiptRecord)
+	shard.indexes = make(map[SortField]*recordIndex)
+	for _, field := range sortFields {
+		shard.indexes[field] = &recordIndex{field: field}
+	}
+}
+
+func (m *shardedRecords) shard(id string) *recordShard {
+	return &m.shards[maphash.String(m.seed, id)&(recordShards-1)]
+}
+
+func (m *shardedRecords) get(id string) (ReceiptRecord, bool) {
+	shard := m.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	record, found := shard.records[id]
+	return record, found
+}
+
+// set stores record in place of the one with its ID, which it returns if
+// there was one. The shard must be record's, locked.
+func (shard *recordShard) set(record ReceiptRecord) (old ReceiptRecord, replaced bool) {
+	old, replaced = shard.records[record.ID]
+	for _, idx := range shard.indexes {
+		if replaced {
+			idx.remove(old)
+		}
+		idx.insert(record)
+	}
+	shard.records[record.ID] = record
+	return old, replaced
+}
+
+// delete removes the record with id and returns it. The shard must be
+// the record's, locked.
+func (shard *recordShard) delete(id string) (ReceiptRecord, bool) {
+	record, found := shard.records[id]
+	if !found {
+		return ReceiptRecord{}, false
+	}
+	delete(shard.records, id)
+	for _, idx := range shard.indexes {
+		idx.remove(record)
+	}
+	return record, true
+}
+
+func (m *shardedRecords) clear() {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		shard.reset()
+		shard.mu.Unlock()
+	}
+}
+
+// scan calls each with the records in the range of opts, in the order of
+// opts.SortBy, until it returns false. Every shard's index holds a part of
+// the range, which scan merges, holding the read locks of all shards so
+// that it sees the records as of one moment.
+func (m *shardedRecords) scan(opts ListOptions, each func(ReceiptRecord) bool) {
+	field := opts.SortBy
+	if !slices.Contains(sortFields, field) {
+		field = SortByID
+	}
+	type cursor struct {
+		shard  *recordShard
+		idx    *recordIndex
+		lo, hi int
+	}
+	cursors := make([]cursor, 0, recordShards)
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		idx := shard.indexes[field]
+		if lo, hi := idx.bounds(opts); lo < hi {
+			cursors = append(cursors, cursor{shard: shard, idx: idx, lo: lo, hi: hi})
+		}
+	}
+
+	// head is the position of the next record of a cursor.
+	head := func(c cursor) int {
+		if opts.Descending {
+			return c.hi - 1
+		}
+		return c.lo
+	}
+	for len(cursors) > 0 {
+		next := 0
+		for i := 1; i < len(cursors); i++ {
+			key, nextKey := cursors[i].idx.keys[head(cursors[i])], cursors[next].idx.keys[head(cursors[next])]
+			if key < nextKey != opts.Descending {
+				next = i
+			}
+		}
+		c := &cursors[next]
+		record := c.shard.records[c.idx.ids[head(*c)]]
+		if opts.Descending {
+			c.hi--
+		} else {
+			c.lo++
+		}
+		if c.lo == c.hi {
+			cursors = slices.Delete(cursors, next, next+1)
+		}
+		if !each(record) {
+			return
+		}
+	}
+}
+
+// shardedBalances maps users to their balances across shards picked by a
+// hash of the user, each with its own lock, so that crediting different
+// users doesn't serialize.
+type shardedBalances struct {
+	seed   maphash.Seed
+	shards [recordShards]balanceShard
+}
+
+type balanceShard struct {
+	mu     sync.Mutex
+	points map[string]int
+}
+
+func newShardedBalances() *shardedBalances {
+	m := &shardedBalances{seed: maphash.MakeSeed()}
+	for i := range m.shards {
+		m.shards[i].points = make(map[string]int)
+	}
+	return m
+}
+
+func (m *shardedBalances) shardIndex(user string) uint64 {
+	return maphash.String(m.seed, user) & (recordShards - 1)
+}
+
+func (m *shardedBalances) shard(user string) *balanceShard {
+	return &m.shards[m.shardIndex(user)]
+}
+
+func (m *shardedBalances) get(user string) (int, bool) {
+	shard := m.shard(user)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	points, found := shard.points[user]
+	return points, found
+}
+
+// add adds points to the balance of user, which it starts if there is
+// none.
+func (m *shardedBalances) add(user string, points int) {
+	shard := m.shard(user)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.points[user] += points
+}
+
+// lock locks the balances of from and to, in the order of their shards so
+// that transfers the other way don't deadlock, and returns the function
+// that unlocks them.
+func (m *shardedBalances) lock(from, to string) (unlock func()) {
+	first, second := m.shardIndex(from), m.shardIndex(to)
+	if first == second {
+		m.shards[first].mu.Lock()
+		return m.shards[first].mu.Unlock
+	}
+	if first > second {
+		first, second = second, first
+	}
+	m.shards[first].mu.Lock()
+	m.shards[second].mu.Lock()
+	return func() {
+		m.shards[second].mu.Unlock()
+		m.shards[first].mu.Unlock()
+	}
+}
+
+// peek looks up the balance of user, which must be locked.
+func (m *shardedBalances) peek(user string) (int, bool) {
+	points, found := m.shard(user).points[user]
+	return points, found
+}
+
+// move moves points from one balance to another. Both must be locked.
+func (m *shardedBalances) move(from, to string, points int) {
+	m.shard(from).points[from] -= points
+	m.shard(to).points[to] += points
+}
+
+func (m *shardedBalances) clone() map[string]int {
+	balances := make(map[string]int)
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		for user, points := range shard.points {
+			balances[user] = points
+		}
+		shard.mu.Unlock()
+	}
+	return balances
+}
+
+// replace replaces every balance with those of balances.
+func (m *shardedBalances) replace(balances map[string]int) {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		clear(shard.points)
+		shard.mu.Unlock()
+	}
+	for user, points := range balances {
+		m.add(user, points)
+	}
+}
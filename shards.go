@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// shardSecretHeader carries the cluster's secret on the requests nodes
+// forward to one another, which the receiving node serves itself.
+const shardSecretHeader = "Shard-Secret"
+
+// shardReplicas is how many points each node has on the hash ring, which
+// evens out the share of keys each one owns.
+const shardReplicas = 128
+
+// ShardNode is an instance of a sharded deployment.
+type ShardNode struct {
+	ID string
+	// URL is the base URL of its HTTP API.
+	URL string
+}
+
+// ShardConfig partitions receipts and users between the nodes of a
+// sharded deployment.
+type ShardConfig struct {
+	NodeID string
+	// Nodes are the nodes of the deployment, this one included.
+	Nodes []ShardNode
+	// Secret authenticates the requests nodes forward to one another.
+	Secret string
+	// Timeout bounds a request forwarded to another node.
+	Timeout time.Duration
+}
+
+// parseShardNodes parses a comma-separated list of id=url nodes.
+func parseShardNodes(list string) ([]ShardNode, error) {
+	var nodes []ShardNode
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, rawURL, found := strings.Cut(entry, "=")
+		if !found || id == "" || rawURL == "" {
+			return nil, fmt.Errorf("node %q must be id=url", entry)
+		}
+		nodes = append(nodes, ShardNode{ID: id, URL: strings.TrimSuffix(rawURL, "/")})
+	}
+	return nodes, nil
+}
+
+// hashRing assigns keys to nodes by consistent hashing, so that adding or
+// removing a node only moves the keys of its neighbours on the ring.
+type hashRing struct {
+	// hashes are the points of the nodes on the ring, in order, and
+	// owners the node of each point.
+	hashes []uint64
+	owners []string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(nodes)*shardReplicas)
+	for _, node := range nodes {
+		for i := 0; i < shardReplicas; i++ {
+			points = append(points, point{ringHash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	slices.SortFunc(points, func(a, b point) int {
+		if a.hash != b.hash {
+			if a.hash < b.hash {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.owner, b.owner)
+	})
+	ring := &hashRing{hashes: make([]uint64, len(points)), owners: make([]string, len(points))}
+	for i, p := range points {
+		ring.hashes[i], ring.owners[i] = p.hash, p.owner
+	}
+	return ring
+}
+
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// owner returns the node owning key: the first on the ring at or after its
+// hash.
+func (r *hashRing) owner(key string) string {
+	i, _ := slices.BinarySearch(r.hashes, ringHash(key))
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// ShardRouter sends each request about a receipt or a user to the node
+// owning it, and each receipt credited to a user to the node owning the
+// user, where it gets an ID of that node.
+type ShardRouter struct {
+	cfg     ShardConfig
+	ring    *hashRing
+	nodes   map[string]ShardNode
+	proxies map[string]*httputil.ReverseProxy
+	client  *http.Client
+}
+
+// NewShardRouter routes requests between the nodes of cfg.
+func NewShardRouter(cfg ShardConfig) (*ShardRouter, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("sharding needs a secret for forwarded requests")
+	}
+	router := &ShardRouter{
+		cfg:     cfg,
+		nodes:   make(map[string]ShardNode),
+		proxies: make(map[string]*httputil.ReverseProxy),
+		client:  &http.Client{Timeout: cfg.Timeout},
+	}
+	var ids []string
+	for _, node := range cfg.Nodes {
+		if _, dup := router.nodes[node.ID]; dup {
+			return nil, fmt.Errorf("node %q is listed twice", node.ID)
+		}
+		target, err := url.Parse(node.URL)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("node %q needs an http(s) URL", node.ID)
+		}
+		router.nodes[node.ID] = node
+		router.proxies[node.ID] = router.newProxy(node, target)
+		ids = append(ids, node.ID)
+	}
+	if _, found := router.nodes[cfg.NodeID]; !found {
+		return nil, fmt.Errorf("node %q isn't one of the shard nodes", cfg.NodeID)
+	}
+	router.ring = newHashRing(ids)
+	return router, nil
+}
+
+func (sr *ShardRouter) newProxy(node ShardNode, target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Header.Set(shardSecretHeader, sr.cfg.Secret)
+			if id := requestIDFrom(pr.In.Context()); id != "" {
+				pr.Out.Header.Set(requestIDHeader, id)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.ErrorContext(r.Context(), "Failed to forward a request to its shard", "node", node.ID, "err", err)
+			http.Error(w, "The node owning the resource can't be reached", http.StatusBadGateway)
+		},
+	}
+}
+
+// owns reports whether this node owns key.
+func (sr *ShardRouter) owns(key string) bool {
+	return sr.ring.owner(key) == sr.cfg.NodeID
+}
+
+// forwarded reports whether another node forwarded r, for this one to
+// serve.
+func (sr *ShardRouter) forwarded(r *http.Request) bool {
+	secret := r.Header.Get(shardSecretHeader)
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(sr.cfg.Secret)) == 1
+}
+
+// EnableSharding partitions receipts and users between the nodes of
+// router. It must be called before the routes are set up.
+func (s *Server) EnableSharding(router *ShardRouter) {
+	s.shards = router
+}
+
+// shardBy forwards the requests of a route to the node owning its path
+// parameter param, a receipt or user ID, unless this node owns it.
+func (s *Server) shardBy(param string) Middleware {
+	if s.shards == nil {
+		return Middleware{Name: "shard"}
+	}
+	return Middleware{Name: "shard", Wrap: func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			owner := s.shards.ring.owner(mux.Vars(r)[param])
+			if owner == s.shards.cfg.NodeID || s.shards.forwarded(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			s.shards.proxies[owner].ServeHTTP(w, r)
+		})
+	}}
+}
+
+// newReceiptID returns a new receipt ID. Sharded nodes only mint the IDs
+// they own, so that requests about the receipt come back to them.
+func (s *Server) newReceiptID() string {
+	for {
+		id := s.ids.NewID()
+		if s.shards == nil || s.shards.owns(id) {
+			return id
+		}
+	}
+}
+
+// shardProcessRequest is a receipt forwarded to the node owning its user.
+type shardProcessRequest struct {
+	Receipt Receipt `json:"receipt"`
+	Owner   string  `json:"owner"`
+	Tenant  string  `json:"tenant,omitempty"`
+	User    bool    `json:"user,omitempty"`
+	Source  string  `json:"source,omitempty"`
+}
+
+// shardProblemError is a problem another node answered a forwarded
+// receipt with, which is passed on as it is.
+type shardProblemError struct {
+	problem Problem
+}
+
+func (e *shardProblemError) Error() string {
+	return e.problem.Title + ": " + e.problem.Detail
+}
+
+// processOnShard processes a receipt on the node owning its user.
+func (sr *ShardRouter) processOnShard(receipt Receipt, from submitter) (ReceiptRecord, error) {
+	node := sr.nodes[sr.ring.owner(receipt.UserID)]
+	body, err := json.Marshal(shardProcessRequest{
+		Receipt: receipt,
+		Owner:   from.owner,
+		Tenant:  from.tenant,
+		User:    from.user,
+		Source:  from.source,
+	})
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	req, err := http.NewRequestWithContext(from.ctx, http.MethodPost, node.URL+"/internal/shard/process", bytes.NewReader(body))
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(shardSecretHeader, sr.cfg.Secret)
+	if id := requestIDFrom(from.ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return ReceiptRecord{}, fmt.Errorf("forward the receipt to %s: %w", node.ID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		var record ReceiptRecord
+		if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+			return ReceiptRecord{}, fmt.Errorf("forward the receipt to %s: %w", node.ID, err)
+		}
+		return record, nil
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var problem Problem
+	if json.Unmarshal(data, &problem) == nil && problem.Status == resp.StatusCode && resp.StatusCode < 500 {
+		problem.Instance, problem.RequestID = "", ""
+		return ReceiptRecord{}, &shardProblemError{problem: problem}
+	}
+	return ReceiptRecord{}, fmt.Errorf("forward the receipt to %s: %s: %s", node.ID, resp.Status, strings.TrimSpace(string(data)))
+}
+
+// ShardProcessHandler processes a receipt another node forwarded because
+// this one owns its user, and responds with the stored record.
+func (s *Server) ShardProcessHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.shards.forwarded(r) {
+		http.Error(w, "Forwarded receipts need the cluster's secret", http.StatusForbidden)
+		return
+	}
+	var request shardProcessRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		if problem, tooLarge := bodyTooLargeProblem(err); tooLarge {
+			writeProblem(w, r, problem)
+			return
+		}
+		http.Error(w, "The forwarded receipt can't be read: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Nodes that disagree on the ring would pass receipts back and forth.
+	if !s.shards.owns(request.Receipt.UserID) {
+		http.Error(w, "This node doesn't own the receipt's user", http.StatusMisdirectedRequest)
+		return
+	}
+
+	from := submitter{ctx: r.Context(), owner: request.Owner, tenant: request.Tenant, user: request.User, source: request.Source}
+	record, err := s.processReceipt(request.Receipt, from)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
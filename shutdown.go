@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs listeners until one fails or the process gets SIGINT or
+// SIGTERM. It then shuts down gracefully: the listeners close at once, and
+// in-flight requests and queued jobs get until timeout to finish before
+// the store is flushed.
+func (s *Server) serve(listeners []listener, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			if err := l.serve(); err != nil {
+				served <- fmt.Errorf("%s: %w", l.name, err)
+			}
+		}(l)
+	}
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	// A second signal kills the process right away.
+	stop()
+	slog.Info("Shutting down, waiting for requests in flight", "timeout", timeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.shutdown(ctx, listeners)
+}
+
+// shutdown stops listeners and flushes everything kept for later. It
+// carries on when a step fails so that the rest still gets saved.
+func (s *Server) shutdown(ctx context.Context, listeners []listener) error {
+	var errs []error
+	// Event streams never finish on their own.
+	s.events.Close()
+	for _, l := range listeners {
+		if err := l.shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stop %s: %w", l.name, err))
+		}
+	}
+	if err := s.jobs.Close(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("finish queued jobs: %w", err))
+	}
+	// After the jobs, whose receipts notify webhooks too.
+	if s.webhookDispatcher != nil {
+		if err := s.webhookDispatcher.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("send webhook notifications: %w", err))
+		}
+	}
+	if s.apiKeys != nil {
+		if err := s.apiKeys.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("save API key usage: %w", err))
+		}
+	}
+	if s.tracer != nil {
+		if err := s.tracer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("export spans: %w", err))
+		}
+	}
+	if closer, ok := unwrapStore(s.store).(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close store: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
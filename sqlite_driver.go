@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package main
+
+// The SQLite driver requires cgo, so it is opt-in to keep the default
+// build a static binary.
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,106 @@
+//go:build sqs
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// sqsWaitSeconds is how long each poll waits for messages.
+	sqsWaitSeconds = 20
+	// sqsBatchSize is how many messages each poll takes at most.
+	sqsBatchSize = 10
+)
+
+// sqsListener polls cfg.QueueURL for receipts, with the credentials and
+// region of the environment. Messages are deleted once their receipt is
+// stored. Invalid receipts are left on the queue for its redrive policy to
+// move to a dead-letter queue.
+func sqsListener(cfg SQSConfig, s *Server) (listener, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return listener{}, fmt.Errorf("load AWS configuration: %w", err)
+	}
+	src := &sqsSource{client: sqs.NewFromConfig(awsCfg), queueURL: cfg.QueueURL}
+	return ingestListener("SQS poller of "+cfg.QueueURL, src, cfg.Tenant, s), nil
+}
+
+type sqsSource struct {
+	client   *sqs.Client
+	queueURL string
+	// received holds the messages of the last poll not yet handed out.
+	received []types.Message
+}
+
+// Receive hands out the messages of the last poll before polling again,
+// even once ctx is done, so that the messages already received are still
+// handled at shutdown. Failed polls are retried.
+func (q *sqsSource) Receive(ctx context.Context) (SourceMessage, error) {
+	wait := time.Second
+	for len(q.received) == 0 {
+		out, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(q.queueURL),
+			MaxNumberOfMessages: sqsBatchSize,
+			WaitTimeSeconds:     sqsWaitSeconds,
+		})
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			slog.Error("Failed to poll SQS, retrying", "err", err, "in", wait.String())
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+			wait = min(2*wait, ingestRetryWait)
+			continue
+		}
+		wait = time.Second
+		q.received = out.Messages
+	}
+	m := q.received[0]
+	q.received = q.received[1:]
+	return &sqsMessage{source: q, m: m}, nil
+}
+
+func (q *sqsSource) Close() error { return nil }
+
+type sqsMessage struct {
+	source *sqsSource
+	m      types.Message
+}
+
+func (m *sqsMessage) ID() string { return aws.ToString(m.m.MessageId) }
+
+func (m *sqsMessage) Data() []byte { return []byte(aws.ToString(m.m.Body)) }
+
+// Ack deletes the message. Failing to is only logged: the message will be
+// received again, and deduplication can tell it was stored.
+func (m *sqsMessage) Ack(ctx context.Context, result BatchResult) error {
+	_, err := m.source.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(m.source.queueURL),
+		ReceiptHandle: m.m.ReceiptHandle,
+	})
+	if err != nil {
+		slog.Error("Failed to delete a processed receipt from SQS", "message", m.ID(), "receipt", result.ID, "err", err)
+	}
+	return nil
+}
+
+// Reject leaves the message on the queue for its redrive policy.
+func (m *sqsMessage) Reject(ctx context.Context, result BatchResult) error { return nil }
+
+// Nack leaves the message to show up again once its visibility times out.
+func (m *sqsMessage) Nack() {}
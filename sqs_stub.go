@@ -0,0 +1,9 @@
+//go:build !sqs
+
+package main
+
+import "errors"
+
+func sqsListener(cfg SQSConfig, s *Server) (listener, error) {
+	return listener{}, errors.New("SQS is not compiled in; rebuild with -tags sqs")
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNotFound = errors.New("receipt not found")
+
+// ErrDuplicateContent is returned by stores that keep content hashes
+// unique, for a receipt with the ContentHash of another stored receipt.
+var ErrDuplicateContent = errors.New("a receipt with the same contents is already stored")
+
+// ErrNoBalances is returned by stores that don't keep balances, such as
+// Redis stores whose receipts expire.
+var ErrNoBalances = errors.New("the store doesn't keep balances")
+
+// ErrInsufficientPoints is returned for transfers of more points than the
+// sender has.
+var ErrInsufficientPoints = errors.New("not enough points")
+
+type ReceiptRecord struct {
+	ID          string
+	Receipt     Receipt
+	Points      int
+	ProcessedAt time.Time
+	// ContentHash identifies the receipt's contents, for duplicate detection.
+	ContentHash string
+	// Amendments lists earlier versions of the receipt, oldest first.
+	Amendments []Amendment
+	// Flags marks receipts that need attention, such as FlagTotalMismatch.
+	Flags []string
+	// RulesVersion is the version of the rule set that scored the receipt.
+	RulesVersion string
+	// Campaigns lists the IDs of the campaigns that awarded the receipt
+	// points.
+	Campaigns []string
+	// Retailer is the canonical retailer name, for grouping receipts from
+	// the same retailer.
+	Retailer string
+	// Owner identifies the caller that submitted the receipt, such as the
+	// subject of its access token. It is empty without authentication.
+	Owner string
+	// ExpiredAt is when the receipt's points expired. Expired points no
+	// longer count toward the user's balance.
+	ExpiredAt *time.Time
+	// AnomalyScore is how many standard deviations the total is from the
+	// mean of the retailer's totals, for receipts flagged as anomalous.
+	AnomalyScore float64
+	// Review tracks the manual review of flagged receipts.
+	Review *Review
+	// Source is where receipts that didn't come through the API came
+	// from, such as the email they were read from.
+	Source string
+	// Attachment describes the original artifact of the receipt, if one
+	// was attached.
+	Attachment *Attachment
+	// Version counts the writes of the receipt in a Raft cluster, which
+	// refuses writes of a version that is no longer the stored one. Other
+	// stores leave it alone.
+	Version int64
+}
+
+// FlagTotalMismatch is set on receipts whose item prices don't add up to
+// their total.
+const FlagTotalMismatch = "total-mismatch"
+
+type Amendment struct {
+	AmendedAt            time.Time `json:"amendedAt"`
+	PreviousPoints       int       `json:"previousPoints"`
+	PreviousRulesVersion string    `json:"previousRulesVersion,omitempty"`
+}
+
+// Store persists processed receipts. Implementations must be safe for
+// concurrent use, since every HTTP handler shares the same store.
+type Store interface {
+	Get(id string) (ReceiptRecord, error)
+	Put(record ReceiptRecord) error
+	Delete(id string) error
+	List(opts ListOptions) ([]ReceiptRecord, error)
+	// FindByContentHash returns a receipt with the given ContentHash.
+	FindByContentHash(hash string) (ReceiptRecord, error)
+	// Balance returns the points of all receipts credited to a user. Stores
+	// keep balances up to date in the same transaction that stores or
+	// deletes a receipt. Users without receipts are ErrNotFound.
+	Balance(userID string) (int, error)
+	// Transfer moves points from one user's balance to another's, checking
+	// the sender has enough in the same transaction, and returns the
+	// sender's new balance. Unknown senders are ErrNotFound.
+	Transfer(from, to string, points int) (int, error)
+}
+
+// balanceOf returns the balance a record's points count toward and the
+// points, or "" when the receipt isn't credited to a user. Users are
+// qualified with the receipt's tenant like receipt IDs are. Expired
+// receipts, and flagged ones that weren't approved, count for nothing.
+func balanceOf(record ReceiptRecord) (string, int) {
+	if record.Receipt.UserID == "" {
+		return "", 0
+	}
+	user, points := record.Receipt.UserID, record.Points
+	if tenant := tenantOfID(record.ID); tenant != "" {
+		user = tenant + tenantSeparator + user
+	}
+	if record.ExpiredAt != nil || !record.Review.awardsPoints() {
+		points = 0
+	}
+	return user, points
+}
+
+type ListOptions struct {
+	Filter ListFilter
+	// SortBy defaults to ordering by receipt ID.
+	SortBy     SortField
+	Descending bool
+	// After resumes the listing after this position in the chosen order.
+	After ListPosition
+	// Limit caps the number of receipts returned; zero means no limit.
+	Limit int
+}
+
+// BatchGetter is implemented by stores that can look up many receipts in a
+// single round trip. Unknown ids are omitted from the result.
+type BatchGetter interface {
+	GetMany(ids []string) (map[string]ReceiptRecord, error)
+}
+
+// getMany looks up ids in one round trip when the store supports it, and
+// one by one otherwise.
+func getMany(store Store, ids []string) (map[string]ReceiptRecord, error) {
+	if bg, ok := store.(BatchGetter); ok {
+		return bg.GetMany(ids)
+	}
+
+	records := make(map[string]ReceiptRecord, len(ids))
+	for _, id := range ids {
+		record, err := store.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records[id] = record
+	}
+	return records, nil
+}
+
+// Snapshotter is implemented by stores that can read all of their receipts
+// and balances as of a single point in time, for backups. Snapshot hands
+// each receipt to receipt in ID order, then returns the balances, which
+// differ from the sums of the receipts by the points users transferred.
+type Snapshotter interface {
+	Snapshot(receipt func(ReceiptRecord) error) (map[string]int, error)
+}
+
+type RedisConfig struct {
+	Addr      string
+	Password  string
+	DB        int
+	KeyPrefix string
+	// TTL is how long each receipt is kept; zero keeps receipts forever.
+	TTL time.Duration
+}
+
+// MemoryStore is the default in-process Store. Its contents are lost when
+// the service restarts, unless it writes snapshots.
+//
+// Receipts are sharded together with their indexes, and balances on their
+// own, each shard with its own lock, so that writes of different receipts
+// and users don't wait for one another. Writes hold mu shared; whatever
+// needs the whole store as of one moment, such as a snapshot, holds it
+// exclusively.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	receipts *shardedRecords
+	balances *shardedBalances
+	hashMu   sync.RWMutex
+	byHash   map[string]string
+	// outbox holds the events not yet published, which is only as
+	// durable as the receipts.
+	outboxMu sync.Mutex
+	outbox   []OutboxEvent
+	lastSeq  int64
+	// changes counts the writes to receipts and balances, for snapshots
+	// to tell whether there is anything new to write.
+	changes atomic.Uint64
+	// snapshots is nil unless the store writes snapshots, and wal unless
+	// it logs writes ahead.
+	snapshots *memorySnapshots
+	wal       *memoryWAL
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		receipts: newShardedRecords(),
+		balances: newShardedBalances(),
+		byHash:   make(map[string]string),
+	}
+}
+
+func (s *MemoryStore) Get(id string) (ReceiptRecord, error) {
+	record, found := s.receipts.get(id)
+	if !found {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	return record, nil
+}
+
+func (s *MemoryStore) Put(record ReceiptRecord) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	shard := s.receipts.shard(record.ID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if err := s.log(walEntry{Op: walPut, Record: &record}); err != nil {
+		return err
+	}
+	s.put(shard, record)
+	return nil
+}
+
+func (s *MemoryStore) PutWithEvent(record ReceiptRecord, event OutboxEvent) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	shard := s.receipts.shard(record.ID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if err := s.log(walEntry{Op: walPut, Record: &record}); err != nil {
+		return err
+	}
+	s.put(shard, record)
+	s.appendEvent(event)
+	return nil
+}
+
+// appendEvent adds event to the outbox with the next sequence number.
+func (s *MemoryStore) appendEvent(event OutboxEvent) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	s.lastSeq++
+	event.Seq = s.lastSeq
+	s.outbox = append(s.outbox, event)
+}
+
+func (s *MemoryStore) OutboxEvents(limit int) ([]OutboxEvent, error) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	return slices.Clone(s.outbox[:min(limit, len(s.outbox))]), nil
+}
+
+func (s *MemoryStore) DeleteOutboxEvents(seq int64) error {
+	s.deleteEvents(seq)
+	return nil
+}
+
+// deleteEvents drops the outbox events up to seq.
+func (s *MemoryStore) deleteEvents(seq int64) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	n := 0
+	for n < len(s.outbox) && s.outbox[n].Seq <= seq {
+		n++
+	}
+	s.outbox = slices.Delete(s.outbox, 0, n)
+}
+
+// put stores record in shard, which must be the record's, locked. It must
+// be called with s.mu held.
+func (s *MemoryStore) put(shard *recordShard, record ReceiptRecord) {
+	old, replaced := shard.set(record)
+	if replaced {
+		s.unhash(old)
+	}
+	if record.ContentHash != "" {
+		s.hashMu.Lock()
+		s.byHash[record.ContentHash] = record.ID
+		s.hashMu.Unlock()
+	}
+	s.moveBalance(old, record)
+	s.changes.Add(1)
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	shard := s.receipts.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, found := shard.records[id]; !found {
+		return ErrNotFound
+	}
+	if err := s.log(walEntry{Op: walDelete, ID: id}); err != nil {
+		return err
+	}
+	s.delete(shard, id)
+	return nil
+}
+
+// delete removes a stored receipt from shard, which must be its shard,
+// locked. It must be called with s.mu held.
+func (s *MemoryStore) delete(shard *recordShard, id string) {
+	record, _ := shard.delete(id)
+	s.unhash(record)
+	s.moveBalance(record, ReceiptRecord{})
+	s.changes.Add(1)
+}
+
+// unhash removes record from the content hashes, unless another receipt
+// took its hash since.
+func (s *MemoryStore) unhash(record ReceiptRecord) {
+	s.hashMu.Lock()
+	defer s.hashMu.Unlock()
+	if s.byHash[record.ContentHash] == record.ID {
+		delete(s.byHash, record.ContentHash)
+	}
+}
+
+// moveBalance moves the points of the stored receipt old to the balance
+// record credits, in one step if both credit the same user. Either may be
+// the zero record.
+func (s *MemoryStore) moveBalance(old, record ReceiptRecord) {
+	oldUser, oldPoints := balanceOf(old)
+	user, points := balanceOf(record)
+	if oldUser != "" && oldUser == user {
+		s.balances.add(user, points-oldPoints)
+		return
+	}
+	if oldUser != "" {
+		s.balances.add(oldUser, -oldPoints)
+	}
+	if user != "" {
+		s.balances.add(user, points)
+	}
+}
+
+func (s *MemoryStore) FindByContentHash(hash string) (ReceiptRecord, error) {
+	s.hashMu.RLock()
+	id, found := s.byHash[hash]
+	s.hashMu.RUnlock()
+	if !found {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	return s.Get(id)
+}
+
+func (s *MemoryStore) Balance(userID string) (int, error) {
+	points, found := s.balances.get(userID)
+	if !found {
+		return 0, ErrNotFound
+	}
+	return points, nil
+}
+
+func (s *MemoryStore) Transfer(from, to string, points int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	unlock := s.balances.lock(from, to)
+	defer unlock()
+
+	balance, found := s.balances.peek(from)
+	if !found {
+		return 0, ErrNotFound
+	}
+	if balance < points {
+		return balance, ErrInsufficientPoints
+	}
+	if err := s.log(walEntry{Op: walTransfer, From: from, To: to, Points: points}); err != nil {
+		return 0, err
+	}
+	s.transfer(from, to, points)
+	balance, _ = s.balances.peek(from)
+	return balance, nil
+}
+
+// transfer moves points between balances, which must be locked. It must
+// be called with s.mu held.
+func (s *MemoryStore) transfer(from, to string, points int) {
+	s.balances.move(from, to, points)
+	s.changes.Add(1)
+}
+
+// Snapshot copies the receipts and balances under the lock, so that writes
+// wait for the copy rather than for receipt.
+func (s *MemoryStore) Snapshot(receipt func(ReceiptRecord) error) (map[string]int, error) {
+	return s.state().Snapshot(receipt)
+}
+
+// List merges the indexes of the receipt shards.
+func (s *MemoryStore) List(opts ListOptions) ([]ReceiptRecord, error) {
+	var records []ReceiptRecord
+	s.receipts.scan(opts, func(record ReceiptRecord) bool {
+		if opts.Filter.Matches(record) {
+			records = append(records, record)
+		}
+		return opts.Limit <= 0 || len(records) < opts.Limit
+	})
+	return records, nil
+}
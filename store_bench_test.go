@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// singleLockStore reads the memory store the way it did before its
+// receipts were sharded, under the store lock, as a baseline.
+type singleLockStore struct {
+	*MemoryStore
+}
+
+func (s singleLockStore) Get(id string) (ReceiptRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, found := s.receipts.get(id)
+	if !found {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	return record, nil
+}
+
+const benchmarkReceipts = 10000
+
+func benchmarkRecord(i int) ReceiptRecord {
+	return ReceiptRecord{
+		ID:       "receipt-" + strconv.Itoa(i),
+		Owner:    "owner-" + strconv.Itoa(i%100),
+		Retailer: "Target",
+		Points:   i % 120,
+	}
+}
+
+func newBenchmarkStore(b *testing.B) *MemoryStore {
+	b.Helper()
+	s := NewMemoryStore()
+	for i := 0; i < benchmarkReceipts; i++ {
+		if err := s.Put(benchmarkRecord(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s
+}
+
+// benchmarkGet runs parallel gets of stored receipts. With writing set, a
+// goroutine keeps putting receipts meanwhile.
+func benchmarkGet(b *testing.B, s *MemoryStore, get func(string) (ReceiptRecord, error), writing bool) {
+	ids := make([]string, benchmarkReceipts)
+	for i := range ids {
+		ids[i] = benchmarkRecord(i).ID
+	}
+	if writing {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Put(benchmarkRecord(i % benchmarkReceipts))
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := get(ids[i%len(ids)]); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkMemoryStoreGet(b *testing.B) {
+	s := newBenchmarkStore(b)
+	benchmarkGet(b, s, s.Get, false)
+}
+
+func BenchmarkMemoryStoreGetSingleLock(b *testing.B) {
+	s := newBenchmarkStore(b)
+	benchmarkGet(b, s, singleLockStore{s}.Get, false)
+}
+
+func BenchmarkMemoryStoreGetWhileWriting(b *testing.B) {
+	s := newBenchmarkStore(b)
+	benchmarkGet(b, s, s.Get, true)
+}
+
+func BenchmarkMemoryStoreGetWhileWritingSingleLock(b *testing.B) {
+	s := newBenchmarkStore(b)
+	benchmarkGet(b, s, singleLockStore{s}.Get, true)
+}
+
+// benchmarkPut runs parallel puts, with put, of receipts credited to a
+// hundred users.
+func benchmarkPut(b *testing.B, put func(ReceiptRecord) error) {
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			record := benchmarkRecord(i % benchmarkReceipts)
+			record.Receipt.UserID = record.Owner
+			if err := put(record); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// Put only locks the receipt's shard, with its indexes, and its user's
+// balance, so parallel puts scale with -cpu.
+func BenchmarkMemoryStorePut(b *testing.B) {
+	s := newBenchmarkStore(b)
+	benchmarkPut(b, s.Put)
+}
+
+// BenchmarkMemoryStorePutSingleLock puts one receipt at a time, as the
+// store did when a single lock guarded the indexes and balances.
+func BenchmarkMemoryStorePutSingleLock(b *testing.B) {
+	s := newBenchmarkStore(b)
+	var mu sync.Mutex
+	benchmarkPut(b, func(record ReceiptRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return s.Put(record)
+	})
+}
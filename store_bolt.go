@@ -0,0 +1,370 @@
+//go:build bolt
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var receiptsBucket = []byte("receipts")
+
+// indexBucket holds one key per receipt, ordered by field and ID. The
+// primary bucket already orders receipts by ID.
+func indexBucket(field SortField) []byte {
+	return []byte("index:" + string(field))
+}
+
+var indexedFields = []SortField{SortByPurchaseDate, SortByPoints}
+
+// hashBucket maps content hashes to receipt IDs.
+var hashBucket = []byte("index:contentHash")
+
+// balancesBucket maps user IDs to their balance, as a decimal number.
+var balancesBucket = []byte("balances")
+
+// BoltStore persists receipts to a single local file with bbolt. Every
+// write runs in its own transaction that is fsynced before returning, so an
+// acknowledged receipt survives a crash.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	// Fail fast instead of blocking forever if another process holds the
+	// file lock.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(receiptsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(hashBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(balancesBucket); err != nil {
+			return err
+		}
+		for _, field := range indexedFields {
+			if _, err := tx.CreateBucketIfNotExists(indexBucket(field)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(id string) (ReceiptRecord, error) {
+	var record ReceiptRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(receiptsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &record)
+	})
+	return record, err
+}
+
+func (s *BoltStore) Put(record ReceiptRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := updateBalances(tx, record.ID, &record); err != nil {
+			return err
+		}
+		if err := removeIndexEntries(tx, record.ID); err != nil {
+			return err
+		}
+		for _, field := range indexedFields {
+			if err := tx.Bucket(indexBucket(field)).Put([]byte(indexKey(field, positionOf(record))), nil); err != nil {
+				return err
+			}
+		}
+		if record.ContentHash != "" {
+			if err := tx.Bucket(hashBucket).Put([]byte(record.ContentHash), []byte(record.ID)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(receiptsBucket).Put([]byte(record.ID), data)
+	})
+}
+
+func (s *BoltStore) FindByContentHash(hash string) (ReceiptRecord, error) {
+	var record ReceiptRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(hashBucket).Get([]byte(hash))
+		if id == nil {
+			return ErrNotFound
+		}
+		data := tx.Bucket(receiptsBucket).Get(id)
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &record)
+	})
+	return record, err
+}
+
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(receiptsBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		if err := updateBalances(tx, id, nil); err != nil {
+			return err
+		}
+		if err := removeIndexEntries(tx, id); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) Balance(userID string) (int, error) {
+	var points int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(balancesBucket).Get([]byte(userID))
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		points, err = strconv.Atoi(string(data))
+		return err
+	})
+	return points, err
+}
+
+func (s *BoltStore) Transfer(from, to string, points int) (int, error) {
+	var balance int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(balancesBucket)
+		if bucket.Get([]byte(from)) == nil {
+			return ErrNotFound
+		}
+		var err error
+		balance, err = boltBalance(bucket, from)
+		if err != nil {
+			return err
+		}
+		if balance < points {
+			return ErrInsufficientPoints
+		}
+		balance -= points
+		if err := bucket.Put([]byte(from), []byte(strconv.Itoa(balance))); err != nil {
+			return err
+		}
+		credited, err := boltBalance(bucket, to)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(to), []byte(strconv.Itoa(credited+points)))
+	})
+	return balance, err
+}
+
+// Snapshot reads the receipts and balances within one read transaction,
+// which doesn't hold up writes.
+func (s *BoltStore) Snapshot(receipt func(ReceiptRecord) error) (map[string]int, error) {
+	balances := make(map[string]int)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(receiptsBucket).ForEach(func(id, data []byte) error {
+			var record ReceiptRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return fmt.Errorf("decode receipt %s: %w", id, err)
+			}
+			return receipt(record)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(balancesBucket).ForEach(func(user, data []byte) error {
+			points, err := strconv.Atoi(string(data))
+			if err != nil {
+				return fmt.Errorf("decode balance of %s: %w", user, err)
+			}
+			balances[string(user)] = points
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return balances, nil
+}
+
+// boltBalance reads a user's balance from the balances bucket; users
+// without one have none.
+func boltBalance(bucket *bolt.Bucket, user string) (int, error) {
+	data := bucket.Get([]byte(user))
+	if data == nil {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("decode balance of %s: %w", user, err)
+	}
+	return n, nil
+}
+
+// updateBalances takes the points of the currently stored version of a
+// receipt, if there is one, off its user's balance and adds those of
+// record, which is nil when the receipt is being deleted.
+func updateBalances(tx *bolt.Tx, id string, record *ReceiptRecord) error {
+	bucket := tx.Bucket(balancesBucket)
+	add := func(r ReceiptRecord, sign int) error {
+		user, points := balanceOf(r)
+		if user == "" {
+			return nil
+		}
+		balance, err := boltBalance(bucket, user)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user), []byte(strconv.Itoa(balance+sign*points)))
+	}
+
+	if data := tx.Bucket(receiptsBucket).Get([]byte(id)); data != nil {
+		var old ReceiptRecord
+		if err := json.Unmarshal(data, &old); err != nil {
+			return fmt.Errorf("decode receipt %s: %w", id, err)
+		}
+		if err := add(old, -1); err != nil {
+			return err
+		}
+	}
+	if record != nil {
+		return add(*record, 1)
+	}
+	return nil
+}
+
+// removeIndexEntries drops the index keys of the currently stored version
+// of a receipt, if there is one.
+func removeIndexEntries(tx *bolt.Tx, id string) error {
+	data := tx.Bucket(receiptsBucket).Get([]byte(id))
+	if data == nil {
+		return nil
+	}
+	var old ReceiptRecord
+	if err := json.Unmarshal(data, &old); err != nil {
+		return fmt.Errorf("decode receipt %s: %w", id, err)
+	}
+	for _, field := range indexedFields {
+		if err := tx.Bucket(indexBucket(field)).Delete([]byte(indexKey(field, positionOf(old)))); err != nil {
+			return err
+		}
+	}
+	if old.ContentHash != "" && string(tx.Bucket(hashBucket).Get([]byte(old.ContentHash))) == id {
+		return tx.Bucket(hashBucket).Delete([]byte(old.ContentHash))
+	}
+	return nil
+}
+
+// List walks the primary bucket or an index bucket with a cursor, seeking
+// directly to the requested range.
+func (s *BoltStore) List(opts ListOptions) ([]ReceiptRecord, error) {
+	field := opts.SortBy
+	if field == "" {
+		field = SortByID
+	}
+
+	var lo, hi string
+	var hasHi bool
+	if field != SortByID {
+		lo, hi, hasHi = keyRange(field, opts.Filter)
+	}
+	var after string
+	if opts.After.ID != "" {
+		after = indexKey(field, opts.After)
+	}
+
+	var records []ReceiptRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		primary := tx.Bucket(receiptsBucket)
+		bucket := primary
+		if field != SortByID {
+			bucket = tx.Bucket(indexBucket(field))
+		}
+		c := bucket.Cursor()
+
+		var k []byte
+		if opts.Descending {
+			// upper is the exclusive end of the range; empty means the end
+			// of the bucket.
+			var upper string
+			if hasHi {
+				upper = hi + "\x01"
+			}
+			if after != "" && (upper == "" || after < upper) {
+				upper = after
+			}
+			if upper == "" {
+				k, _ = c.Last()
+			} else if k, _ = c.Seek([]byte(upper)); k == nil {
+				k, _ = c.Last()
+			} else {
+				k, _ = c.Prev()
+			}
+		} else {
+			k, _ = c.Seek([]byte(lo))
+			if after != "" && after >= lo {
+				if k, _ = c.Seek([]byte(after)); k != nil && string(k) == after {
+					k, _ = c.Next()
+				}
+			}
+		}
+
+		for ; k != nil; k = step(c, opts.Descending) {
+			key := string(k)
+			if opts.Descending && key < lo ||
+				!opts.Descending && hasHi && key >= hi+"\x01" {
+				break
+			}
+			if opts.Limit > 0 && len(records) == opts.Limit {
+				break
+			}
+
+			id := key[strings.LastIndexByte(key, 0)+1:]
+			var record ReceiptRecord
+			if err := json.Unmarshal(primary.Get([]byte(id)), &record); err != nil {
+				return fmt.Errorf("decode receipt %s: %w", id, err)
+			}
+			if opts.Filter.Matches(record) {
+				records = append(records, record)
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+func step(c *bolt.Cursor, backwards bool) []byte {
+	var k []byte
+	if backwards {
+		k, _ = c.Prev()
+	} else {
+		k, _ = c.Next()
+	}
+	return k
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
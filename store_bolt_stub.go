@@ -0,0 +1,11 @@
+//go:build !bolt
+
+package main
+
+import "errors"
+
+type BoltStore struct{ Store }
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	return nil, errors.New("bolt store is not compiled in; rebuild with -tags bolt")
+}
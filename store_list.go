@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type SortField string
+
+const (
+	SortByID           SortField = "id"
+	SortByPurchaseDate SortField = "purchaseDate"
+	SortByPoints       SortField = "points"
+)
+
+// sortFields are the secondary orders every store keeps an index for.
+var sortFields = []SortField{SortByID, SortByPurchaseDate, SortByPoints}
+
+type ListFilter struct {
+	// Retailer matches receipts whose retailer contains it, ignoring case.
+	Retailer string
+	// PurchasedFrom and PurchasedTo bound the purchase date (YYYY-MM-DD),
+	// both inclusive.
+	PurchasedFrom string
+	PurchasedTo   string
+	MinPoints     *int
+	MaxPoints     *int
+	// Owner, when set, only matches receipts submitted by that principal.
+	Owner string
+	// UserID, when set, only matches receipts credited to that user.
+	UserID string
+	// Flagged only matches receipts with flags, and Flag, when set, those
+	// with that flag.
+	Flagged bool
+	Flag    string
+	// ReviewStatus, when set, only matches receipts in that review state.
+	ReviewStatus ReviewStatus
+	// Tenant, when set, only matches receipts of that tenant.
+	Tenant *string
+}
+
+func (f ListFilter) Matches(record ReceiptRecord) bool {
+	if f.Retailer != "" &&
+		!strings.Contains(strings.ToLower(record.Receipt.Retailer), strings.ToLower(f.Retailer)) {
+		return false
+	}
+	if f.PurchasedFrom != "" && record.Receipt.PurchaseDate < f.PurchasedFrom {
+		return false
+	}
+	if f.PurchasedTo != "" && record.Receipt.PurchaseDate > f.PurchasedTo {
+		return false
+	}
+	if f.MinPoints != nil && record.Points < *f.MinPoints {
+		return false
+	}
+	if f.MaxPoints != nil && record.Points > *f.MaxPoints {
+		return false
+	}
+	if f.Owner != "" && record.Owner != f.Owner {
+		return false
+	}
+	if f.UserID != "" && record.Receipt.UserID != f.UserID {
+		return false
+	}
+	if f.Flagged && len(record.Flags) == 0 {
+		return false
+	}
+	if f.Flag != "" && !slices.Contains(record.Flags, f.Flag) {
+		return false
+	}
+	if f.ReviewStatus != "" && (record.Review == nil || record.Review.Status != f.ReviewStatus) {
+		return false
+	}
+	if f.Tenant != nil && tenantOfID(record.ID) != *f.Tenant {
+		return false
+	}
+	return true
+}
+
+// ListPosition identifies a receipt's place in a listing, so pagination can
+// resume after it under any sort order.
+type ListPosition struct {
+	ID           string `json:"id"`
+	PurchaseDate string `json:"purchaseDate,omitempty"`
+	Points       int    `json:"points,omitempty"`
+}
+
+func positionOf(record ReceiptRecord) ListPosition {
+	return ListPosition{
+		ID:           record.ID,
+		PurchaseDate: record.Receipt.PurchaseDate,
+		Points:       record.Points,
+	}
+}
+
+// sortKey renders the value a listing is ordered by as a string whose byte
+// order matches the value order, so the same index layout works for every
+// field and backend. Ties are broken by receipt ID.
+func sortKey(field SortField, pos ListPosition) string {
+	switch field {
+	case SortByPurchaseDate:
+		return pos.PurchaseDate
+	case SortByPoints:
+		return pointsKey(pos.Points)
+	default:
+		return ""
+	}
+}
+
+// pointsKey flips the sign bit so negative points sort before positive ones.
+func pointsKey(points int) string {
+	return fmt.Sprintf("%020d", uint64(points)^(1<<63))
+}
+
+// indexKey is the full ordering key: the sort key followed by the ID.
+func indexKey(field SortField, pos ListPosition) string {
+	if field == SortByID || field == "" {
+		return pos.ID
+	}
+	return sortKey(field, pos) + "\x00" + pos.ID
+}
+
+// keyRange converts the part of a filter that constrains the sort field into
+// inclusive sort key bounds, so stores can seek straight to it.
+func keyRange(field SortField, f ListFilter) (lo, hi string, hasHi bool) {
+	switch field {
+	case SortByPurchaseDate:
+		return f.PurchasedFrom, f.PurchasedTo, f.PurchasedTo != ""
+	case SortByPoints:
+		if f.MinPoints != nil {
+			lo = pointsKey(*f.MinPoints)
+		}
+		if f.MaxPoints != nil {
+			hi, hasHi = pointsKey(*f.MaxPoints), true
+		}
+	}
+	return lo, hi, hasHi
+}
+
+// recordIndex keeps receipts ordered by one sort field so that listings can
+// binary-search to the requested range instead of scanning every receipt.
+type recordIndex struct {
+	field SortField
+	keys  []string
+	ids   []string
+}
+
+func (idx *recordIndex) search(key string) int {
+	return sort.SearchStrings(idx.keys, key)
+}
+
+func (idx *recordIndex) insert(record ReceiptRecord) {
+	key := indexKey(idx.field, positionOf(record))
+	i := idx.search(key)
+	idx.keys = append(idx.keys, "")
+	copy(idx.keys[i+1:], idx.keys[i:])
+	idx.keys[i] = key
+	idx.ids = append(idx.ids, "")
+	copy(idx.ids[i+1:], idx.ids[i:])
+	idx.ids[i] = record.ID
+}
+
+func (idx *recordIndex) remove(record ReceiptRecord) {
+	key := indexKey(idx.field, positionOf(record))
+	i := idx.search(key)
+	if i < len(idx.keys) && idx.keys[i] == key {
+		idx.keys = append(idx.keys[:i], idx.keys[i+1:]...)
+		idx.ids = append(idx.ids[:i], idx.ids[i+1:]...)
+	}
+}
+
+// bounds returns the half-open range [lo, hi) of index positions that can
+// satisfy opts.
+func (idx *recordIndex) bounds(opts ListOptions) (lo, hi int) {
+	lo, hi = 0, len(idx.keys)
+
+	if idx.field != SortByID {
+		loKey, hiKey, hasHi := keyRange(idx.field, opts.Filter)
+		lo = idx.search(loKey)
+		if hasHi {
+			// "\x01" sorts after the "\x00" separating key from ID.
+			hi = idx.search(hiKey + "\x01")
+		}
+	}
+
+	if opts.After.ID != "" {
+		after := indexKey(idx.field, opts.After)
+		i := idx.search(after)
+		if opts.Descending {
+			hi = min(hi, i)
+		} else {
+			if i < len(idx.keys) && idx.keys[i] == after {
+				i++
+			}
+			lo = max(lo, i)
+		}
+	}
+	return lo, hi
+}
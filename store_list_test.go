@@ -0,0 +1,66 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStoreListMergesShards(t *testing.T) {
+	s := NewMemoryStore()
+	var all []ReceiptRecord
+	for i := 0; i < 500; i++ {
+		record := ReceiptRecord{
+			ID:      "r" + strconv.Itoa(i),
+			Receipt: Receipt{PurchaseDate: "2022-01-" + strconv.Itoa(10+i%20)},
+			Points:  i * 7 % 120,
+		}
+		if err := s.Put(record); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, record)
+	}
+	minPoints := 30
+
+	for _, field := range sortFields {
+		for _, descending := range []bool{false, true} {
+			opts := ListOptions{SortBy: field, Descending: descending, Filter: ListFilter{MinPoints: &minPoints}}
+			var want []string
+			sorted := slices.Clone(all)
+			slices.SortFunc(sorted, func(a, b ReceiptRecord) int {
+				ka, kb := indexKey(field, positionOf(a)), indexKey(field, positionOf(b))
+				if descending {
+					ka, kb = kb, ka
+				}
+				return strings.Compare(ka, kb)
+			})
+			for _, record := range sorted {
+				if record.Points >= minPoints {
+					want = append(want, record.ID)
+				}
+			}
+
+			// Page through the listing, resuming after the last receipt.
+			var got []string
+			for {
+				opts.Limit = 37
+				page, err := s.List(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, record := range page {
+					got = append(got, record.ID)
+				}
+				if len(page) < opts.Limit {
+					break
+				}
+				opts.After = positionOf(page[len(page)-1])
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("List by %s, descending %t: got %d receipts %v..., want %d %v...",
+					field, descending, len(got), got[:min(5, len(got))], len(want), want[:min(5, len(want))])
+			}
+		}
+	}
+}
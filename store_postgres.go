@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// postgresMigrations are applied in order on startup and tracked in the
+// schema_migrations table. New schema changes must only ever be appended.
+var postgresMigrations = []string{
+	`CREATE TABLE receipts (
+		id      TEXT PRIMARY KEY,
+		receipt JSONB NOT NULL,
+		points  INTEGER NOT NULL
+	)`,
+	`ALTER TABLE receipts ADD COLUMN processed_at TIMESTAMPTZ`,
+	`CREATE INDEX receipts_purchase_date ON receipts ((receipt->>'purchaseDate'), id)`,
+	`CREATE INDEX receipts_points ON receipts (points, id)`,
+	`ALTER TABLE receipts ADD COLUMN content_hash TEXT`,
+	`CREATE INDEX receipts_content_hash ON receipts (content_hash)`,
+	`ALTER TABLE receipts ADD COLUMN metadata JSONB`,
+	`CREATE INDEX receipts_owner ON receipts ((metadata->>'owner'), id)`,
+	`CREATE TABLE balances (
+		user_id TEXT PRIMARY KEY,
+		points  BIGINT NOT NULL
+	)`,
+	`CREATE INDEX receipts_user_id ON receipts ((receipt->>'userId'), id)`,
+	`CREATE TABLE outbox (
+		seq   BIGSERIAL PRIMARY KEY,
+		event JSONB NOT NULL
+	)`,
+	// Content hashes became unique. Receipts stored as duplicates, with
+	// deduplication off, keep the hash of the first one only.
+	`UPDATE receipts SET content_hash = NULL WHERE content_hash = '' OR id NOT IN (
+		SELECT MIN(id) FROM receipts WHERE content_hash IS NOT NULL GROUP BY content_hash)`,
+	`DROP INDEX receipts_content_hash`,
+	`CREATE UNIQUE INDEX receipts_content_hash ON receipts (content_hash)`,
+}
+
+type PostgresPoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// PostgresStore keeps receipts in PostgreSQL through the pgx driver, which
+// is only linked in when building with `-tags postgres`. The hot-path
+// queries used by the process and points endpoints are prepared once up
+// front and shared by the connection pool.
+type PostgresStore struct {
+	db *sql.DB
+
+	getStmt    *sql.Stmt
+	putStmt    *sql.Stmt
+	deleteStmt *sql.Stmt
+}
+
+func NewPostgresStore(dsn string, pool PostgresPoolConfig) (*PostgresStore, error) {
+	if dsn == "" {
+		return nil, errors.New("postgres store requires a DSN (set RECEIPTS_POSTGRES_DSN)")
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres database (build with -tags postgres?): %w", err)
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
+	store := &PostgresStore{db: db}
+	if err := store.init(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *PostgresStore) init() error {
+	if err := s.db.Ping(); err != nil {
+		return fmt.Errorf("connect to postgres: %w", err)
+	}
+	if err := s.migrate(); err != nil {
+		return err
+	}
+
+	var err error
+	if s.getStmt, err = s.db.Prepare(`SELECT ` + postgresColumns + ` FROM receipts WHERE id = $1`); err != nil {
+		return fmt.Errorf("prepare get: %w", err)
+	}
+	if s.putStmt, err = s.db.Prepare(`INSERT INTO receipts (` + postgresColumns + `) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET receipt = EXCLUDED.receipt, points = EXCLUDED.points,
+			processed_at = EXCLUDED.processed_at, content_hash = EXCLUDED.content_hash,
+			metadata = EXCLUDED.metadata`); err != nil {
+		return fmt.Errorf("prepare put: %w", err)
+	}
+	if s.deleteStmt, err = s.db.Prepare(`DELETE FROM receipts WHERE id = $1`); err != nil {
+		return fmt.Errorf("prepare delete: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var version int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := version; i < len(postgresMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(postgresMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("apply migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("record migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const postgresColumns = `id, receipt, points, processed_at, content_hash, metadata`
+
+func scanPostgresRecord(row interface{ Scan(...any) error }) (ReceiptRecord, error) {
+	var record ReceiptRecord
+	var data []byte
+	var processedAt sql.NullTime
+	var contentHash sql.NullString
+	var metadata []byte
+	if err := row.Scan(&record.ID, &data, &record.Points, &processedAt, &contentHash, &metadata); err != nil {
+		return ReceiptRecord{}, err
+	}
+	if err := json.Unmarshal(data, &record.Receipt); err != nil {
+		return ReceiptRecord{}, fmt.Errorf("decode receipt %s: %w", record.ID, err)
+	}
+	// Receipts stored before processed_at existed have no timestamp.
+	record.ProcessedAt = processedAt.Time
+	record.ContentHash = contentHash.String
+	if err := decodeMetadata(metadata, &record); err != nil {
+		return ReceiptRecord{}, fmt.Errorf("decode metadata of receipt %s: %w", record.ID, err)
+	}
+	return record, nil
+}
+
+func (s *PostgresStore) Get(id string) (ReceiptRecord, error) {
+	record, err := scanPostgresRecord(s.getStmt.QueryRow(id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	return record, err
+}
+
+func (s *PostgresStore) FindByContentHash(hash string) (ReceiptRecord, error) {
+	record, err := scanPostgresRecord(s.db.QueryRow(`SELECT `+postgresColumns+` FROM receipts WHERE content_hash = $1 LIMIT 1`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	return record, err
+}
+
+func (s *PostgresStore) Put(record ReceiptRecord) error {
+	return s.put(record, nil)
+}
+
+func (s *PostgresStore) PutWithEvent(record ReceiptRecord, event OutboxEvent) error {
+	return s.put(record, &event)
+}
+
+func (s *PostgresStore) OutboxEvents(limit int) ([]OutboxEvent, error) {
+	return postgresDialect.outboxEvents(s.db, limit)
+}
+
+func (s *PostgresStore) DeleteOutboxEvents(seq int64) error {
+	return postgresDialect.deleteOutboxEvents(s.db, seq)
+}
+
+// put stores record, and event in the outbox unless it is nil, in one
+// transaction.
+func (s *PostgresStore) put(record ReceiptRecord, event *OutboxEvent) error {
+	data, err := json.Marshal(record.Receipt)
+	if err != nil {
+		return err
+	}
+	metadata, err := encodeMetadata(record)
+	if err != nil {
+		return err
+	}
+
+	// The previous version is locked until the balances are updated, so
+	// concurrent writes of the same receipt can't both count its points.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old, err := postgresDialect.storedRecord(tx, postgresColumns, scanPostgresRecord, record.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(s.putStmt).Exec(record.ID, data, record.Points, record.ProcessedAt, contentHashValue(record), metadata); err != nil {
+		return postgresDialect.putError(err)
+	}
+	if err := postgresDialect.updateBalances(tx, old, &record); err != nil {
+		return err
+	}
+	if event != nil {
+		if err := postgresDialect.addOutboxEvent(tx, *event); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) Delete(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old, err := postgresDialect.storedRecord(tx, postgresColumns, scanPostgresRecord, id)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return ErrNotFound
+	}
+	if _, err := tx.Stmt(s.deleteStmt).Exec(id); err != nil {
+		return err
+	}
+	if err := postgresDialect.updateBalances(tx, old, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) Balance(userID string) (int, error) {
+	return postgresDialect.balance(s.db, userID)
+}
+
+func (s *PostgresStore) Transfer(from, to string, points int) (int, error) {
+	return postgresDialect.transfer(s.db, from, to, points)
+}
+
+// Snapshot reads the receipts and balances in a repeatable read
+// transaction, which doesn't hold up writes.
+func (s *PostgresStore) Snapshot(receipt func(ReceiptRecord) error) (map[string]int, error) {
+	return postgresDialect.readSnapshot(s.db, postgresColumns, scanPostgresRecord, receipt)
+}
+
+func (s *PostgresStore) List(opts ListOptions) ([]ReceiptRecord, error) {
+	query, args := postgresDialect.listQuery(postgresColumns, opts)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []ReceiptRecord
+	for rows.Next() {
+		record, err := scanPostgresRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *PostgresStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.getStmt, s.putStmt, s.deleteStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return s.db.Close()
+}
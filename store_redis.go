@@ -0,0 +1,344 @@
+//go:build redis
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore shares receipts between service instances through Redis.
+// Each receipt is stored as a JSON document under KeyPrefix+"receipt:"+ID
+// and expires after the configured TTL. Balances would keep counting
+// expired receipts, so they are only kept without a TTL.
+type RedisStore struct {
+	client *redis.Client
+	cfg    RedisConfig
+}
+
+func NewRedisStore(cfg RedisConfig) (*RedisStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect to redis at %s: %w", cfg.Addr, err)
+	}
+	return &RedisStore{client: client, cfg: cfg}, nil
+}
+
+func (s *RedisStore) key(id string) string {
+	return s.cfg.KeyPrefix + "receipt:" + id
+}
+
+func (s *RedisStore) Get(id string) (ReceiptRecord, error) {
+	data, err := s.client.Get(context.Background(), s.key(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+
+	var record ReceiptRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return ReceiptRecord{}, fmt.Errorf("decode receipt %s: %w", id, err)
+	}
+	return record, nil
+}
+
+// GetMany looks up all ids in a single pipelined round trip. Unknown ids
+// are omitted from the result.
+func (s *RedisStore) GetMany(ids []string) (map[string]ReceiptRecord, error) {
+	ctx := context.Background()
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.Get(ctx, s.key(id))
+	}
+	// Exec reports redis.Nil when any key is missing; those are handled
+	// per command below.
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	records := make(map[string]ReceiptRecord, len(ids))
+	for i, cmd := range cmds {
+		data, err := cmd.Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var record ReceiptRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("decode receipt %s: %w", ids[i], err)
+		}
+		records[ids[i]] = record
+	}
+	return records, nil
+}
+
+func (s *RedisStore) hashKey(hash string) string {
+	return s.cfg.KeyPrefix + "hash:" + hash
+}
+
+func (s *RedisStore) FindByContentHash(hash string) (ReceiptRecord, error) {
+	id, err := s.client.Get(context.Background(), s.hashKey(hash)).Result()
+	if errors.Is(err, redis.Nil) {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	return s.Get(id)
+}
+
+// balancesKey holds a hash of user balances.
+func (s *RedisStore) balancesKey() string {
+	return s.cfg.KeyPrefix + "balances"
+}
+
+func (s *RedisStore) Balance(userID string) (int, error) {
+	if s.cfg.TTL > 0 {
+		return 0, ErrNoBalances
+	}
+	points, err := s.client.HGet(context.Background(), s.balancesKey(), userID).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrNotFound
+	}
+	return points, err
+}
+
+// transferScript debits KEYS[1][ARGV[1]] and credits KEYS[1][ARGV[2]] with
+// ARGV[3] points, returning the sender's new balance, or -1 for unknown
+// senders and -2 for senders without enough points.
+var transferScript = redis.NewScript(`
+local balance = redis.call('HGET', KEYS[1], ARGV[1])
+if not balance then
+	return -1
+end
+local points = tonumber(ARGV[3])
+if tonumber(balance) < points then
+	return -2
+end
+redis.call('HINCRBY', KEYS[1], ARGV[2], points)
+return redis.call('HINCRBY', KEYS[1], ARGV[1], -points)
+`)
+
+// Transfer runs as a script so the balance check and both updates happen
+// atomically.
+func (s *RedisStore) Transfer(from, to string, points int) (int, error) {
+	if s.cfg.TTL > 0 {
+		return 0, ErrNoBalances
+	}
+	balance, err := transferScript.Run(context.Background(), s.client, []string{s.balancesKey()}, from, to, points).Int()
+	switch {
+	case err != nil:
+		return 0, err
+	case balance == -1:
+		return 0, ErrNotFound
+	case balance == -2:
+		current, err := s.Balance(from)
+		if err != nil {
+			return 0, err
+		}
+		return current, ErrInsufficientPoints
+	}
+	return balance, nil
+}
+
+// moveBalance queues the balance updates for replacing old with record;
+// either may be nil.
+func (s *RedisStore) moveBalance(ctx context.Context, pipe redis.Pipeliner, old, record *ReceiptRecord) {
+	if s.cfg.TTL > 0 {
+		return
+	}
+	if old != nil {
+		if user, points := balanceOf(*old); user != "" {
+			pipe.HIncrBy(ctx, s.balancesKey(), user, int64(-points))
+		}
+	}
+	if record != nil {
+		if user, points := balanceOf(*record); user != "" {
+			pipe.HIncrBy(ctx, s.balancesKey(), user, int64(points))
+		}
+	}
+}
+
+func (s *RedisStore) indexKey(field SortField) string {
+	return s.cfg.KeyPrefix + "index:" + string(field)
+}
+
+// redisUpdateAttempts is how often update tries again when the receipt
+// changes between reading and writing it.
+const redisUpdateAttempts = 10
+
+// update reads the receipt stored under id, nil if there is none, and
+// queues the writes replacing it in a transaction. The transaction fails
+// if another client changed the receipt after it was read, and update
+// tries again.
+func (s *RedisStore) update(id string, write func(pipe redis.Pipeliner, old *ReceiptRecord) error) error {
+	ctx := context.Background()
+	key := s.key(id)
+	for attempt := 0; attempt < redisUpdateAttempts; attempt++ {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			var old *ReceiptRecord
+			data, err := tx.Get(ctx, key).Bytes()
+			switch {
+			case errors.Is(err, redis.Nil):
+			case err != nil:
+				return err
+			default:
+				old = new(ReceiptRecord)
+				if err := json.Unmarshal(data, old); err != nil {
+					return fmt.Errorf("decode receipt %s: %w", id, err)
+				}
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return write(pipe, old)
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return errStaleWrite
+}
+
+// Put stores the record and maintains one lexicographically ordered sorted
+// set per sort field, so listings can range over an index.
+func (s *RedisStore) Put(record ReceiptRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	return s.update(record.ID, func(pipe redis.Pipeliner, old *ReceiptRecord) error {
+		for _, field := range sortFields {
+			if old != nil {
+				pipe.ZRem(ctx, s.indexKey(field), indexKey(field, positionOf(*old)))
+			}
+			pipe.ZAdd(ctx, s.indexKey(field), redis.Z{Member: indexKey(field, positionOf(record))})
+		}
+		s.moveBalance(ctx, pipe, old, &record)
+		if record.ContentHash != "" {
+			pipe.Set(ctx, s.hashKey(record.ContentHash), record.ID, s.cfg.TTL)
+		}
+		pipe.Set(ctx, s.key(record.ID), data, s.cfg.TTL)
+		return nil
+	})
+}
+
+func (s *RedisStore) Delete(id string) error {
+	ctx := context.Background()
+	return s.update(id, func(pipe redis.Pipeliner, record *ReceiptRecord) error {
+		if record == nil {
+			return ErrNotFound
+		}
+		for _, field := range sortFields {
+			pipe.ZRem(ctx, s.indexKey(field), indexKey(field, positionOf(*record)))
+		}
+		if record.ContentHash != "" {
+			pipe.Del(ctx, s.hashKey(record.ContentHash))
+		}
+		s.moveBalance(ctx, pipe, record, nil)
+		pipe.Del(ctx, s.key(id))
+		return nil
+	})
+}
+
+const redisListBatch = 100
+
+// List ranges over the index for the requested order. Entries whose receipt
+// has expired through the TTL are skipped and pruned from the index.
+func (s *RedisStore) List(opts ListOptions) ([]ReceiptRecord, error) {
+	ctx := context.Background()
+	field := opts.SortBy
+	if field == "" {
+		field = SortByID
+	}
+
+	min, max := "-", "+"
+	var lo, hi string
+	var hasHi bool
+	if field != SortByID {
+		lo, hi, hasHi = keyRange(field, opts.Filter)
+	}
+	if lo != "" {
+		min = "[" + lo
+	}
+	if hasHi {
+		max = "(" + hi + "\x01"
+	}
+	if opts.After.ID != "" {
+		after := indexKey(field, opts.After)
+		if opts.Descending && (!hasHi || after < hi+"\x01") {
+			max = "(" + after
+		}
+		if !opts.Descending && after >= lo {
+			min = "(" + after
+		}
+	}
+
+	var records []ReceiptRecord
+	var stale []any
+	for offset := int64(0); ; offset += redisListBatch {
+		by := &redis.ZRangeBy{Min: min, Max: max, Offset: offset, Count: redisListBatch}
+		var members []string
+		var err error
+		if opts.Descending {
+			members, err = s.client.ZRevRangeByLex(ctx, s.indexKey(field), by).Result()
+		} else {
+			members, err = s.client.ZRangeByLex(ctx, s.indexKey(field), by).Result()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]string, len(members))
+		for i, member := range members {
+			ids[i] = member[strings.LastIndexByte(member, 0)+1:]
+		}
+		found, err := s.GetMany(ids)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, id := range ids {
+			record, ok := found[id]
+			if !ok {
+				stale = append(stale, members[i])
+				continue
+			}
+			if opts.Filter.Matches(record) {
+				records = append(records, record)
+			}
+			if opts.Limit > 0 && len(records) == opts.Limit {
+				break
+			}
+		}
+		if len(members) < redisListBatch || opts.Limit > 0 && len(records) == opts.Limit {
+			break
+		}
+	}
+
+	if len(stale) > 0 {
+		s.client.ZRem(ctx, s.indexKey(field), stale...)
+	}
+	return records, nil
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
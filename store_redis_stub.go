@@ -0,0 +1,11 @@
+//go:build !redis
+
+package main
+
+import "errors"
+
+type RedisStore struct{ Store }
+
+func NewRedisStore(cfg RedisConfig) (*RedisStore, error) {
+	return nil, errors.New("redis store is not compiled in; rebuild with -tags redis")
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlMetadata holds the record fields that nothing queries on. SQL stores
+// keep them in a single JSON column so adding one needs no migration.
+type sqlMetadata struct {
+	Amendments   []Amendment `json:"amendments,omitempty"`
+	Flags        []string    `json:"flags,omitempty"`
+	RulesVersion string      `json:"rulesVersion,omitempty"`
+	Campaigns    []string    `json:"campaigns,omitempty"`
+	Retailer     string      `json:"retailer,omitempty"`
+	Owner        string      `json:"owner,omitempty"`
+	ExpiredAt    *time.Time  `json:"expiredAt,omitempty"`
+	AnomalyScore float64     `json:"anomalyScore,omitempty"`
+	Review       *Review     `json:"review,omitempty"`
+	Source       string      `json:"source,omitempty"`
+	Attachment   *Attachment `json:"attachment,omitempty"`
+}
+
+func encodeMetadata(record ReceiptRecord) ([]byte, error) {
+	return json.Marshal(sqlMetadata{
+		Amendments:   record.Amendments,
+		Flags:        record.Flags,
+		RulesVersion: record.RulesVersion,
+		Campaigns:    record.Campaigns,
+		Retailer:     record.Retailer,
+		Owner:        record.Owner,
+		ExpiredAt:    record.ExpiredAt,
+		AnomalyScore: record.AnomalyScore,
+		Review:       record.Review,
+		Source:       record.Source,
+		Attachment:   record.Attachment,
+	})
+}
+
+func decodeMetadata(data []byte, record *ReceiptRecord) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var m sqlMetadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	record.Amendments = m.Amendments
+	record.Flags = m.Flags
+	record.RulesVersion = m.RulesVersion
+	record.Campaigns = m.Campaigns
+	record.Retailer = m.Retailer
+	record.Owner = m.Owner
+	record.ExpiredAt = m.ExpiredAt
+	record.AnomalyScore = m.AnomalyScore
+	record.Review = m.Review
+	record.Source = m.Source
+	record.Attachment = m.Attachment
+	return nil
+}
+
+// sqlDialect captures the differences between the SQL backends that matter
+// when building listing queries.
+type sqlDialect struct {
+	placeholder func(n int) string
+	// purchaseDate, retailer and userID extract fields from the stored
+	// receipt JSON. They must match the expressions the indexes were
+	// created on.
+	purchaseDate string
+	retailer     string
+	userID       string
+	// owner extracts the owner from the metadata JSON, and flags the
+	// array of flags, which is left out when there are none.
+	owner string
+	flags string
+	// hasFlag tests whether the flags contain the flag bound to arg.
+	hasFlag func(arg string) string
+	// reviewStatus extracts the review status from the metadata JSON.
+	reviewStatus string
+	// like is the case-insensitive LIKE operator.
+	like string
+	// noLimit is bound as the LIMIT when opts.Limit is zero.
+	noLimit any
+	// forUpdate locks the rows a SELECT reads within a transaction.
+	forUpdate string
+	// snapshot starts a transaction that reads the database as of its
+	// start.
+	snapshot *sql.TxOptions
+	// contentHashConflict is how errors name the unique index on content
+	// hashes when a write violates it.
+	contentHashConflict string
+}
+
+var (
+	sqliteDialect = sqlDialect{
+		placeholder:  func(int) string { return "?" },
+		purchaseDate: `json_extract(receipt, '$.purchaseDate')`,
+		retailer:     `json_extract(receipt, '$.retailer')`,
+		userID:       `json_extract(receipt, '$.userId')`,
+		owner:        `json_extract(metadata, '$.owner')`,
+		flags:        `json_extract(metadata, '$.flags')`,
+		like:         "LIKE",
+		noLimit:      -1,
+		hasFlag: func(arg string) string {
+			return `EXISTS (SELECT 1 FROM json_each(metadata, '$.flags') WHERE value = ` + arg + `)`
+		},
+		reviewStatus:        `json_extract(metadata, '$.review.status')`,
+		contentHashConflict: "receipts.content_hash",
+	}
+	postgresDialect = sqlDialect{
+		placeholder:  func(n int) string { return "$" + strconv.Itoa(n) },
+		purchaseDate: `(receipt->>'purchaseDate')`,
+		retailer:     `(receipt->>'retailer')`,
+		userID:       `(receipt->>'userId')`,
+		owner:        `(metadata->>'owner')`,
+		flags:        `(metadata->'flags')`,
+		like:         "ILIKE",
+		noLimit:      nil,
+		forUpdate:    " FOR UPDATE",
+		snapshot:     &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+		hasFlag: func(arg string) string {
+			return `(metadata->'flags') @> jsonb_build_array(` + arg + `::text)`
+		},
+		reviewStatus:        `(metadata->'review'->>'status')`,
+		contentHashConflict: `"receipts_content_hash"`,
+	}
+)
+
+func (d sqlDialect) sortExpr(field SortField) string {
+	switch field {
+	case SortByPurchaseDate:
+		return d.purchaseDate
+	case SortByPoints:
+		return "points"
+	default:
+		return ""
+	}
+}
+
+// listQuery builds a keyset-paginated SELECT for opts. Ordering on an
+// indexed expression with the ID as tiebreaker lets the database walk the
+// index instead of sorting the table.
+func (d sqlDialect) listQuery(columns string, opts ListOptions) (string, []any) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return d.placeholder(len(args))
+	}
+
+	f := opts.Filter
+	if f.Retailer != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(f.Retailer)
+		where = append(where, d.retailer+" "+d.like+" "+arg("%"+escaped+"%")+` ESCAPE '\'`)
+	}
+	if f.PurchasedFrom != "" {
+		where = append(where, d.purchaseDate+" >= "+arg(f.PurchasedFrom))
+	}
+	if f.PurchasedTo != "" {
+		where = append(where, d.purchaseDate+" <= "+arg(f.PurchasedTo))
+	}
+	if f.MinPoints != nil {
+		where = append(where, "points >= "+arg(*f.MinPoints))
+	}
+	if f.MaxPoints != nil {
+		where = append(where, "points <= "+arg(*f.MaxPoints))
+	}
+	if f.Owner != "" {
+		where = append(where, d.owner+" = "+arg(f.Owner))
+	}
+	if f.UserID != "" {
+		where = append(where, d.userID+" = "+arg(f.UserID))
+	}
+	if f.Flagged {
+		where = append(where, d.flags+" IS NOT NULL")
+	}
+	if f.Flag != "" {
+		where = append(where, d.hasFlag(arg(f.Flag)))
+	}
+	if f.ReviewStatus != "" {
+		where = append(where, d.reviewStatus+" = "+arg(string(f.ReviewStatus)))
+	}
+	if f.Tenant != nil && *f.Tenant == "" {
+		where = append(where, "id NOT LIKE "+arg("%"+tenantSeparator+"%"))
+	} else if f.Tenant != nil {
+		// Tenant names can't contain LIKE wildcards.
+		where = append(where, "id LIKE "+arg(*f.Tenant+tenantSeparator+"%"))
+	}
+
+	cmp, dir := ">", "ASC"
+	if opts.Descending {
+		cmp, dir = "<", "DESC"
+	}
+	order := "id " + dir
+	expr := d.sortExpr(opts.SortBy)
+	if expr != "" {
+		order = expr + " " + dir + ", " + order
+	}
+
+	if opts.After.ID != "" {
+		if expr == "" {
+			where = append(where, "id "+cmp+" "+arg(opts.After.ID))
+		} else {
+			var value any = opts.After.PurchaseDate
+			if opts.SortBy == SortByPoints {
+				value = opts.After.Points
+			}
+			where = append(where, "("+expr+", id) "+cmp+" ("+arg(value)+", "+arg(opts.After.ID)+")")
+		}
+	}
+
+	query := "SELECT " + columns + " FROM receipts"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	var limit any = d.noLimit
+	if opts.Limit > 0 {
+		limit = opts.Limit
+	}
+	query += " ORDER BY " + order + " LIMIT " + arg(limit)
+	return query, args
+}
+
+// updateBalances takes the points of the previously stored version of a
+// receipt off its user's balance and adds those of the new version, within
+// the transaction that stores or deletes it. Either version may be nil.
+func (d sqlDialect) updateBalances(tx *sql.Tx, old, record *ReceiptRecord) error {
+	for _, change := range []struct {
+		record *ReceiptRecord
+		sign   int
+	}{{old, -1}, {record, 1}} {
+		if change.record == nil {
+			continue
+		}
+		user, points := balanceOf(*change.record)
+		if user == "" {
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO balances (user_id, points) VALUES (`+d.placeholder(1)+`, `+d.placeholder(2)+`)
+			ON CONFLICT (user_id) DO UPDATE SET points = balances.points + excluded.points`, user, change.sign*points)
+		if err != nil {
+			return fmt.Errorf("update balance of %s: %w", user, err)
+		}
+	}
+	return nil
+}
+
+// putError turns a violation of the unique index on content hashes into
+// ErrDuplicateContent.
+func (d sqlDialect) putError(err error) error {
+	if err != nil && strings.Contains(err.Error(), d.contentHashConflict) {
+		return ErrDuplicateContent
+	}
+	return err
+}
+
+// contentHashValue stores records without a content hash with NULL, which
+// the unique index doesn't compare.
+func contentHashValue(record ReceiptRecord) sql.NullString {
+	return sql.NullString{String: record.ContentHash, Valid: record.ContentHash != ""}
+}
+
+// storedRecord returns the stored version of a receipt within tx, locking
+// it where the database supports that, or nil if there is none.
+func (d sqlDialect) storedRecord(tx *sql.Tx, columns string, scan func(interface{ Scan(...any) error }) (ReceiptRecord, error), id string) (*ReceiptRecord, error) {
+	record, err := scan(tx.QueryRow(`SELECT `+columns+` FROM receipts WHERE id = `+d.placeholder(1)+d.forUpdate, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// addOutboxEvent adds event to the outbox within the transaction that
+// stores its receipt.
+func (d sqlDialect) addOutboxEvent(tx *sql.Tx, event OutboxEvent) error {
+	data, err := encodeOutboxEvent(event)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO outbox (event) VALUES (`+d.placeholder(1)+`)`, data); err != nil {
+		return fmt.Errorf("add outbox event: %w", err)
+	}
+	return nil
+}
+
+// outboxEvents reads up to limit events of the outbox, oldest first.
+func (d sqlDialect) outboxEvents(db *sql.DB, limit int) ([]OutboxEvent, error) {
+	rows, err := db.Query(`SELECT seq, event FROM outbox ORDER BY seq LIMIT `+d.placeholder(1), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OutboxEvent
+	for rows.Next() {
+		var seq int64
+		var data []byte
+		if err := rows.Scan(&seq, &data); err != nil {
+			return nil, err
+		}
+		event, err := decodeOutboxEvent(seq, data)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (d sqlDialect) deleteOutboxEvents(db *sql.DB, seq int64) error {
+	_, err := db.Exec(`DELETE FROM outbox WHERE seq <= `+d.placeholder(1), seq)
+	return err
+}
+
+// readSnapshot reads every receipt, in ID order, and every balance within
+// one transaction, so that they are consistent with each other.
+func (d sqlDialect) readSnapshot(db *sql.DB, columns string, scan func(interface{ Scan(...any) error }) (ReceiptRecord, error), receipt func(ReceiptRecord) error) (map[string]int, error) {
+	tx, err := db.BeginTx(context.Background(), d.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	// The transaction only reads.
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT ` + columns + ` FROM receipts ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		record, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err := receipt(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	balances := make(map[string]int)
+	rows, err = tx.Query(`SELECT user_id, points FROM balances`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user string
+		var points int
+		if err := rows.Scan(&user, &points); err != nil {
+			return nil, err
+		}
+		balances[user] = points
+	}
+	return balances, rows.Err()
+}
+
+// balance reads a user's balance.
+func (d sqlDialect) balance(db *sql.DB, userID string) (int, error) {
+	var points int
+	err := db.QueryRow(`SELECT points FROM balances WHERE user_id = `+d.placeholder(1), userID).Scan(&points)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return points, err
+}
+
+// transfer moves points between balances. The sender is only debited if it
+// has enough points, in a single statement, so concurrent transfers can't
+// overdraw it.
+func (d sqlDialect) transfer(db *sql.DB, from, to string, points int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE balances SET points = points - `+d.placeholder(1)+
+		` WHERE user_id = `+d.placeholder(2)+` AND points >= `+d.placeholder(3), points, from, points)
+	if err != nil {
+		return 0, fmt.Errorf("debit %s: %w", from, err)
+	}
+	debited, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	var balance int
+	err = tx.QueryRow(`SELECT points FROM balances WHERE user_id = `+d.placeholder(1), from).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if debited == 0 {
+		return balance, ErrInsufficientPoints
+	}
+	_, err = tx.Exec(`INSERT INTO balances (user_id, points) VALUES (`+d.placeholder(1)+`, `+d.placeholder(2)+`)
+		ON CONFLICT (user_id) DO UPDATE SET points = balances.points + excluded.points`, to, points)
+	if err != nil {
+		return 0, fmt.Errorf("credit %s: %w", to, err)
+	}
+	return balance, tx.Commit()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// sqliteMigrations are applied in order on startup. The index of the last
+// applied migration is tracked in SQLite's user_version pragma, so new
+// schema changes must only ever be appended.
+var sqliteMigrations = []string{
+	`CREATE TABLE receipts (
+		id      TEXT PRIMARY KEY,
+		receipt TEXT NOT NULL,
+		points  INTEGER NOT NULL
+	)`,
+	`ALTER TABLE receipts ADD COLUMN processed_at TIMESTAMP`,
+	`CREATE INDEX receipts_purchase_date ON receipts (json_extract(receipt, '$.purchaseDate'), id)`,
+	`CREATE INDEX receipts_points ON receipts (points, id)`,
+	`ALTER TABLE receipts ADD COLUMN content_hash TEXT`,
+	`CREATE INDEX receipts_content_hash ON receipts (content_hash)`,
+	`ALTER TABLE receipts ADD COLUMN metadata TEXT`,
+	`CREATE INDEX receipts_owner ON receipts (json_extract(metadata, '$.owner'), id)`,
+	`CREATE TABLE balances (
+		user_id TEXT PRIMARY KEY,
+		points  INTEGER NOT NULL
+	)`,
+	`CREATE INDEX receipts_user_id ON receipts (json_extract(receipt, '$.userId'), id)`,
+	`CREATE TABLE outbox (
+		seq   INTEGER PRIMARY KEY AUTOINCREMENT,
+		event TEXT NOT NULL
+	)`,
+	// Content hashes became unique. Receipts stored as duplicates, with
+	// deduplication off, keep the hash of the first one only.
+	`UPDATE receipts SET content_hash = NULL WHERE content_hash = '' OR id NOT IN (
+		SELECT MIN(id) FROM receipts WHERE content_hash IS NOT NULL GROUP BY content_hash)`,
+	`DROP INDEX receipts_content_hash`,
+	`CREATE UNIQUE INDEX receipts_content_hash ON receipts (content_hash)`,
+}
+
+// SQLiteStore persists receipts to a local SQLite database so points
+// survive restarts. The driver is only linked in when building with
+// `-tags sqlite`.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite database (build with -tags sqlite?): %w", err)
+	}
+
+	// SQLite only allows a single writer; serialize access through one
+	// connection rather than surfacing SQLITE_BUSY to handlers.
+	db.SetMaxOpenConns(1)
+
+	store := &SQLiteStore{db: db}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *SQLiteStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("apply migration %d: %w", i+1, err)
+		}
+		// PRAGMA statements cannot take bound parameters.
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("record migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const sqliteColumns = `id, receipt, points, processed_at, content_hash, metadata`
+
+func scanSQLiteRecord(row interface{ Scan(...any) error }) (ReceiptRecord, error) {
+	var record ReceiptRecord
+	var data []byte
+	var processedAt sql.NullTime
+	var contentHash sql.NullString
+	var metadata []byte
+	if err := row.Scan(&record.ID, &data, &record.Points, &processedAt, &contentHash, &metadata); err != nil {
+		return ReceiptRecord{}, err
+	}
+	if err := json.Unmarshal(data, &record.Receipt); err != nil {
+		return ReceiptRecord{}, fmt.Errorf("decode receipt %s: %w", record.ID, err)
+	}
+	// Receipts stored before processed_at existed have no timestamp.
+	record.ProcessedAt = processedAt.Time
+	record.ContentHash = contentHash.String
+	if err := decodeMetadata(metadata, &record); err != nil {
+		return ReceiptRecord{}, fmt.Errorf("decode metadata of receipt %s: %w", record.ID, err)
+	}
+	return record, nil
+}
+
+func (s *SQLiteStore) Get(id string) (ReceiptRecord, error) {
+	record, err := scanSQLiteRecord(s.db.QueryRow(`SELECT `+sqliteColumns+` FROM receipts WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	return record, err
+}
+
+func (s *SQLiteStore) FindByContentHash(hash string) (ReceiptRecord, error) {
+	record, err := scanSQLiteRecord(s.db.QueryRow(`SELECT `+sqliteColumns+` FROM receipts WHERE content_hash = ? LIMIT 1`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	return record, err
+}
+
+func (s *SQLiteStore) Put(record ReceiptRecord) error {
+	return s.put(record, nil)
+}
+
+func (s *SQLiteStore) PutWithEvent(record ReceiptRecord, event OutboxEvent) error {
+	return s.put(record, &event)
+}
+
+func (s *SQLiteStore) OutboxEvents(limit int) ([]OutboxEvent, error) {
+	return sqliteDialect.outboxEvents(s.db, limit)
+}
+
+func (s *SQLiteStore) DeleteOutboxEvents(seq int64) error {
+	return sqliteDialect.deleteOutboxEvents(s.db, seq)
+}
+
+// put stores record, and event in the outbox unless it is nil, in one
+// transaction.
+func (s *SQLiteStore) put(record ReceiptRecord, event *OutboxEvent) error {
+	data, err := json.Marshal(record.Receipt)
+	if err != nil {
+		return err
+	}
+	metadata, err := encodeMetadata(record)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old, err := sqliteDialect.storedRecord(tx, sqliteColumns, scanSQLiteRecord, record.ID)
+	if err != nil {
+		return err
+	}
+	// Not INSERT OR REPLACE, which would replace the receipt with the
+	// same content hash too.
+	_, err = tx.Exec(`INSERT INTO receipts (`+sqliteColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET receipt = excluded.receipt, points = excluded.points,
+			processed_at = excluded.processed_at, content_hash = excluded.content_hash,
+			metadata = excluded.metadata`,
+		record.ID, data, record.Points, record.ProcessedAt, contentHashValue(record), metadata)
+	if err != nil {
+		return sqliteDialect.putError(err)
+	}
+	if err := sqliteDialect.updateBalances(tx, old, &record); err != nil {
+		return err
+	}
+	if event != nil {
+		if err := sqliteDialect.addOutboxEvent(tx, *event); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Delete(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old, err := sqliteDialect.storedRecord(tx, sqliteColumns, scanSQLiteRecord, id)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM receipts WHERE id = ?`, id); err != nil {
+		return err
+	}
+	if err := sqliteDialect.updateBalances(tx, old, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Balance(userID string) (int, error) {
+	return sqliteDialect.balance(s.db, userID)
+}
+
+func (s *SQLiteStore) Transfer(from, to string, points int) (int, error) {
+	return sqliteDialect.transfer(s.db, from, to, points)
+}
+
+// Snapshot reads the whole database before handing out any receipt, since
+// its transaction holds the only connection.
+func (s *SQLiteStore) Snapshot(receipt func(ReceiptRecord) error) (map[string]int, error) {
+	var records []ReceiptRecord
+	balances, err := sqliteDialect.readSnapshot(s.db, sqliteColumns, scanSQLiteRecord, func(record ReceiptRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if err := receipt(record); err != nil {
+			return nil, err
+		}
+	}
+	return balances, nil
+}
+
+func (s *SQLiteStore) List(opts ListOptions) ([]ReceiptRecord, error) {
+	query, args := sqliteDialect.listQuery(sqliteColumns, opts)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []ReceiptRecord
+	for rows.Next() {
+		record, err := scanSQLiteRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
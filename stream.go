@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// StreamResult reports the outcome for the receipt on Line of a stream,
+// counting from 1.
+type StreamResult struct {
+	Line int `json:"line"`
+	BatchResult
+}
+
+// ProcessStreamHandler processes newline-delimited JSON receipts, writing a
+// result line for each as soon as it is processed. The stream has no size
+// limit; each line is limited by -max-body-bytes and ends the stream if
+// it's longer. Blank lines are skipped.
+//
+// The stream stays open as long as the client keeps sending within
+// -stream-idle-timeout, so the server's read and write timeouts don't
+// apply to it.
+func (s *Server) ProcessStreamHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// HTTP/1.1 clients get results while still sending, where they support
+	// it. Otherwise the results wait in the connection's buffers.
+	rc.EnableFullDuplex()
+	s.extendStreamDeadlines(rc)
+
+	// The status goes out with the first result, after the first read of
+	// the body: writing it earlier would refuse clients waiting for a 100
+	// Continue.
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	write := func(result StreamResult) bool {
+		s.extendStreamDeadlines(rc)
+		if err := encoder.Encode(result); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	from := submitterOf(r)
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, int(s.cfg.MaxBodyBytes))
+	line, processed := 0, 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		if refusal := s.chargeStreamReceipt(r); refusal != "" {
+			write(StreamResult{Line: line, BatchResult: BatchResult{Error: refusal}})
+			break
+		}
+		result := s.processBatchItem(from, data)
+		if result.Error != "" {
+			s.refundQuota(r, 1)
+		}
+		processed++
+		if !write(StreamResult{Line: line, BatchResult: result}) {
+			break
+		}
+	}
+
+	switch err := scanner.Err(); {
+	case errors.Is(err, bufio.ErrTooLong):
+		write(StreamResult{Line: line + 1, BatchResult: BatchResult{
+			Error: fmt.Sprintf("Lines are limited to %d bytes", s.cfg.MaxBodyBytes),
+		}})
+	case err != nil:
+		// The client went away or stopped sending, so there's no one to
+		// tell.
+		logAttrs(r, slog.String("streamError", err.Error()))
+	}
+	logAttrs(r, slog.Int("receipts", processed))
+}
+
+// extendStreamDeadlines gives the client of a stream another
+// -stream-idle-timeout to send and receive.
+func (s *Server) extendStreamDeadlines(rc *http.ResponseController) {
+	var deadline time.Time
+	if s.cfg.StreamIdleTimeout > 0 {
+		deadline = time.Now().Add(s.cfg.StreamIdleTimeout)
+	}
+	rc.SetReadDeadline(deadline)
+	rc.SetWriteDeadline(deadline)
+}
+
+// chargeStreamReceipt charges a receipt of a stream against the quota of
+// its API key, returning why it can't be processed if the quota is used
+// up. Streams stop there, since it's too late to refuse them with a status.
+func (s *Server) chargeStreamReceipt(r *http.Request) string {
+	p := principalFrom(r)
+	if s.apiKeys == nil || p == nil {
+		return ""
+	}
+	usage, err := s.apiKeys.Charge(p.ID, 1, s.clock.Now())
+	if !errors.Is(err, errQuotaExceeded) {
+		return ""
+	}
+	return fmt.Sprintf("The monthly quota of %d receipts is used up until %s", usage.MonthlyQuota, usage.ResetsAt.Format("2006-01-02"))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// tenantPattern restricts tenant names, which become part of the stored
+// receipt IDs.
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// tenantSeparator separates the tenant from the receipt ID in stored IDs.
+// Receipt IDs are UUIDs, which never contain it.
+const tenantSeparator = "/"
+
+// tenantOfID returns the tenant of a stored receipt ID; receipts of the
+// default tenant have plain IDs.
+func tenantOfID(id string) string {
+	tenant, _, found := strings.Cut(id, tenantSeparator)
+	if !found {
+		return ""
+	}
+	return tenant
+}
+
+// tenantStore confines a Store to the receipts of one tenant. Receipts are
+// stored under IDs qualified with their tenant, as "tenant/id", and looked
+// up the same way, so a receipt ID guessed from another tenant names a
+// receipt that doesn't exist. The default tenant "" keeps plain IDs, so
+// receipts stored before tenants existed stay where they were.
+type tenantStore struct {
+	store  Store
+	tenant string
+}
+
+// tenantStore returns the store of tenant. With tracing on, its calls are
+// recorded as children of the span in ctx.
+func (s *Server) tenantStore(ctx context.Context, tenant string) Store {
+	if s.tracer != nil {
+		return tenantStore{store: tracedStore{store: s.store, server: s, ctx: ctx}, tenant: tenant}
+	}
+	return tenantStore{store: s.store, tenant: tenant}
+}
+
+func (t tenantStore) qualify(id string) string {
+	if t.tenant == "" {
+		return id
+	}
+	return t.tenant + tenantSeparator + id
+}
+
+// local strips the tenant from a stored record.
+func (t tenantStore) local(record ReceiptRecord) ReceiptRecord {
+	record.ID = strings.TrimPrefix(record.ID, t.qualify(""))
+	record.ContentHash = strings.TrimPrefix(record.ContentHash, t.qualify(""))
+	return record
+}
+
+func (t tenantStore) Get(id string) (ReceiptRecord, error) {
+	// Qualified IDs would reach into other tenants.
+	if strings.Contains(id, tenantSeparator) {
+		return ReceiptRecord{}, ErrNotFound
+	}
+	record, err := t.store.Get(t.qualify(id))
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	return t.local(record), nil
+}
+
+func (t tenantStore) GetMany(ids []string) (map[string]ReceiptRecord, error) {
+	qualified := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !strings.Contains(id, tenantSeparator) {
+			qualified = append(qualified, t.qualify(id))
+		}
+	}
+	found, err := getMany(t.store, qualified)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]ReceiptRecord, len(found))
+	for _, record := range found {
+		record = t.local(record)
+		records[record.ID] = record
+	}
+	return records, nil
+}
+
+// Put stores the record under the tenant. Its content hash is qualified
+// too, so duplicates are only detected within a tenant.
+func (t tenantStore) Put(record ReceiptRecord) error {
+	record.ID = t.qualify(record.ID)
+	if record.ContentHash != "" {
+		record.ContentHash = t.qualify(record.ContentHash)
+	}
+	return t.store.Put(record)
+}
+
+// PutWithEvent is Put for stores with an outbox.
+func (t tenantStore) PutWithEvent(record ReceiptRecord, event OutboxEvent) error {
+	record.ID = t.qualify(record.ID)
+	if record.ContentHash != "" {
+		record.ContentHash = t.qualify(record.ContentHash)
+	}
+	outbox, err := outboxOf(t.store)
+	if err != nil {
+		return err
+	}
+	return outbox.PutWithEvent(record, event)
+}
+
+func (t tenantStore) OutboxEvents(limit int) ([]OutboxEvent, error) {
+	outbox, err := outboxOf(t.store)
+	if err != nil {
+		return nil, err
+	}
+	return outbox.OutboxEvents(limit)
+}
+
+func (t tenantStore) DeleteOutboxEvents(seq int64) error {
+	outbox, err := outboxOf(t.store)
+	if err != nil {
+		return err
+	}
+	return outbox.DeleteOutboxEvents(seq)
+}
+
+func (t tenantStore) Delete(id string) error {
+	if strings.Contains(id, tenantSeparator) {
+		return ErrNotFound
+	}
+	return t.store.Delete(t.qualify(id))
+}
+
+func (t tenantStore) List(opts ListOptions) ([]ReceiptRecord, error) {
+	opts.Filter.Tenant = &t.tenant
+	if opts.After.ID != "" {
+		opts.After.ID = t.qualify(opts.After.ID)
+	}
+	records, err := t.store.List(opts)
+	for i := range records {
+		records[i] = t.local(records[i])
+	}
+	return records, err
+}
+
+func (t tenantStore) FindByContentHash(hash string) (ReceiptRecord, error) {
+	record, err := t.store.FindByContentHash(t.qualify(hash))
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	return t.local(record), nil
+}
+
+func (t tenantStore) Balance(userID string) (int, error) {
+	if strings.Contains(userID, tenantSeparator) {
+		return 0, ErrNotFound
+	}
+	return t.store.Balance(t.qualify(userID))
+}
+
+func (t tenantStore) Transfer(from, to string, points int) (int, error) {
+	if strings.Contains(from, tenantSeparator) || strings.Contains(to, tenantSeparator) {
+		return 0, ErrNotFound
+	}
+	return t.store.Transfer(t.qualify(from), t.qualify(to), points)
+}
+
+type tenantKey struct{}
+
+// tenantFrom returns the tenant of a request; "" is the default tenant.
+func tenantFrom(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return tenant
+}
+
+// withTenant works out the tenant of a request before calling next. API
+// keys bound to a tenant always act for it. Other callers may name a tenant
+// in the tenant header, if one is configured, and use the default tenant
+// otherwise. It must run inside the "auth" middleware.
+func (s *Server) withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requested string
+		if s.cfg.TenantHeader != "" {
+			requested = r.Header.Get(s.cfg.TenantHeader)
+		}
+		tenant := requested
+		if p := principalFrom(r); p != nil && p.Tenant != "" {
+			if requested != "" && requested != p.Tenant {
+				writeProblem(w, r, Problem{
+					Type:   "/problems/forbidden",
+					Title:  "Not allowed",
+					Status: http.StatusForbidden,
+					Detail: fmt.Sprintf("These credentials can only act for tenant %q.", p.Tenant),
+				})
+				return
+			}
+			tenant = p.Tenant
+		}
+		if tenant != "" && !tenantPattern.MatchString(tenant) {
+			http.Error(w, "Tenants must be lowercase letters, digits and hyphens", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	})
+}
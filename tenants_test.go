@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTenantBoundKeysCantActAcrossTenants(t *testing.T) {
+	rules, err := NewRulesEngine(RulesConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(NewMemoryStore(), rules, systemClock{}, uuidGenerator{}, ServerConfig{})
+	keys, err := NewAPIKeyStore("", "bootstrap-key", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.EnableAPIKeys(keys)
+	tenantKey, _, err := keys.Create("acme admin", "acme", []Role{RoleAdmin}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A receipt of another tenant, scored by rules long gone so that a
+	// recalculation changes it.
+	receipt := Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Total:        "6.49",
+		Items:        []Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}},
+	}
+	if err := s.store.Put(ReceiptRecord{ID: "globex/r1", Receipt: receipt, Points: 999}); err != nil {
+		t.Fatal(err)
+	}
+	// The routes under test, behind the authentication and tenant
+	// middleware of main's chain.
+	api := routes{router: mux.NewRouter(), chain: Chain{
+		s.requireScope(ScopeAdmin),
+		{Name: "tenant", Wrap: s.withTenant},
+	}}
+	api.handle("POST", "/admin/recalculate", s.StartRecalculationHandler)
+	api.handle("GET", "/admin/recalculate/{id}", s.GetRecalculationHandler)
+	api.handle("POST", "/admin/rules/reload", s.ReloadRulesHandler)
+	api.handle("GET", "/admin/retailer-overrides", s.ListRetailerOverridesHandler)
+	api.handle("POST", "/admin/retailer-overrides", s.CreateRetailerOverrideHandler)
+	api.handle("GET", "/admin/retailer-aliases", s.ListRetailerAliasesHandler)
+	api.handle("PUT", "/admin/retailer-aliases/{alias}", s.PutRetailerAliasHandler)
+	api.handle("GET", "/admin/config", s.GetConfigHandler)
+	api.handle("GET", "/admin/log-level", GetLogLevelHandler)
+	api.handle("PUT", "/admin/log-level", SetLogLevelHandler)
+	handler := api.router
+
+	do := func(key, method, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do(tenantKey, "POST", "/admin/recalculate"); w.Code != http.StatusForbidden {
+		t.Errorf("recalculation started with a tenant-bound key: %d %s", w.Code, w.Body)
+	}
+
+	w := do("bootstrap-key", "POST", "/admin/recalculate")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST /admin/recalculate = %d %s", w.Code, w.Body)
+	}
+	var started struct{ ID string }
+	json.NewDecoder(w.Body).Decode(&started)
+	run := "/admin/recalculate/" + started.ID
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w = do("bootstrap-key", "GET", run)
+		if strings.Contains(w.Body.String(), `"status":"completed"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the recalculation didn't complete: %s", w.Body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(w.Body.String(), "globex/r1") {
+		t.Fatalf("the recalculation didn't change the other tenant's receipt: %s", w.Body)
+	}
+	if w := do(tenantKey, "GET", run); w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "globex") {
+		t.Errorf("GET %s with a tenant-bound key = %d %s", run, w.Code, w.Body)
+	}
+
+	// Settings every tenant shares.
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/admin/rules/reload"},
+		{"GET", "/admin/retailer-overrides"},
+		{"POST", "/admin/retailer-overrides"},
+		{"GET", "/admin/retailer-aliases"},
+		{"PUT", "/admin/retailer-aliases/tgt"},
+		{"GET", "/admin/log-level"},
+		{"PUT", "/admin/log-level"},
+		{"GET", "/admin/config"},
+	} {
+		if w := do(tenantKey, route.method, route.path); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with a tenant-bound key = %d, want 403", route.method, route.path, w.Code)
+		}
+	}
+}
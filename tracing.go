@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type TracingConfig struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector spans are
+	// exported to; empty turns tracing off.
+	Endpoint string
+	// Insecure exports over plain HTTP instead of HTTPS.
+	Insecure    bool
+	ServiceName string
+	// SampleRatio is the share of new traces recorded. Traces started by
+	// callers keep their sampling decision.
+	SampleRatio float64
+}
+
+func (cfg TracingConfig) validate() error {
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return errors.New("-trace-sample-ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// Tracer records spans. The OpenTelemetry one is only compiled in with
+// -tags otel, so that the default build doesn't carry its dependencies.
+type Tracer interface {
+	// StartRequest starts the span of an incoming request, continuing the
+	// trace in its traceparent header if it has one.
+	StartRequest(ctx context.Context, header http.Header, name string) (context.Context, Span)
+	// Start starts a span as a child of the one in ctx.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Shutdown exports the spans not sent yet.
+	Shutdown(ctx context.Context) error
+}
+
+type Span interface {
+	SetAttribute(key string, value any)
+	// End ends the span, marking it failed when err isn't nil.
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) End(err error)                      {}
+
+// EnableTracing records spans of requests, scoring and store calls.
+func (s *Server) EnableTracing(tracer Tracer) {
+	s.tracer = tracer
+}
+
+// startSpan starts a span as a child of the one in ctx, or returns a span
+// that records nothing when tracing is off.
+func (s *Server) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if s.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return s.tracer.Start(ctx, name)
+}
+
+// score scores receipt with rules in a span of its own.
+func (s *Server) score(ctx context.Context, rules *RuleSet, receipt *Receipt, at time.Time) PointsBreakdown {
+	_, span := s.startSpan(ctx, "rules.Score")
+	breakdown := rules.Score(receipt, at)
+	span.SetAttribute("rules.version", breakdown.RulesVersion)
+	span.SetAttribute("points", breakdown.Points)
+	span.End(nil)
+	return breakdown
+}
+
+// traceRequests records a span for each request, named after its route.
+func (s *Server) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := r.Method
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				name += " " + template
+			}
+		}
+		ctx, span := s.tracer.StartRequest(r.Context(), r.Header, name)
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttribute("http.response.status_code", recorder.status)
+		var err error
+		if recorder.status >= http.StatusInternalServerError {
+			err = errors.New(http.StatusText(recorder.status))
+		}
+		span.End(err)
+	})
+}
+
+// statusRecorder remembers the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// tracedStore records a span for each call to a Store, as a child of the
+// span in ctx. Receipts that don't exist aren't counted as failures.
+type tracedStore struct {
+	store  Store
+	server *Server
+	ctx    context.Context
+}
+
+func (t tracedStore) start(name string) Span {
+	_, span := t.server.startSpan(t.ctx, "store."+name)
+	return span
+}
+
+func (t tracedStore) end(span Span, err error) {
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	span.End(err)
+}
+
+func (t tracedStore) Get(id string) (ReceiptRecord, error) {
+	span := t.start("Get")
+	record, err := t.store.Get(id)
+	t.end(span, err)
+	return record, err
+}
+
+func (t tracedStore) GetMany(ids []string) (map[string]ReceiptRecord, error) {
+	span := t.start("GetMany")
+	span.SetAttribute("receipts", len(ids))
+	records, err := getMany(t.store, ids)
+	t.end(span, err)
+	return records, err
+}
+
+func (t tracedStore) Put(record ReceiptRecord) error {
+	span := t.start("Put")
+	err := t.store.Put(record)
+	t.end(span, err)
+	return err
+}
+
+func (t tracedStore) PutWithEvent(record ReceiptRecord, event OutboxEvent) error {
+	span := t.start("PutWithEvent")
+	outbox, err := outboxOf(t.store)
+	if err == nil {
+		err = outbox.PutWithEvent(record, event)
+	}
+	t.end(span, err)
+	return err
+}
+
+func (t tracedStore) OutboxEvents(limit int) ([]OutboxEvent, error) {
+	outbox, err := outboxOf(t.store)
+	if err != nil {
+		return nil, err
+	}
+	return outbox.OutboxEvents(limit)
+}
+
+func (t tracedStore) DeleteOutboxEvents(seq int64) error {
+	outbox, err := outboxOf(t.store)
+	if err != nil {
+		return err
+	}
+	return outbox.DeleteOutboxEvents(seq)
+}
+
+func (t tracedStore) Delete(id string) error {
+	span := t.start("Delete")
+	err := t.store.Delete(id)
+	t.end(span, err)
+	return err
+}
+
+func (t tracedStore) List(opts ListOptions) ([]ReceiptRecord, error) {
+	span := t.start("List")
+	records, err := t.store.List(opts)
+	span.SetAttribute("receipts", len(records))
+	t.end(span, err)
+	return records, err
+}
+
+func (t tracedStore) FindByContentHash(hash string) (ReceiptRecord, error) {
+	span := t.start("FindByContentHash")
+	record, err := t.store.FindByContentHash(hash)
+	t.end(span, err)
+	return record, err
+}
+
+func (t tracedStore) Balance(userID string) (int, error) {
+	span := t.start("Balance")
+	balance, err := t.store.Balance(userID)
+	t.end(span, err)
+	return balance, err
+}
+
+func (t tracedStore) Transfer(from, to string, points int) (int, error) {
+	span := t.start("Transfer")
+	balance, err := t.store.Transfer(from, to, points)
+	t.end(span, err)
+	return balance, err
+}
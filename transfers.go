@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type TransferRequest struct {
+	To     string `json:"to"`
+	Points int    `json:"points"`
+}
+
+type TransferResponse struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Points int    `json:"points"`
+	// Balance is the sender's balance after the transfer.
+	Balance int `json:"balance"`
+}
+
+// transferLimits tracks how many points each user sent today, for the
+// daily transfer limit. The counts are kept in memory, so they start over
+// when the service restarts.
+type transferLimits struct {
+	mu   sync.Mutex
+	day  string
+	sent map[string]int
+}
+
+// reserve counts points against the user's daily limit, reporting false
+// without counting them when they don't fit.
+func (l *transferLimits) reserve(user string, points, limit int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if day := now.UTC().Format(time.DateOnly); day != l.day {
+		l.day, l.sent = day, make(map[string]int)
+	}
+	if l.sent[user]+points > limit {
+		return false
+	}
+	l.sent[user] += points
+	return true
+}
+
+// release gives back points reserved for a transfer that failed.
+func (l *transferLimits) release(user string, points int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sent[user] >= points {
+		l.sent[user] -= points
+	}
+}
+
+// TransferPointsHandler moves points from a user's balance to another
+// user's. Users can only transfer their own points.
+func (s *Server) TransferPointsHandler(w http.ResponseWriter, r *http.Request) {
+	from := mux.Vars(r)["id"]
+	if !ownedBy(r, from) {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+
+	var request TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "The request must be a JSON object with the user to transfer to and the points", http.StatusBadRequest)
+		return
+	}
+	if !userIDPattern.MatchString(request.To) {
+		http.Error(w, "to must be a valid user id", http.StatusBadRequest)
+		return
+	}
+	if request.To == from {
+		http.Error(w, "Points can't be transferred to the same user", http.StatusBadRequest)
+		return
+	}
+	if request.Points <= 0 {
+		http.Error(w, "points must be positive", http.StatusBadRequest)
+		return
+	}
+	// The balances of users on different nodes can't be moved atomically.
+	if s.shards != nil && !s.shards.owns(request.To) {
+		http.Error(w, "Points can't be transferred to a user kept by another node", http.StatusConflict)
+		return
+	}
+	if limit := s.cfg.TransferMaxPoints; limit > 0 && request.Points > limit {
+		writeProblem(w, r, Problem{
+			Type:   "/problems/transfer-limit-exceeded",
+			Title:  "Transfer limit exceeded",
+			Status: http.StatusUnprocessableEntity,
+			Detail: fmt.Sprintf("At most %d points can be transferred at once.", limit),
+		})
+		return
+	}
+
+	tenant := tenantFrom(r)
+	limited := s.cfg.TransferDailyMaxPoints > 0
+	sender := tenant + tenantSeparator + from
+	if limited && !s.transfers.reserve(sender, request.Points, s.cfg.TransferDailyMaxPoints, s.clock.Now()) {
+		writeProblem(w, r, Problem{
+			Type:   "/problems/transfer-limit-exceeded",
+			Title:  "Transfer limit exceeded",
+			Status: http.StatusUnprocessableEntity,
+			Detail: fmt.Sprintf("A user can transfer at most %d points a day.", s.cfg.TransferDailyMaxPoints),
+		})
+		return
+	}
+
+	balance, err := s.tenantStore(r.Context(), tenant).Transfer(from, request.To, request.Points)
+	if err != nil && limited {
+		s.transfers.release(sender, request.Points)
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, r, errUserNotFound)
+		return
+	case errors.Is(err, ErrInsufficientPoints):
+		writeProblem(w, r, Problem{
+			Type:   "/problems/insufficient-points",
+			Title:  "Not enough points",
+			Status: http.StatusConflict,
+			Detail: fmt.Sprintf("The balance is %d points, which is less than the %d to transfer.", balance, request.Points),
+		})
+		return
+	case err != nil:
+		writeError(w, r, err)
+		return
+	}
+
+	audit(r, "action=transfer-out user=%s to=%s points=%d balance=%d", from, request.To, request.Points, balance)
+	audit(r, "action=transfer-in user=%s from=%s points=%d", request.To, from, request.Points)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TransferResponse{From: from, To: request.To, Points: request.Points, Balance: balance})
+}
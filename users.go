@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// errUserNotFound is returned for users without receipts, since users only
+// exist through the receipts credited to them.
+var errUserNotFound = errors.New("user not found")
+
+type UserPointsResponse struct {
+	UserID string `json:"userId"`
+	Points int    `json:"points"`
+	// ExpiringPoints are the points that expire before ExpiringBefore.
+	// Both are left out when points don't expire.
+	ExpiringPoints *int       `json:"expiringPoints,omitempty"`
+	ExpiringBefore *time.Time `json:"expiringBefore,omitempty"`
+}
+
+// UserReceipt is an entry of a user's receipt history.
+type UserReceipt struct {
+	ID           string    `json:"id"`
+	Retailer     string    `json:"retailer"`
+	PurchaseDate string    `json:"purchaseDate"`
+	Points       int       `json:"points"`
+	ProcessedAt  time.Time `json:"processedAt"`
+	// ExpiresAt is left out when points don't expire, and ExpiredAt until
+	// they did.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	ExpiredAt *time.Time `json:"expiredAt,omitempty"`
+}
+
+type UserReceiptsResponse struct {
+	UserID   string        `json:"userId"`
+	Receipts []UserReceipt `json:"receipts"`
+	// NextCursor is omitted on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ListUserReceiptsHandler lists the receipts credited to a user, newest
+// purchase first unless asked otherwise. It takes the same filter, sort
+// and paging parameters as the receipt listing. Users can only list their
+// own receipts.
+func (s *Server) ListUserReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !ownedBy(r, id) {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+	opts, limit, problem := parseListOptions(r, SortByPurchaseDate, true)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	opts.Filter.UserID = id
+	records, next, err := listPage(s.tenantStore(r.Context(), tenantFrom(r)), opts, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	response := UserReceiptsResponse{UserID: id, Receipts: []UserReceipt{}, NextCursor: next}
+	for _, record := range records {
+		receipt := UserReceipt{
+			ID:           record.ID,
+			Retailer:     record.Receipt.Retailer,
+			PurchaseDate: record.Receipt.PurchaseDate,
+			Points:       record.Points,
+			ProcessedAt:  record.ProcessedAt,
+			ExpiredAt:    record.ExpiredAt,
+		}
+		if at := s.expiresAt(record); !at.IsZero() {
+			receipt.ExpiresAt = &at
+		}
+		response.Receipts = append(response.Receipts, receipt)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetUserPointsHandler returns the points of all receipts credited to a
+// user. Users can only look up their own balance.
+func (s *Server) GetUserPointsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !ownedBy(r, id) {
+		writeError(w, r, errUserNotFound)
+		return
+	}
+
+	store := s.tenantStore(r.Context(), tenantFrom(r))
+	points, err := store.Balance(id)
+	if errors.Is(err, ErrNotFound) {
+		err = errUserNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	response := UserPointsResponse{UserID: id, Points: points}
+	if s.cfg.PointsExpiry > 0 {
+		before := s.clock.Now().UTC().Add(s.cfg.PointsExpiryWarning)
+		expiring, err := s.expiringPoints(store, id, before)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		response.ExpiringPoints = &expiring
+		response.ExpiringBefore = &before
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
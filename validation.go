@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Patterns from the receipt processor API specification.
+var (
+	retailerPattern = regexp.MustCompile(`^[\w\s\-&]+$`)
+	// unicodeRetailerPattern also accepts letters and digits of any script,
+	// for rule sets with UnicodeRetailerNames.
+	unicodeRetailerPattern = regexp.MustCompile(`^[\p{L}\p{N}\w\s\-&]+$`)
+	descriptionPattern     = regexp.MustCompile(`^[\w\s\-]+$`)
+	amountPattern          = regexp.MustCompile(`^\d+\.\d{2}$`)
+)
+
+// amountInRange reports whether an amount matching amountPattern is small
+// enough to be parsed.
+func amountInRange(amount string) bool {
+	_, err := parseCents(amount)
+	return err == nil
+}
+
+// userIDPattern accepts the user IDs of common identity providers, such
+// as emails and "auth0|123". Slashes are reserved for qualifying users
+// with their tenant.
+var userIDPattern = regexp.MustCompile(`^[\w.@:|+\-]{1,128}$`)
+
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+	Value  string `json:"value"`
+}
+
+// ValidationError lists every field of a receipt that failed validation,
+// so clients can fix them all in one go.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = fmt.Sprintf("%s %s (got %q)", f.Field, f.Reason, f.Value)
+	}
+	return strings.Join(problems, "; ")
+}
+
+func (e *ValidationError) add(field, reason, value string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Reason: reason, Value: value})
+}
+
+// decodeError turns a JSON decoding failure into something a client can
+// act on, pointing at the offending field where possible.
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &ValidationError{Fields: []FieldError{{
+			Field:  typeErr.Field,
+			Reason: "must be a JSON " + jsonTypeName(typeErr.Type.Kind()) + ", not " + typeErr.Value,
+		}}}
+	}
+	return fmt.Errorf("the request body is not valid JSON: %w", err)
+}
+
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	default:
+		return kind.String()
+	}
+}
+
+// checkUnknownFields reports every key in a receipt document, including
+// inside its items, that does not belong to the receipt schema.
+// encoding/json's DisallowUnknownFields stops at the first one.
+func checkUnknownFields(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return decodeError(err)
+	}
+	// Items have already been type-checked by the regular decode.
+	var items []map[string]json.RawMessage
+	json.Unmarshal(fields["items"], &items)
+
+	verr := &ValidationError{}
+	for _, key := range sortedKeys(fields) {
+		if !receiptFields[key] {
+			verr.add(key, "is not a recognized field", string(fields[key]))
+		}
+	}
+	for i, item := range items {
+		for _, key := range sortedKeys(item) {
+			if !itemFields[key] {
+				verr.add(fmt.Sprintf("items[%d].%s", i, key), "is not a recognized field", string(item[key]))
+			}
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+var (
+	receiptFields = jsonFieldSet(Receipt{})
+	itemFields    = jsonFieldSet(Item{})
+)
+
+// jsonFieldSet collects the JSON names of a struct's fields.
+func jsonFieldSet(v any) map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type validationOptions struct {
+	// UnicodeRetailerNames accepts letters and digits of any script in
+	// retailer names.
+	UnicodeRetailerNames bool
+	// Refunds accepts negative item prices.
+	Refunds bool
+	// MaxItems and MaxDescriptionLength limit the size of receipts. Zero
+	// means no limit.
+	MaxItems             int
+	MaxDescriptionLength int
+}
+
+func validateReceipt(receipt *Receipt, opts validationOptions) error {
+	verr := &ValidationError{}
+
+	// Validate the receipt
+	pattern := retailerPattern
+	if opts.UnicodeRetailerNames {
+		pattern = unicodeRetailerPattern
+	}
+	if !pattern.MatchString(receipt.Retailer) {
+		verr.add("retailer", "must be letters, digits, spaces, '-' or '&'", receipt.Retailer)
+	}
+	if _, err := time.Parse("2006-01-02", receipt.PurchaseDate); err != nil {
+		verr.add("purchaseDate", "must be a valid date in YYYY-MM-DD format", receipt.PurchaseDate)
+	}
+	if _, err := time.Parse("15:04", receipt.PurchaseTime); err != nil {
+		verr.add("purchaseTime", "must be a valid 24-hour time in HH:MM format", receipt.PurchaseTime)
+	}
+	if !amountPattern.MatchString(receipt.Total) {
+		verr.add("total", "must be an amount with two decimal places", receipt.Total)
+	} else if !amountInRange(receipt.Total) {
+		verr.add("total", "must be at most "+maxCents.String(), receipt.Total)
+	}
+	if receipt.UserID != "" && !userIDPattern.MatchString(receipt.UserID) {
+		verr.add("userId", "must be up to 128 letters, digits or '.', '@', ':', '|', '+', '-' or '_'", receipt.UserID)
+	}
+	if len(receipt.Items) == 0 {
+		verr.add("items", "must contain at least one item", "")
+	}
+	if opts.MaxItems > 0 && len(receipt.Items) > opts.MaxItems {
+		verr.add("items", fmt.Sprintf("must contain at most %d items", opts.MaxItems), strconv.Itoa(len(receipt.Items)))
+		// Don't list errors for every item of an oversized receipt.
+		return verr
+	}
+
+	// Validate the items
+	for i, item := range receipt.Items {
+		field := fmt.Sprintf("items[%d]", i)
+		switch {
+		case opts.MaxDescriptionLength > 0 && utf8.RuneCountInString(item.ShortDescription) > opts.MaxDescriptionLength:
+			verr.add(field+".shortDescription", fmt.Sprintf("must be at most %d characters", opts.MaxDescriptionLength), item.ShortDescription)
+		case !descriptionPattern.MatchString(item.ShortDescription):
+			verr.add(field+".shortDescription", "must be letters, digits, spaces or '-'", item.ShortDescription)
+		}
+		price, negative := strings.CutPrefix(item.Price, "-")
+		switch {
+		case !amountPattern.MatchString(price):
+			verr.add(field+".price", "must be an amount with two decimal places", item.Price)
+		case !amountInRange(price):
+			verr.add(field+".price", "must be at most "+maxCents.String(), item.Price)
+		case negative && !opts.Refunds:
+			verr.add(field+".price", "must not be negative", item.Price)
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
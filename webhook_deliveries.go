@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type WebhookConfig struct {
+	// File persists the webhooks; they are kept in memory if it's empty.
+	File string
+	// Workers bounds how many notifications are sent at once.
+	Workers int
+	// Timeout bounds each attempt to send a notification.
+	Timeout time.Duration
+	// MaxAttempts is how many times a notification is tried before it is
+	// given up on.
+	MaxAttempts int
+}
+
+const (
+	// webhookQueueSize is how many notifications may wait for a worker
+	// before new ones are dropped.
+	webhookQueueSize = 1024
+	// webhookLogSize is how many of its latest deliveries are kept for
+	// each webhook.
+	webhookLogSize = 100
+)
+
+// webhookDeliveries counts notifications by outcome: delivered, retried
+// after a failed attempt, failed for good, and dropped because the queue
+// was full, the webhook was deleted or the server shut down.
+var webhookDeliveries = expvar.NewMap("webhookDeliveries")
+
+var (
+	errDeliveryNotFound = errors.New("webhook delivery not found")
+	errDeliveryPending  = errors.New("webhook delivery still pending")
+)
+
+// WebhookNotification is the body of a webhook request.
+type WebhookNotification struct {
+	// ID identifies the notification, as in the X-Webhook-Delivery header,
+	// so that receivers can ignore retries they already handled.
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Data      ReceiptEvent `json:"data"`
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+	DeliveryDropped   DeliveryStatus = "dropped"
+)
+
+// DeliveryAttempt is one try at sending a notification. StatusCode is
+// zero when no answer came, and Error says why.
+type DeliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// WebhookDelivery is the history of a notification sent to a webhook.
+type WebhookDelivery struct {
+	ID            string            `json:"id"`
+	WebhookID     string            `json:"webhookId"`
+	ReceiptID     string            `json:"receiptId"`
+	Status        DeliveryStatus    `json:"status"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	NextAttemptAt *time.Time        `json:"nextAttemptAt,omitempty"`
+	Attempts      []DeliveryAttempt `json:"attempts"`
+
+	body []byte
+	// attempt counts the attempts since the delivery was last queued,
+	// which redelivering starts over.
+	attempt int
+}
+
+// WebhookDispatcher sends a notification to each of a tenant's webhooks
+// for each receipt processed for it. Failed attempts are retried with
+// exponential backoff. Notifications, and the log of the latest ones,
+// are kept in memory, so those still waiting at shutdown are lost.
+type WebhookDispatcher struct {
+	hooks  *WebhookStore
+	client *http.Client
+	clock  Clock
+	ids    IDGenerator
+	cfg    WebhookConfig
+
+	queue   chan *WebhookDelivery
+	workers sync.WaitGroup
+
+	// mu guards the deliveries as well as the fields below.
+	mu      sync.Mutex
+	closed  bool
+	retries map[*time.Timer]*WebhookDelivery
+	// log holds the latest deliveries of each webhook, oldest first.
+	log map[string][]*WebhookDelivery
+}
+
+func NewWebhookDispatcher(hooks *WebhookStore, clock Clock, ids IDGenerator, cfg WebhookConfig) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		hooks:   hooks,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		clock:   clock,
+		ids:     ids,
+		cfg:     cfg,
+		queue:   make(chan *WebhookDelivery, webhookQueueSize),
+		retries: make(map[*time.Timer]*WebhookDelivery),
+		log:     make(map[string][]*WebhookDelivery),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			for delivery := range d.queue {
+				d.deliver(delivery)
+			}
+		}()
+	}
+	return d
+}
+
+// Notify queues a notification of event for each webhook of its tenant.
+// It never waits, so it can be an event sink.
+func (d *WebhookDispatcher) Notify(event ReceiptEvent) {
+	for _, hook := range d.hooks.List(event.tenant) {
+		now := d.clock.Now().UTC()
+		id := d.ids.NewID()
+		body, err := json.Marshal(WebhookNotification{
+			ID:        id,
+			Type:      "receipt.processed",
+			CreatedAt: now,
+			Data:      event,
+		})
+		if err != nil {
+			slog.Error("Failed to encode a webhook notification", "err", err)
+			continue
+		}
+		delivery := &WebhookDelivery{
+			ID:        id,
+			WebhookID: hook.ID,
+			ReceiptID: event.ID,
+			Status:    DeliveryPending,
+			CreatedAt: now,
+			Attempts:  []DeliveryAttempt{},
+			body:      body,
+			attempt:   1,
+		}
+
+		d.mu.Lock()
+		log := append(d.log[hook.ID], delivery)
+		if len(log) > webhookLogSize {
+			log = slices.Delete(log, 0, len(log)-webhookLogSize)
+		}
+		d.log[hook.ID] = log
+		d.enqueue(delivery)
+		d.mu.Unlock()
+	}
+}
+
+// enqueue hands delivery to the workers. d.mu must be held.
+func (d *WebhookDispatcher) enqueue(delivery *WebhookDelivery) {
+	delivery.NextAttemptAt = nil
+	if d.closed {
+		delivery.Status = DeliveryDropped
+		webhookDeliveries.Add("dropped", 1)
+		return
+	}
+	select {
+	case d.queue <- delivery:
+	default:
+		delivery.Status = DeliveryDropped
+		webhookDeliveries.Add("dropped", 1)
+		slog.Warn("Webhook queue full, dropping a notification", "webhook", delivery.WebhookID, "delivery", delivery.ID)
+	}
+}
+
+func (d *WebhookDispatcher) deliver(delivery *WebhookDelivery) {
+	// The webhook is looked up for each attempt, so that retries go to its
+	// current URL and stop once it is deleted.
+	hook, found := d.hooks.lookup(delivery.WebhookID)
+	if !found {
+		d.mu.Lock()
+		delivery.Status = DeliveryDropped
+		d.mu.Unlock()
+		webhookDeliveries.Add("dropped", 1)
+		return
+	}
+
+	start := d.clock.Now()
+	status, err := d.send(hook, delivery)
+	attempt := DeliveryAttempt{
+		At:         start.UTC(),
+		StatusCode: status,
+		DurationMs: d.clock.Now().Sub(start).Milliseconds(),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	logger := slog.With("webhook", hook.ID, "delivery", delivery.ID, "attempt", delivery.attempt)
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		webhookDeliveries.Add("delivered", 1)
+		return
+	case delivery.attempt >= d.cfg.MaxAttempts:
+		delivery.Status = DeliveryFailed
+		webhookDeliveries.Add("failed", 1)
+		logger.Error("Giving up on a webhook notification", "err", err)
+		return
+	case d.closed:
+		delivery.Status = DeliveryDropped
+		webhookDeliveries.Add("dropped", 1)
+		return
+	}
+
+	webhookDeliveries.Add("retried", 1)
+	wait := webhookBackoff(delivery.attempt)
+	logger.Warn("Webhook notification failed, retrying", "err", err, "in", wait.String())
+	delivery.attempt++
+	next := d.clock.Now().Add(wait).UTC()
+	delivery.NextAttemptAt = &next
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.retries, timer)
+		d.enqueue(delivery)
+	})
+	d.retries[timer] = delivery
+}
+
+// webhookBackoff is how long to wait after the attempt failed: a second,
+// doubling with each attempt up to an hour, give or take a fifth so that
+// retries to a webhook that was down don't all arrive at once.
+func webhookBackoff(attempt int) time.Duration {
+	wait := time.Hour
+	if attempt < 13 {
+		wait = min(time.Second<<(attempt-1), time.Hour)
+	}
+	jitter := time.Duration(mathrand.Int63n(int64(wait)*2/5+1)) - wait/5
+	return wait + jitter
+}
+
+// send makes one attempt at a notification and returns the status code
+// of the answer, if any. Only 2xx answers count as delivered.
+func (d *WebhookDispatcher) send(hook Webhook, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(d.clock.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "receipt-processor-webhooks")
+	req.Header.Set(WebhookHeader, hook.ID)
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureTimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, signWebhook(hook.Secret, timestamp, delivery.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("webhook answered " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the hex-encoded HMAC-SHA256 of
+//
+//	timestamp + "\n" + body
+//
+// under the webhook's secret.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliveries returns the latest deliveries of a webhook, newest first.
+func (d *WebhookDispatcher) Deliveries(hookID string) []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	log := d.log[hookID]
+	deliveries := make([]WebhookDelivery, 0, len(log))
+	for i := len(log) - 1; i >= 0; i-- {
+		delivery := *log[i]
+		delivery.Attempts = slices.Clone(delivery.Attempts)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
+
+// Redeliver queues a delivery that is no longer pending again, with a
+// fresh count of attempts. Its attempts are added to its history.
+func (d *WebhookDispatcher) Redeliver(hookID, id string) (WebhookDelivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, delivery := range d.log[hookID] {
+		if delivery.ID != id {
+			continue
+		}
+		if delivery.Status == DeliveryPending {
+			return WebhookDelivery{}, errDeliveryPending
+		}
+		delivery.Status = DeliveryPending
+		delivery.attempt = 1
+		d.enqueue(delivery)
+		redelivered := *delivery
+		redelivered.Attempts = slices.Clone(delivery.Attempts)
+		return redelivered, nil
+	}
+	return WebhookDelivery{}, errDeliveryNotFound
+}
+
+// forget drops the deliveries of a deleted webhook. Those still pending
+// are dropped when their turn comes.
+func (d *WebhookDispatcher) forget(hookID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.log, hookID)
+}
+
+// Close stops taking notifications, drops the retries still waiting and
+// waits for the queued notifications to be sent, or for ctx to be done.
+func (d *WebhookDispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		dropped := 0
+		for timer, delivery := range d.retries {
+			if timer.Stop() {
+				delivery.Status = DeliveryDropped
+				delivery.NextAttemptAt = nil
+				dropped++
+			}
+		}
+		if dropped > 0 {
+			webhookDeliveries.Add("dropped", int64(dropped))
+			slog.Warn("Dropping webhook notifications waiting to be retried", "count", dropped)
+		}
+		close(d.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhook is a URL notified of each receipt processed for its tenant.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Secret signs the notifications. It is only shown when the webhook
+	// is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+// public leaves out the secret.
+func (h Webhook) public() Webhook {
+	h.Secret = ""
+	return h
+}
+
+// WebhookHeader carries the ID of the webhook a notification is for, and
+// WebhookDeliveryHeader the ID of the notification, which stays the same
+// across retries. Notifications are signed with the headers of signed
+// requests, see HMACAuthenticator.
+const (
+	WebhookHeader         = "X-Webhook-Id"
+	WebhookDeliveryHeader = "X-Webhook-Delivery"
+)
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// WebhookStore holds the webhooks, persisting them to a file if it has a
+// path.
+type WebhookStore struct {
+	path string
+
+	mu    sync.RWMutex
+	hooks []Webhook
+}
+
+func NewWebhookStore(path string) (*WebhookStore, error) {
+	s := &WebhookStore{path: path}
+	if err := loadJSONFile(path, &s.hooks); err != nil {
+		return nil, fmt.Errorf("load webhooks: %w", err)
+	}
+	return s, nil
+}
+
+// Create registers a webhook with a new secret and returns it, secret
+// included.
+func (s *WebhookStore) Create(id, rawURL, tenant string, now time.Time) (Webhook, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, err
+	}
+	hook := Webhook{
+		ID:        id,
+		URL:       rawURL,
+		Tenant:    tenant,
+		CreatedAt: now.UTC(),
+		Secret:    "whsec_" + base64.RawURLEncoding.EncodeToString(secret),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hooks := append(s.hooks[:len(s.hooks):len(s.hooks)], hook)
+	if err := saveJSONFile(s.path, hooks); err != nil {
+		return Webhook{}, fmt.Errorf("save webhooks: %w", err)
+	}
+	s.hooks = hooks
+	return hook, nil
+}
+
+func (s *WebhookStore) Delete(id, tenant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, hook := range s.hooks {
+		if hook.ID != id || hook.Tenant != tenant {
+			continue
+		}
+		hooks := append(s.hooks[:i:i], s.hooks[i+1:]...)
+		if err := saveJSONFile(s.path, hooks); err != nil {
+			return fmt.Errorf("save webhooks: %w", err)
+		}
+		s.hooks = hooks
+		return nil
+	}
+	return errWebhookNotFound
+}
+
+// Get returns the webhook of tenant with the id, secret included.
+func (s *WebhookStore) Get(id, tenant string) (Webhook, error) {
+	hook, found := s.lookup(id)
+	if !found || hook.Tenant != tenant {
+		return Webhook{}, errWebhookNotFound
+	}
+	return hook, nil
+}
+
+// lookup finds a webhook of any tenant.
+func (s *WebhookStore) lookup(id string) (Webhook, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, hook := range s.hooks {
+		if hook.ID == id {
+			return hook, true
+		}
+	}
+	return Webhook{}, false
+}
+
+// Update points a webhook at another URL. It keeps its secret.
+func (s *WebhookStore) Update(id, tenant, rawURL string) (Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, hook := range s.hooks {
+		if hook.ID != id || hook.Tenant != tenant {
+			continue
+		}
+		hook.URL = rawURL
+		hooks := slices.Clone(s.hooks)
+		hooks[i] = hook
+		if err := saveJSONFile(s.path, hooks); err != nil {
+			return Webhook{}, fmt.Errorf("save webhooks: %w", err)
+		}
+		s.hooks = hooks
+		return hook, nil
+	}
+	return Webhook{}, errWebhookNotFound
+}
+
+// List returns the webhooks of tenant, secrets included.
+func (s *WebhookStore) List(tenant string) []Webhook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hooks := []Webhook{}
+	for _, hook := range s.hooks {
+		if hook.Tenant == tenant {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// EnableWebhooks serves the webhook admin API and notifies the webhooks of
+// processed receipts.
+func (s *Server) EnableWebhooks(hooks *WebhookStore, cfg WebhookConfig) {
+	s.webhooks = hooks
+	s.webhookDispatcher = NewWebhookDispatcher(hooks, s.clock, s.ids, cfg)
+	s.events.AddSink(s.webhookDispatcher.Notify)
+}
+
+// WebhookRequest creates or updates a webhook.
+type WebhookRequest struct {
+	URL string `json:"url"`
+}
+
+// checkWebhookURL accepts absolute http and https URLs.
+func checkWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// readWebhookRequest returns the URL of a WebhookRequest, answering
+// requests without a valid one.
+func readWebhookRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var request WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "The request must be a JSON object with a url", http.StatusBadRequest)
+		return "", false
+	}
+	request.URL = strings.TrimSpace(request.URL)
+	if err := checkWebhookURL(request.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return request.URL, true
+}
+
+// CreateWebhookHandler registers a webhook for the tenant the request acts
+// for. The response holds the secret, which isn't shown again.
+func (s *Server) CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	rawURL, ok := readWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+
+	hook, err := s.webhooks.Create(s.ids.NewID(), rawURL, tenantFrom(r), s.clock.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=create-webhook webhook=%s url=%q", hook.ID, hook.URL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/webhooks/"+hook.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+func (s *Server) ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks := s.webhooks.List(tenantFrom(r))
+	for i := range hooks {
+		hooks[i] = hooks[i].public()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+func (s *Server) GetWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook, err := s.webhooks.Get(mux.Vars(r)["id"], tenantFrom(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook.public())
+}
+
+// UpdateWebhookHandler points a webhook at another URL. Notifications
+// still waiting to be retried go to the new one.
+func (s *Server) UpdateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	rawURL, ok := readWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+	hook, err := s.webhooks.Update(mux.Vars(r)["id"], tenantFrom(r), rawURL)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=update-webhook webhook=%s url=%q", hook.ID, hook.URL)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook.public())
+}
+
+func (s *Server) DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.webhooks.Delete(id, tenantFrom(r)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.webhookDispatcher.forget(id)
+	audit(r, "action=delete-webhook webhook=%s", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WebhookDeliveriesHandler lists the latest notifications sent to a
+// webhook, newest first, with their attempts.
+func (s *Server) WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	hook, err := s.webhooks.Get(mux.Vars(r)["id"], tenantFrom(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.webhookDispatcher.Deliveries(hook.ID))
+}
+
+// RedeliverWebhookHandler sends a notification that was delivered, failed
+// or dropped again.
+func (s *Server) RedeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hook, err := s.webhooks.Get(vars["id"], tenantFrom(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	delivery, err := s.webhookDispatcher.Redeliver(hook.ID, vars["delivery"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	audit(r, "action=redeliver-webhook webhook=%s delivery=%s", hook.ID, delivery.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
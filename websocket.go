@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// wsConn is a WebSocket connection. The websocket build tag provides it.
+type wsConn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+// webSocketUpgrader turns a request into a WebSocket connection, or writes
+// an error response and fails.
+type webSocketUpgrader func(w http.ResponseWriter, r *http.Request) (wsConn, error)
+
+// The message types of RFC 6455.
+const (
+	wsTextMessage  = 1
+	wsCloseMessage = 8
+	wsPingMessage  = 9
+)
+
+// The close codes of RFC 6455.
+const (
+	wsCloseNormal    = 1000
+	wsCloseGoingAway = 1001
+)
+
+const (
+	// wsPongWait is how long a connection may go without a message or a
+	// pong before it is dropped.
+	wsPongWait = time.Minute
+	// wsPingPeriod is how often connections are pinged. It leaves time
+	// for the pong within wsPongWait.
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsWriteWait bounds each write to a connection.
+	wsWriteWait = 10 * time.Second
+	// wsMaxWatched caps the users one connection can watch the balance of.
+	wsMaxWatched = 100
+)
+
+// wsRequest is a message from a WebSocket client. Ref is copied into the
+// reply so that clients can match the two up.
+type wsRequest struct {
+	Type    string          `json:"type"`
+	Ref     string          `json:"ref,omitempty"`
+	Receipt json.RawMessage `json:"receipt,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	UserID  string          `json:"userId,omitempty"`
+}
+
+// wsMessage is a message to a WebSocket client.
+type wsMessage struct {
+	Type    string   `json:"type"`
+	Ref     string   `json:"ref,omitempty"`
+	ID      string   `json:"id,omitempty"`
+	UserID  string   `json:"userId,omitempty"`
+	Points  *int     `json:"points,omitempty"`
+	Flagged bool     `json:"flagged,omitempty"`
+	Problem *Problem `json:"problem,omitempty"`
+}
+
+// EnableWebSocket serves the WebSocket API at /ws, upgrading requests with
+// upgrade.
+func (s *Server) EnableWebSocket(upgrade webSocketUpgrader) {
+	s.upgradeWebSocket = upgrade
+}
+
+// WebSocketHandler upgrades an authenticated request to a connection on
+// which the client submits receipts and asks for points, and hears about
+// changes to the balances it watches.
+func (s *Server) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgradeWebSocket(w, r)
+	if err != nil {
+		// The upgrader answered the request.
+		logAttrs(r, slog.String("upgradeError", err.Error()))
+		return
+	}
+	session := &wsSession{
+		s:       s,
+		r:       r,
+		conn:    conn,
+		out:     make(chan wsMessage, eventsBuffer),
+		stopped: make(chan struct{}),
+		watched: make(map[string]bool),
+	}
+	session.run()
+}
+
+// wsSession serves a WebSocket connection. Replies and balance updates
+// all go through out, so that only the writer writes to the connection.
+type wsSession struct {
+	s    *Server
+	r    *http.Request
+	conn wsConn
+	out  chan wsMessage
+	// stopped is closed when the writer stops, after which replies have
+	// nowhere to go.
+	stopped chan struct{}
+
+	mu      sync.Mutex
+	watched map[string]bool
+}
+
+func (c *wsSession) run() {
+	tenant := tenantFrom(c.r)
+	events, unsubscribe := c.s.events.Subscribe(eventsBuffer, func(e ReceiptEvent) bool {
+		return e.tenant == tenant && e.userID != "" && c.watches(e.userID)
+	})
+	defer unsubscribe()
+
+	// The reader stops on errors and when the connection closes. The
+	// writer closes the connection when the bus closes on shutdown.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.read()
+	}()
+	c.write(events, done)
+	close(c.stopped)
+	c.conn.Close()
+	<-done
+}
+
+func (c *wsSession) watches(userID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.watched[userID]
+}
+
+func (c *wsSession) read() {
+	c.conn.SetReadLimit(c.s.cfg.MaxBodyBytes)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		if messageType != wsTextMessage {
+			c.reply(c.fail("", Problem{
+				Type:   "/problems/malformed-message",
+				Title:  "The message can't be decoded",
+				Status: http.StatusBadRequest,
+				Detail: "Messages must be JSON text messages.",
+			}))
+			continue
+		}
+		var request wsRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			c.reply(c.fail("", Problem{
+				Type:   "/problems/malformed-message",
+				Title:  "The message can't be decoded",
+				Status: http.StatusBadRequest,
+				Detail: err.Error(),
+			}))
+			continue
+		}
+		c.reply(c.handle(request))
+	}
+}
+
+func (c *wsSession) reply(message wsMessage) {
+	select {
+	case c.out <- message:
+	case <-c.stopped:
+	}
+}
+
+// write sends the replies and balance updates, and pings the client,
+// until the reader is done or the bus closes.
+func (c *wsSession) write(events <-chan ReceiptEvent, done <-chan struct{}) {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-done:
+			c.close(wsCloseNormal)
+			return
+		case message := <-c.out:
+			err = c.send(message)
+		case event, open := <-events:
+			if !open {
+				c.close(wsCloseGoingAway)
+				return
+			}
+			if message, ok := c.balance("", event.userID); ok {
+				err = c.send(message)
+			}
+		case <-ping.C:
+			err = c.conn.WriteControl(wsPingMessage, nil, time.Now().Add(wsWriteWait))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *wsSession) send(message wsMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteMessage(wsTextMessage, data)
+}
+
+func (c *wsSession) close(code int) {
+	// The close frame's payload is the code, big-endian.
+	payload := []byte{byte(code >> 8), byte(code)}
+	c.conn.WriteControl(wsCloseMessage, payload, time.Now().Add(wsWriteWait))
+}
+
+// fail returns an error message carrying the problem.
+func (c *wsSession) fail(ref string, problem Problem) wsMessage {
+	problem.RequestID = requestIDFrom(c.r.Context())
+	return wsMessage{Type: "error", Ref: ref, Problem: &problem}
+}
+
+// handle answers a request. Every request gets exactly one reply.
+func (c *wsSession) handle(request wsRequest) wsMessage {
+	r := c.r
+	if c.s.limiter != nil {
+		if allowed, wait := c.s.limiter.Allow(rateLimitKey(r), c.s.clock.Now()); !allowed {
+			return c.fail(request.Ref, Problem{
+				Type:   "/problems/too-many-requests",
+				Title:  "Too many requests",
+				Status: http.StatusTooManyRequests,
+				Detail: fmt.Sprintf("At most %g messages a second are allowed, with bursts of %g. Try again in %d seconds.",
+					c.s.limiter.rps, c.s.limiter.burst, int(math.Ceil(wait.Seconds()))),
+			})
+		}
+	}
+
+	switch request.Type {
+	case "process":
+		return c.process(request)
+	case "points":
+		if p := principalFrom(r); p != nil && !p.has(ScopeRead) {
+			return c.fail(request.Ref, missingScopeProblem(ScopeRead))
+		}
+		record, err := c.s.tenantStore(r.Context(), tenantFrom(r)).Get(request.ID)
+		if err == nil && !ownedBy(r, record.Owner) {
+			err = ErrNotFound
+		}
+		if err != nil {
+			return c.fail(request.Ref, c.problem(err))
+		}
+		return wsMessage{Type: "points", Ref: request.Ref, ID: record.ID, Points: &record.Points}
+	case "watchBalance":
+		if p := principalFrom(r); p != nil && !p.has(ScopeRead) {
+			return c.fail(request.Ref, missingScopeProblem(ScopeRead))
+		}
+		if !ownedBy(r, request.UserID) {
+			return c.fail(request.Ref, c.problem(errUserNotFound))
+		}
+		message, ok := c.balance(request.Ref, request.UserID)
+		if !ok {
+			return message
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if len(c.watched) >= wsMaxWatched && !c.watched[request.UserID] {
+			return c.fail(request.Ref, Problem{
+				Type:   "/problems/too-many-watches",
+				Title:  "Too many balances watched",
+				Status: http.StatusUnprocessableEntity,
+				Detail: fmt.Sprintf("A connection can watch the balances of at most %d users.", wsMaxWatched),
+			})
+		}
+		c.watched[request.UserID] = true
+		return message
+	case "unwatchBalance":
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.watched, request.UserID)
+		return wsMessage{Type: "unwatched", Ref: request.Ref, UserID: request.UserID}
+	}
+	return c.fail(request.Ref, Problem{
+		Type:   "/problems/malformed-message",
+		Title:  "The message can't be decoded",
+		Status: http.StatusBadRequest,
+		Detail: fmt.Sprintf("Unknown message type %q.", request.Type),
+	})
+}
+
+func (c *wsSession) process(request wsRequest) wsMessage {
+	receipt, err := c.s.parseReceipt(request.Receipt)
+	if err != nil {
+		return c.fail(request.Ref, invalidReceiptProblem(err))
+	}
+	if refusal := c.s.chargeStreamReceipt(c.r); refusal != "" {
+		return c.fail(request.Ref, Problem{
+			Type:   "/problems/quota-exceeded",
+			Title:  "Monthly quota exceeded",
+			Status: http.StatusTooManyRequests,
+			Detail: refusal,
+		})
+	}
+	record, err := c.s.processReceipt(receipt, submitterOf(c.r))
+	if err != nil {
+		c.s.refundQuota(c.r, 1)
+		return c.fail(request.Ref, c.problem(err))
+	}
+	return wsMessage{Type: "processed", Ref: request.Ref, ID: record.ID, Points: &record.Points, Flagged: len(record.Flags) > 0}
+}
+
+// balance looks up the balance of a user, returning an error message if
+// it can't.
+func (c *wsSession) balance(ref, userID string) (wsMessage, bool) {
+	points, err := c.s.tenantStore(c.r.Context(), tenantFrom(c.r)).Balance(userID)
+	if errors.Is(err, ErrNotFound) {
+		err = errUserNotFound
+	}
+	if err != nil {
+		return c.fail(ref, c.problem(err)), false
+	}
+	return wsMessage{Type: "balance", Ref: ref, UserID: userID, Points: &points}, true
+}
+
+// problem describes err like writeError would.
+func (c *wsSession) problem(err error) Problem {
+	problem, known := errorProblem(err)
+	if !known {
+		slog.ErrorContext(c.r.Context(), "WebSocket request failed", "err", err)
+	}
+	return problem
+}
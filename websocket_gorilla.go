@@ -0,0 +1,35 @@
+//go:build websocket
+
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/websocket"
+)
+
+// newWebSocketUpgrader accepts upgrades from pages on the origins, or only
+// from pages served by this host if there are none. Requests without an
+// Origin header don't come from browsers and are always accepted.
+func newWebSocketUpgrader(origins []string) (webSocketUpgrader, error) {
+	upgrader := &websocket.Upgrader{}
+	if len(origins) > 0 {
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || slices.Contains(origins, origin)
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) (wsConn, error) {
+		// The upgrader needs the server's own writer to hijack the
+		// connection from.
+		for {
+			unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+			if !ok {
+				break
+			}
+			w = unwrapper.Unwrap()
+		}
+		return upgrader.Upgrade(w, r, nil)
+	}, nil
+}
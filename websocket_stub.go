@@ -0,0 +1,9 @@
+//go:build !websocket
+
+package main
+
+import "errors"
+
+func newWebSocketUpgrader(origins []string) (webSocketUpgrader, error) {
+	return nil, errors.New("WebSocket support is not compiled in; rebuild with -tags websocket")
+}